@@ -10,18 +10,25 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/mitchellh/panicwrap"
 	watchman "github.com/renderedtext/go-watchman"
 	api "github.com/semaphoreci/agent/pkg/api"
+	"github.com/semaphoreci/agent/pkg/compression"
 	"github.com/semaphoreci/agent/pkg/config"
+	"github.com/semaphoreci/agent/pkg/docker"
 	"github.com/semaphoreci/agent/pkg/eventlogger"
+	"github.com/semaphoreci/agent/pkg/executors"
+	"github.com/semaphoreci/agent/pkg/joblogs"
 	jobs "github.com/semaphoreci/agent/pkg/jobs"
 	"github.com/semaphoreci/agent/pkg/kubernetes"
 	listener "github.com/semaphoreci/agent/pkg/listener"
+	"github.com/semaphoreci/agent/pkg/logfile"
 	server "github.com/semaphoreci/agent/pkg/server"
+	"github.com/semaphoreci/agent/pkg/shell"
 	slices "github.com/semaphoreci/agent/pkg/slices"
 	log "github.com/sirupsen/logrus"
 	pflag "github.com/spf13/pflag"
@@ -32,9 +39,18 @@ var VERSION = "dev"
 var HTTPUserAgent = fmt.Sprintf("SemaphoreAgent/%s", VERSION)
 
 func main() {
+	/*
+	 * Used by the SSH jump point of the docker executor, to open a shell
+	 * in the job's container. It runs in the SSH session of the user,
+	 * so it doesn't log anything, nor gets wrapped like the other actions.
+	 */
+	if len(os.Args) > 1 && os.Args[1] == "docker-exec" {
+		os.Exit(RunDockerExec(os.Args[2:]))
+	}
+
 	logfile := OpenLogfile()
 	log.SetOutput(logfile)
-	log.SetFormatter(new(eventlogger.CustomFormatter))
+	log.SetFormatter(getLogFormatter())
 	log.SetLevel(getLogLevel())
 
 	exitStatus, err := panicwrap.BasicWrap(panicHandler)
@@ -70,9 +86,17 @@ func main() {
 	}
 }
 
+/*
+ * SEMAPHORE_AGENT_LOG_MAX_SIZE (in MB) can be used to rotate the agent log file
+ * when it gets too big, keeping at most SEMAPHORE_AGENT_LOG_MAX_FILES rotated files.
+ * By default, the agent log file is never rotated.
+ */
 func OpenLogfile() io.Writer {
-	// #nosec
-	f, err := os.OpenFile(getLogFilePath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	f, err := logfile.NewRotatingFile(logfile.RotatingFileConfig{
+		Path:           getLogFilePath(),
+		MaxSizeInBytes: int64(getIntFromEnv("SEMAPHORE_AGENT_LOG_MAX_SIZE", 0)) * 1024 * 1024,
+		MaxFiles:       getIntFromEnv("SEMAPHORE_AGENT_LOG_MAX_FILES", logfile.DefaultMaxFiles),
+	})
 
 	if err != nil {
 		log.Fatal(err)
@@ -81,6 +105,33 @@ func OpenLogfile() io.Writer {
 	return io.MultiWriter(f, os.Stdout)
 }
 
+func getIntFromEnv(name string, defaultValue int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Fatalf("Invalid %s '%s': must be a non-negative integer", name, value)
+	}
+
+	return n
+}
+
+func getLogFormat() string {
+	return os.Getenv("SEMAPHORE_AGENT_LOG_FORMAT")
+}
+
+func getLogFormatter() log.Formatter {
+	formatter, err := eventlogger.NewAgentLogFormatter(getLogFormat(), "")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return formatter
+}
+
 func getLogLevel() log.Level {
 	logLevel := os.Getenv("SEMAPHORE_AGENT_LOG_LEVEL")
 	if logLevel == "" {
@@ -140,6 +191,49 @@ func RunListener(httpClient *http.Client, logfile io.Writer) {
 		fmt.Sprintf("Timeout for the pod to be ready, in seconds. Default is %d.", config.DefaultKubernetesPodStartTimeout),
 	)
 	_ = pflag.String(config.KubernetesDefaultImage, "", "Default image to use in Kubernetes executor if no containers are specified in the job request")
+	_ = pflag.String(config.JobLogsDirectory, "", "Directory where a local copy of the logs for each job is kept. If not set, job logs are not kept.")
+	_ = pflag.Int(
+		config.JobLogsMaxAge,
+		config.DefaultJobLogsMaxAgeInHours,
+		fmt.Sprintf("How long to keep job logs in --%s, in hours. Use 0 to keep them forever. Default is %d.", config.JobLogsDirectory, config.DefaultJobLogsMaxAgeInHours),
+	)
+	_ = pflag.Int(
+		config.JobLogsMaxSize,
+		config.DefaultJobLogsMaxSizeInMB,
+		fmt.Sprintf("Maximum size of --%s, in MB. Use 0 for no limit. Default is %d.", config.JobLogsDirectory, config.DefaultJobLogsMaxSizeInMB),
+	)
+	_ = pflag.StringSlice(
+		config.JobLogsRendering,
+		[]string{},
+		fmt.Sprintf("How to render the job logs uploaded as a job artifact. Allowed values are: %v", eventlogger.ValidRenderOptions),
+	)
+	_ = pflag.Bool(config.LogsCompressOnDisk, false, "Keep the job logs compressed on disk while the job is running, using --logs-compression-algorithm and --logs-compression-level.")
+	_ = pflag.String(
+		config.LogsCompressionAlgorithm,
+		compression.AlgorithmGzip,
+		fmt.Sprintf("Algorithm used to compress the job logs on disk. Allowed values are: %v", compression.ValidAlgorithms),
+	)
+	_ = pflag.Int(config.LogsCompressionLevel, 0, "Level used to compress the job logs on disk. Use 0 for the default level of the algorithm.")
+	_ = pflag.String(config.StateDirectory, "", "Directory where the agent keeps what it needs to finish pushing the logs for a job if it is restarted in the middle of it. If not set, the remaining logs for a job interrupted by a restart are not pushed.")
+	_ = pflag.String(config.ShellExecutable, "", "Shell used to run the job commands with the shell and docker-compose executors, e.g. bash, zsh or sh. Default is bash, or powershell on Windows.")
+	_ = pflag.StringSlice(config.ShellArgs, []string{}, "Arguments used to start --shell-executable. If not set, the defaults for the shell are used, e.g. --login for bash.")
+	_ = pflag.Bool(config.DisablePTY, false, "Run commands without a PTY in the shell executor, reporting stdout and stderr separately. Each command runs in a new shell, so shell functions and aliases are not kept between commands. Not used on Windows.")
+	_ = pflag.Bool(config.TrackEnvChanges, false, "Emit an env_changed event in the job logs for every command that changes environment variables or the working directory. Only the names of the variables are logged. Only available with the shell executor.")
+	_ = pflag.Int(config.OutputMaxBytesPerCommand, 0, "Maximum number of bytes of output kept for a single command. After that, the output is omitted, except for the last --output-tail-bytes. Use 0 for no limit. Can be overridden per job.")
+	_ = pflag.Int(config.OutputTailBytes, 0, "Number of bytes from the end of the output of a command shown when --output-max-bytes-per-command is reached. Can be overridden per job.")
+	_ = pflag.Int(config.OutputMaxBytesPerSecond, 0, "Maximum rate of output for a single command, in bytes per second. Output above that rate is dropped. Use 0 for no limit. Can be overridden per job.")
+	_ = pflag.Bool(config.OutputCollapseRepeated, false, "Replace consecutive identical lines in the output of a command with a notice saying how many times the line was repeated. Can be overridden per job.")
+	_ = pflag.Uint16(config.TerminalColumns, 0, "Number of columns of the terminal the job commands run in. Must be used together with --terminal-rows. Can be overridden per job.")
+	_ = pflag.Uint16(config.TerminalRows, 0, "Number of rows of the terminal the job commands run in. Must be used together with --terminal-columns. Can be overridden per job.")
+	_ = pflag.Bool(config.DockerComposeEnvInTmpfs, true, "Deliver the job's environment variables and files through an in-memory filesystem mounted in the main container, instead of files in the host. If disabled, only containers running as root or as the agent's user can read them. Only used by the docker compose executor.")
+	_ = pflag.Bool(config.PodmanExecutor, false, "Run the jobs that use containers with podman, instead of docker. Jobs can also ask for the podman executor themselves.")
+	_ = pflag.Bool(config.SSHExecutor, false, "Run the shell jobs in the remote machines given by --ssh-hosts, through SSH. Jobs can also ask for the ssh executor themselves.")
+	_ = pflag.StringSlice(config.SSHHosts, []string{}, "Remote machines used by the ssh executor, in the format [user@]host[:port]. Each job runs in one of them, picked at random.")
+	_ = pflag.String(config.SSHIdentityFile, "", "Private key used by the ssh executor to authenticate in the remote machines. If empty, the ssh defaults are used.")
+	_ = pflag.String(config.SSHKnownHostsFile, "", "Known hosts file used by the ssh executor to verify the remote machines. If empty, the ssh defaults are used.")
+	_ = pflag.Bool(config.SSHAcceptNewHostKeys, false, "Accept the keys of remote machines not in the known hosts file the first time they are seen, and add them to it. By default, the ssh executor does not connect to them.")
+	_ = pflag.String(config.TerminalType, "", "Value of TERM for the job commands. If empty, the agent's TERM is used. Can be overridden per job.")
+	_ = pflag.StringSlice(config.JobLogSinks, []string{}, "Additional destinations for job logs, in the format <type>:<target>, e.g. file:/var/log/semaphore-jobs or otlp:http://localhost:4318")
 
 	pflag.Parse()
 
@@ -180,6 +274,14 @@ func RunListener(httpClient *http.Client, logfile io.Writer) {
 		log.Fatal("Kubernetes pod start timeout can't be negative. Exiting...")
 	}
 
+	if viper.GetInt(config.JobLogsMaxAge) < 0 {
+		log.Fatal("Job logs max age can't be negative. Exiting...")
+	}
+
+	if viper.GetInt(config.JobLogsMaxSize) < 0 {
+		log.Fatal("Job logs max size can't be negative. Exiting...")
+	}
+
 	scheme := "https"
 	if viper.GetBool(config.NoHTTPS) {
 		scheme = "http"
@@ -200,6 +302,51 @@ func RunListener(httpClient *http.Client, logfile io.Writer) {
 		log.Fatalf("Error parsing --%s: %v", config.KubernetesLabels, err)
 	}
 
+	jobLogSinks, err := ParseJobLogSinks(viper.GetStringSlice(config.JobLogSinks))
+	if err != nil {
+		log.Fatalf("Error parsing --%s: %v", config.JobLogSinks, err)
+	}
+
+	jobLogsRendering, err := eventlogger.ParseRenderOptions(viper.GetStringSlice(config.JobLogsRendering))
+	if err != nil {
+		log.Fatalf("Error parsing --%s: %v", config.JobLogsRendering, err)
+	}
+
+	logsCompression, err := ParseLogsCompression()
+	if err != nil {
+		log.Fatalf("Error parsing --%s: %v", config.LogsCompressionAlgorithm, err)
+	}
+
+	sshHosts, err := ParseSSHHosts(viper.GetStringSlice(config.SSHHosts))
+	if err != nil {
+		log.Fatalf("Error parsing --%s: %v", config.SSHHosts, err)
+	}
+
+	if viper.GetBool(config.SSHExecutor) && len(sshHosts) == 0 {
+		log.Fatalf("--%s requires --%s. Exiting...", config.SSHExecutor, config.SSHHosts)
+	}
+
+	outputLimits := shell.OutputLimits{
+		MaxBytesPerCommand:    viper.GetInt(config.OutputMaxBytesPerCommand),
+		TailBytes:             viper.GetInt(config.OutputTailBytes),
+		MaxBytesPerSecond:     viper.GetInt(config.OutputMaxBytesPerSecond),
+		CollapseRepeatedLines: viper.GetBool(config.OutputCollapseRepeated),
+	}
+
+	if err := outputLimits.Validate(); err != nil {
+		log.Fatalf("Invalid output limits: %v", err)
+	}
+
+	terminal := shell.Terminal{
+		Cols: viper.GetUint16(config.TerminalColumns),
+		Rows: viper.GetUint16(config.TerminalRows),
+		Type: viper.GetString(config.TerminalType),
+	}
+
+	if err := terminal.Validate(); err != nil {
+		log.Fatalf("Invalid terminal: %v", err)
+	}
+
 	config := listener.Config{
 		AgentName:                        getAgentName(),
 		Endpoint:                         viper.GetString(config.Endpoint),
@@ -230,6 +377,25 @@ func RunListener(httpClient *http.Client, logfile io.Writer) {
 		KubernetesPodStartTimeoutSeconds: viper.GetInt(config.KubernetesPodStartTimeout),
 		KubernetesLabels:                 kubernetesLabels,
 		KubernetesDefaultImage:           viper.GetString(config.KubernetesDefaultImage),
+		JobLogsArchive:                   createJobLogsArchive(),
+		JobLogSinks:                      jobLogSinks,
+		JobLogsRendering:                 jobLogsRendering,
+		JobLogsCompression:               logsCompression,
+		AgentLogFormat:                   getLogFormat(),
+		StateDirectory:                   createStateDirectory(),
+		ShellExecutable:                  viper.GetString(config.ShellExecutable),
+		ShellArgs:                        viper.GetStringSlice(config.ShellArgs),
+		DisablePTY:                       viper.GetBool(config.DisablePTY),
+		TrackEnvChanges:                  viper.GetBool(config.TrackEnvChanges),
+		OutputLimits:                     outputLimits,
+		Terminal:                         terminal,
+		DockerComposeEnvInTmpfs:          viper.GetBool(config.DockerComposeEnvInTmpfs),
+		PodmanExecutor:                   viper.GetBool(config.PodmanExecutor),
+		SSHExecutor:                      viper.GetBool(config.SSHExecutor),
+		SSHHosts:                         sshHosts,
+		SSHIdentityFile:                  viper.GetString(config.SSHIdentityFile),
+		SSHKnownHostsFile:                viper.GetString(config.SSHKnownHostsFile),
+		SSHAcceptNewHostKeys:             viper.GetBool(config.SSHAcceptNewHostKeys),
 	}
 
 	go func() {
@@ -251,6 +417,38 @@ func createImageValidator(expressions []string) *kubernetes.ImageValidator {
 	return imageValidator
 }
 
+func createStateDirectory() string {
+	directory := viper.GetString(config.StateDirectory)
+	if directory == "" {
+		return ""
+	}
+
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		log.Fatalf("Error creating --%s '%s': %v", config.StateDirectory, directory, err)
+	}
+
+	return directory
+}
+
+func createJobLogsArchive() *joblogs.Archive {
+	directory := viper.GetString(config.JobLogsDirectory)
+	if directory == "" {
+		return nil
+	}
+
+	archive, err := joblogs.NewArchive(joblogs.ArchiveConfig{
+		Directory:      directory,
+		MaxAge:         time.Duration(viper.GetInt(config.JobLogsMaxAge)) * time.Hour,
+		MaxSizeInBytes: int64(viper.GetInt(config.JobLogsMaxSize)) * 1024 * 1024,
+	})
+
+	if err != nil {
+		log.Panicf("Error creating job logs archive: %v", err)
+	}
+
+	return archive
+}
+
 func loadConfigFile(configFile string) {
 	viper.SetConfigFile(configFile)
 	if err := viper.ReadInConfig(); err != nil {
@@ -365,6 +563,51 @@ func ParseLabels() (map[string]string, error) {
 	return labels, nil
 }
 
+func ParseJobLogSinks(values []string) ([]eventlogger.SinkConfig, error) {
+	sinks := []eventlogger.SinkConfig{}
+	for _, value := range values {
+		sink, err := eventlogger.ParseSinkConfig(value)
+		if err != nil {
+			return nil, err
+		}
+
+		sinks = append(sinks, sink)
+	}
+
+	return sinks, nil
+}
+
+func ParseLogsCompression() (*compression.Options, error) {
+	if !viper.GetBool(config.LogsCompressOnDisk) {
+		return nil, nil
+	}
+
+	options := compression.Options{
+		Algorithm: viper.GetString(config.LogsCompressionAlgorithm),
+		Level:     viper.GetInt(config.LogsCompressionLevel),
+	}
+
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &options, nil
+}
+
+func ParseSSHHosts(values []string) ([]executors.SSHHost, error) {
+	hosts := []executors.SSHHost{}
+	for _, value := range values {
+		host, err := executors.ParseSSHHost(value)
+		if err != nil {
+			return nil, err
+		}
+
+		hosts = append(hosts, host)
+	}
+
+	return hosts, nil
+}
+
 func RunServer(httpClient *http.Client, logfile io.Writer) {
 	authTokenSecret := pflag.String("auth-token-secret", "", "Auth token for accessing the server")
 	port := pflag.Int("port", 8000, "Port of the server")
@@ -408,6 +651,7 @@ func RunServer(httpClient *http.Client, logfile io.Writer) {
 		TLSKeyPath:            *tlsKeyPath,
 		Version:               VERSION,
 		LogFile:               logfile,
+		LogFilePath:           getLogFilePath(),
 		JWTSecret:             []byte(*authTokenSecret),
 		HTTPClient:            httpClient,
 		PreJobHookPath:        *preJobHookPath,
@@ -440,6 +684,28 @@ func RunSingleJob(httpClient *http.Client) {
 	job.Run()
 }
 
+/*
+ * docker-exec [--tty] <socket> <container> <command> [args...]
+ */
+func RunDockerExec(args []string) int {
+	tty := len(args) > 0 && args[0] == "--tty"
+	if tty {
+		args = args[1:]
+	}
+
+	if len(args) < 3 {
+		fmt.Fprintln(os.Stderr, "usage: agent docker-exec [--tty] <socket> <container> <command> [args...]")
+		return 1
+	}
+
+	exitCode, err := docker.NewClient(args[0]).ExecWithStdio(args[1], args[2:], tty)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	}
+
+	return exitCode
+}
+
 func panicHandler(output string) {
 	log.Printf("Child agent process panicked:\n\n%s\n", output)
 	os.Exit(1)
@@ -80,10 +80,34 @@ type Callbacks struct {
 }
 
 type Logger struct {
-	Method         string `json:"method" yaml:"method"`
-	URL            string `json:"url" yaml:"url"`
-	Token          string `json:"token" yaml:"token"`
-	MaxSizeInBytes int    `json:"max_size_in_bytes" yaml:"max_size_in_bytes"`
+	Method          string `json:"method" yaml:"method"`
+	URL             string `json:"url" yaml:"url"`
+	Token           string `json:"token" yaml:"token"`
+	MaxSizeInBytes  int    `json:"max_size_in_bytes" yaml:"max_size_in_bytes"`
+	TrimStrategy    string `json:"trim_strategy" yaml:"trim_strategy"`
+	TailSizeInBytes int    `json:"tail_size_in_bytes" yaml:"tail_size_in_bytes"`
+	Compression     string `json:"compression" yaml:"compression"`
+}
+
+/*
+ * Overrides the output limits configured in the agent for the job.
+ * Zero values keep the agent's configuration, and negative values remove the limit.
+ */
+type OutputLimits struct {
+	MaxBytesPerCommand    int   `json:"max_bytes_per_command" yaml:"max_bytes_per_command"`
+	TailBytes             int   `json:"tail_bytes" yaml:"tail_bytes"`
+	MaxBytesPerSecond     int   `json:"max_bytes_per_second" yaml:"max_bytes_per_second"`
+	CollapseRepeatedLines *bool `json:"collapse_repeated_lines" yaml:"collapse_repeated_lines"`
+}
+
+/*
+ * Overrides the terminal configured in the agent for the job.
+ * Zero values keep the agent's configuration.
+ */
+type Terminal struct {
+	Columns int    `json:"columns" yaml:"columns"`
+	Rows    int    `json:"rows" yaml:"rows"`
+	Type    string `json:"type" yaml:"type"`
 }
 
 type PublicKey string
@@ -107,6 +131,9 @@ type JobRequest struct {
 	Files     []File    `json:"files" yaml:"file"`
 	Callbacks Callbacks `json:"callbacks" yaml:"callbacks"`
 	Logger    Logger    `json:"logger" yaml:"logger"`
+
+	OutputLimits *OutputLimits `json:"output_limits,omitempty" yaml:"output_limits,omitempty"`
+	Terminal     *Terminal     `json:"terminal,omitempty" yaml:"terminal,omitempty"`
 }
 
 func (j *JobRequest) FindEnvVar(varName string) (string, error) {
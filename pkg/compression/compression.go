@@ -0,0 +1,192 @@
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const AlgorithmGzip = "gzip"
+const AlgorithmZstd = "zstd"
+
+var ValidAlgorithms = []string{
+	AlgorithmGzip,
+	AlgorithmZstd,
+}
+
+type Options struct {
+	// If empty, AlgorithmGzip is used.
+	Algorithm string
+
+	// If zero, the default level for the algorithm is used.
+	// For gzip, levels go from 1 (fastest) to 9 (smallest).
+	// For zstd, levels go from 1 (fastest) to 22 (smallest).
+	Level int
+}
+
+func (o Options) algorithm() string {
+	if o.Algorithm == "" {
+		return AlgorithmGzip
+	}
+
+	return o.Algorithm
+}
+
+func (o Options) Validate() error {
+	switch o.algorithm() {
+	case AlgorithmGzip:
+		if o.Level != 0 && (o.Level < gzip.BestSpeed || o.Level > gzip.BestCompression) {
+			return fmt.Errorf("level %d is not valid for gzip - must be between %d and %d", o.Level, gzip.BestSpeed, gzip.BestCompression)
+		}
+	case AlgorithmZstd:
+		if o.Level < 0 || o.Level > 22 {
+			return fmt.Errorf("level %d is not valid for zstd - must be between 1 and 22", o.Level)
+		}
+	default:
+		return fmt.Errorf("unknown compression algorithm '%s' - allowed algorithms are %v", o.Algorithm, ValidAlgorithms)
+	}
+
+	return nil
+}
+
+// The file extension used for files compressed with these options.
+func (o Options) Extension() string {
+	if o.algorithm() == AlgorithmZstd {
+		return ".zst"
+	}
+
+	return ".gz"
+}
+
+/*
+ * A streaming compressor.
+ * Flush() makes everything written so far decodable by a reader,
+ * Close() finishes the compressed stream, and Reset() starts a new one,
+ * reusing the compressor's internal state.
+ */
+type Writer interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+func NewWriter(w io.Writer, options Options) (Writer, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+
+	switch options.algorithm() {
+	case AlgorithmZstd:
+		level := zstd.SpeedDefault
+		if options.Level != 0 {
+			level = zstd.EncoderLevelFromZstd(options.Level)
+		}
+
+		encoder, err := zstd.NewWriter(w, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+
+		return encoder, nil
+
+	default:
+		level := gzip.DefaultCompression
+		if options.Level != 0 {
+			level = options.Level
+		}
+
+		gzipWriter, err := gzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, err
+		}
+
+		return gzipWriter, nil
+	}
+}
+
+/*
+ * Both gzip and zstd allow multiple compressed streams to be concatenated,
+ * and the reader returned here reads through all of them.
+ */
+func NewReader(r io.Reader, options Options) (io.ReadCloser, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+
+	switch options.algorithm() {
+	case AlgorithmZstd:
+		decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+
+		return decoder.IOReadCloser(), nil
+
+	default:
+		gzipReader, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+
+		return gzipReader, nil
+	}
+}
+
+func CompressBytesWithOptions(data []byte, options Options) ([]byte, error) {
+	buffer := bytes.Buffer{}
+	writer, err := NewWriter(&buffer, options)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := writer.Write(data); err != nil {
+		return nil, fmt.Errorf("error compressing data: %v", err)
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("error flushing compressed data: %v", err)
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func CompressWithOptions(rawFileName string, options Options) (string, error) {
+	// #nosec
+	rawFile, err := os.Open(rawFileName)
+	if err != nil {
+		return "", fmt.Errorf("error opening raw file %s: %v", rawFileName, err)
+	}
+
+	defer rawFile.Close()
+
+	compressedFileName := rawFileName + options.Extension()
+
+	// #nosec
+	compressedFile, err := os.Create(compressedFileName)
+	if err != nil {
+		return "", fmt.Errorf("error creating file %s for compression: %v", compressedFileName, err)
+	}
+
+	defer compressedFile.Close()
+
+	writer, err := NewWriter(compressedFile, options)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(writer, rawFile)
+	if err != nil {
+		return "", fmt.Errorf("error writing data into %s: %v", compressedFileName, err)
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return "", fmt.Errorf("error flushing compressed data into %s: %v", compressedFileName, err)
+	}
+
+	return compressedFileName, nil
+}
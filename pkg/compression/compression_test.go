@@ -0,0 +1,100 @@
+package compression
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test__CompressWithOptions(t *testing.T) {
+	raw, err := os.CreateTemp(t.TempDir(), "*.txt")
+	require.NoError(t, err)
+
+	content := ""
+	for i := 0; i < 1000; i++ {
+		content += fmt.Sprintf("[%d] abcdefghijklmnopqrstuvwxyz\n", i)
+	}
+
+	_, err = raw.WriteString(content)
+	require.NoError(t, err)
+	require.NoError(t, raw.Close())
+
+	for _, options := range []Options{{}, {Algorithm: AlgorithmGzip, Level: 9}, {Algorithm: AlgorithmZstd}, {Algorithm: AlgorithmZstd, Level: 19}} {
+		compressed, err := CompressWithOptions(raw.Name(), options)
+		require.NoError(t, err)
+		assert.True(t, strings.HasSuffix(compressed, options.Extension()))
+		assert.Equal(t, string(decompress(t, readFile(t, compressed), options)), content)
+	}
+}
+
+func Test__ValidateOptions(t *testing.T) {
+	assert.NoError(t, Options{}.Validate())
+	assert.NoError(t, Options{Algorithm: AlgorithmZstd, Level: 22}.Validate())
+	assert.ErrorContains(t, Options{Algorithm: AlgorithmGzip, Level: 10}.Validate(), "level 10 is not valid for gzip")
+	assert.ErrorContains(t, Options{Algorithm: AlgorithmZstd, Level: 23}.Validate(), "level 23 is not valid for zstd")
+	assert.ErrorContains(t, Options{Algorithm: "lz4"}.Validate(), "unknown compression algorithm 'lz4'")
+
+	_, err := NewWriter(io.Discard, Options{Algorithm: "lz4"})
+	assert.Error(t, err)
+}
+
+func Test__StreamingWriterWithConcatenatedStreams(t *testing.T) {
+	for _, algorithm := range ValidAlgorithms {
+		options := Options{Algorithm: algorithm}
+		buffer := bytes.Buffer{}
+
+		writer, err := NewWriter(&buffer, options)
+		require.NoError(t, err)
+
+		// everything flushed is readable before the stream is closed
+		_, err = writer.Write([]byte("hello\n"))
+		require.NoError(t, err)
+		require.NoError(t, writer.Flush())
+		assert.Equal(t, "hello\n", string(decompressPartial(t, buffer.Bytes(), options)))
+
+		_, err = writer.Write([]byte("world\n"))
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+
+		// a new stream is appended to the same buffer
+		writer.Reset(&buffer)
+		_, err = writer.Write([]byte("again\n"))
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+
+		assert.Equal(t, "hello\nworld\nagain\n", string(decompress(t, buffer.Bytes(), options)), algorithm)
+	}
+}
+
+func readFile(t *testing.T, name string) []byte {
+	content, err := os.ReadFile(name)
+	require.NoError(t, err)
+	return content
+}
+
+func decompress(t *testing.T, data []byte, options Options) []byte {
+	reader, err := NewReader(bytes.NewReader(data), options)
+	require.NoError(t, err)
+	defer reader.Close()
+
+	content, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	return content
+}
+
+// Reads everything available from a stream that was not closed yet.
+func decompressPartial(t *testing.T, data []byte, options Options) []byte {
+	reader, err := NewReader(bytes.NewReader(data), options)
+	require.NoError(t, err)
+	defer reader.Close()
+
+	content := bytes.Buffer{}
+	_, _ = io.Copy(&content, reader)
+	return content.Bytes()
+}
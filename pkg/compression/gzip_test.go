@@ -1,6 +1,7 @@
 package compression
 
 import (
+	"bytes"
 	"compress/gzip"
 	"fmt"
 	"io"
@@ -41,3 +42,20 @@ func Test__Compress(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, content, string(text))
 }
+
+func Test__CompressBytes(t *testing.T) {
+	content := ""
+	for i := 0; i < 100; i++ {
+		content += fmt.Sprintf("[%d] abcdefghijklmnopqrstuvwxyz\n", i)
+	}
+
+	compressed, err := CompressBytes([]byte(content))
+	require.NoError(t, err)
+	require.Less(t, len(compressed), len(content))
+
+	gzipReader, err := gzip.NewReader(bytes.NewReader(compressed))
+	require.NoError(t, err)
+	text, err := io.ReadAll(gzipReader)
+	require.NoError(t, err)
+	require.Equal(t, content, string(text))
+}
@@ -29,10 +29,42 @@ const (
 	KubernetesPodStartTimeout  = "kubernetes-pod-start-timeout"
 	KubernetesLabels           = "kubernetes-labels"
 	KubernetesDefaultImage     = "kubernetes-default-image"
+	JobLogsDirectory           = "job-logs-directory"
+	JobLogsMaxAge              = "job-logs-max-age"
+	JobLogsMaxSize             = "job-logs-max-size"
+	JobLogSinks                = "job-log-sinks"
+	JobLogsRendering           = "job-logs-rendering"
+	LogsCompressOnDisk         = "logs-compress-on-disk"
+	LogsCompressionAlgorithm   = "logs-compression-algorithm"
+	LogsCompressionLevel       = "logs-compression-level"
+	StateDirectory             = "state-directory"
+	ShellExecutable            = "shell-executable"
+	ShellArgs                  = "shell-args"
+	DisablePTY                 = "disable-pty"
+	TrackEnvChanges            = "track-env-changes"
+	OutputMaxBytesPerCommand   = "output-max-bytes-per-command"
+	OutputTailBytes            = "output-tail-bytes"
+	OutputMaxBytesPerSecond    = "output-max-bytes-per-second"
+	OutputCollapseRepeated     = "output-collapse-repeated-lines"
+	TerminalColumns            = "terminal-columns"
+	TerminalRows               = "terminal-rows"
+	TerminalType               = "terminal-type"
+	DockerComposeEnvInTmpfs    = "docker-compose-env-in-tmpfs"
+	PodmanExecutor             = "podman-executor"
+	SSHExecutor                = "ssh-executor"
+	SSHHosts                   = "ssh-hosts"
+	SSHIdentityFile            = "ssh-identity-file"
+	SSHKnownHostsFile          = "ssh-known-hosts-file"
+	SSHAcceptNewHostKeys       = "ssh-accept-new-host-keys"
 )
 
 const DefaultKubernetesPodStartTimeout = 300
 
+// By default, archived job logs are kept for 7 days,
+// and the archive can use up to 1GB of disk space.
+const DefaultJobLogsMaxAgeInHours = 168
+const DefaultJobLogsMaxSizeInMB = 1024
+
 type ImagePullPolicy string
 
 const (
@@ -87,6 +119,33 @@ var ValidConfigKeys = []string{
 	KubernetesPodStartTimeout,
 	KubernetesLabels,
 	KubernetesDefaultImage,
+	JobLogsDirectory,
+	JobLogsMaxAge,
+	JobLogsMaxSize,
+	JobLogSinks,
+	JobLogsRendering,
+	LogsCompressOnDisk,
+	LogsCompressionAlgorithm,
+	LogsCompressionLevel,
+	StateDirectory,
+	ShellExecutable,
+	ShellArgs,
+	DisablePTY,
+	TrackEnvChanges,
+	OutputMaxBytesPerCommand,
+	OutputTailBytes,
+	OutputMaxBytesPerSecond,
+	OutputCollapseRepeated,
+	TerminalColumns,
+	TerminalRows,
+	TerminalType,
+	DockerComposeEnvInTmpfs,
+	PodmanExecutor,
+	SSHExecutor,
+	SSHHosts,
+	SSHIdentityFile,
+	SSHKnownHostsFile,
+	SSHAcceptNewHostKeys,
 }
 
 type HostEnvVar struct {
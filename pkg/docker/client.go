@@ -0,0 +1,699 @@
+package docker
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultSocket = "/var/run/docker.sock"
+
+// The oldest Engine API version with everything we use - Docker 20.10.
+const APIVersion = "v1.41"
+
+/*
+ * The socket the Docker daemon listens on.
+ * DOCKER_HOST is respected, as long as it points to a unix socket.
+ */
+func SocketFromEnvironment() string {
+	host := os.Getenv("DOCKER_HOST")
+	if strings.HasPrefix(host, "unix://") {
+		return strings.TrimPrefix(host, "unix://")
+	}
+
+	return DefaultSocket
+}
+
+/*
+ * A minimal client for the Docker Engine API,
+ * with only the operations the docker executor needs.
+ * See: https://docs.docker.com/engine/api/v1.41.
+ */
+type Client struct {
+	Socket     string
+	httpClient *http.Client
+}
+
+func NewClient(socket string) *Client {
+	return &Client{
+		Socket: socket,
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					dialer := net.Dialer{Timeout: 10 * time.Second}
+					return dialer.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+type ContainerConfig struct {
+	Image        string            `json:"Image"`
+	Cmd          []string          `json:"Cmd,omitempty"`
+	Entrypoint   []string          `json:"Entrypoint,omitempty"`
+	User         string            `json:"User,omitempty"`
+	Env          []string          `json:"Env,omitempty"`
+	Labels       map[string]string `json:"Labels,omitempty"`
+	Tty          bool              `json:"Tty"`
+	OpenStdin    bool              `json:"OpenStdin"`
+	AttachStdin  bool              `json:"AttachStdin"`
+	AttachStdout bool              `json:"AttachStdout"`
+	AttachStderr bool              `json:"AttachStderr"`
+
+	HostConfig       HostConfig       `json:"HostConfig"`
+	NetworkingConfig NetworkingConfig `json:"NetworkingConfig"`
+}
+
+type HostConfig struct {
+	Binds       []string          `json:"Binds,omitempty"`
+	Devices     []DeviceMapping   `json:"Devices,omitempty"`
+	Tmpfs       map[string]string `json:"Tmpfs,omitempty"`
+	NetworkMode string            `json:"NetworkMode,omitempty"`
+}
+
+type DeviceMapping struct {
+	PathOnHost        string `json:"PathOnHost"`
+	PathInContainer   string `json:"PathInContainer"`
+	CgroupPermissions string `json:"CgroupPermissions"`
+}
+
+type NetworkingConfig struct {
+	EndpointsConfig map[string]EndpointSettings `json:"EndpointsConfig,omitempty"`
+}
+
+type EndpointSettings struct {
+	Aliases []string `json:"Aliases,omitempty"`
+}
+
+/*
+ * One of the messages streamed while an image is pulled.
+ * Messages with progress are sent for every chunk downloaded or extracted.
+ */
+type PullProgress struct {
+	ID          string `json:"id,omitempty"`
+	Status      string `json:"status,omitempty"`
+	Progress    string `json:"progress,omitempty"`
+	Error       string `json:"error,omitempty"`
+	ErrorDetail *struct {
+		Message string `json:"message"`
+	} `json:"errorDetail,omitempty"`
+}
+
+func (p *PullProgress) String() string {
+	if p.ID == "" {
+		return p.Status
+	}
+
+	return fmt.Sprintf("%s: %s", p.ID, p.Status)
+}
+
+type RegistryAuth struct {
+	Username      string `json:"username"`
+	Password      string `json:"password" datapolicy:"password"`
+	ServerAddress string `json:"serveraddress"`
+}
+
+func (a *RegistryAuth) Encode() (string, error) {
+	encoded, err := json.Marshal(a)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.URLEncoding.EncodeToString(encoded), nil
+}
+
+/*
+ * Finds the credentials for the registry the image is pulled from.
+ * Returns nil if there are none.
+ */
+func (c *DockerConfig) RegistryAuthFor(image string) *RegistryAuth {
+	if c == nil {
+		return nil
+	}
+
+	registry := ImageRegistry(image)
+	for server, entry := range c.Auths {
+		if normalizeRegistry(server) == registry {
+			return &RegistryAuth{
+				Username:      entry.Username,
+				Password:      entry.Password,
+				ServerAddress: server,
+			}
+		}
+	}
+
+	return nil
+}
+
+/*
+ * The registry an image reference points to.
+ * Like Docker itself, references without a hostname point to Docker Hub.
+ */
+func ImageRegistry(image string) string {
+	parts := strings.SplitN(image, "/", 2)
+	if len(parts) == 1 {
+		return "docker.io"
+	}
+
+	if strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost" {
+		return normalizeRegistry(parts[0])
+	}
+
+	return "docker.io"
+}
+
+func normalizeRegistry(server string) string {
+	server = strings.TrimPrefix(server, "https://")
+	server = strings.TrimPrefix(server, "http://")
+	server = strings.SplitN(server, "/", 2)[0]
+
+	switch server {
+	case "index.docker.io", "registry-1.docker.io":
+		return "docker.io"
+	default:
+		return server
+	}
+}
+
+/*
+ * Splits an image reference into the name and the tag or digest.
+ * The Engine API pulls all the tags for an image if no tag is given,
+ * so references without one use latest.
+ */
+func SplitImageReference(image string) (string, string) {
+	if strings.Contains(image, "@") {
+		return image, ""
+	}
+
+	lastSlash := strings.LastIndex(image, "/")
+	lastColon := strings.LastIndex(image, ":")
+	if lastColon > lastSlash {
+		return image[:lastColon], image[lastColon+1:]
+	}
+
+	return image, "latest"
+}
+
+func (c *Client) ImageExists(image string) (bool, error) {
+	response, err := c.do(http.MethodGet, "/images/"+image+"/json", nil, nil, nil)
+	if err != nil {
+		return false, err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+
+	if err := checkResponse(response); err != nil {
+		return false, fmt.Errorf("error inspecting image %s: %v", image, err)
+	}
+
+	return true, nil
+}
+
+/*
+ * Pulls an image, calling onProgress for every message the daemon sends.
+ * Errors during the pull are only reported in the stream, after the response status.
+ */
+func (c *Client) PullImage(image string, auth *RegistryAuth, onProgress func(PullProgress)) error {
+	name, tag := SplitImageReference(image)
+	query := url.Values{"fromImage": {name}}
+	if tag != "" {
+		query.Set("tag", tag)
+	}
+
+	headers := map[string]string{}
+	if auth != nil {
+		encoded, err := auth.Encode()
+		if err != nil {
+			return fmt.Errorf("error encoding credentials: %v", err)
+		}
+
+		headers["X-Registry-Auth"] = encoded
+	}
+
+	response, err := c.do(http.MethodPost, "/images/create", query, headers, nil)
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	if err := checkResponse(response); err != nil {
+		return fmt.Errorf("error pulling image %s: %v", image, err)
+	}
+
+	decoder := json.NewDecoder(response.Body)
+	for {
+		progress := PullProgress{}
+		err := decoder.Decode(&progress)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("error reading progress for image %s: %v", image, err)
+		}
+
+		if progress.ErrorDetail != nil && progress.ErrorDetail.Message != "" {
+			return fmt.Errorf("error pulling image %s: %s", image, progress.ErrorDetail.Message)
+		}
+
+		if progress.Error != "" {
+			return fmt.Errorf("error pulling image %s: %s", image, progress.Error)
+		}
+
+		if onProgress != nil {
+			onProgress(progress)
+		}
+	}
+}
+
+func (c *Client) CreateNetwork(name string, labels map[string]string) (string, error) {
+	body := map[string]interface{}{
+		"Name":           name,
+		"CheckDuplicate": true,
+		"Labels":         labels,
+	}
+
+	created := struct {
+		ID string `json:"Id"`
+	}{}
+
+	err := c.doJSON(http.MethodPost, "/networks/create", nil, body, &created)
+	if err != nil {
+		return "", fmt.Errorf("error creating network %s: %v", name, err)
+	}
+
+	return created.ID, nil
+}
+
+// Removing a network that doesn't exist is not an error.
+func (c *Client) RemoveNetwork(id string) error {
+	err := c.doJSON(http.MethodDelete, "/networks/"+id, nil, nil, nil)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("error removing network %s: %v", id, err)
+	}
+
+	return nil
+}
+
+func (c *Client) CreateContainer(name string, config ContainerConfig) (string, error) {
+	created := struct {
+		ID string `json:"Id"`
+	}{}
+
+	err := c.doJSON(http.MethodPost, "/containers/create", url.Values{"name": {name}}, config, &created)
+	if err != nil {
+		return "", fmt.Errorf("error creating container %s: %v", name, err)
+	}
+
+	return created.ID, nil
+}
+
+func (c *Client) StartContainer(id string) error {
+	err := c.doJSON(http.MethodPost, "/containers/"+id+"/start", nil, nil, nil)
+	if err != nil {
+		return fmt.Errorf("error starting container %s: %v", id, err)
+	}
+
+	return nil
+}
+
+/*
+ * Kills the container, if it is running, and removes it, along with its anonymous volumes.
+ * Removing a container that doesn't exist is not an error.
+ */
+func (c *Client) RemoveContainer(id string) error {
+	query := url.Values{"force": {"true"}, "v": {"true"}}
+	err := c.doJSON(http.MethodDelete, "/containers/"+id, query, nil, nil)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("error removing container %s: %v", id, err)
+	}
+
+	return nil
+}
+
+/*
+ * Attaches to the input and output of the container's process.
+ * Only containers with a TTY are supported, since their output is not multiplexed.
+ * The container should be attached to before it is started, so no output is lost.
+ */
+func (c *Client) AttachContainer(id string) (*HijackedConn, error) {
+	query := url.Values{"stream": {"1"}, "stdin": {"1"}, "stdout": {"1"}, "stderr": {"1"}}
+	conn, err := c.hijack("/containers/"+id+"/attach", query, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error attaching to container %s: %v", id, err)
+	}
+
+	return conn, nil
+}
+
+func (c *Client) ResizeContainer(id string, cols, rows uint16) error {
+	err := c.doJSON(http.MethodPost, "/containers/"+id+"/resize", resizeQuery(cols, rows), nil, nil)
+	if err != nil {
+		return fmt.Errorf("error resizing container %s: %v", id, err)
+	}
+
+	return nil
+}
+
+type ExecConfig struct {
+	Cmd          []string `json:"Cmd"`
+	Env          []string `json:"Env,omitempty"`
+	Tty          bool     `json:"Tty"`
+	AttachStdin  bool     `json:"AttachStdin"`
+	AttachStdout bool     `json:"AttachStdout"`
+	AttachStderr bool     `json:"AttachStderr"`
+}
+
+// The exit code is only set once the process finishes.
+type ExecState struct {
+	Running  bool `json:"Running"`
+	ExitCode *int `json:"ExitCode"`
+}
+
+func (c *Client) CreateExec(containerID string, config ExecConfig) (string, error) {
+	created := struct {
+		ID string `json:"Id"`
+	}{}
+
+	err := c.doJSON(http.MethodPost, "/containers/"+containerID+"/exec", nil, config, &created)
+	if err != nil {
+		return "", fmt.Errorf("error creating exec in container %s: %v", containerID, err)
+	}
+
+	return created.ID, nil
+}
+
+/*
+ * Starts a process created with CreateExec, attached to its input and output.
+ * Without a TTY, its output is multiplexed, and can be read with ReadMultiplexed().
+ */
+func (c *Client) StartExec(id string, tty bool) (*HijackedConn, error) {
+	body := map[string]interface{}{"Detach": false, "Tty": tty}
+	conn, err := c.hijack("/exec/"+id+"/start", nil, body)
+	if err != nil {
+		return nil, fmt.Errorf("error starting exec %s: %v", id, err)
+	}
+
+	return conn, nil
+}
+
+func (c *Client) ResizeExec(id string, cols, rows uint16) error {
+	err := c.doJSON(http.MethodPost, "/exec/"+id+"/resize", resizeQuery(cols, rows), nil, nil)
+	if err != nil {
+		return fmt.Errorf("error resizing exec %s: %v", id, err)
+	}
+
+	return nil
+}
+
+func (c *Client) InspectExec(id string) (*ExecState, error) {
+	state := ExecState{}
+	err := c.doJSON(http.MethodGet, "/exec/"+id+"/json", nil, nil, &state)
+	if err != nil {
+		return nil, fmt.Errorf("error inspecting exec %s: %v", id, err)
+	}
+
+	return &state, nil
+}
+
+// How long we wait for the daemon to notice an exec'd process finished, after its output is closed.
+const ExecExitTimeout = 5 * time.Second
+
+/*
+ * Waits for a process created with CreateExec to finish, and returns its exit code.
+ * The output of the process should be read until it is closed before calling it.
+ */
+func (c *Client) WaitExec(id string) (int, error) {
+	deadline := time.Now().Add(ExecExitTimeout)
+	for {
+		state, err := c.InspectExec(id)
+		if err != nil {
+			return 1, err
+		}
+
+		if !state.Running && state.ExitCode != nil {
+			return *state.ExitCode, nil
+		}
+
+		if time.Now().After(deadline) {
+			return 1, fmt.Errorf("exec %s is still running", id)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+/*
+ * Runs a command in the container, without a TTY, giving it the input,
+ * and waits for it to finish. Returns its exit code and its output.
+ */
+func (c *Client) Exec(containerID string, cmd []string, input io.Reader) (int, []byte, error) {
+	id, err := c.CreateExec(containerID, ExecConfig{
+		Cmd:          cmd,
+		AttachStdin:  input != nil,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+
+	if err != nil {
+		return 1, nil, err
+	}
+
+	conn, err := c.StartExec(id, false)
+	if err != nil {
+		return 1, nil, err
+	}
+
+	defer conn.Close()
+
+	// The input is written while the output is read, so a process writing a lot can't block us.
+	if input != nil {
+		go func() {
+			_, _ = io.Copy(conn, input)
+			_ = conn.CloseWrite()
+		}()
+	}
+
+	output := bytes.Buffer{}
+	err = ReadMultiplexed(conn, &output, &output)
+	if err != nil {
+		return 1, output.Bytes(), fmt.Errorf("error reading output of exec %s: %v", id, err)
+	}
+
+	exitCode, err := c.WaitExec(id)
+	return exitCode, output.Bytes(), err
+}
+
+/*
+ * A connection hijacked from an HTTP request, used to stream
+ * the input and output of a process in a container.
+ */
+type HijackedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// The response headers may have been read together with the beginning of the stream.
+func (c *HijackedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// Closes the input of the process, while its output can still be read.
+func (c *HijackedConn) CloseWrite() error {
+	if unixConn, ok := c.Conn.(*net.UnixConn); ok {
+		return unixConn.CloseWrite()
+	}
+
+	return nil
+}
+
+/*
+ * Without a TTY, the output of a process is multiplexed: each frame has
+ * an 8 byte header, with the stream in the first byte, and the size of the frame
+ * in the last four.
+ */
+func ReadMultiplexed(reader io.Reader, stdout, stderr io.Writer) error {
+	header := make([]byte, 8)
+	for {
+		_, err := io.ReadFull(reader, header)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		writer := stdout
+		if header[0] == 2 {
+			writer = stderr
+		}
+
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		_, err = io.CopyN(writer, reader, size)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+var ErrNotFound = errors.New("not found")
+
+func (c *Client) doJSON(method, path string, query url.Values, body interface{}, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+
+		reader = bytes.NewReader(encoded)
+	}
+
+	response, err := c.do(method, path, query, map[string]string{"Content-Type": "application/json"}, reader)
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	if err := checkResponse(response); err != nil {
+		return err
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+/*
+ * The Engine API streams the input and output of processes through
+ * the connection used for the request, after upgrading it.
+ */
+func (c *Client) hijack(path string, query url.Values, body interface{}) (*HijackedConn, error) {
+	encoded := []byte{}
+	if body != nil {
+		var err error
+		encoded, err = json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	u := url.URL{Scheme: "http", Host: "docker", Path: "/" + APIVersion + path}
+	if query != nil {
+		u.RawQuery = query.Encode()
+	}
+
+	request, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(encoded))
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", "tcp")
+
+	conn, err := net.DialTimeout("unix", c.Socket, 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to the Docker daemon at %s: %v", c.Socket, err)
+	}
+
+	err = request.Write(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		err = checkResponse(response)
+		if err == nil {
+			err = fmt.Errorf("status %d: connection was not upgraded", response.StatusCode)
+		}
+
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return &HijackedConn{Conn: conn, reader: reader}, nil
+}
+
+func resizeQuery(cols, rows uint16) url.Values {
+	return url.Values{"w": {strconv.Itoa(int(cols))}, "h": {strconv.Itoa(int(rows))}}
+}
+
+func (c *Client) do(method, path string, query url.Values, headers map[string]string, body io.Reader) (*http.Response, error) {
+	// The host is ignored, since we always connect to the socket.
+	u := url.URL{Scheme: "http", Host: "docker", Path: "/" + APIVersion + path}
+	if query != nil {
+		u.RawQuery = query.Encode()
+	}
+
+	request, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to the Docker daemon at %s: %v", c.Socket, err)
+	}
+
+	return response, nil
+}
+
+/*
+ * The Engine API reports errors with a JSON object holding a message.
+ */
+func checkResponse(response *http.Response) error {
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return nil
+	}
+
+	body, _ := io.ReadAll(response.Body)
+	message := struct {
+		Message string `json:"message"`
+	}{}
+
+	if err := json.Unmarshal(body, &message); err != nil || message.Message == "" {
+		message.Message = strings.TrimSpace(string(body))
+	}
+
+	if response.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %s", ErrNotFound, message.Message)
+	}
+
+	return fmt.Errorf("status %d: %s", response.StatusCode, message.Message)
+}
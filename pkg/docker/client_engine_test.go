@@ -0,0 +1,178 @@
+package docker_test
+
+import (
+	"bytes"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/semaphoreci/agent/pkg/docker"
+	"github.com/semaphoreci/agent/pkg/docker/dockertest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test__Client(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	engine, err := dockertest.NewFakeEngine()
+	require.NoError(t, err)
+	defer engine.Close()
+
+	client := docker.NewClient(engine.Socket)
+
+	t.Run("image exists", func(t *testing.T) {
+		engine.AddImage("ruby:3.2")
+
+		exists, err := client.ImageExists("ruby:3.2")
+		require.NoError(t, err)
+		assert.True(t, exists)
+
+		exists, err = client.ImageExists("ruby:2.6")
+		require.NoError(t, err)
+		assert.False(t, exists)
+	})
+
+	t.Run("pull image streams progress", func(t *testing.T) {
+		messages := []string{}
+		auth := &docker.RegistryAuth{Username: "user", Password: "pass", ServerAddress: "docker.io"}
+		err := client.PullImage("postgres", auth, func(progress docker.PullProgress) {
+			messages = append(messages, progress.String())
+		})
+
+		require.NoError(t, err)
+		assert.Equal(t, []string{
+			"latest: Pulling from postgres",
+			"a1b2c3: Pulling fs layer",
+			"a1b2c3: Downloading",
+			"a1b2c3: Pull complete",
+			"Status: Downloaded newer image for postgres:latest",
+		}, messages)
+
+		expectedAuth, _ := auth.Encode()
+		assert.Equal(t, expectedAuth, engine.AuthFor("postgres"))
+
+		exists, err := client.ImageExists("postgres")
+		require.NoError(t, err)
+		assert.True(t, exists)
+	})
+
+	t.Run("pull errors are reported", func(t *testing.T) {
+		engine.PullErrors["private/image:1.0"] = "pull access denied for private/image"
+		err := client.PullImage("private/image:1.0", nil, nil)
+		assert.ErrorContains(t, err, "error pulling image private/image:1.0: pull access denied for private/image")
+		assert.Empty(t, engine.AuthFor("private/image:1.0"))
+	})
+
+	t.Run("networks", func(t *testing.T) {
+		id, err := client.CreateNetwork("job-network", map[string]string{"job": "1"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"job-network"}, engine.Networks())
+
+		_, err = client.CreateNetwork("job-network", nil)
+		assert.ErrorContains(t, err, "already exists")
+
+		require.NoError(t, client.RemoveNetwork(id))
+		assert.Empty(t, engine.Networks())
+
+		// removing it again is not an error
+		require.NoError(t, client.RemoveNetwork(id))
+	})
+
+	t.Run("containers", func(t *testing.T) {
+		config := docker.ContainerConfig{
+			Image: "ruby:3.2",
+			Cmd:   []string{"bash"},
+			Env:   []string{"A=B"},
+			HostConfig: docker.HostConfig{
+				Binds: []string{"/tmp:/tmp:ro"},
+			},
+		}
+
+		id, err := client.CreateContainer("job-main", config)
+		require.NoError(t, err)
+		require.NoError(t, client.StartContainer(id))
+
+		containers := engine.Containers()
+		require.Len(t, containers, 1)
+		assert.Equal(t, "job-main", containers[0].Name)
+		assert.Equal(t, config, containers[0].Config)
+		assert.True(t, containers[0].Running)
+
+		_, err = client.CreateContainer("job-main", config)
+		assert.ErrorContains(t, err, "error creating container job-main: status 409")
+
+		_, err = client.CreateContainer("job-db", docker.ContainerConfig{Image: "mysql"})
+		assert.ErrorContains(t, err, "No such image: mysql")
+
+		require.NoError(t, client.RemoveContainer(id))
+		assert.Empty(t, engine.Containers())
+
+		// removing it again is not an error
+		require.NoError(t, client.RemoveContainer(id))
+		assert.ErrorContains(t, client.StartContainer(id), "No such container")
+	})
+
+	t.Run("attach and exec", func(t *testing.T) {
+		id, err := client.CreateContainer("job-attach", docker.ContainerConfig{
+			Image: "ruby:3.2",
+			Cmd:   []string{"bash", "--norc", "--noprofile"},
+			Tty:   true,
+		})
+
+		require.NoError(t, err)
+		defer client.RemoveContainer(id)
+
+		_, _, err = client.Exec(id, []string{"true"}, nil)
+		assert.ErrorContains(t, err, "is not running")
+
+		conn, err := client.AttachContainer(id)
+		require.NoError(t, err)
+		defer conn.Close()
+
+		require.NoError(t, client.StartContainer(id))
+		require.NoError(t, client.ResizeContainer(id, 120, 40))
+
+		_, err = conn.Write([]byte("stty size\n"))
+		require.NoError(t, err)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		output := ""
+		buf := make([]byte, 1024)
+		for !strings.Contains(output, "40 120") {
+			n, err := conn.Read(buf)
+			require.NoError(t, err)
+			output += string(buf[:n])
+		}
+
+		// the input is given to the process, and its output is read until it finishes
+		exitCode, execOutput, err := client.Exec(id, []string{"bash", "-c", "cat; echo error >&2; exit 3"}, strings.NewReader("hello\n"))
+		require.NoError(t, err)
+		assert.Equal(t, 3, exitCode)
+		assert.Equal(t, "hello\nerror\n", string(execOutput))
+
+		exitCode, execOutput, err = client.Exec(id, []string{"echo", "no input"}, nil)
+		require.NoError(t, err)
+		assert.Equal(t, 0, exitCode)
+		assert.Equal(t, "no input\n", string(execOutput))
+	})
+
+	t.Run("multiplexed output", func(t *testing.T) {
+		stdout := bytes.Buffer{}
+		stderr := bytes.Buffer{}
+		stream := []byte{1, 0, 0, 0, 0, 0, 0, 3, 'o', 'u', 't', 2, 0, 0, 0, 0, 0, 0, 3, 'e', 'r', 'r'}
+		require.NoError(t, docker.ReadMultiplexed(bytes.NewReader(stream), &stdout, &stderr))
+		assert.Equal(t, "out", stdout.String())
+		assert.Equal(t, "err", stderr.String())
+
+		err := docker.ReadMultiplexed(bytes.NewReader(stream[:5]), &stdout, &stderr)
+		assert.Error(t, err)
+	})
+
+	t.Run("daemon is not running", func(t *testing.T) {
+		_, err := docker.NewClient("/tmp/does-not-exist.sock").ImageExists("ruby")
+		assert.ErrorContains(t, err, "error connecting to the Docker daemon at /tmp/does-not-exist.sock")
+	})
+}
@@ -0,0 +1,88 @@
+package docker
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test__SocketFromEnvironment(t *testing.T) {
+	t.Setenv("DOCKER_HOST", "")
+	assert.Equal(t, DefaultSocket, SocketFromEnvironment())
+
+	t.Setenv("DOCKER_HOST", "tcp://10.0.0.1:2375")
+	assert.Equal(t, DefaultSocket, SocketFromEnvironment())
+
+	t.Setenv("DOCKER_HOST", "unix:///run/user/1000/docker.sock")
+	assert.Equal(t, "/run/user/1000/docker.sock", SocketFromEnvironment())
+}
+
+func Test__ImageRegistry(t *testing.T) {
+	assert.Equal(t, "docker.io", ImageRegistry("ruby"))
+	assert.Equal(t, "docker.io", ImageRegistry("ruby:3.2"))
+	assert.Equal(t, "docker.io", ImageRegistry("semaphoreci/android:30"))
+	assert.Equal(t, "docker.io", ImageRegistry("docker.io/library/ruby"))
+	assert.Equal(t, "gcr.io", ImageRegistry("gcr.io/project/image:1.0"))
+	assert.Equal(t, "localhost", ImageRegistry("localhost/image"))
+	assert.Equal(t, "localhost:5000", ImageRegistry("localhost:5000/image:1.0"))
+	assert.Equal(t, "123.dkr.ecr.us-east-1.amazonaws.com", ImageRegistry("123.dkr.ecr.us-east-1.amazonaws.com/image"))
+}
+
+func Test__RegistryAuthFor(t *testing.T) {
+	config := &DockerConfig{
+		Auths: map[string]DockerConfigAuthEntry{
+			"docker.io":                 {Username: "hub-user", Password: "hub-pass"},
+			"https://gcr.io":            {Username: "_json_key", Password: "{}"},
+			"registry.example.com:5000": {Username: "user", Password: "pass"},
+		},
+	}
+
+	auth := config.RegistryAuthFor("ruby:3.2")
+	require.NotNil(t, auth)
+	assert.Equal(t, RegistryAuth{Username: "hub-user", Password: "hub-pass", ServerAddress: "docker.io"}, *auth)
+
+	auth = config.RegistryAuthFor("gcr.io/project/image")
+	require.NotNil(t, auth)
+	assert.Equal(t, RegistryAuth{Username: "_json_key", Password: "{}", ServerAddress: "https://gcr.io"}, *auth)
+
+	auth = config.RegistryAuthFor("registry.example.com:5000/image:1.0")
+	require.NotNil(t, auth)
+	assert.Equal(t, "user", auth.Username)
+
+	assert.Nil(t, config.RegistryAuthFor("quay.io/image"))
+
+	var noConfig *DockerConfig
+	assert.Nil(t, noConfig.RegistryAuthFor("ruby"))
+}
+
+func Test__RegistryAuthEncode(t *testing.T) {
+	auth := RegistryAuth{Username: "user", Password: "pass", ServerAddress: "docker.io"}
+	encoded, err := auth.Encode()
+	require.NoError(t, err)
+
+	decoded, err := base64.URLEncoding.DecodeString(encoded)
+	require.NoError(t, err)
+
+	result := RegistryAuth{}
+	require.NoError(t, json.Unmarshal(decoded, &result))
+	assert.Equal(t, auth, result)
+}
+
+func Test__SplitImageReference(t *testing.T) {
+	cases := map[string][]string{
+		"ruby":                       {"ruby", "latest"},
+		"ruby:3.2":                   {"ruby", "3.2"},
+		"localhost:5000/image":       {"localhost:5000/image", "latest"},
+		"localhost:5000/image:1.0":   {"localhost:5000/image", "1.0"},
+		"ruby@sha256:abcdef":         {"ruby@sha256:abcdef", ""},
+		"gcr.io/project/image:1.0.1": {"gcr.io/project/image", "1.0.1"},
+	}
+
+	for image, expected := range cases {
+		name, tag := SplitImageReference(image)
+		assert.Equal(t, expected, []string{name, tag}, image)
+	}
+}
@@ -0,0 +1,567 @@
+package dockertest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/semaphoreci/agent/pkg/docker"
+	"github.com/semaphoreci/agent/pkg/shell"
+)
+
+/*
+ * An in-memory implementation of the parts of the Engine API the client uses,
+ * listening on a unix socket. Used to test the client and the docker executor
+ * without a Docker daemon. The processes of containers and execs
+ * run directly in the host, ignoring the image.
+ */
+type FakeEngine struct {
+	Socket string
+
+	// Images that can't be pulled, and the error returned when pulling them.
+	PullErrors map[string]string
+
+	lock       sync.Mutex
+	directory  string
+	server     *http.Server
+	images     map[string]bool
+	pulls      []string
+	auths      map[string]string
+	networks   map[string]bool
+	containers map[string]*FakeContainer
+	order      []string
+	execs      map[string]*fakeExec
+}
+
+type FakeContainer struct {
+	Name    string
+	Config  docker.ContainerConfig
+	Running bool
+
+	attached *hijackedConn
+	process  *exec.Cmd
+	tty      *os.File
+}
+
+type fakeExec struct {
+	container string
+	config    docker.ExecConfig
+	process   *exec.Cmd
+	tty       *os.File
+	running   bool
+	exitCode  *int
+}
+
+func NewFakeEngine() (*FakeEngine, error) {
+	// Paths for unix sockets are limited to around 100 characters,
+	// so we can't use the test's temporary directory.
+	directory, err := os.MkdirTemp("", "docker-engine-")
+	if err != nil {
+		return nil, err
+	}
+
+	socket := filepath.Join(directory, "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		_ = os.RemoveAll(directory)
+		return nil, err
+	}
+
+	engine := &FakeEngine{
+		Socket:     socket,
+		PullErrors: map[string]string{},
+		directory:  directory,
+		images:     map[string]bool{},
+		auths:      map[string]string{},
+		networks:   map[string]bool{},
+		containers: map[string]*FakeContainer{},
+		execs:      map[string]*fakeExec{},
+	}
+
+	engine.server = &http.Server{Handler: http.HandlerFunc(engine.handle)}
+	go func() {
+		_ = engine.server.Serve(listener)
+	}()
+
+	return engine, nil
+}
+
+func (f *FakeEngine) Close() {
+	_ = f.server.Close()
+
+	f.lock.Lock()
+	for name := range f.containers {
+		f.killProcesses(name)
+	}
+	f.lock.Unlock()
+
+	_ = os.RemoveAll(f.directory)
+}
+
+func (f *FakeEngine) AddImage(image string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.images[fakeImageKey(image)] = true
+}
+
+// The images pulled, in the order they were pulled.
+func (f *FakeEngine) Pulls() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string{}, f.pulls...)
+}
+
+// The encoded credentials used to pull an image.
+func (f *FakeEngine) AuthFor(image string) string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.auths[fakeImageKey(image)]
+}
+
+func (f *FakeEngine) Networks() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	networks := []string{}
+	for name := range f.networks {
+		networks = append(networks, name)
+	}
+
+	return networks
+}
+
+// The containers that exist, in the order they were created.
+func (f *FakeEngine) Containers() []FakeContainer {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	containers := []FakeContainer{}
+	for _, name := range f.order {
+		if c, ok := f.containers[name]; ok {
+			containers = append(containers, *c)
+		}
+	}
+
+	return containers
+}
+
+func (f *FakeEngine) handle(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/"+docker.APIVersion)
+	query := r.URL.Query()
+
+	switch {
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "/images/") && strings.HasSuffix(path, "/json"):
+		image := strings.TrimSuffix(strings.TrimPrefix(path, "/images/"), "/json")
+		if !f.images[fakeImageKey(image)] {
+			fakeError(w, http.StatusNotFound, "No such image: "+image)
+			return
+		}
+
+		fmt.Fprintf(w, `{"Id": "sha256:%s"}`, image)
+
+	case r.Method == http.MethodPost && path == "/images/create":
+		f.pull(w, r, query.Get("fromImage"), query.Get("tag"))
+
+	case r.Method == http.MethodPost && path == "/networks/create":
+		body := map[string]interface{}{}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		name, _ := body["Name"].(string)
+		if f.networks[name] {
+			fakeError(w, http.StatusConflict, "network with name "+name+" already exists")
+			return
+		}
+
+		f.networks[name] = true
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"Id": "%s"}`, name)
+
+	case r.Method == http.MethodDelete && strings.HasPrefix(path, "/networks/"):
+		name := strings.TrimPrefix(path, "/networks/")
+		if !f.networks[name] {
+			fakeError(w, http.StatusNotFound, "network "+name+" not found")
+			return
+		}
+
+		delete(f.networks, name)
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPost && path == "/containers/create":
+		f.createContainer(w, r, query.Get("name"))
+
+	case r.Method == http.MethodPost && strings.HasPrefix(path, "/containers/") && strings.HasSuffix(path, "/start"):
+		name := strings.TrimSuffix(strings.TrimPrefix(path, "/containers/"), "/start")
+		container, ok := f.containers[name]
+		if !ok {
+			fakeError(w, http.StatusNotFound, "No such container: "+name)
+			return
+		}
+
+		f.startContainer(w, container)
+
+	case r.Method == http.MethodPost && strings.HasPrefix(path, "/containers/") && strings.HasSuffix(path, "/attach"):
+		name := strings.TrimSuffix(strings.TrimPrefix(path, "/containers/"), "/attach")
+		container, ok := f.containers[name]
+		if !ok {
+			fakeError(w, http.StatusNotFound, "No such container: "+name)
+			return
+		}
+
+		conn, err := fakeHijack(w)
+		if err != nil {
+			return
+		}
+
+		container.attached = conn
+
+	case r.Method == http.MethodPost && strings.HasPrefix(path, "/containers/") && strings.HasSuffix(path, "/resize"):
+		name := strings.TrimSuffix(strings.TrimPrefix(path, "/containers/"), "/resize")
+		container, ok := f.containers[name]
+		if !ok {
+			fakeError(w, http.StatusNotFound, "No such container: "+name)
+			return
+		}
+
+		fakeResize(w, container.tty, query)
+
+	case r.Method == http.MethodPost && strings.HasPrefix(path, "/containers/") && strings.HasSuffix(path, "/exec"):
+		name := strings.TrimSuffix(strings.TrimPrefix(path, "/containers/"), "/exec")
+		f.createExec(w, r, name)
+
+	case r.Method == http.MethodDelete && strings.HasPrefix(path, "/containers/"):
+		name := strings.TrimPrefix(path, "/containers/")
+		if _, ok := f.containers[name]; !ok {
+			fakeError(w, http.StatusNotFound, "No such container: "+name)
+			return
+		}
+
+		f.killProcesses(name)
+		delete(f.containers, name)
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodPost && strings.HasPrefix(path, "/exec/") && strings.HasSuffix(path, "/start"):
+		id := strings.TrimSuffix(strings.TrimPrefix(path, "/exec/"), "/start")
+		f.startExec(w, r, id)
+
+	case r.Method == http.MethodPost && strings.HasPrefix(path, "/exec/") && strings.HasSuffix(path, "/resize"):
+		id := strings.TrimSuffix(strings.TrimPrefix(path, "/exec/"), "/resize")
+		e, ok := f.execs[id]
+		if !ok {
+			fakeError(w, http.StatusNotFound, "No such exec instance: "+id)
+			return
+		}
+
+		fakeResize(w, e.tty, query)
+
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "/exec/") && strings.HasSuffix(path, "/json"):
+		id := strings.TrimSuffix(strings.TrimPrefix(path, "/exec/"), "/json")
+		e, ok := f.execs[id]
+		if !ok {
+			fakeError(w, http.StatusNotFound, "No such exec instance: "+id)
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(docker.ExecState{Running: e.running, ExitCode: e.exitCode})
+
+	default:
+		fakeError(w, http.StatusNotFound, "page not found")
+	}
+}
+
+func (f *FakeEngine) pull(w http.ResponseWriter, r *http.Request, name, tag string) {
+	image := name
+	if tag != "" {
+		image = name + ":" + tag
+	}
+
+	f.pulls = append(f.pulls, image)
+	f.auths[fakeImageKey(image)] = r.Header.Get("X-Registry-Auth")
+
+	// Like the real API, errors are reported in the stream.
+	encoder := json.NewEncoder(w)
+	_ = encoder.Encode(docker.PullProgress{ID: tag, Status: "Pulling from " + name})
+	if message, ok := f.PullErrors[image]; ok {
+		_ = encoder.Encode(map[string]interface{}{
+			"error":       message,
+			"errorDetail": map[string]string{"message": message},
+		})
+		return
+	}
+
+	_ = encoder.Encode(docker.PullProgress{ID: "a1b2c3", Status: "Pulling fs layer"})
+	_ = encoder.Encode(docker.PullProgress{ID: "a1b2c3", Status: "Downloading", Progress: "[=====>      ]  1MB/2MB"})
+	_ = encoder.Encode(docker.PullProgress{ID: "a1b2c3", Status: "Pull complete"})
+	_ = encoder.Encode(docker.PullProgress{Status: "Status: Downloaded newer image for " + image})
+	f.images[fakeImageKey(image)] = true
+}
+
+func (f *FakeEngine) createContainer(w http.ResponseWriter, r *http.Request, name string) {
+	if _, ok := f.containers[name]; ok {
+		fakeError(w, http.StatusConflict, "Conflict. The container name "+name+" is already in use")
+		return
+	}
+
+	config := docker.ContainerConfig{}
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		fakeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !f.images[fakeImageKey(config.Image)] {
+		fakeError(w, http.StatusNotFound, "No such image: "+config.Image)
+		return
+	}
+
+	f.containers[name] = &FakeContainer{Name: name, Config: config}
+	f.order = append(f.order, name)
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, `{"Id": "%s"}`, name)
+}
+
+/*
+ * If something is attached to the container, its command
+ * runs in a PTY, connected to what is attached.
+ */
+func (f *FakeEngine) startContainer(w http.ResponseWriter, container *FakeContainer) {
+	if container.attached != nil && len(container.Config.Cmd) > 0 {
+		// #nosec
+		cmd := exec.Command(container.Config.Cmd[0], container.Config.Cmd[1:]...)
+		cmd.Env = append(os.Environ(), container.Config.Env...)
+		tty, err := shell.StartPTY(cmd)
+		if err != nil {
+			fakeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		container.process = cmd
+		container.tty = tty
+
+		conn := container.attached
+		go func() {
+			_, _ = io.Copy(tty, conn)
+		}()
+
+		go func() {
+			_, _ = io.Copy(conn, tty)
+			_ = cmd.Wait()
+
+			f.lock.Lock()
+			container.Running = false
+			f.lock.Unlock()
+
+			_ = conn.Close()
+		}()
+	}
+
+	container.Running = true
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *FakeEngine) createExec(w http.ResponseWriter, r *http.Request, name string) {
+	container, ok := f.containers[name]
+	if !ok {
+		fakeError(w, http.StatusNotFound, "No such container: "+name)
+		return
+	}
+
+	if !container.Running {
+		fakeError(w, http.StatusConflict, "Container "+name+" is not running")
+		return
+	}
+
+	config := docker.ExecConfig{}
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		fakeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	id := fmt.Sprintf("exec-%d", len(f.execs)+1)
+	f.execs[id] = &fakeExec{container: name, config: config}
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, `{"Id": "%s"}`, id)
+}
+
+/*
+ * Like the real API, the output is only multiplexed without a TTY,
+ * and the connection is closed once the process finishes.
+ */
+func (f *FakeEngine) startExec(w http.ResponseWriter, r *http.Request, id string) {
+	e, ok := f.execs[id]
+	if !ok {
+		fakeError(w, http.StatusNotFound, "No such exec instance: "+id)
+		return
+	}
+
+	body := struct{ Tty bool }{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		fakeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// #nosec
+	cmd := exec.Command(e.config.Cmd[0], e.config.Cmd[1:]...)
+	cmd.Env = append(os.Environ(), e.config.Env...)
+
+	conn, err := fakeHijack(w)
+	if err != nil {
+		return
+	}
+
+	if body.Tty {
+		e.tty, err = shell.StartPTY(cmd)
+		if err == nil {
+			go func() {
+				_, _ = io.Copy(e.tty, conn)
+			}()
+		}
+	} else {
+		err = f.startMultiplexed(cmd, conn, e.config.AttachStdin)
+	}
+
+	if err != nil {
+		_, _ = conn.Write([]byte(err.Error()))
+		_ = conn.Close()
+		return
+	}
+
+	e.process = cmd
+	e.running = true
+
+	go func() {
+		if e.tty != nil {
+			_, _ = io.Copy(conn, e.tty)
+		}
+
+		_ = cmd.Wait()
+		exitCode := cmd.ProcessState.ExitCode()
+
+		f.lock.Lock()
+		e.running = false
+		e.exitCode = &exitCode
+		f.lock.Unlock()
+
+		_ = conn.Close()
+	}()
+}
+
+func (f *FakeEngine) startMultiplexed(cmd *exec.Cmd, conn *hijackedConn, attachStdin bool) error {
+	if attachStdin {
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			_, _ = io.Copy(stdin, conn)
+			_ = stdin.Close()
+		}()
+	}
+
+	lock := &sync.Mutex{}
+	cmd.Stdout = &fakeStreamWriter{conn: conn, stream: 1, lock: lock}
+	cmd.Stderr = &fakeStreamWriter{conn: conn, stream: 2, lock: lock}
+	return cmd.Start()
+}
+
+func (f *FakeEngine) killProcesses(container string) {
+	if c, ok := f.containers[container]; ok && c.process != nil {
+		_ = c.process.Process.Kill()
+	}
+
+	for _, e := range f.execs {
+		if e.container == container && e.process != nil {
+			_ = e.process.Process.Kill()
+		}
+	}
+}
+
+type fakeStreamWriter struct {
+	conn   io.Writer
+	stream byte
+	lock   *sync.Mutex
+}
+
+func (w *fakeStreamWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	header := make([]byte, 8)
+	header[0] = w.stream
+	binary.BigEndian.PutUint32(header[4:], uint32(len(p)))
+	_, err := w.conn.Write(append(header, p...))
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// The request may have been read together with the beginning of the stream.
+type hijackedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *hijackedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func fakeHijack(w http.ResponseWriter) (*hijackedConn, error) {
+	conn, buffer, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		fakeError(w, http.StatusInternalServerError, err.Error())
+		return nil, err
+	}
+
+	_, err = conn.Write([]byte("HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n"))
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	// Anything the client sent after the request may already be buffered.
+	return &hijackedConn{Conn: conn, reader: buffer.Reader}, nil
+}
+
+func fakeResize(w http.ResponseWriter, tty *os.File, query url.Values) {
+	if tty == nil {
+		fakeError(w, http.StatusConflict, "no TTY to resize")
+		return
+	}
+
+	cols, _ := strconv.Atoi(query.Get("w"))
+	rows, _ := strconv.Atoi(query.Get("h"))
+	if err := shell.ResizePTY(tty, uint16(cols), uint16(rows)); err != nil {
+		fakeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func fakeImageKey(image string) string {
+	name, tag := docker.SplitImageReference(image)
+	if tag == "" {
+		return name
+	}
+
+	return name + ":" + tag
+}
+
+func fakeError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"message": message})
+}
@@ -0,0 +1,103 @@
+package docker
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/term"
+)
+
+/*
+ * Runs a command in the container connected to the agent's own standard
+ * input and output, like "docker exec -i", or "docker exec -ti" with a TTY.
+ * Used to open shells in the job's container through SSH, without the docker CLI.
+ * Returns the exit code of the command.
+ */
+func (c *Client) ExecWithStdio(containerID string, cmd []string, tty bool) (int, error) {
+	stdin := int(os.Stdin.Fd())
+	if tty && !term.IsTerminal(stdin) {
+		return 1, fmt.Errorf("the input device is not a TTY")
+	}
+
+	config := ExecConfig{
+		Cmd:          cmd,
+		Tty:          tty,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+	}
+
+	if tty && os.Getenv("TERM") != "" {
+		config.Env = []string{"TERM=" + os.Getenv("TERM")}
+	}
+
+	id, err := c.CreateExec(containerID, config)
+	if err != nil {
+		return 1, err
+	}
+
+	conn, err := c.StartExec(id, tty)
+	if err != nil {
+		return 1, err
+	}
+
+	defer conn.Close()
+
+	if tty {
+		state, err := term.MakeRaw(stdin)
+		if err != nil {
+			return 1, fmt.Errorf("error putting the terminal in raw mode: %v", err)
+		}
+
+		defer func() {
+			_ = term.Restore(stdin, state)
+		}()
+
+		stopResizing := c.resizeExecWithTerminal(id, stdin)
+		defer stopResizing()
+	}
+
+	go func() {
+		_, _ = io.Copy(conn, os.Stdin)
+		_ = conn.CloseWrite()
+	}()
+
+	if tty {
+		_, err = io.Copy(os.Stdout, conn)
+	} else {
+		err = ReadMultiplexed(conn, os.Stdout, os.Stderr)
+	}
+
+	if err != nil {
+		return 1, fmt.Errorf("error reading output of exec %s: %v", id, err)
+	}
+
+	return c.WaitExec(id)
+}
+
+/*
+ * Keeps the size of the exec's TTY in sync with the agent's terminal.
+ * Returns a function to stop it.
+ */
+func (c *Client) resizeExecWithTerminal(id string, fd int) func() {
+	resize := func() {
+		cols, rows, err := term.GetSize(fd)
+		if err != nil {
+			return
+		}
+
+		_ = c.ResizeExec(id, uint16(cols), uint16(rows))
+	}
+
+	resize()
+
+	resized, stop := notifyTerminalResize()
+	go func() {
+		for range resized {
+			resize()
+		}
+	}()
+
+	return stop
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+
+package docker
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+/*
+ * The channel receives a value every time the agent's terminal is resized.
+ * The returned function stops the notifications and closes the channel.
+ */
+func notifyTerminalResize() (<-chan os.Signal, func()) {
+	resized := make(chan os.Signal, 1)
+	signal.Notify(resized, syscall.SIGWINCH)
+
+	return resized, func() {
+		signal.Stop(resized)
+		close(resized)
+	}
+}
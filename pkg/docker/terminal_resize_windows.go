@@ -0,0 +1,13 @@
+//go:build windows
+
+package docker
+
+import "os"
+
+// There is no signal for terminal resizes in Windows.
+func notifyTerminalResize() (<-chan os.Signal, func()) {
+	resized := make(chan os.Signal)
+	return resized, func() {
+		close(resized)
+	}
+}
@@ -1,6 +1,9 @@
 package eventlogger
 
-import "io"
+import (
+	"io"
+	"time"
+)
 
 type Backend interface {
 	Open() error
@@ -11,6 +14,15 @@ type Backend interface {
 	CloseWithOptions(CloseOptions) error
 }
 
+/*
+ * Backends can optionally implement this to receive the phases of a job.
+ * Phases are not part of the job log, so backends that don't implement this don't see them.
+ */
+type PhaseTracer interface {
+	PhaseStarted(name string, startedAt time.Time)
+	PhaseFinished(name string, exitCode int, finishedAt time.Time)
+}
+
 type CloseOptions struct {
 	OnClose func(bool)
 }
@@ -18,3 +30,8 @@ type CloseOptions struct {
 var _ Backend = (*FileBackend)(nil)
 var _ Backend = (*HTTPBackend)(nil)
 var _ Backend = (*InMemoryBackend)(nil)
+var _ Backend = (*MultiBackend)(nil)
+var _ Backend = (*OTLPBackend)(nil)
+
+var _ PhaseTracer = (*MultiBackend)(nil)
+var _ PhaseTracer = (*OTLPBackend)(nil)
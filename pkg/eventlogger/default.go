@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/semaphoreci/agent/pkg/api"
+	"github.com/semaphoreci/agent/pkg/compression"
 )
 
 const LoggerMethodPull = "pull"
@@ -17,6 +18,19 @@ type LoggerOptions struct {
 	Request        *api.JobRequest
 	RefreshTokenFn func() (string, error)
 	UserAgent      string
+
+	// Where the HTTP backend keeps its state,
+	// so the logs can still be pushed if the agent is restarted.
+	// The logs are kept in the same directory.
+	HTTPBackendStateFile string
+
+	// Additional destinations for the job events.
+	// The backend for the logger method in the request is still
+	// the one used to serve and upload the job logs.
+	Sinks []SinkConfig
+
+	// If set, the job logs are kept compressed on disk while the job is running.
+	OnDiskCompression *compression.Options
 }
 
 func CreateLogger(options LoggerOptions) (*Logger, error) {
@@ -24,43 +38,61 @@ func CreateLogger(options LoggerOptions) (*Logger, error) {
 		return nil, fmt.Errorf("request is required")
 	}
 
+	var backend Backend
+	var err error
+
 	switch options.Request.Logger.Method {
 	case LoggerMethodPull:
-		return Default(options.Request)
+		backend, err = defaultBackend(options.Request, options.OnDiskCompression)
 	case LoggerMethodPush:
-		return DefaultHTTP(options)
+		backend, err = defaultHTTPBackend(options)
 	default:
 		return nil, fmt.Errorf("unknown logger type")
 	}
-}
 
-func Default(request *api.JobRequest) (*Logger, error) {
-	path := filepath.Join(os.TempDir(), fmt.Sprintf("job_log_%d.json", time.Now().UnixNano()))
-
-	maxSize := DefaultMaxSizeInBytes
-	if request.Logger.MaxSizeInBytes > 0 {
-		maxSize = request.Logger.MaxSizeInBytes
+	if err != nil {
+		return nil, err
 	}
 
-	backend, err := NewFileBackend(path, maxSize)
+	backend, err = withSinks(backend, options)
 	if err != nil {
 		return nil, err
 	}
 
-	logger, err := NewLogger(backend)
+	return openLogger(backend)
+}
+
+func Default(request *api.JobRequest) (*Logger, error) {
+	backend, err := defaultBackend(request, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	err = logger.Open()
+	return openLogger(backend)
+}
+
+func DefaultHTTP(options LoggerOptions) (*Logger, error) {
+	backend, err := defaultHTTPBackend(options)
 	if err != nil {
 		return nil, err
 	}
 
-	return logger, nil
+	return openLogger(backend)
 }
 
-func DefaultHTTP(options LoggerOptions) (*Logger, error) {
+func defaultBackend(request *api.JobRequest, onDiskCompression *compression.Options) (Backend, error) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("job_log_%d.json", time.Now().UnixNano()))
+
+	return NewFileBackendWithOptions(FileBackendOptions{
+		Path:            path,
+		MaxSizeInBytes:  maxSizeFor(request),
+		TrimStrategy:    request.Logger.TrimStrategy,
+		TailSizeInBytes: request.Logger.TailSizeInBytes,
+		Compression:     onDiskCompression,
+	})
+}
+
+func defaultHTTPBackend(options LoggerOptions) (Backend, error) {
 	request := options.Request
 	if request.Logger.URL == "" {
 		return nil, errors.New("HTTP logger needs a URL")
@@ -70,19 +102,24 @@ func DefaultHTTP(options LoggerOptions) (*Logger, error) {
 		return nil, errors.New("HTTP logger needs a refresh token function")
 	}
 
-	backend, err := NewHTTPBackend(HTTPBackendConfig{
+	return NewHTTPBackend(HTTPBackendConfig{
 		URL:                   request.Logger.URL,
 		Token:                 request.Logger.Token,
 		RefreshTokenFn:        options.RefreshTokenFn,
 		UserAgent:             options.UserAgent,
 		LinesPerRequest:       MaxLinesPerRequest,
 		FlushTimeoutInSeconds: DefaultFlushTimeoutInSeconds,
+		Compression:           request.Logger.Compression,
+		TrimStrategy:          request.Logger.TrimStrategy,
+		MaxSizeInBytes:        maxSizeFor(request),
+		TailSizeInBytes:       request.Logger.TailSizeInBytes,
+		StateFile:             options.HTTPBackendStateFile,
+		JobID:                 request.JobID,
+		OnDiskCompression:     options.OnDiskCompression,
 	})
+}
 
-	if err != nil {
-		return nil, err
-	}
-
+func openLogger(backend Backend) (*Logger, error) {
 	logger, err := NewLogger(backend)
 	if err != nil {
 		return nil, err
@@ -96,6 +133,14 @@ func DefaultHTTP(options LoggerOptions) (*Logger, error) {
 	return logger, nil
 }
 
+func maxSizeFor(request *api.JobRequest) int {
+	if request.Logger.MaxSizeInBytes > 0 {
+		return request.Logger.MaxSizeInBytes
+	}
+
+	return DefaultMaxSizeInBytes
+}
+
 func DefaultTestLogger() (*Logger, *InMemoryBackend) {
 	backend, err := NewInMemoryBackend()
 	if err != nil {
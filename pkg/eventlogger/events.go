@@ -1,34 +1,123 @@
 package eventlogger
 
+//
+// All events carry a timestamp in seconds, for compatibility with existing consumers.
+// Newer consumers should use the optional *_ms fields, which carry the same
+// information in milliseconds. The duration_ms field in cmd_finished events
+// is measured using a monotonic clock, so it is not affected by wall clock changes.
+//
+
+// Phases of a job, reported to backends that implement PhaseTracer.
+const (
+	PhasePrepare       = "Prepare"
+	PhaseStart         = "Start"
+	PhaseExportEnvVars = "ExportEnvVars"
+	PhaseInjectFiles   = "InjectFiles"
+	PhaseEpilogues     = "Epilogues"
+	PhaseTeardown      = "Teardown"
+)
+
 type JobStartedEvent struct {
-	Event     string `json:"event"`
-	Timestamp int    `json:"timestamp"`
+	Event       string `json:"event"`
+	Timestamp   int    `json:"timestamp"`
+	TimestampMs int64  `json:"timestamp_ms,omitempty"`
 }
 
 type JobFinishedEvent struct {
-	Event     string `json:"event"`
-	Timestamp int    `json:"timestamp"`
-	Result    string `json:"result"`
+	Event       string `json:"event"`
+	Timestamp   int    `json:"timestamp"`
+	TimestampMs int64  `json:"timestamp_ms,omitempty"`
+	Result      string `json:"result"`
 }
 
 type CommandStartedEvent struct {
-	Event     string `json:"event"`
-	Timestamp int    `json:"timestamp"`
-	Directive string `json:"directive"`
+	Event       string `json:"event"`
+	Timestamp   int    `json:"timestamp"`
+	TimestampMs int64  `json:"timestamp_ms,omitempty"`
+	Directive   string `json:"directive"`
 }
 
+// Streams a cmd_output event can come from.
+// Output from commands running in a PTY has no stream.
+const (
+	OutputStreamStdout = "stdout"
+	OutputStreamStderr = "stderr"
+)
+
 type CommandOutputEvent struct {
-	Event     string `json:"event"`
-	Timestamp int    `json:"timestamp"`
-	Output    string `json:"output"`
+	Event       string `json:"event"`
+	Timestamp   int    `json:"timestamp"`
+	TimestampMs int64  `json:"timestamp_ms,omitempty"`
+	Output      string `json:"output"`
+	Stream      string `json:"stream,omitempty"`
+}
+
+/*
+ * Emitted before cmd_finished, if the agent tracks environment changes
+ * and the command changed any environment variables or the working directory.
+ * Only the names of the variables are included, so no secrets are leaked.
+ */
+type EnvironmentChangedEvent struct {
+	Event       string   `json:"event"`
+	Timestamp   int      `json:"timestamp"`
+	TimestampMs int64    `json:"timestamp_ms,omitempty"`
+	Directive   string   `json:"directive"`
+	Added       []string `json:"added,omitempty"`
+	Changed     []string `json:"changed,omitempty"`
+	Removed     []string `json:"removed,omitempty"`
+	Directory   string   `json:"directory,omitempty"`
 }
 
 type CommandFinishedEvent struct {
-	Event     string `json:"event"`
-	Timestamp int    `json:"timestamp"`
+	Event       string `json:"event"`
+	Timestamp   int    `json:"timestamp"`
+	TimestampMs int64  `json:"timestamp_ms,omitempty"`
+
+	Directive    string `json:"directive"`
+	ExitCode     int    `json:"exit_code"`
+	StartedAt    int    `json:"started_at"`
+	FinishedAt   int    `json:"finished_at"`
+	StartedAtMs  int64  `json:"started_at_ms,omitempty"`
+	FinishedAtMs int64  `json:"finished_at_ms,omitempty"`
+	DurationMs   int64  `json:"duration_ms"`
+
+	// Only set if the command was killed.
+	Signal     string `json:"signal,omitempty"`
+	CoreDumped bool   `json:"core_dumped,omitempty"`
+	OOMKilled  bool   `json:"oom_killed,omitempty"`
+}
 
-	Directive  string `json:"directive"`
+/*
+ * Emitted when a user attaches an interactive shell to the running job,
+ * and when that shell exits, so attach sessions can be audited.
+ * Nothing typed or printed in the attached shell is logged.
+ */
+type AttachStartedEvent struct {
+	Event       string `json:"event"`
+	Timestamp   int    `json:"timestamp"`
+	TimestampMs int64  `json:"timestamp_ms,omitempty"`
+
+	SessionID     string `json:"session_id"`
+	User          string `json:"user"`
+	RemoteAddress string `json:"remote_address,omitempty"`
+}
+
+type AttachFinishedEvent struct {
+	Event       string `json:"event"`
+	Timestamp   int    `json:"timestamp"`
+	TimestampMs int64  `json:"timestamp_ms,omitempty"`
+
+	SessionID  string `json:"session_id"`
+	User       string `json:"user"`
 	ExitCode   int    `json:"exit_code"`
-	StartedAt  int    `json:"started_at"`
-	FinishedAt int    `json:"finished_at"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+type OutputTruncatedEvent struct {
+	Event       string `json:"event"`
+	Timestamp   int    `json:"timestamp"`
+	TimestampMs int64  `json:"timestamp_ms,omitempty"`
+
+	OmittedEvents int `json:"omitted_events"`
+	OmittedBytes  int `json:"omitted_bytes"`
 }
@@ -2,11 +2,15 @@ package eventlogger
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"sync"
 
+	"github.com/semaphoreci/agent/pkg/compression"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -14,20 +18,197 @@ import (
 // This default value is used when the job request doesn't specify a limit.
 const DefaultMaxSizeInBytes = 16777216
 
+// The file backend keeps the byte offset of every Nth line written,
+// so reads can seek close to the requested line, instead of scanning the file from the beginning.
+// Indexing every line would take too much memory for logs with millions of lines,
+// so we index every 64th line, which means we skip at most 63 lines after seeking.
+const LineIndexInterval = 64
+
+// When the logs are kept compressed on disk, events are grouped into frames,
+// each one compressed independently once it reaches this size.
+// Reads only need to decompress from the frame that contains the starting line.
+// The frame being filled is kept uncompressed in memory until then.
+const CompressedFrameSize = 128 * 1024
+
 type FileBackend struct {
 	path           string
 	file           *os.File
 	maxSizeInBytes int
+	trimStrategy   string
+	headSize       int
+	bytesWritten   int
+	linesWritten   int
+	lineIndex      []int64
+	tail           *TailBuffer
+	liveTailSize   int
+	keepOnClose    bool
+	mu             sync.Mutex
+
+	// Only used when the logs are compressed on disk.
+	compression    *compression.Options
+	compressor     compression.Writer
+	frames         []compressedFrame
+	frame          bytes.Buffer
+	frameStartLine int
+	compressedSize int64
+}
+
+type compressedFrame struct {
+	line   int
+	offset int64
+}
+
+type FileBackendOptions struct {
+	Path           string
+	MaxSizeInBytes int
+
+	// Which part of the logs should be kept
+	// when they go above MaxSizeInBytes.
+	// By default, TrimStrategyHead is used.
+	TrimStrategy string
+
+	// Only used with TrimStrategyHeadAndTail.
+	// If not specified, half of MaxSizeInBytes is used.
+	TailSizeInBytes int
+
+	// By default, the file is removed when the backend is closed.
+	KeepOnClose bool
+
+	// If set, the logs are kept compressed on disk.
+	Compression *compression.Options
 }
 
 func NewFileBackend(path string, maxSizeInBytes int) (*FileBackend, error) {
-	return &FileBackend{path: path, maxSizeInBytes: maxSizeInBytes}, nil
+	return &FileBackend{path: path, maxSizeInBytes: maxSizeInBytes, trimStrategy: TrimStrategyHead}, nil
+}
+
+func NewFileBackendWithOptions(options FileBackendOptions) (*FileBackend, error) {
+	backend, err := newFileBackendForStrategy(options)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.Compression != nil {
+		if err := options.Compression.Validate(); err != nil {
+			return nil, err
+		}
+
+		backend.compression = options.Compression
+	}
+
+	return backend, nil
+}
+
+func newFileBackendForStrategy(options FileBackendOptions) (*FileBackend, error) {
+	switch options.TrimStrategy {
+	case "", TrimStrategyHead:
+		return &FileBackend{
+			path:           options.Path,
+			maxSizeInBytes: options.MaxSizeInBytes,
+			trimStrategy:   TrimStrategyHead,
+			keepOnClose:    options.KeepOnClose,
+		}, nil
+
+	case TrimStrategyHeadAndTail:
+		tail, err := newTailBufferFor(options.MaxSizeInBytes, options.TailSizeInBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		return &FileBackend{
+			path:           options.Path,
+			maxSizeInBytes: options.MaxSizeInBytes,
+			trimStrategy:   TrimStrategyHeadAndTail,
+			headSize:       options.MaxSizeInBytes - tail.maxSizeInBytes,
+			tail:           tail,
+			liveTailSize:   tail.maxSizeInBytes / 2,
+			keepOnClose:    options.KeepOnClose,
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown trim strategy '%s'", options.TrimStrategy)
+	}
+}
+
+/*
+ * Opens a file written by a file backend before the agent was restarted,
+ * so the events in it can be read again. No more events are expected to be written to it.
+ *
+ * Compressed files are decompressed into a new file first, since the position
+ * of the frames was only kept in memory, and the last frame might not have been
+ * completely written. Everything that can still be decompressed is kept.
+ */
+func RecoverFileBackend(path string, options *compression.Options) (*FileBackend, error) {
+	if options != nil {
+		recoveredPath, err := decompressForRecovery(path, *options)
+		if err != nil {
+			return nil, err
+		}
+
+		path = recoveredPath
+	}
+
+	// #nosec
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	return &FileBackend{
+		path:           path,
+		file:           file,
+		maxSizeInBytes: math.MaxInt32,
+		trimStrategy:   TrimStrategyHead,
+		bytesWritten:   int(fileInfo.Size()),
+	}, nil
+}
+
+func decompressForRecovery(path string, options compression.Options) (string, error) {
+	// #nosec
+	compressedFile, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+
+	defer compressedFile.Close()
+
+	recoveredPath := path + ".recovered"
+
+	// #nosec
+	recoveredFile, err := os.Create(recoveredPath)
+	if err != nil {
+		return "", err
+	}
+
+	defer recoveredFile.Close()
+
+	reader, err := compression.NewReader(compressedFile, options)
+	if err == nil {
+		defer reader.Close()
+		_, err = io.Copy(recoveredFile, reader)
+	}
+
+	if err != nil && err != io.EOF {
+		log.Warnf("Could not decompress all the logs in %s - the last events might be lost: %v", path, err)
+	}
+
+	if err := os.Remove(path); err != nil {
+		log.Errorf("Error removing %s: %v", path, err)
+	}
+
+	return recoveredPath, nil
 }
 
 func (l *FileBackend) Open() error {
 	file, err := os.Create(l.path)
 	if err != nil {
-		return nil
+		return err
 	}
 
 	l.file = file
@@ -42,21 +223,230 @@ func (l *FileBackend) Write(event interface{}) error {
 	}
 	jsonBytes = append(jsonBytes, '\n')
 
-	_, err = l.file.Write(jsonBytes)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.tail != nil {
+		// The job is finished, so we know no more output is coming.
+		// Everything kept in the tail goes into the file before the job_finished event.
+		if _, ok := event.(*JobFinishedEvent); ok {
+			if err := l.flushTail(); err != nil {
+				return err
+			}
+		} else if l.tail.Active() || l.bytesWritten+len(jsonBytes) > l.headSize {
+			l.tail.Append(jsonBytes)
+			return nil
+		}
+	}
+
+	return l.writeToFile(jsonBytes)
+}
+
+/*
+ * Every event is written as a single line,
+ * so each call here adds exactly one line to the file.
+ */
+func (l *FileBackend) writeToFile(jsonBytes []byte) error {
+	if l.compression != nil {
+		return l.writeToFrame(jsonBytes)
+	}
+
+	_, err := l.file.Write(jsonBytes)
 	if err != nil {
 		return err
 	}
 
+	if l.linesWritten%LineIndexInterval == 0 {
+		l.lineIndex = append(l.lineIndex, int64(l.bytesWritten))
+	}
+
+	l.bytesWritten += len(jsonBytes)
+	l.linesWritten++
 	log.Debugf("%s", jsonBytes)
 
 	return nil
 }
 
+func (l *FileBackend) writeToFrame(jsonBytes []byte) error {
+	l.frame.Write(jsonBytes)
+	l.bytesWritten += len(jsonBytes)
+	l.linesWritten++
+	log.Debugf("%s", jsonBytes)
+
+	if l.frame.Len() >= CompressedFrameSize {
+		return l.flushFrame()
+	}
+
+	return nil
+}
+
+/*
+ * Compresses the current frame and appends it to the file.
+ * Callers must hold l.mu.
+ */
+func (l *FileBackend) flushFrame() error {
+	if l.frame.Len() == 0 {
+		return nil
+	}
+
+	counter := &countingWriter{writer: l.file}
+	if l.compressor == nil {
+		compressor, err := compression.NewWriter(counter, *l.compression)
+		if err != nil {
+			return err
+		}
+
+		l.compressor = compressor
+	} else {
+		l.compressor.Reset(counter)
+	}
+
+	if _, err := l.compressor.Write(l.frame.Bytes()); err != nil {
+		return err
+	}
+
+	if err := l.compressor.Close(); err != nil {
+		return err
+	}
+
+	l.frames = append(l.frames, compressedFrame{line: l.frameStartLine, offset: l.compressedSize})
+	l.compressedSize += counter.written
+	l.frameStartLine = l.linesWritten
+	l.frame.Reset()
+	return nil
+}
+
+type countingWriter struct {
+	writer  io.Writer
+	written int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+/*
+ * Writes everything kept in the tail buffer into the file.
+ * If anything had to be dropped from the tail buffer,
+ * an output_truncated event is written before the tail events.
+ * Callers must hold l.mu.
+ */
+func (l *FileBackend) flushTail() error {
+	if l.tail == nil || !l.tail.Active() {
+		return nil
+	}
+
+	marker, err := l.tail.TruncationMarker()
+	if err != nil {
+		return err
+	}
+
+	if marker != nil {
+		if err := l.writeToFile(marker); err != nil {
+			return err
+		}
+	}
+
+	for _, event := range l.tail.Drain() {
+		if err := l.writeToFile(event); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (l *FileBackend) FlushFrame() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil || l.compression == nil {
+		return nil
+	}
+
+	return l.flushFrame()
+}
+
+func (l *FileBackend) FlushTail() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+
+	return l.flushTail()
+}
+
+/*
+ * Writes the events kept in the tail buffer into the file while the job is still running,
+ * so the end of the logs can be followed before the job finishes.
+ * Each call writes at most half of the tail, dropping the older events,
+ * so while the job runs, the logs only go above MaxSizeInBytes by that much per flush.
+ */
+func (l *FileBackend) FlushLiveTail() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil || l.tail == nil || !l.tail.Active() {
+		return nil
+	}
+
+	l.tail.Fit(l.liveTailSize)
+	return l.flushTail()
+}
+
+func (l *FileBackend) Trimmed() bool {
+	if l.trimStrategy == TrimStrategyHeadAndTail {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return l.tail.Trimmed()
+	}
+
+	// The size of the file on disk is not the size of the logs, if they are compressed.
+	if l.compression != nil {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return l.bytesWritten >= l.maxSizeInBytes
+	}
+
+	fileInfo, err := os.Stat(l.file.Name())
+	if err != nil {
+		log.Errorf("Couldn't stat file '%s': %v", l.file.Name(), err)
+		return false
+	}
+
+	trimmed := fileInfo.Size() >= int64(l.maxSizeInBytes)
+	log.Debugf(
+		"Log file has %d bytes - max bytes allowed are %d - trimmed=%v",
+		fileInfo.Size(),
+		int64(l.maxSizeInBytes),
+		trimmed,
+	)
+
+	return trimmed
+}
+
 func (l *FileBackend) Close() error {
 	return l.CloseWithOptions(CloseOptions{})
 }
 
 func (l *FileBackend) CloseWithOptions(options CloseOptions) error {
+	// Nothing to close if the file was never opened.
+	if l.file == nil {
+		return nil
+	}
+
+	if err := l.FlushTail(); err != nil {
+		log.Errorf("Error flushing tail of logs into %s: %v", l.file.Name(), err)
+	}
+
+	if err := l.FlushFrame(); err != nil {
+		log.Errorf("Error flushing compressed logs into %s: %v", l.file.Name(), err)
+	}
+
 	err := l.file.Close()
 	if err != nil {
 		log.Errorf("Error closing file %s: %v\n", l.file.Name(), err)
@@ -64,20 +454,11 @@ func (l *FileBackend) CloseWithOptions(options CloseOptions) error {
 	}
 
 	if options.OnClose != nil {
-		fileInfo, err := os.Stat(l.file.Name())
-		if err != nil {
-			log.Errorf("Couldn't stat file '%s': %v", l.file.Name(), err)
-		} else {
-			trimmed := fileInfo.Size() >= int64(l.maxSizeInBytes)
-			log.Debugf(
-				"Log file has %d bytes - max bytes allowed are %d - trimmed=%v",
-				fileInfo.Size(),
-				int64(l.maxSizeInBytes),
-				trimmed,
-			)
-
-			options.OnClose(trimmed)
-		}
+		options.OnClose(l.Trimmed())
+	}
+
+	if l.keepOnClose {
+		return nil
 	}
 
 	log.Debugf("Removing %s\n", l.file.Name())
@@ -90,14 +471,14 @@ func (l *FileBackend) CloseWithOptions(options CloseOptions) error {
 }
 
 func (l *FileBackend) Iterate(fn func([]byte) error) error {
-	fd, err := os.OpenFile(l.path, os.O_RDONLY, os.ModePerm)
+	reader, _, closeFn, err := l.openAt(0)
 	if err != nil {
 		return fmt.Errorf("error opening file '%s': %v", l.path, err)
 	}
 
-	defer fd.Close()
+	defer closeFn()
 
-	scanner := bufio.NewScanner(fd)
+	scanner := bufio.NewScanner(reader)
 	for scanner.Scan() {
 		if len(scanner.Bytes()) == 0 {
 			continue
@@ -111,21 +492,108 @@ func (l *FileBackend) Iterate(fn func([]byte) error) error {
 	return scanner.Err()
 }
 
-func (l *FileBackend) Read(startingLineNumber, maxLines int, writer io.Writer) (int, error) {
+/*
+ * Finds the closest indexed line at or before the line we want to start from,
+ * and the byte offset for it in the file.
+ */
+func (l *FileBackend) seekPosition(startingLineNumber int) (int, int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.lineIndex) == 0 || startingLineNumber <= 0 {
+		return 0, 0
+	}
+
+	i := startingLineNumber / LineIndexInterval
+	if i >= len(l.lineIndex) {
+		i = len(l.lineIndex) - 1
+	}
+
+	return i * LineIndexInterval, l.lineIndex[i]
+}
+
+/*
+ * Returns a reader for the logs, positioned at a line at or before the one we want to start from,
+ * and the number of that line. The returned function must be used to release the reader.
+ */
+func (l *FileBackend) openAt(startingLineNumber int) (io.Reader, int, func(), error) {
 	fd, err := os.OpenFile(l.path, os.O_RDONLY, os.ModePerm)
+	if err != nil {
+		return nil, startingLineNumber, nil, err
+	}
+
+	if l.compression != nil {
+		return l.openCompressedAt(fd, startingLineNumber)
+	}
+
+	lineNumber, offset := l.seekPosition(startingLineNumber)
+	if _, err := fd.Seek(offset, io.SeekStart); err != nil {
+		_ = fd.Close()
+		return nil, startingLineNumber, nil, err
+	}
+
+	return fd, lineNumber, func() { _ = fd.Close() }, nil
+}
+
+/*
+ * The frames in the file never change after they are written,
+ * so we only need the lock to take a snapshot of where they are,
+ * and of the frame that is still in memory.
+ */
+func (l *FileBackend) openCompressedAt(fd *os.File, startingLineNumber int) (io.Reader, int, func(), error) {
+	l.mu.Lock()
+	pending := bytes.NewReader(append([]byte{}, l.frame.Bytes()...))
+	pendingStartLine := l.frameStartLine
+	compressedSize := l.compressedSize
+
+	// The first frame always starts at line 0,
+	// so we can always find a frame at or before the starting line.
+	var frame *compressedFrame
+	for i := len(l.frames) - 1; i >= 0; i-- {
+		if l.frames[i].line <= startingLineNumber {
+			frame = &compressedFrame{line: l.frames[i].line, offset: l.frames[i].offset}
+			break
+		}
+	}
+
+	l.mu.Unlock()
+
+	// Everything we need is still in memory.
+	if frame == nil || startingLineNumber >= pendingStartLine {
+		_ = fd.Close()
+		return pending, pendingStartLine, func() {}, nil
+	}
+
+	section := io.NewSectionReader(fd, frame.offset, compressedSize-frame.offset)
+	decompressor, err := compression.NewReader(section, *l.compression)
+	if err != nil {
+		_ = fd.Close()
+		return nil, startingLineNumber, nil, fmt.Errorf("error decompressing '%s': %v", l.path, err)
+	}
+
+	closeFn := func() {
+		_ = decompressor.Close()
+		_ = fd.Close()
+	}
+
+	return io.MultiReader(decompressor, pending), frame.line, closeFn, nil
+}
+
+func (l *FileBackend) Read(startingLineNumber, maxLines int, writer io.Writer) (int, error) {
+	reader, lineNumber, closeFn, err := l.openAt(startingLineNumber)
 	if err != nil {
 		return startingLineNumber, err
 	}
 
-	reader := bufio.NewReader(fd)
-	lineNumber := 0
+	defer closeFn()
+
+	bufferedReader := bufio.NewReader(reader)
 	linesStreamed := 0
 
 	for {
-		line, err := reader.ReadString('\n')
+		line, err := bufferedReader.ReadString('\n')
 		if err != nil {
 			if err != io.EOF {
-				_ = fd.Close()
 				return lineNumber, err
 			}
 
@@ -149,5 +617,5 @@ func (l *FileBackend) Read(startingLineNumber, maxLines int, writer io.Writer) (
 		}
 	}
 
-	return lineNumber, fd.Close()
+	return lineNumber, nil
 }
@@ -3,14 +3,18 @@ package eventlogger
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/semaphoreci/agent/pkg/compression"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test__LogsArePushedToFile(t *testing.T) {
@@ -41,7 +45,7 @@ func Test__LogsArePushedToFile(t *testing.T) {
 		fmt.Sprintf(`{"event":"job_started","timestamp":%d}`, timestamp),
 		fmt.Sprintf(`{"event":"cmd_started","timestamp":%d,"directive":"echo hello"}`, timestamp),
 		fmt.Sprintf(`{"event":"cmd_output","timestamp":%d,"output":"hello\n"}`, timestamp),
-		fmt.Sprintf(`{"event":"cmd_finished","timestamp":%d,"directive":"echo hello","exit_code":0,"started_at":%d,"finished_at":%d}`, timestamp, timestamp, timestamp),
+		fmt.Sprintf(`{"event":"cmd_finished","timestamp":%d,"directive":"echo hello","exit_code":0,"started_at":%d,"finished_at":%d,"duration_ms":0}`, timestamp, timestamp, timestamp),
 		fmt.Sprintf(`{"event":"job_finished","timestamp":%d,"result":"passed"}`, timestamp),
 		"", // newline at the end of the file
 	}, logs)
@@ -79,7 +83,7 @@ func Test__ReadDoesNotIncludeDoubleNewlines(t *testing.T) {
 		fmt.Sprintf(`{"event":"job_started","timestamp":%d}`, timestamp),
 		fmt.Sprintf(`{"event":"cmd_started","timestamp":%d,"directive":"echo hello"}`, timestamp),
 		fmt.Sprintf(`{"event":"cmd_output","timestamp":%d,"output":"hello\n"}`, timestamp),
-		fmt.Sprintf(`{"event":"cmd_finished","timestamp":%d,"directive":"echo hello","exit_code":0,"started_at":%d,"finished_at":%d}`, timestamp, timestamp, timestamp),
+		fmt.Sprintf(`{"event":"cmd_finished","timestamp":%d,"directive":"echo hello","exit_code":0,"started_at":%d,"finished_at":%d,"duration_ms":0}`, timestamp, timestamp, timestamp),
 		fmt.Sprintf(`{"event":"job_finished","timestamp":%d,"result":"passed"}`, timestamp),
 		"", // newline at the end of the file
 	}, logs)
@@ -131,3 +135,345 @@ func Test__CloseWithOptions(t *testing.T) {
 		assert.False(t, logsWereTrimmed)
 	})
 }
+
+func Test__HeadAndTailTrimming(t *testing.T) {
+	t.Run("bad options", func(t *testing.T) {
+		_, err := NewFileBackendWithOptions(FileBackendOptions{
+			Path:            "whatever",
+			MaxSizeInBytes:  100,
+			TrimStrategy:    TrimStrategyHeadAndTail,
+			TailSizeInBytes: 100,
+		})
+
+		assert.ErrorContains(t, err, "must be between 1 and 99")
+
+		_, err = NewFileBackendWithOptions(FileBackendOptions{
+			Path:           "whatever",
+			MaxSizeInBytes: 100,
+			TrimStrategy:   "not-a-strategy",
+		})
+
+		assert.ErrorContains(t, err, "unknown trim strategy")
+	})
+
+	t.Run("logs below the limit are not trimmed", func(t *testing.T) {
+		tmpFileName := filepath.Join(os.TempDir(), fmt.Sprintf("logs_%d.json", time.Now().UnixNano()))
+		fileBackend, err := NewFileBackendWithOptions(FileBackendOptions{
+			Path:           tmpFileName,
+			MaxSizeInBytes: 1024 * 1024,
+			TrimStrategy:   TrimStrategyHeadAndTail,
+		})
+
+		assert.Nil(t, err)
+		assert.Nil(t, fileBackend.Open())
+		generateLogEvents(t, 5, fileBackend)
+
+		events, err := readSimplifiedEvents(fileBackend)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{
+			"job_started",
+			"directive: echo hello",
+			"hello\n",
+			"hello\n",
+			"hello\n",
+			"hello\n",
+			"hello\n",
+			"Exit Code: 0",
+			"job_finished: passed",
+		}, events)
+
+		logsWereTrimmed := true
+		err = fileBackend.CloseWithOptions(CloseOptions{OnClose: func(b bool) { logsWereTrimmed = b }})
+		assert.Nil(t, err)
+		assert.False(t, logsWereTrimmed)
+	})
+
+	t.Run("logs above the limit keep head and tail", func(t *testing.T) {
+		tmpFileName := filepath.Join(os.TempDir(), fmt.Sprintf("logs_%d.json", time.Now().UnixNano()))
+		fileBackend, err := NewFileBackendWithOptions(FileBackendOptions{
+			Path:            tmpFileName,
+			MaxSizeInBytes:  1000,
+			TrimStrategy:    TrimStrategyHeadAndTail,
+			TailSizeInBytes: 400,
+		})
+
+		assert.Nil(t, err)
+		assert.Nil(t, fileBackend.Open())
+
+		count := 0
+		generateLogEventsWithOutputGenerator(t, 100, fileBackend, func() string {
+			count++
+			return fmt.Sprintf("line %03d", count)
+		})
+
+		events, err := readSimplifiedEvents(fileBackend)
+		assert.Nil(t, err)
+
+		// the beginning of the logs is kept
+		assert.Equal(t, []string{"job_started", "directive: echo hello", "line 001\n"}, events[0:3])
+
+		// the end of the logs is kept, after the truncation marker
+		assert.Equal(t, []string{"line 099\n", "line 100\n", "Exit Code: 0", "job_finished: passed"}, events[len(events)-4:])
+		assert.Contains(t, events, "line 098\n")
+		assert.NotContains(t, events, "line 050\n")
+
+		markers := 0
+		for _, e := range events {
+			if strings.HasPrefix(e, "output_truncated") {
+				markers++
+			}
+		}
+
+		assert.Equal(t, 1, markers)
+
+		// the file never goes above the limit, apart from the marker and job_finished events
+		fileInfo, err := os.Stat(tmpFileName)
+		assert.Nil(t, err)
+		assert.Less(t, fileInfo.Size(), int64(1200))
+
+		logsWereTrimmed := false
+		err = fileBackend.CloseWithOptions(CloseOptions{OnClose: func(b bool) { logsWereTrimmed = b }})
+		assert.Nil(t, err)
+		assert.True(t, logsWereTrimmed)
+	})
+
+	t.Run("tail is flushed on every flush window while the job runs", func(t *testing.T) {
+		tmpFileName := filepath.Join(os.TempDir(), fmt.Sprintf("logs_%d.json", time.Now().UnixNano()))
+		fileBackend, err := NewFileBackendWithOptions(FileBackendOptions{
+			Path:            tmpFileName,
+			MaxSizeInBytes:  1000,
+			TrimStrategy:    TrimStrategyHeadAndTail,
+			TailSizeInBytes: 400,
+		})
+
+		assert.Nil(t, err)
+		assert.Nil(t, fileBackend.Open())
+
+		timestamp := int(time.Now().Unix())
+		assert.Nil(t, fileBackend.Write(&JobStartedEvent{Timestamp: timestamp, Event: "job_started"}))
+		assert.Nil(t, fileBackend.Write(&CommandStartedEvent{Timestamp: timestamp, Event: "cmd_started", Directive: "echo hello"}))
+
+		for i := 1; i <= 100; i++ {
+			assert.Nil(t, fileBackend.Write(&CommandOutputEvent{Timestamp: timestamp, Event: "cmd_output", Output: fmt.Sprintf("line %03d\n", i)}))
+
+			if i%20 == 0 {
+				assert.Nil(t, fileBackend.FlushLiveTail())
+			}
+		}
+
+		// output from every flush window was written before the job finished
+		events, err := readSimplifiedEvents(fileBackend)
+		assert.Nil(t, err)
+		assert.Contains(t, events, "line 020\n")
+		assert.Contains(t, events, "line 080\n")
+		assert.Contains(t, events, "line 100\n")
+
+		assert.Nil(t, fileBackend.Write(&JobFinishedEvent{Timestamp: timestamp, Event: "job_finished", Result: "passed"}))
+
+		events, err = readSimplifiedEvents(fileBackend)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"job_started", "directive: echo hello", "line 001\n"}, events[0:3])
+		assert.Equal(t, []string{"line 099\n", "line 100\n", "job_finished: passed"}, events[len(events)-3:])
+		assert.NotContains(t, events, "line 050\n")
+
+		// every output line is either in the logs, or counted as omitted
+		lines, omitted := countOutputLines(events)
+		assert.Equal(t, 100, lines+omitted)
+
+		// each flush goes above the limit by half of the tail at most, apart from the markers
+		fileInfo, err := os.Stat(tmpFileName)
+		assert.Nil(t, err)
+		assert.Less(t, fileInfo.Size(), int64(1000+5*200+5*100))
+		assert.Nil(t, fileBackend.Close())
+	})
+}
+
+/*
+ * Returns how many output lines are in the events,
+ * and how many were omitted according to the truncation markers.
+ */
+func countOutputLines(events []string) (int, int) {
+	lines := 0
+	omitted := 0
+	for _, e := range events {
+		var n int
+		if _, err := fmt.Sscanf(e, "output_truncated: %d events", &n); err == nil {
+			omitted += n
+		} else if strings.HasSuffix(e, "\n") {
+			lines++
+		}
+	}
+
+	return lines, omitted
+}
+
+func readSimplifiedEvents(backend Backend) ([]string, error) {
+	w := new(bytes.Buffer)
+	_, err := backend.Read(0, 100000, w)
+	if err != nil {
+		return nil, err
+	}
+
+	objects, err := TransformToObjects(strings.Split(strings.TrimSpace(w.String()), "\n"))
+	if err != nil {
+		return nil, err
+	}
+
+	return SimplifyLogEvents(objects, SimplifyOptions{IncludeOutput: true})
+}
+
+func Test__ReadUsesLineIndex(t *testing.T) {
+	tmpFileName := filepath.Join(os.TempDir(), fmt.Sprintf("logs_%d.json", time.Now().UnixNano()))
+	fileBackend, err := NewFileBackend(tmpFileName, DefaultMaxSizeInBytes)
+	assert.Nil(t, err)
+	assert.Nil(t, fileBackend.Open())
+
+	count := 0
+	generateLogEventsWithOutputGenerator(t, 1000, fileBackend, func() string {
+		count++
+		return fmt.Sprintf("line %d", count)
+	})
+
+	content, err := ioutil.ReadFile(tmpFileName)
+	assert.Nil(t, err)
+	allLines := strings.SplitAfter(string(content), "\n")
+	allLines = allLines[:len(allLines)-1]
+
+	for _, startFrom := range []int{0, 1, 63, 64, 65, 127, 128, 500, 1000, 1003, 1004, 2000} {
+		w := new(bytes.Buffer)
+		next, err := fileBackend.Read(startFrom, 10, w)
+		assert.Nil(t, err)
+
+		expected := []string{}
+		if startFrom < len(allLines) {
+			end := startFrom + 10
+			if end > len(allLines) {
+				end = len(allLines)
+			}
+
+			expected = allLines[startFrom:end]
+		}
+
+		assert.Equal(t, strings.Join(expected, ""), w.String(), "start_from=%d", startFrom)
+
+		if startFrom < len(allLines) {
+			assert.Equal(t, startFrom+len(expected), next, "start_from=%d", startFrom)
+		}
+	}
+
+	assert.Nil(t, fileBackend.Close())
+}
+
+func Test__CompressedFileBackend(t *testing.T) {
+	for _, algorithm := range compression.ValidAlgorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			plain, err := NewFileBackend(filepath.Join(t.TempDir(), "plain.json"), math.MaxInt32)
+			require.NoError(t, err)
+			require.NoError(t, plain.Open())
+
+			compressed, err := NewFileBackendWithOptions(FileBackendOptions{
+				Path:           filepath.Join(t.TempDir(), "compressed.json"),
+				MaxSizeInBytes: math.MaxInt32,
+				Compression:    &compression.Options{Algorithm: algorithm},
+				KeepOnClose:    true,
+			})
+
+			require.NoError(t, err)
+			require.NoError(t, compressed.Open())
+
+			// enough events for a few frames, with the last one still in memory
+			for i := 0; i < 5000; i++ {
+				event := &CommandOutputEvent{Event: "cmd_output", Timestamp: i, Output: fmt.Sprintf("line %d %s\n", i, strings.Repeat("x", 64))}
+				require.NoError(t, plain.Write(event))
+				require.NoError(t, compressed.Write(event))
+			}
+
+			require.Greater(t, len(compressed.frames), 1)
+			require.Greater(t, compressed.frame.Len(), 0)
+
+			// the file on disk is much smaller than the logs
+			fileInfo, err := os.Stat(compressed.path)
+			require.NoError(t, err)
+			assert.Less(t, fileInfo.Size(), int64(compressed.bytesWritten/4))
+
+			for _, startFrom := range []int{0, 1, 1500, 1800, 3000, 4990, 4999, 5000, 6000} {
+				expected := new(bytes.Buffer)
+				expectedNext, err := plain.Read(startFrom, 100, expected)
+				require.NoError(t, err)
+
+				w := new(bytes.Buffer)
+				next, err := compressed.Read(startFrom, 100, w)
+				require.NoError(t, err)
+				assert.Equal(t, expected.String(), w.String(), "start_from=%d", startFrom)
+				if startFrom < 5000 {
+					assert.Equal(t, expectedNext, next, "start_from=%d", startFrom)
+				}
+			}
+
+			// iterating returns all the events
+			count := 0
+			require.NoError(t, compressed.Iterate(func(event []byte) error {
+				assert.Contains(t, string(event), fmt.Sprintf("line %d ", count))
+				count++
+				return nil
+			}))
+
+			assert.Equal(t, 5000, count)
+
+			// after closing, everything is in the compressed file
+			require.NoError(t, compressed.Close())
+			require.NoError(t, plain.Close())
+
+			file, err := os.Open(compressed.path)
+			require.NoError(t, err)
+			defer file.Close()
+
+			reader, err := compression.NewReader(file, compression.Options{Algorithm: algorithm})
+			require.NoError(t, err)
+			content, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			assert.Equal(t, 5000, strings.Count(string(content), "\n"))
+		})
+	}
+}
+
+// These benchmarks create very big log files, so the bigger ones are skipped with -short.
+// Each iteration reads the last batch of lines in the file, which is what
+// the HTTP backend and the /jobs/{id}/log endpoint do as the job progresses.
+func Benchmark__FileBackendRead(b *testing.B) {
+	sizes := []struct {
+		name   string
+		events int
+		short  bool
+	}{
+		{name: "100MB", events: 1400000, short: true},
+		{name: "1GB", events: 14000000, short: false},
+		{name: "4GB", events: 56000000, short: false},
+	}
+
+	for _, size := range sizes {
+		b.Run(size.name, func(b *testing.B) {
+			if testing.Short() && !size.short {
+				b.Skip("skipping big log file with -short")
+			}
+
+			b.StopTimer()
+			tmpFileName := filepath.Join(os.TempDir(), fmt.Sprintf("logs_%d.json", time.Now().UnixNano()))
+			fileBackend, err := NewFileBackend(tmpFileName, DefaultMaxSizeInBytes)
+			require.Nil(b, err)
+			require.Nil(b, fileBackend.Open())
+			generateLogEvents(b, size.events, fileBackend)
+
+			startFrom := size.events - MaxLinesPerRequest
+			b.StartTimer()
+
+			for i := 0; i < b.N; i++ {
+				_, err := fileBackend.Read(startFrom, MaxLinesPerRequest, ioutil.Discard)
+				require.Nil(b, err)
+			}
+
+			b.StopTimer()
+			require.Nil(b, fileBackend.Close())
+		})
+	}
+}
@@ -1,8 +1,10 @@
 package eventlogger
 
 import (
+	"encoding/json"
 	"fmt"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -38,3 +40,76 @@ func (f *CustomFormatter) formatFields(fields log.Fields) string {
 
 	return strings.Join(result, " ")
 }
+
+const AgentLogFormatText = "text"
+const AgentLogFormatJSON = "json"
+
+var ValidAgentLogFormats = []string{
+	AgentLogFormatText,
+	AgentLogFormatJSON,
+}
+
+// The ID of the job currently running, included in the agent logs when using the JSON format.
+var currentJobID atomic.Value
+
+func SetCurrentJobID(jobID string) {
+	currentJobID.Store(jobID)
+}
+
+func CurrentJobID() string {
+	if jobID, ok := currentJobID.Load().(string); ok {
+		return jobID
+	}
+
+	return ""
+}
+
+func NewAgentLogFormatter(format, agentName string) (log.Formatter, error) {
+	switch format {
+	case "", AgentLogFormatText:
+		return &CustomFormatter{AgentName: agentName}, nil
+	case AgentLogFormatJSON:
+		return &JSONFormatter{AgentName: agentName}, nil
+	default:
+		return nil, fmt.Errorf("unknown agent log format '%s' - allowed formats are %v", format, ValidAgentLogFormats)
+	}
+}
+
+/*
+ * Writes every log entry as a single JSON object,
+ * so the agent logs can be ingested by log aggregation tools.
+ */
+type JSONFormatter struct {
+	AgentName string
+}
+
+func (f *JSONFormatter) Format(entry *log.Entry) ([]byte, error) {
+	data := make(map[string]interface{}, len(entry.Data)+5)
+	for key, value := range entry.Data {
+		// errors don't have exported fields, so they would be encoded as {}.
+		if err, ok := value.(error); ok {
+			data[key] = err.Error()
+		} else {
+			data[key] = value
+		}
+	}
+
+	data["time"] = entry.Time.UTC().Format(time.RFC3339Nano)
+	data["level"] = entry.Level.String()
+	data["msg"] = strings.TrimSuffix(entry.Message, "\n")
+
+	if f.AgentName != "" {
+		data["agent"] = f.AgentName
+	}
+
+	if jobID := CurrentJobID(); jobID != "" {
+		data["job_id"] = jobID
+	}
+
+	line, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding log entry: %v", err)
+	}
+
+	return append(line, '\n'), nil
+}
@@ -0,0 +1,58 @@
+package eventlogger
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test__JSONFormatter(t *testing.T) {
+	formatter, err := NewAgentLogFormatter(AgentLogFormatJSON, "agent-1")
+	require.NoError(t, err)
+
+	SetCurrentJobID("job-1")
+	defer SetCurrentJobID("")
+
+	entry := &log.Entry{
+		Time:    time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		Level:   log.InfoLevel,
+		Message: "hello\n",
+		Data:    log.Fields{"attempt": 2, "error": fmt.Errorf("oops")},
+	}
+
+	line, err := formatter.Format(entry)
+	require.NoError(t, err)
+	assert.Equal(t, byte('\n'), line[len(line)-1])
+
+	fields := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(line, &fields))
+	assert.Equal(t, map[string]interface{}{
+		"time":    "2026-01-02T03:04:05Z",
+		"level":   "info",
+		"msg":     "hello",
+		"agent":   "agent-1",
+		"job_id":  "job-1",
+		"attempt": float64(2),
+		"error":   "oops",
+	}, fields)
+
+	// no job running
+	SetCurrentJobID("")
+	line, err = formatter.Format(entry)
+	require.NoError(t, err)
+	assert.NotContains(t, string(line), "job_id")
+}
+
+func Test__NewAgentLogFormatter(t *testing.T) {
+	formatter, err := NewAgentLogFormatter("", "agent-1")
+	require.NoError(t, err)
+	assert.IsType(t, &CustomFormatter{}, formatter)
+
+	_, err = NewAgentLogFormatter("xml", "")
+	assert.ErrorContains(t, err, "unknown agent log format 'xml'")
+}
@@ -9,8 +9,10 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/semaphoreci/agent/pkg/compression"
 	"github.com/semaphoreci/agent/pkg/random"
 	"github.com/semaphoreci/agent/pkg/retry"
 	log "github.com/sirupsen/logrus"
@@ -20,16 +22,33 @@ const (
 	MaxLinesPerRequest           = 2000
 	MaxFlushTimeoutInSeconds     = 900
 	DefaultFlushTimeoutInSeconds = 60
+
+	// With TrimStrategyHeadAndTail, how often the tail of the logs is pushed while the job runs.
+	DefaultTailPushIntervalInSeconds = 10
+)
+
+const (
+	// Compress requests only if the API says it accepts compressed requests.
+	CompressionAuto = ""
+
+	// Always compress requests.
+	CompressionGzip = "gzip"
+
+	// Never compress requests.
+	CompressionNone = "none"
 )
 
 type HTTPBackend struct {
 	client      *http.Client
-	fileBackend FileBackend
+	fileBackend *FileBackend
 	startFrom   int
 	config      HTTPBackendConfig
 	stop        bool
 	flush       bool
 	useArtifact bool
+	compress    bool
+
+	lastTailPush time.Time
 }
 
 type HTTPBackendConfig struct {
@@ -39,43 +58,184 @@ type HTTPBackendConfig struct {
 	LinesPerRequest       int
 	FlushTimeoutInSeconds int
 	RefreshTokenFn        func() (string, error)
+	Compression           string
+
+	// By default, the API instructs the HTTP backend when to stop
+	// streaming logs due to their size hitting the limits.
+	// With TrimStrategyHeadAndTail, the agent trims the logs itself,
+	// keeping them below MaxSizeInBytes, so the end of the logs is always pushed.
+	TrimStrategy    string
+	MaxSizeInBytes  int
+	TailSizeInBytes int
+
+	// How often the tail of the logs is pushed while the job runs.
+	// If not specified, DefaultTailPushIntervalInSeconds is used.
+	TailPushIntervalInSeconds int
+
+	// If set, the state of the backend is saved into this file,
+	// so the logs can still be pushed if the agent is restarted in the middle of the job.
+	// See ResumeHTTPBackend().
+	StateFile string
+	JobID     string
+
+	// If set, the logs are kept compressed on disk while the job is running.
+	OnDiskCompression *compression.Options
 }
 
 func NewHTTPBackend(config HTTPBackendConfig) (*HTTPBackend, error) {
-	if config.LinesPerRequest <= 0 || config.LinesPerRequest > MaxLinesPerRequest {
-		return nil, fmt.Errorf("config.LinesPerRequest must be between 1 and %d", MaxLinesPerRequest)
+	if err := validateHTTPBackendConfig(config); err != nil {
+		return nil, err
 	}
 
-	if config.FlushTimeoutInSeconds <= 0 || config.FlushTimeoutInSeconds > MaxFlushTimeoutInSeconds {
-		return nil, fmt.Errorf("config.FlushTimeoutInSeconds must be between 1 and %d", MaxFlushTimeoutInSeconds)
+	// The logs need to survive a reboot to be resumed,
+	// so they are kept next to the state file, instead of in the temporary directory.
+	directory := os.TempDir()
+	if config.StateFile != "" {
+		directory = filepath.Dir(config.StateFile)
 	}
 
-	path := filepath.Join(os.TempDir(), fmt.Sprintf("job_log_%d.json", time.Now().UnixNano()))
+	path := filepath.Join(directory, fmt.Sprintf("job_log_%d.json", time.Now().UnixNano()))
+	fileBackend, err := newFileBackendForHTTP(path, config)
+	if err != nil {
+		return nil, err
+	}
 
-	// The API will instruct the HTTP backend when to stop
-	// streaming logs due to their size hitting the limits.
-	// We don't need to impose any limits on the underlying file backend.
-	fileBackend, err := NewFileBackend(path, math.MaxInt32)
+	return newHTTPBackend(config, fileBackend, 0), nil
+}
+
+/*
+ * Creates an HTTP backend to finish pushing the logs of a job
+ * whose HTTP backend was not closed, because the agent was restarted.
+ * The URL, token and position for the logs come from the state file,
+ * and the rest of the configuration comes from the config passed here.
+ * No more events should be written to the backend, it should only be closed,
+ * which pushes the remaining logs, and removes the state file and the logs.
+ */
+func ResumeHTTPBackend(stateFile string, config HTTPBackendConfig) (*HTTPBackend, error) {
+	state, err := LoadHTTPBackendState(stateFile)
 	if err != nil {
 		return nil, err
 	}
 
+	config.URL = state.URL
+	config.Token = state.Token
+	config.Compression = state.Compression
+	config.JobID = state.JobID
+	config.StateFile = stateFile
+
+	if err := validateHTTPBackendConfig(config); err != nil {
+		return nil, err
+	}
+
+	fileBackend, err := RecoverFileBackend(state.Path, state.OnDiskCompression)
+	if err != nil {
+		return nil, fmt.Errorf("error recovering logs for job %s: %v", state.JobID, err)
+	}
+
+	log.Infof("Resuming to push logs for job %s from line %d", state.JobID, state.StartFrom)
+	return newHTTPBackend(config, fileBackend, state.StartFrom), nil
+}
+
+func newHTTPBackend(config HTTPBackendConfig, fileBackend *FileBackend, startFrom int) *HTTPBackend {
 	httpBackend := HTTPBackend{
 		client: &http.Client{
 			Timeout: 30 * time.Second,
 		},
-		fileBackend: *fileBackend,
-		startFrom:   0,
+		fileBackend: fileBackend,
+		startFrom:   startFrom,
 		config:      config,
+		compress:    config.Compression == CompressionGzip,
 	}
 
 	go httpBackend.push()
 
-	return &httpBackend, nil
+	return &httpBackend
+}
+
+func validateHTTPBackendConfig(config HTTPBackendConfig) error {
+	if config.LinesPerRequest <= 0 || config.LinesPerRequest > MaxLinesPerRequest {
+		return fmt.Errorf("config.LinesPerRequest must be between 1 and %d", MaxLinesPerRequest)
+	}
+
+	if config.FlushTimeoutInSeconds <= 0 || config.FlushTimeoutInSeconds > MaxFlushTimeoutInSeconds {
+		return fmt.Errorf("config.FlushTimeoutInSeconds must be between 1 and %d", MaxFlushTimeoutInSeconds)
+	}
+
+	switch config.Compression {
+	case CompressionAuto, CompressionGzip, CompressionNone:
+	default:
+		return fmt.Errorf("config.Compression must be one of '%s', '%s' or empty", CompressionGzip, CompressionNone)
+	}
+
+	return nil
+}
+
+func newFileBackendForHTTP(path string, config HTTPBackendConfig) (*FileBackend, error) {
+	if config.TrimStrategy == TrimStrategyHeadAndTail {
+		return NewFileBackendWithOptions(FileBackendOptions{
+			Path:            path,
+			MaxSizeInBytes:  config.MaxSizeInBytes,
+			TrimStrategy:    config.TrimStrategy,
+			TailSizeInBytes: config.TailSizeInBytes,
+			Compression:     config.OnDiskCompression,
+		})
+	}
+
+	// The API will instruct the HTTP backend when to stop
+	// streaming logs due to their size hitting the limits.
+	// We don't need to impose any limits on the underlying file backend.
+	return NewFileBackendWithOptions(FileBackendOptions{
+		Path:           path,
+		MaxSizeInBytes: math.MaxInt32,
+		Compression:    config.OnDiskCompression,
+	})
+}
+
+func (l *HTTPBackend) JobID() string {
+	return l.config.JobID
 }
 
 func (l *HTTPBackend) Open() error {
-	return l.fileBackend.Open()
+	if err := l.fileBackend.Open(); err != nil {
+		return err
+	}
+
+	l.saveState()
+	return nil
+}
+
+/*
+ * Errors saving the state are only logged,
+ * since they only matter if the agent is restarted.
+ */
+func (l *HTTPBackend) saveState() {
+	if l.config.StateFile == "" {
+		return
+	}
+
+	state := HTTPBackendState{
+		JobID:             l.config.JobID,
+		Path:              l.fileBackend.path,
+		StartFrom:         l.startFrom,
+		URL:               l.config.URL,
+		Token:             l.config.Token,
+		Compression:       l.config.Compression,
+		OnDiskCompression: l.fileBackend.compression,
+	}
+
+	if err := state.Save(l.config.StateFile); err != nil {
+		log.Errorf("Error saving state for logs into %s: %v", l.config.StateFile, err)
+	}
+}
+
+func (l *HTTPBackend) removeState() {
+	if l.config.StateFile == "" {
+		return
+	}
+
+	if err := os.Remove(l.config.StateFile); err != nil && !os.IsNotExist(err) {
+		log.Errorf("Error removing %s: %v", l.config.StateFile, err)
+	}
 }
 
 func (l *HTTPBackend) Write(event interface{}) error {
@@ -114,6 +274,8 @@ func (l *HTTPBackend) push() {
 		log.Infof("Waiting %v to push next batch of logs...", delay)
 		time.Sleep(delay)
 
+		l.pushTail()
+
 		/*
 		 * Send the next batch of logs.
 		 * If an error occurs, it will be retried in the next tick,
@@ -128,6 +290,31 @@ func (l *HTTPBackend) push() {
 	log.Info("Stopped pushing logs.")
 }
 
+/*
+ * With TrimStrategyHeadAndTail, the output after the head of the logs
+ * is kept in memory, so it needs to be written into the file
+ * from time to time, for it to be pushed while the job is running.
+ */
+func (l *HTTPBackend) pushTail() {
+	if l.config.TrimStrategy != TrimStrategyHeadAndTail || l.flush {
+		return
+	}
+
+	interval := time.Duration(l.config.TailPushIntervalInSeconds) * time.Second
+	if interval <= 0 {
+		interval = DefaultTailPushIntervalInSeconds * time.Second
+	}
+
+	if time.Since(l.lastTailPush) < interval {
+		return
+	}
+
+	l.lastTailPush = time.Now()
+	if err := l.fileBackend.FlushLiveTail(); err != nil {
+		log.Errorf("Error flushing tail of logs: %v", err)
+	}
+}
+
 /*
  * The delay between log requests.
  * Note that this isn't a rate,
@@ -177,7 +364,8 @@ func (l *HTTPBackend) newRequest() error {
 
 	log.Infof("Pushing next batch of logs with %d log events...", (nextStartFrom - l.startFrom))
 	url := fmt.Sprintf("%s?start_from=%d", l.config.URL, l.startFrom)
-	request, err := http.NewRequest("POST", url, buffer)
+	body, compressed := l.requestBody(buffer.Bytes())
+	request, err := http.NewRequest("POST", url, bytes.NewReader(body))
 	if err != nil {
 		return err
 	}
@@ -185,19 +373,37 @@ func (l *HTTPBackend) newRequest() error {
 	request.Header.Set("Content-Type", "text/plain")
 	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", l.config.Token))
 	request.Header.Set("User-Agent", l.config.UserAgent)
+	if compressed {
+		request.Header.Set("Content-Encoding", "gzip")
+	}
+
 	response, err := l.client.Do(request)
 	if err != nil {
 		return err
 	}
 
+	defer response.Body.Close()
+
 	switch response.StatusCode {
 
 	// Everything went fine,
 	// just update the index and move on.
 	case http.StatusOK:
 		l.startFrom = nextStartFrom
+		l.handleCompressionHint(response)
+		l.saveState()
 		return nil
 
+	// The API does not accept compressed requests.
+	// We stop compressing them, and let the caller do the retrying.
+	case http.StatusUnsupportedMediaType:
+		if compressed {
+			log.Warn("Compressed log requests are not accepted - sending them uncompressed")
+			l.compress = false
+		}
+
+		return fmt.Errorf("request to %s failed: %s", url, response.Status)
+
 	// No more space is available for this job's logs.
 	// The API will keep rejecting the requests if we keep sending them, so just stop.
 	case http.StatusUnprocessableEntity:
@@ -223,6 +429,41 @@ func (l *HTTPBackend) newRequest() error {
 	}
 }
 
+/*
+ * If compressing the request fails for some reason,
+ * we still send the logs, uncompressed.
+ */
+func (l *HTTPBackend) requestBody(raw []byte) ([]byte, bool) {
+	if !l.compress {
+		return raw, false
+	}
+
+	compressed, err := compression.CompressBytes(raw)
+	if err != nil {
+		log.Errorf("Error compressing logs - sending them uncompressed: %v", err)
+		return raw, false
+	}
+
+	log.Debugf("Compressed logs from %d to %d bytes", len(raw), len(compressed))
+	return compressed, true
+}
+
+/*
+ * The API can tell us it accepts compressed requests
+ * by including an Accept-Encoding header in its responses (RFC 7694).
+ * We only follow that hint if no compression was explicitly configured.
+ */
+func (l *HTTPBackend) handleCompressionHint(response *http.Response) {
+	if l.compress || l.config.Compression != CompressionAuto {
+		return
+	}
+
+	if strings.Contains(response.Header.Get("Accept-Encoding"), "gzip") {
+		log.Info("Log requests will be compressed")
+		l.compress = true
+	}
+}
+
 func (l *HTTPBackend) CloseWithOptions(options CloseOptions) error {
 	/*
 	 * Try to flush all the remaining logs.
@@ -231,6 +472,12 @@ func (l *HTTPBackend) CloseWithOptions(options CloseOptions) error {
 	 */
 	l.flush = true
 
+	// If we are keeping the tail of the logs in memory,
+	// it needs to be in the file before we can push it.
+	if err := l.fileBackend.FlushTail(); err != nil {
+		log.Errorf("Error flushing tail of logs: %v", err)
+	}
+
 	log.Printf("Waiting for all logs to be flushed...")
 	err := retry.RetryWithConstantWait(retry.RetryOptions{
 		Task:                 "wait for logs to be flushed",
@@ -247,7 +494,7 @@ func (l *HTTPBackend) CloseWithOptions(options CloseOptions) error {
 	})
 
 	if options.OnClose != nil {
-		options.OnClose(l.useArtifact)
+		options.OnClose(l.useArtifact || l.fileBackend.Trimmed())
 	}
 
 	if err != nil {
@@ -255,6 +502,7 @@ func (l *HTTPBackend) CloseWithOptions(options CloseOptions) error {
 	}
 
 	l.stop = true
+	l.removeState()
 	return l.fileBackend.Close()
 }
 
@@ -0,0 +1,79 @@
+package eventlogger
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/semaphoreci/agent/pkg/compression"
+)
+
+/*
+ * What the HTTP backend needs to keep pushing the logs for a job
+ * if the agent is restarted in the middle of it.
+ * It is saved every time a batch of logs is pushed,
+ * and removed when the backend is closed.
+ */
+type HTTPBackendState struct {
+	JobID             string               `json:"job_id"`
+	Path              string               `json:"path"`
+	StartFrom         int                  `json:"start_from"`
+	URL               string               `json:"url"`
+	Token             string               `json:"token"`
+	Compression       string               `json:"compression"`
+	OnDiskCompression *compression.Options `json:"on_disk_compression,omitempty"`
+}
+
+const httpBackendStatePrefix = "job_log_push_"
+
+func HTTPBackendStateFile(directory, jobID string) string {
+	return filepath.Join(directory, fmt.Sprintf("%s%s.json", httpBackendStatePrefix, jobID))
+}
+
+/*
+ * Returns the state files left behind by HTTP backends
+ * that were not closed, because the agent was restarted.
+ */
+func FindHTTPBackendStateFiles(directory string) ([]string, error) {
+	return filepath.Glob(filepath.Join(directory, httpBackendStatePrefix+"*.json"))
+}
+
+func LoadHTTPBackendState(path string) (*HTTPBackendState, error) {
+	// #nosec
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	state := HTTPBackendState{}
+	if err := json.Unmarshal(content, &state); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", path, err)
+	}
+
+	if state.Path == "" || state.URL == "" {
+		return nil, fmt.Errorf("%s is missing the path or URL for the logs", path)
+	}
+
+	return &state, nil
+}
+
+/*
+ * The state includes the token used to push the logs,
+ * so only the agent's user should be able to read it.
+ * We write it into a temporary file first, and then rename it,
+ * so a restart in the middle of a write never leaves a broken state behind.
+ */
+func (s *HTTPBackendState) Save(path string) error {
+	content, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, content, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,144 @@
+package eventlogger
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/semaphoreci/agent/pkg/compression"
+	testsupport "github.com/semaphoreci/agent/test/support"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test__HTTPBackendSavesAndRemovesState(t *testing.T) {
+	mockServer := testsupport.NewLoghubMockServer()
+	mockServer.Init()
+	defer mockServer.Close()
+
+	stateFile := HTTPBackendStateFile(t.TempDir(), "job-1")
+	httpBackend, err := NewHTTPBackend(HTTPBackendConfig{
+		URL:                   mockServer.URL(),
+		Token:                 "token",
+		RefreshTokenFn:        func() (string, error) { return "", nil },
+		LinesPerRequest:       20,
+		FlushTimeoutInSeconds: DefaultFlushTimeoutInSeconds,
+		UserAgent:             fmt.Sprintf("SemaphoreAgent/%s", testsupport.AgentVersionExpected),
+		StateFile:             stateFile,
+		JobID:                 "job-1",
+	})
+
+	require.NoError(t, err)
+	require.NoError(t, httpBackend.Open())
+
+	state, err := LoadHTTPBackendState(stateFile)
+	require.NoError(t, err)
+	assert.Equal(t, "job-1", state.JobID)
+	assert.Equal(t, httpBackend.fileBackend.path, state.Path)
+	assert.Equal(t, filepath.Dir(stateFile), filepath.Dir(state.Path))
+	assert.Equal(t, mockServer.URL(), state.URL)
+	assert.Equal(t, "token", state.Token)
+	assert.Equal(t, 0, state.StartFrom)
+
+	// state file is only readable by the agent, since it has the token
+	fileInfo, err := os.Stat(stateFile)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fileInfo.Mode().Perm())
+
+	generateLogEvents(t, 1, httpBackend)
+	require.NoError(t, httpBackend.Close())
+	assert.NoFileExists(t, stateFile)
+	assert.Len(t, mockServer.GetLogs(), 5)
+}
+
+func Test__ResumeHTTPBackend(t *testing.T) {
+	for name, onDiskCompression := range map[string]*compression.Options{
+		"uncompressed": nil,
+		"compressed":   {Algorithm: compression.AlgorithmZstd},
+	} {
+		t.Run(name, func(t *testing.T) {
+			mockServer := testsupport.NewLoghubMockServer()
+			mockServer.Init()
+			defer mockServer.Close()
+
+			// The agent was restarted after pushing the first 3 events,
+			// leaving the logs and the state behind.
+			directory := t.TempDir()
+			logsPath := filepath.Join(directory, "job_log.json")
+			fileBackend, err := NewFileBackendWithOptions(FileBackendOptions{
+				Path:           logsPath,
+				MaxSizeInBytes: DefaultMaxSizeInBytes,
+				Compression:    onDiskCompression,
+				KeepOnClose:    true,
+			})
+
+			require.NoError(t, err)
+			require.NoError(t, fileBackend.Open())
+			generateLogEvents(t, 3, fileBackend)
+			require.NoError(t, fileBackend.Close())
+
+			stateFile := HTTPBackendStateFile(directory, "job-1")
+			state := HTTPBackendState{
+				JobID:             "job-1",
+				Path:              logsPath,
+				StartFrom:         3,
+				URL:               mockServer.URL(),
+				Token:             "token",
+				OnDiskCompression: onDiskCompression,
+			}
+
+			require.NoError(t, state.Save(stateFile))
+
+			stateFiles, err := FindHTTPBackendStateFiles(directory)
+			require.NoError(t, err)
+			assert.Equal(t, []string{stateFile}, stateFiles)
+
+			httpBackend, err := ResumeHTTPBackend(stateFile, HTTPBackendConfig{
+				RefreshTokenFn:        func() (string, error) { return "", nil },
+				LinesPerRequest:       20,
+				FlushTimeoutInSeconds: DefaultFlushTimeoutInSeconds,
+				UserAgent:             fmt.Sprintf("SemaphoreAgent/%s", testsupport.AgentVersionExpected),
+			})
+
+			require.NoError(t, err)
+			assert.Equal(t, "job-1", httpBackend.JobID())
+			require.NoError(t, httpBackend.Close())
+
+			// only the events not pushed yet are pushed
+			eventObjects, err := TransformToObjects(mockServer.GetLogs())
+			require.NoError(t, err)
+			simplifiedEvents, err := SimplifyLogEvents(eventObjects, SimplifyOptions{IncludeOutput: true})
+			require.NoError(t, err)
+			assert.Equal(t, []string{"hello\n", "hello\n", "Exit Code: 0", "job_finished: passed"}, simplifiedEvents)
+
+			// everything is cleaned up
+			assert.NoFileExists(t, stateFile)
+			files, _ := os.ReadDir(directory)
+			assert.Empty(t, files)
+		})
+	}
+}
+
+func Test__ResumeHTTPBackendWithInvalidState(t *testing.T) {
+	directory := t.TempDir()
+	config := HTTPBackendConfig{
+		RefreshTokenFn:        func() (string, error) { return "", nil },
+		LinesPerRequest:       20,
+		FlushTimeoutInSeconds: DefaultFlushTimeoutInSeconds,
+	}
+
+	_, err := ResumeHTTPBackend(filepath.Join(directory, "nope.json"), config)
+	assert.Error(t, err)
+
+	stateFile := HTTPBackendStateFile(directory, "job-1")
+	require.NoError(t, os.WriteFile(stateFile, []byte(`{"job_id": "job-1"}`), 0600))
+	_, err = ResumeHTTPBackend(stateFile, config)
+	assert.ErrorContains(t, err, "is missing the path or URL for the logs")
+
+	// logs are gone
+	state := HTTPBackendState{JobID: "job-1", Path: filepath.Join(directory, "nope.json"), URL: "http://localhost"}
+	require.NoError(t, state.Save(stateFile))
+	_, err = ResumeHTTPBackend(stateFile, config)
+	assert.ErrorContains(t, err, "error recovering logs for job job-1")
+}
@@ -1,7 +1,10 @@
 package eventlogger
 
 import (
+	"bytes"
 	"fmt"
+	"math"
+	"strings"
 	"testing"
 	"time"
 
@@ -70,6 +73,20 @@ func Test__ArgumentsMustBeValid(t *testing.T) {
 		assert.ErrorContains(t, err, "must be between 1 and 900")
 	})
 
+	t.Run("Compression must be a known value", func(t *testing.T) {
+		backend, err := NewHTTPBackend(HTTPBackendConfig{
+			URL:                   "whatever",
+			Token:                 "token",
+			RefreshTokenFn:        func() (string, error) { return "", nil },
+			LinesPerRequest:       MaxLinesPerRequest,
+			FlushTimeoutInSeconds: DefaultFlushTimeoutInSeconds,
+			Compression:           "zip",
+		})
+
+		assert.Nil(t, backend)
+		assert.ErrorContains(t, err, "config.Compression must be one of")
+	})
+
 	t.Run("FlushTimeoutInSeconds cannot be above the maximum allowed", func(t *testing.T) {
 		backend, err := NewHTTPBackend(HTTPBackendConfig{
 			URL:                   "whatever",
@@ -284,6 +301,226 @@ func Test__TokenIsRefreshed(t *testing.T) {
 	mockServer.Close()
 }
 
+func Test__HeadAndTailTrimmingPushesTheEndOfTheLogs(t *testing.T) {
+	mockServer := testsupport.NewLoghubMockServer()
+	mockServer.Init()
+
+	httpBackend, err := NewHTTPBackend(HTTPBackendConfig{
+		URL:                   mockServer.URL(),
+		Token:                 "token",
+		RefreshTokenFn:        func() (string, error) { return "", nil },
+		LinesPerRequest:       20,
+		FlushTimeoutInSeconds: DefaultFlushTimeoutInSeconds,
+		UserAgent:             fmt.Sprintf("SemaphoreAgent/%s", testsupport.AgentVersionExpected),
+		TrimStrategy:          TrimStrategyHeadAndTail,
+		MaxSizeInBytes:        1000,
+		TailSizeInBytes:       400,
+	})
+
+	assert.Nil(t, err)
+	assert.Nil(t, httpBackend.Open())
+
+	generateLogEvents(t, 100, httpBackend)
+
+	logsWereTrimmed := false
+	err = httpBackend.CloseWithOptions(CloseOptions{OnClose: func(trimmed bool) {
+		logsWereTrimmed = trimmed
+	}})
+
+	assert.Nil(t, err)
+	assert.True(t, logsWereTrimmed)
+
+	eventObjects, err := TransformToObjects(mockServer.GetLogs())
+	assert.Nil(t, err)
+
+	simplifiedEvents, err := SimplifyLogEvents(eventObjects, SimplifyOptions{IncludeOutput: true})
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{"job_started", "directive: echo hello", "hello\n"}, simplifiedEvents[0:3])
+	assert.Equal(t, []string{"hello\n", "Exit Code: 0", "job_finished: passed"}, simplifiedEvents[len(simplifiedEvents)-3:])
+
+	// every output line was either pushed, or counted as omitted
+	lines, omitted := countOutputLines(simplifiedEvents)
+	assert.Greater(t, omitted, 0)
+	assert.Equal(t, 100, lines+omitted)
+
+	mockServer.Close()
+}
+
+func Test__HeadAndTailTrimmingPushesTheTailWhileTheJobRuns(t *testing.T) {
+	mockServer := testsupport.NewLoghubMockServer()
+	mockServer.Init()
+
+	httpBackend, err := NewHTTPBackend(HTTPBackendConfig{
+		URL:                       mockServer.URL(),
+		Token:                     "token",
+		RefreshTokenFn:            func() (string, error) { return "", nil },
+		LinesPerRequest:           20,
+		FlushTimeoutInSeconds:     DefaultFlushTimeoutInSeconds,
+		UserAgent:                 fmt.Sprintf("SemaphoreAgent/%s", testsupport.AgentVersionExpected),
+		TrimStrategy:              TrimStrategyHeadAndTail,
+		MaxSizeInBytes:            1000,
+		TailSizeInBytes:           400,
+		TailPushIntervalInSeconds: 1,
+	})
+
+	assert.Nil(t, err)
+	assert.Nil(t, httpBackend.Open())
+
+	timestamp := int(time.Now().Unix())
+	assert.Nil(t, httpBackend.Write(&JobStartedEvent{Timestamp: timestamp, Event: "job_started"}))
+	assert.Nil(t, httpBackend.Write(&CommandStartedEvent{Timestamp: timestamp, Event: "cmd_started", Directive: "echo hello"}))
+	for i := 1; i <= 50; i++ {
+		assert.Nil(t, httpBackend.Write(&CommandOutputEvent{Timestamp: timestamp, Event: "cmd_output", Output: fmt.Sprintf("line %03d\n", i)}))
+	}
+
+	// the last line written is pushed before the job finishes
+	assert.Eventually(t, func() bool {
+		for _, event := range mockServer.GetLogs() {
+			if strings.Contains(event, "line 050") {
+				return true
+			}
+		}
+
+		return false
+	}, 10*time.Second, 100*time.Millisecond)
+
+	assert.Nil(t, httpBackend.Write(&JobFinishedEvent{Timestamp: timestamp, Event: "job_finished", Result: "passed"}))
+	assert.Nil(t, httpBackend.Close())
+
+	eventObjects, err := TransformToObjects(mockServer.GetLogs())
+	assert.Nil(t, err)
+
+	simplifiedEvents, err := SimplifyLogEvents(eventObjects, SimplifyOptions{IncludeOutput: true})
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{"job_started", "directive: echo hello", "line 001\n"}, simplifiedEvents[0:3])
+	assert.Equal(t, []string{"line 050\n", "job_finished: passed"}, simplifiedEvents[len(simplifiedEvents)-2:])
+
+	lines, omitted := countOutputLines(simplifiedEvents)
+	assert.Equal(t, 50, lines+omitted)
+
+	mockServer.Close()
+}
+
+func Test__CompressedRequests(t *testing.T) {
+	t.Run("gzip compression is used if configured", func(t *testing.T) {
+		mockServer := testsupport.NewLoghubMockServer()
+		mockServer.Init()
+
+		httpBackend, err := NewHTTPBackend(HTTPBackendConfig{
+			URL:                   mockServer.URL(),
+			Token:                 "token",
+			RefreshTokenFn:        func() (string, error) { return "", nil },
+			LinesPerRequest:       20,
+			FlushTimeoutInSeconds: DefaultFlushTimeoutInSeconds,
+			UserAgent:             fmt.Sprintf("SemaphoreAgent/%s", testsupport.AgentVersionExpected),
+			Compression:           CompressionGzip,
+		})
+
+		assert.Nil(t, err)
+		assert.Nil(t, httpBackend.Open())
+
+		generateLogEvents(t, 100, httpBackend)
+		expected := readAllLines(t, httpBackend)
+		assert.Nil(t, httpBackend.Close())
+
+		assert.Equal(t, expected, mockServer.GetLogs())
+		assert.Greater(t, mockServer.GetCompressedRequests(), 0)
+		assert.Equal(t, 0, mockServer.GetUncompressedRequests())
+		mockServer.Close()
+	})
+
+	t.Run("gzip compression is used if the API says it accepts it", func(t *testing.T) {
+		mockServer := testsupport.NewLoghubMockServer()
+		mockServer.Init()
+		mockServer.SetAcceptEncoding("gzip")
+
+		httpBackend, err := NewHTTPBackend(HTTPBackendConfig{
+			URL:                   mockServer.URL(),
+			Token:                 "token",
+			RefreshTokenFn:        func() (string, error) { return "", nil },
+			LinesPerRequest:       20,
+			FlushTimeoutInSeconds: DefaultFlushTimeoutInSeconds,
+			UserAgent:             fmt.Sprintf("SemaphoreAgent/%s", testsupport.AgentVersionExpected),
+		})
+
+		assert.Nil(t, err)
+		assert.Nil(t, httpBackend.Open())
+
+		generateLogEvents(t, 100, httpBackend)
+		expected := readAllLines(t, httpBackend)
+		assert.Nil(t, httpBackend.Close())
+
+		// first request is not compressed, but the following ones are.
+		assert.Equal(t, expected, mockServer.GetLogs())
+		assert.Equal(t, 1, mockServer.GetUncompressedRequests())
+		assert.Greater(t, mockServer.GetCompressedRequests(), 0)
+		mockServer.Close()
+	})
+
+	t.Run("gzip compression is not used if disabled", func(t *testing.T) {
+		mockServer := testsupport.NewLoghubMockServer()
+		mockServer.Init()
+		mockServer.SetAcceptEncoding("gzip")
+
+		httpBackend, err := NewHTTPBackend(HTTPBackendConfig{
+			URL:                   mockServer.URL(),
+			Token:                 "token",
+			RefreshTokenFn:        func() (string, error) { return "", nil },
+			LinesPerRequest:       20,
+			FlushTimeoutInSeconds: DefaultFlushTimeoutInSeconds,
+			UserAgent:             fmt.Sprintf("SemaphoreAgent/%s", testsupport.AgentVersionExpected),
+			Compression:           CompressionNone,
+		})
+
+		assert.Nil(t, err)
+		assert.Nil(t, httpBackend.Open())
+
+		generateLogEvents(t, 100, httpBackend)
+		expected := readAllLines(t, httpBackend)
+		assert.Nil(t, httpBackend.Close())
+
+		assert.Equal(t, expected, mockServer.GetLogs())
+		assert.Equal(t, 0, mockServer.GetCompressedRequests())
+		mockServer.Close()
+	})
+
+	t.Run("falls back to uncompressed requests if API rejects them", func(t *testing.T) {
+		mockServer := testsupport.NewLoghubMockServer()
+		mockServer.Init()
+		mockServer.SetRejectCompression(true)
+
+		httpBackend, err := NewHTTPBackend(HTTPBackendConfig{
+			URL:                   mockServer.URL(),
+			Token:                 "token",
+			RefreshTokenFn:        func() (string, error) { return "", nil },
+			LinesPerRequest:       20,
+			FlushTimeoutInSeconds: DefaultFlushTimeoutInSeconds,
+			UserAgent:             fmt.Sprintf("SemaphoreAgent/%s", testsupport.AgentVersionExpected),
+			Compression:           CompressionGzip,
+		})
+
+		assert.Nil(t, err)
+		assert.Nil(t, httpBackend.Open())
+
+		generateLogEvents(t, 100, httpBackend)
+		expected := readAllLines(t, httpBackend)
+		assert.Nil(t, httpBackend.Close())
+
+		assert.Equal(t, expected, mockServer.GetLogs())
+		assert.Equal(t, 0, mockServer.GetCompressedRequests())
+		mockServer.Close()
+	})
+}
+
+func readAllLines(t *testing.T, backend Backend) []string {
+	w := new(bytes.Buffer)
+	_, err := backend.Read(0, math.MaxInt32, w)
+	assert.Nil(t, err)
+	return testsupport.FilterEmpty(strings.Split(w.String(), "\n"))
+}
+
 func generateLogEventsWithOutputGenerator(t testing.TB, outputEventsCount int, backend Backend, outputGenerator func() string) {
 	timestamp := int(time.Now().Unix())
 
@@ -1,41 +1,208 @@
 package eventlogger
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"io"
 	"strings"
+	"sync"
 )
 
+/*
+ * Keeps the job logs in memory, serialized in the same way the FileBackend does,
+ * so the whole logging pipeline can be tested without touching the disk.
+ *
+ * Events holds every event written, as it was written,
+ * even the ones dropped from the logs because of trimming.
+ */
 type InMemoryBackend struct {
 	Events []interface{}
+
+	lines          [][]byte
+	maxSizeInBytes int
+	trimStrategy   string
+	headSize       int
+	bytesWritten   int
+	tail           *TailBuffer
+	mu             sync.Mutex
+}
+
+type InMemoryBackendOptions struct {
+	// If not specified, DefaultMaxSizeInBytes is used.
+	MaxSizeInBytes int
+
+	// By default, TrimStrategyHead is used.
+	TrimStrategy string
+
+	// Only used with TrimStrategyHeadAndTail.
+	// If not specified, half of MaxSizeInBytes is used.
+	TailSizeInBytes int
 }
 
 func NewInMemoryBackend() (*InMemoryBackend, error) {
-	return &InMemoryBackend{}, nil
+	return NewInMemoryBackendWithOptions(InMemoryBackendOptions{})
+}
+
+func NewInMemoryBackendWithOptions(options InMemoryBackendOptions) (*InMemoryBackend, error) {
+	maxSizeInBytes := options.MaxSizeInBytes
+	if maxSizeInBytes == 0 {
+		maxSizeInBytes = DefaultMaxSizeInBytes
+	}
+
+	switch options.TrimStrategy {
+	case "", TrimStrategyHead:
+		return &InMemoryBackend{
+			maxSizeInBytes: maxSizeInBytes,
+			trimStrategy:   TrimStrategyHead,
+		}, nil
+
+	case TrimStrategyHeadAndTail:
+		tail, err := newTailBufferFor(maxSizeInBytes, options.TailSizeInBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		return &InMemoryBackend{
+			maxSizeInBytes: maxSizeInBytes,
+			trimStrategy:   TrimStrategyHeadAndTail,
+			headSize:       maxSizeInBytes - tail.maxSizeInBytes,
+			tail:           tail,
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown trim strategy '%s'", options.TrimStrategy)
+	}
 }
 
 func (l *InMemoryBackend) Open() error {
 	return nil
 }
 
+func (l *InMemoryBackend) Write(event interface{}) error {
+	jsonBytes, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	jsonBytes = append(jsonBytes, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.Events = append(l.Events, event)
+
+	if l.tail != nil {
+		if _, ok := event.(*JobFinishedEvent); ok {
+			if err := l.flushTail(); err != nil {
+				return err
+			}
+		} else if l.tail.Active() || l.bytesWritten+len(jsonBytes) > l.headSize {
+			l.tail.Append(jsonBytes)
+			return nil
+		}
+	}
+
+	l.writeLine(jsonBytes)
+	return nil
+}
+
+func (l *InMemoryBackend) writeLine(line []byte) {
+	l.lines = append(l.lines, line)
+	l.bytesWritten += len(line)
+}
+
+/*
+ * Callers must hold l.mu.
+ */
+func (l *InMemoryBackend) flushTail() error {
+	if l.tail == nil || !l.tail.Active() {
+		return nil
+	}
+
+	marker, err := l.tail.TruncationMarker()
+	if err != nil {
+		return err
+	}
+
+	if marker != nil {
+		l.writeLine(marker)
+	}
+
+	for _, event := range l.tail.Drain() {
+		l.writeLine(event)
+	}
+
+	return nil
+}
+
 func (l *InMemoryBackend) Iterate(fn func([]byte) error) error {
+	l.mu.Lock()
+	lines := l.lines
+	l.mu.Unlock()
+
+	for _, line := range lines {
+		if err := fn(bytes.TrimSuffix(line, []byte("\n"))); err != nil {
+			return fmt.Errorf("error processing event: %v", err)
+		}
+	}
+
 	return nil
 }
 
 func (l *InMemoryBackend) Read(startFrom, maxLines int, writer io.Writer) (int, error) {
-	return 0, nil
+	l.mu.Lock()
+	lines := l.lines
+	l.mu.Unlock()
+
+	if startFrom >= len(lines) {
+		return len(lines), nil
+	}
+
+	// Like in the FileBackend, a non-positive maxLines means no limit.
+	end := len(lines)
+	if maxLines > 0 && startFrom+maxLines < end {
+		end = startFrom + maxLines
+	}
+
+	for _, line := range lines[startFrom:end] {
+		if _, err := writer.Write(line); err != nil {
+			return startFrom, err
+		}
+
+		startFrom++
+	}
+
+	return startFrom, nil
 }
 
-func (l *InMemoryBackend) Write(event interface{}) error {
-	l.Events = append(l.Events, event)
+func (l *InMemoryBackend) Trimmed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 
-	return nil
+	if l.tail != nil {
+		return l.tail.Trimmed()
+	}
+
+	return l.bytesWritten >= l.maxSizeInBytes
 }
 
 func (l *InMemoryBackend) Close() error {
-	return nil
+	return l.CloseWithOptions(CloseOptions{})
 }
 
 func (l *InMemoryBackend) CloseWithOptions(options CloseOptions) error {
+	l.mu.Lock()
+	err := l.flushTail()
+	l.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if options.OnClose != nil {
+		options.OnClose(l.Trimmed())
+	}
+
 	return nil
 }
 
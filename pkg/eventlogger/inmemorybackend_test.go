@@ -0,0 +1,152 @@
+package eventlogger
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test__InMemoryBackendMatchesFileBackend(t *testing.T) {
+	fileBackend, err := NewFileBackend(filepath.Join(t.TempDir(), "logs.json"), DefaultMaxSizeInBytes)
+	require.NoError(t, err)
+	require.NoError(t, fileBackend.Open())
+
+	inMemoryBackend, err := NewInMemoryBackend()
+	require.NoError(t, err)
+	require.NoError(t, inMemoryBackend.Open())
+
+	multiBackend, err := NewMultiBackend(fileBackend, []NamedBackend{{Name: "memory", Backend: inMemoryBackend}})
+	require.NoError(t, err)
+
+	count := 0
+	generateLogEventsWithOutputGenerator(t, 100, multiBackend, func() string {
+		count++
+		return fmt.Sprintf("line %d", count)
+	})
+
+	// sinks are written asynchronously
+	require.Eventually(t, func() bool {
+		n := 0
+		_ = inMemoryBackend.Iterate(func(event []byte) error {
+			n++
+			return nil
+		})
+
+		return n == 104
+	}, time.Second, 10*time.Millisecond)
+
+	for _, startFrom := range []int{0, 1, 50, 103, 104, 105, 200} {
+		for _, maxLines := range []int{0, 1, 10, math.MaxInt32} {
+			expected := new(bytes.Buffer)
+			expectedNext, err := fileBackend.Read(startFrom, maxLines, expected)
+			require.NoError(t, err)
+
+			w := new(bytes.Buffer)
+			next, err := inMemoryBackend.Read(startFrom, maxLines, w)
+			require.NoError(t, err)
+
+			assert.Equal(t, expected.String(), w.String(), "start_from=%d, max_lines=%d", startFrom, maxLines)
+			assert.Equal(t, expectedNext, next, "start_from=%d, max_lines=%d", startFrom, maxLines)
+		}
+	}
+
+	expectedEvents := []string{}
+	require.NoError(t, fileBackend.Iterate(func(event []byte) error {
+		expectedEvents = append(expectedEvents, string(event))
+		return nil
+	}))
+
+	events := []string{}
+	require.NoError(t, inMemoryBackend.Iterate(func(event []byte) error {
+		events = append(events, string(event))
+		return nil
+	}))
+
+	assert.Equal(t, expectedEvents, events)
+	assert.Len(t, inMemoryBackend.Events, 104)
+	require.NoError(t, multiBackend.Close())
+}
+
+func Test__InMemoryBackendTrimming(t *testing.T) {
+	t.Run("head", func(t *testing.T) {
+		backend, err := NewInMemoryBackendWithOptions(InMemoryBackendOptions{MaxSizeInBytes: 500})
+		require.NoError(t, err)
+		generateLogEvents(t, 100, backend)
+
+		logsWereTrimmed := false
+		require.NoError(t, backend.CloseWithOptions(CloseOptions{OnClose: func(b bool) { logsWereTrimmed = b }}))
+		assert.True(t, logsWereTrimmed)
+	})
+
+	t.Run("head and tail", func(t *testing.T) {
+		backend, err := NewInMemoryBackendWithOptions(InMemoryBackendOptions{
+			MaxSizeInBytes:  1000,
+			TrimStrategy:    TrimStrategyHeadAndTail,
+			TailSizeInBytes: 400,
+		})
+
+		require.NoError(t, err)
+
+		count := 0
+		generateLogEventsWithOutputGenerator(t, 100, backend, func() string {
+			count++
+			return fmt.Sprintf("line %03d", count)
+		})
+
+		events, err := readSimplifiedEvents(backend)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"job_started", "directive: echo hello", "line 001\n"}, events[0:3])
+		assert.Equal(t, []string{"line 099\n", "line 100\n", "Exit Code: 0", "job_finished: passed"}, events[len(events)-4:])
+		assert.NotContains(t, events, "line 050\n")
+
+		logsWereTrimmed := false
+		require.NoError(t, backend.CloseWithOptions(CloseOptions{OnClose: func(b bool) { logsWereTrimmed = b }}))
+		assert.True(t, logsWereTrimmed)
+	})
+
+	t.Run("not trimmed", func(t *testing.T) {
+		backend, err := NewInMemoryBackend()
+		require.NoError(t, err)
+		generateLogEvents(t, 5, backend)
+
+		logsWereTrimmed := true
+		require.NoError(t, backend.CloseWithOptions(CloseOptions{OnClose: func(b bool) { logsWereTrimmed = b }}))
+		assert.False(t, logsWereTrimmed)
+	})
+
+	t.Run("bad options", func(t *testing.T) {
+		_, err := NewInMemoryBackendWithOptions(InMemoryBackendOptions{TrimStrategy: "not-a-strategy"})
+		assert.ErrorContains(t, err, "unknown trim strategy")
+
+		_, err = NewInMemoryBackendWithOptions(InMemoryBackendOptions{
+			MaxSizeInBytes:  100,
+			TrimStrategy:    TrimStrategyHeadAndTail,
+			TailSizeInBytes: 100,
+		})
+
+		assert.ErrorContains(t, err, "must be between 1 and 99")
+	})
+}
+
+func Test__InMemoryBackendGeneratesPlainTextFile(t *testing.T) {
+	logger, _ := DefaultTestLogger()
+	logger.LogJobStarted()
+	logger.LogCommandStarted("echo hello")
+	logger.LogCommandOutput("hello\n")
+	logger.LogJobFinished("passed")
+
+	file, err := logger.GeneratePlainTextFileIn(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, logger.Close())
+
+	content, err := os.ReadFile(file)
+	require.NoError(t, err)
+	assert.Equal(t, "echo hello\nhello\n", string(content))
+}
@@ -2,7 +2,6 @@ package eventlogger
 
 import (
 	"bufio"
-	"encoding/json"
 	"fmt"
 	"os"
 	"time"
@@ -31,7 +30,15 @@ func (l *Logger) CloseWithOptions(options CloseOptions) error {
 }
 
 func (l *Logger) GeneratePlainTextFileIn(directory string) (string, error) {
-	tmpFile, err := os.CreateTemp(directory, "*.txt")
+	return l.GenerateRenderedFileIn(directory, RenderOptions{})
+}
+
+/*
+ * Render the JSON logs into a human-readable file, using the options given.
+ * Note: the caller must delete the generated file after it's done with it.
+ */
+func (l *Logger) GenerateRenderedFileIn(directory string, options RenderOptions) (string, error) {
+	tmpFile, err := os.CreateTemp(directory, "*."+options.FileExtension())
 	if err != nil {
 		return "", fmt.Errorf("error creating plain text file: %v", err)
 	}
@@ -39,33 +46,27 @@ func (l *Logger) GeneratePlainTextFileIn(directory string) (string, error) {
 	defer tmpFile.Close()
 
 	bufferedWriter := bufio.NewWriterSize(tmpFile, 64*1024)
-	err = l.Backend.Iterate(func(event []byte) error {
-		var object map[string]interface{}
-		err := json.Unmarshal(event, &object)
-		if err != nil {
-			return fmt.Errorf("error unmarshaling log event '%s': %v", string(event), err)
-		}
+	renderer := newLogRenderer(bufferedWriter, options)
 
-		switch eventType := object["event"].(string); {
-		case eventType == "cmd_started":
-			if _, err := bufferedWriter.WriteString(object["directive"].(string) + "\n"); err != nil {
-				return fmt.Errorf("error writing to output: %v", err)
-			}
-		case eventType == "cmd_output":
-			if _, err := bufferedWriter.WriteString(object["output"].(string)); err != nil {
-				return fmt.Errorf("error writing to output: %v", err)
-			}
-		default:
-			// We can ignore all the other event types here
+	if options.CommandHeaders {
+		if err := renderer.collectCommandSummaries(l.Backend); err != nil {
+			return "", fmt.Errorf("error iterating on log backend: %v", err)
 		}
+	}
 
-		return nil
-	})
+	if err := renderer.begin(); err != nil {
+		return "", fmt.Errorf("error writing to output: %v", err)
+	}
 
+	err = l.Backend.Iterate(renderer.render)
 	if err != nil {
 		return "", fmt.Errorf("error iterating on log backend: %v", err)
 	}
 
+	if err := renderer.end(); err != nil {
+		return "", fmt.Errorf("error writing to output: %v", err)
+	}
+
 	err = bufferedWriter.Flush()
 	if err != nil {
 		return "", fmt.Errorf("error flushing buffered writer: %v", err)
@@ -83,9 +84,11 @@ func (l *Logger) GeneratePlainTextFile() (string, error) {
 }
 
 func (l *Logger) LogJobStarted() {
+	now := time.Now()
 	event := &JobStartedEvent{
-		Timestamp: int(time.Now().Unix()),
-		Event:     "job_started",
+		Timestamp:   int(now.Unix()),
+		TimestampMs: now.UnixMilli(),
+		Event:       "job_started",
 	}
 
 	err := l.Backend.Write(event)
@@ -95,10 +98,12 @@ func (l *Logger) LogJobStarted() {
 }
 
 func (l *Logger) LogJobFinished(result string) {
+	now := time.Now()
 	event := &JobFinishedEvent{
-		Timestamp: int(time.Now().Unix()),
-		Event:     "job_finished",
-		Result:    result,
+		Timestamp:   int(now.Unix()),
+		TimestampMs: now.UnixMilli(),
+		Event:       "job_finished",
+		Result:      result,
 	}
 
 	err := l.Backend.Write(event)
@@ -108,10 +113,12 @@ func (l *Logger) LogJobFinished(result string) {
 }
 
 func (l *Logger) LogCommandStarted(directive string) {
+	now := time.Now()
 	event := &CommandStartedEvent{
-		Timestamp: int(time.Now().Unix()),
-		Event:     "cmd_started",
-		Directive: directive,
+		Timestamp:   int(now.Unix()),
+		TimestampMs: now.UnixMilli(),
+		Event:       "cmd_started",
+		Directive:   directive,
 	}
 
 	err := l.Backend.Write(event)
@@ -121,10 +128,17 @@ func (l *Logger) LogCommandStarted(directive string) {
 }
 
 func (l *Logger) LogCommandOutput(output string) {
+	l.LogCommandOutputFromStream(output, "")
+}
+
+func (l *Logger) LogCommandOutputFromStream(output, stream string) {
+	now := time.Now()
 	event := &CommandOutputEvent{
-		Timestamp: int(time.Now().Unix()),
-		Event:     "cmd_output",
-		Output:    output,
+		Timestamp:   int(now.Unix()),
+		TimestampMs: now.UnixMilli(),
+		Event:       "cmd_output",
+		Output:      output,
+		Stream:      stream,
 	}
 
 	err := l.Backend.Write(event)
@@ -133,14 +147,59 @@ func (l *Logger) LogCommandOutput(output string) {
 	}
 }
 
-func (l *Logger) LogCommandFinished(directive string, exitCode int, startedAt int, finishedAt int) {
+func (l *Logger) LogEnvironmentChanged(directive string, added, changed, removed []string, directory string) {
+	now := time.Now()
+	event := &EnvironmentChangedEvent{
+		Timestamp:   int(now.Unix()),
+		TimestampMs: now.UnixMilli(),
+		Event:       "env_changed",
+		Directive:   directive,
+		Added:       added,
+		Changed:     changed,
+		Removed:     removed,
+		Directory:   directory,
+	}
+
+	err := l.Backend.Write(event)
+	if err != nil {
+		log.Errorf("Error writing env_changed log: %v", err)
+	}
+}
+
+// How a command was killed, if it was.
+type CommandTermination struct {
+	Signal     string
+	CoreDumped bool
+	OOMKilled  bool
+}
+
+/*
+ * The startedAt and finishedAt times should come from time.Now(),
+ * so the duration is calculated using their monotonic clock readings.
+ */
+func (l *Logger) LogCommandFinished(directive string, exitCode int, startedAt, finishedAt time.Time) {
+	l.LogCommandFinishedWithTermination(directive, exitCode, startedAt, finishedAt, nil)
+}
+
+func (l *Logger) LogCommandFinishedWithTermination(directive string, exitCode int, startedAt, finishedAt time.Time, termination *CommandTermination) {
+	now := time.Now()
 	event := &CommandFinishedEvent{
-		Timestamp:  int(time.Now().Unix()),
-		Event:      "cmd_finished",
-		Directive:  directive,
-		ExitCode:   exitCode,
-		StartedAt:  startedAt,
-		FinishedAt: finishedAt,
+		Timestamp:    int(now.Unix()),
+		TimestampMs:  now.UnixMilli(),
+		Event:        "cmd_finished",
+		Directive:    directive,
+		ExitCode:     exitCode,
+		StartedAt:    int(startedAt.Unix()),
+		FinishedAt:   int(finishedAt.Unix()),
+		StartedAtMs:  startedAt.UnixMilli(),
+		FinishedAtMs: finishedAt.UnixMilli(),
+		DurationMs:   finishedAt.Sub(startedAt).Milliseconds(),
+	}
+
+	if termination != nil {
+		event.Signal = termination.Signal
+		event.CoreDumped = termination.CoreDumped
+		event.OOMKilled = termination.OOMKilled
 	}
 
 	err := l.Backend.Write(event)
@@ -148,3 +207,55 @@ func (l *Logger) LogCommandFinished(directive string, exitCode int, startedAt in
 		log.Errorf("Error writing cmd_finished log: %v", err)
 	}
 }
+
+func (l *Logger) LogAttachStarted(sessionID, user, remoteAddress string) {
+	now := time.Now()
+	event := &AttachStartedEvent{
+		Timestamp:     int(now.Unix()),
+		TimestampMs:   now.UnixMilli(),
+		Event:         "attach_started",
+		SessionID:     sessionID,
+		User:          user,
+		RemoteAddress: remoteAddress,
+	}
+
+	err := l.Backend.Write(event)
+	if err != nil {
+		log.Errorf("Error writing attach_started log: %v", err)
+	}
+}
+
+func (l *Logger) LogAttachFinished(sessionID, user string, exitCode int, startedAt, finishedAt time.Time) {
+	now := time.Now()
+	event := &AttachFinishedEvent{
+		Timestamp:   int(now.Unix()),
+		TimestampMs: now.UnixMilli(),
+		Event:       "attach_finished",
+		SessionID:   sessionID,
+		User:        user,
+		ExitCode:    exitCode,
+		DurationMs:  finishedAt.Sub(startedAt).Milliseconds(),
+	}
+
+	err := l.Backend.Write(event)
+	if err != nil {
+		log.Errorf("Error writing attach_finished log: %v", err)
+	}
+}
+
+/*
+ * Reports the start of a job phase to backends that support tracing.
+ * The returned function must be called with the phase's exit code when it finishes.
+ * Phases still open when the job finishes are ended with it.
+ */
+func (l *Logger) StartPhase(name string) func(exitCode int) {
+	tracer, ok := l.Backend.(PhaseTracer)
+	if !ok {
+		return func(int) {}
+	}
+
+	tracer.PhaseStarted(name, time.Now())
+	return func(exitCode int) {
+		tracer.PhaseFinished(name, exitCode, time.Now())
+	}
+}
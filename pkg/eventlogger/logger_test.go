@@ -48,6 +48,32 @@ func Test__GeneratePlainLogs(t *testing.T) {
 	os.Remove(file)
 }
 
+func Test__GeneratePlainLogsWithTruncatedOutput(t *testing.T) {
+	tmpFileName := filepath.Join(os.TempDir(), fmt.Sprintf("logs_%d.json", time.Now().UnixNano()))
+	backend, _ := NewFileBackendWithOptions(FileBackendOptions{
+		Path:            tmpFileName,
+		MaxSizeInBytes:  1000,
+		TrimStrategy:    TrimStrategyHeadAndTail,
+		TailSizeInBytes: 400,
+	})
+
+	assert.Nil(t, backend.Open())
+	logger, _ := NewLogger(backend)
+	generateLogEvents(t, 100, backend)
+
+	file, err := logger.GeneratePlainTextFile()
+	assert.NoError(t, err)
+	assert.FileExists(t, file)
+
+	bytes, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Contains(t, string(bytes), "[... output truncated: ")
+	assert.True(t, strings.HasSuffix(string(bytes), "hello\nhello\n"))
+
+	assert.NoError(t, logger.Close())
+	os.Remove(file)
+}
+
 func Benchmark__GeneratePlainLogs(b *testing.B) {
 	//
 	// We do not want to account for this setup time in our benchmark
@@ -101,3 +127,45 @@ func Benchmark__GeneratePlainLogs(b *testing.B) {
 
 	require.NoError(b, logger.Close())
 }
+
+func Test__LogEventsIncludeMilliseconds(t *testing.T) {
+	logger, backend := DefaultTestLogger()
+
+	before := time.Now().UnixMilli()
+	logger.LogJobStarted()
+	logger.LogCommandStarted("echo hello")
+	logger.LogCommandOutput("hello\n")
+	after := time.Now().UnixMilli()
+
+	require.Len(t, backend.Events, 3)
+
+	jobStarted := backend.Events[0].(*JobStartedEvent)
+	assert.GreaterOrEqual(t, jobStarted.TimestampMs, before)
+	assert.LessOrEqual(t, jobStarted.TimestampMs, after)
+	assert.Equal(t, int64(jobStarted.Timestamp), jobStarted.TimestampMs/1000)
+
+	cmdStarted := backend.Events[1].(*CommandStartedEvent)
+	assert.GreaterOrEqual(t, cmdStarted.TimestampMs, jobStarted.TimestampMs)
+
+	cmdOutput := backend.Events[2].(*CommandOutputEvent)
+	assert.GreaterOrEqual(t, cmdOutput.TimestampMs, cmdStarted.TimestampMs)
+}
+
+func Test__LogCommandFinishedIncludesDuration(t *testing.T) {
+	logger, backend := DefaultTestLogger()
+
+	startedAt := time.Now()
+	finishedAt := startedAt.Add(250 * time.Millisecond)
+	logger.LogCommandFinished("echo hello", 0, startedAt, finishedAt)
+
+	require.Len(t, backend.Events, 1)
+	event := backend.Events[0].(*CommandFinishedEvent)
+
+	// second-based fields are still populated, for older consumers
+	assert.Equal(t, int(startedAt.Unix()), event.StartedAt)
+	assert.Equal(t, int(finishedAt.Unix()), event.FinishedAt)
+
+	assert.Equal(t, startedAt.UnixMilli(), event.StartedAtMs)
+	assert.Equal(t, finishedAt.UnixMilli(), event.FinishedAtMs)
+	assert.Equal(t, int64(250), event.DurationMs)
+}
@@ -0,0 +1,258 @@
+package eventlogger
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How many events can be waiting to be written to a sink.
+// If a sink is too slow and its buffer is full, it misses the new events.
+const SinkBufferSize = 10000
+
+// How long closing the logs waits for the sinks
+// to receive the events still in their buffers.
+const DefaultSinkCloseTimeout = 30 * time.Second
+
+/*
+ * Writes every event to a primary backend and to a list of additional sinks.
+ *
+ * The primary backend is the source of truth for the job logs:
+ * reads and iterations go to it, and errors from it are returned to the caller.
+ *
+ * The sinks are independent from each other and from the primary backend.
+ * Each sink receives the events through a buffer, in its own goroutine,
+ * so a slow or hanging sink never blocks the job.
+ * A sink that fails to open is disabled for the rest of the job,
+ * and errors writing to or closing a sink are only logged,
+ * so a misbehaving sink never breaks the job.
+ */
+type MultiBackend struct {
+	primary      Backend
+	sinks        []*sink
+	closeTimeout time.Duration
+}
+
+type sink struct {
+	name       string
+	backend    Backend
+	disabled   bool
+	failures   int
+	operations chan func()
+	done       chan struct{}
+	mu         sync.Mutex
+}
+
+type NamedBackend struct {
+	Name    string
+	Backend Backend
+}
+
+func NewMultiBackend(primary Backend, sinks []NamedBackend) (*MultiBackend, error) {
+	if primary == nil {
+		return nil, fmt.Errorf("primary backend is required")
+	}
+
+	b := &MultiBackend{primary: primary, closeTimeout: DefaultSinkCloseTimeout}
+	for _, s := range sinks {
+		if s.Backend == nil {
+			return nil, fmt.Errorf("backend for sink '%s' is required", s.Name)
+		}
+
+		b.sinks = append(b.sinks, &sink{name: s.Name, backend: s.Backend})
+	}
+
+	return b, nil
+}
+
+func (b *MultiBackend) Open() error {
+	if err := b.primary.Open(); err != nil {
+		return err
+	}
+
+	for _, s := range b.sinks {
+		if err := s.backend.Open(); err != nil {
+			log.Errorf("Error opening job log sink '%s' - disabling it: %v", s.name, err)
+			s.disabled = true
+			continue
+		}
+
+		s.mu.Lock()
+		s.start()
+		s.mu.Unlock()
+	}
+
+	return nil
+}
+
+func (b *MultiBackend) Write(event interface{}) error {
+	err := b.primary.Write(event)
+
+	for _, s := range b.sinks {
+		s.write(event)
+	}
+
+	return err
+}
+
+func (b *MultiBackend) PhaseStarted(name string, startedAt time.Time) {
+	if tracer, ok := b.primary.(PhaseTracer); ok {
+		tracer.PhaseStarted(name, startedAt)
+	}
+
+	for _, s := range b.sinks {
+		s.phaseStarted(name, startedAt)
+	}
+}
+
+func (b *MultiBackend) PhaseFinished(name string, exitCode int, finishedAt time.Time) {
+	if tracer, ok := b.primary.(PhaseTracer); ok {
+		tracer.PhaseFinished(name, exitCode, finishedAt)
+	}
+
+	for _, s := range b.sinks {
+		s.phaseFinished(name, exitCode, finishedAt)
+	}
+}
+
+func (b *MultiBackend) Read(startFrom, maxLines int, writer io.Writer) (int, error) {
+	return b.primary.Read(startFrom, maxLines, writer)
+}
+
+func (b *MultiBackend) Iterate(fn func(event []byte) error) error {
+	return b.primary.Iterate(fn)
+}
+
+func (b *MultiBackend) Close() error {
+	return b.CloseWithOptions(CloseOptions{})
+}
+
+/*
+ * Sinks are closed before the primary backend,
+ * and only the primary backend receives the close options.
+ * All the sinks share the same timeout to receive the events in their buffers,
+ * and the ones that don't make it in time are abandoned.
+ */
+func (b *MultiBackend) CloseWithOptions(options CloseOptions) error {
+	for _, s := range b.sinks {
+		s.stop()
+	}
+
+	deadline := time.After(b.closeTimeout)
+	for _, s := range b.sinks {
+		if s.done == nil {
+			continue
+		}
+
+		select {
+		case <-s.done:
+		case <-deadline:
+			log.Errorf("Job log sink '%s' did not receive all events after %v - giving up on it", s.name, b.closeTimeout)
+		}
+	}
+
+	return b.primary.CloseWithOptions(options)
+}
+
+/*
+ * The events are written to the sink in the order they arrive,
+ * and the sink is closed after the last one.
+ * Sinks opened by the caller are only started with their first event.
+ * Callers must hold s.mu.
+ */
+func (s *sink) start() {
+	if s.operations != nil {
+		return
+	}
+
+	s.operations = make(chan func(), SinkBufferSize)
+	s.done = make(chan struct{})
+
+	go func() {
+		defer close(s.done)
+
+		for operation := range s.operations {
+			operation()
+		}
+
+		s.mu.Lock()
+		failures := s.failures
+		s.mu.Unlock()
+
+		if failures > 0 {
+			log.Warnf("Job log sink '%s' failed to receive %d events", s.name, failures)
+		}
+
+		if err := s.backend.Close(); err != nil {
+			log.Errorf("Error closing job log sink '%s': %v", s.name, err)
+		}
+	}()
+}
+
+func (s *sink) enqueue(operation func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.disabled {
+		return
+	}
+
+	s.start()
+	select {
+	case s.operations <- operation:
+	default:
+		s.recordFailure(fmt.Errorf("buffer with %d events is full", SinkBufferSize))
+	}
+}
+
+/*
+ * We only log the first error, to avoid flooding the agent logs
+ * with one error per event when a sink is down.
+ * Callers must hold s.mu.
+ */
+func (s *sink) recordFailure(err error) {
+	if s.failures == 0 {
+		log.Errorf("Error writing to job log sink '%s': %v", s.name, err)
+	}
+
+	s.failures++
+}
+
+func (s *sink) write(event interface{}) {
+	s.enqueue(func() {
+		if err := s.backend.Write(event); err != nil {
+			s.mu.Lock()
+			s.recordFailure(err)
+			s.mu.Unlock()
+		}
+	})
+}
+
+func (s *sink) phaseStarted(name string, startedAt time.Time) {
+	if tracer, ok := s.backend.(PhaseTracer); ok {
+		s.enqueue(func() { tracer.PhaseStarted(name, startedAt) })
+	}
+}
+
+func (s *sink) phaseFinished(name string, exitCode int, finishedAt time.Time) {
+	if tracer, ok := s.backend.(PhaseTracer); ok {
+		s.enqueue(func() { tracer.PhaseFinished(name, exitCode, finishedAt) })
+	}
+}
+
+// A stopped sink does not receive any more events.
+func (s *sink) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.disabled {
+		return
+	}
+
+	s.start()
+	s.disabled = true
+	close(s.operations)
+}
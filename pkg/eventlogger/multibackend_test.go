@@ -0,0 +1,285 @@
+package eventlogger
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/semaphoreci/agent/pkg/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test__MultiBackendWritesToAllBackends(t *testing.T) {
+	primary, _ := NewInMemoryBackend()
+	sink1, _ := NewInMemoryBackend()
+	sink2, _ := NewInMemoryBackend()
+
+	backend, err := NewMultiBackend(primary, []NamedBackend{
+		{Name: "sink1", Backend: sink1},
+		{Name: "sink2", Backend: sink2},
+	})
+
+	require.NoError(t, err)
+	require.NoError(t, backend.Open())
+	require.NoError(t, backend.Write(&JobStartedEvent{Event: "job_started"}))
+	require.NoError(t, backend.Write(&JobFinishedEvent{Event: "job_finished", Result: "passed"}))
+	require.NoError(t, backend.Close())
+
+	for _, b := range []*InMemoryBackend{primary, sink1, sink2} {
+		events, err := b.SimplifiedEvents(true, false)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"job_started", "job_finished: passed"}, events)
+	}
+}
+
+func Test__MultiBackendIgnoresFailingSinks(t *testing.T) {
+	primary := &failingBackend{}
+	healthy, _ := NewInMemoryBackend()
+	failingWrite := &failingBackend{failWrite: true}
+	failingOpen := &failingBackend{failOpen: true}
+
+	backend, err := NewMultiBackend(primary, []NamedBackend{
+		{Name: "failing-write", Backend: failingWrite},
+		{Name: "failing-open", Backend: failingOpen},
+		{Name: "healthy", Backend: healthy},
+	})
+
+	require.NoError(t, err)
+	require.NoError(t, backend.Open())
+	require.NoError(t, backend.Write(&JobStartedEvent{Event: "job_started"}))
+	require.NoError(t, backend.Write(&JobFinishedEvent{Event: "job_finished", Result: "passed"}))
+
+	onCloseCalled := false
+	require.NoError(t, backend.CloseWithOptions(CloseOptions{OnClose: func(bool) { onCloseCalled = true }}))
+	assert.True(t, onCloseCalled)
+
+	assert.Equal(t, 2, primary.writes)
+	assert.Len(t, healthy.Events, 2)
+	assert.Equal(t, 2, failingWrite.writes)
+	assert.True(t, failingWrite.closed)
+
+	// A sink that failed to open doesn't receive events, and is not closed.
+	assert.Equal(t, 0, failingOpen.writes)
+	assert.False(t, failingOpen.closed)
+}
+
+func Test__MultiBackendReturnsErrorsFromPrimary(t *testing.T) {
+	sink, _ := NewInMemoryBackend()
+
+	backend, err := NewMultiBackend(&failingBackend{failOpen: true}, []NamedBackend{{Name: "sink", Backend: sink}})
+	require.NoError(t, err)
+	assert.Error(t, backend.Open())
+
+	backend, err = NewMultiBackend(&failingBackend{failWrite: true}, []NamedBackend{{Name: "sink", Backend: sink}})
+	require.NoError(t, err)
+	require.NoError(t, backend.Open())
+	assert.Error(t, backend.Write(&JobStartedEvent{Event: "job_started"}))
+
+	// the sink still receives the event
+	require.NoError(t, backend.Close())
+	assert.Len(t, sink.Events, 1)
+}
+
+func Test__MultiBackendDoesNotWaitForHangingSinks(t *testing.T) {
+	t.Run("close gives up on hanging sinks", func(t *testing.T) {
+		primary, _ := NewInMemoryBackend()
+		healthy, _ := NewInMemoryBackend()
+		hanging := &hangingBackend{release: make(chan struct{})}
+		defer close(hanging.release)
+
+		backend, err := NewMultiBackend(primary, []NamedBackend{
+			{Name: "hanging", Backend: hanging},
+			{Name: "healthy", Backend: healthy},
+		})
+
+		require.NoError(t, err)
+		backend.closeTimeout = 100 * time.Millisecond
+		require.NoError(t, backend.Open())
+
+		for i := 0; i < 100; i++ {
+			require.NoError(t, backend.Write(&CommandOutputEvent{Event: "cmd_output", Output: "hello\n"}))
+		}
+
+		start := time.Now()
+		require.NoError(t, backend.Close())
+		assert.Less(t, time.Since(start), 5*time.Second)
+
+		// the other sinks and the primary backend still receive everything
+		assert.Len(t, primary.Events, 100)
+		assert.Len(t, healthy.Events, 100)
+	})
+
+	t.Run("writes do not block when the buffer is full", func(t *testing.T) {
+		primary, _ := NewInMemoryBackend()
+		hanging := &hangingBackend{release: make(chan struct{})}
+		defer close(hanging.release)
+
+		backend, err := NewMultiBackend(primary, []NamedBackend{{Name: "hanging", Backend: hanging}})
+		require.NoError(t, err)
+		backend.closeTimeout = 100 * time.Millisecond
+		require.NoError(t, backend.Open())
+
+		start := time.Now()
+		for i := 0; i < SinkBufferSize+10; i++ {
+			require.NoError(t, backend.Write(&CommandOutputEvent{Event: "cmd_output", Output: "hello\n"}))
+		}
+
+		require.NoError(t, backend.Close())
+		assert.Less(t, time.Since(start), 5*time.Second)
+		assert.Len(t, primary.Events, SinkBufferSize+10)
+	})
+}
+
+func Test__FileSinkRejectsInvalidJobIDs(t *testing.T) {
+	directory := t.TempDir()
+
+	for _, jobID := range []string{"", "../job-1", "job/1", ".hidden"} {
+		_, err := createSink(LoggerOptions{Request: &api.JobRequest{JobID: jobID}}, SinkConfig{Type: SinkTypeFile, Target: directory})
+		assert.ErrorContains(t, err, "invalid job ID", jobID)
+	}
+
+	entries, err := os.ReadDir(directory)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func Test__MultiBackendReadsFromPrimary(t *testing.T) {
+	primary, err := NewFileBackend(filepath.Join(t.TempDir(), "primary.json"), DefaultMaxSizeInBytes)
+	require.NoError(t, err)
+	sink, _ := NewInMemoryBackend()
+
+	backend, err := NewMultiBackend(primary, []NamedBackend{{Name: "sink", Backend: sink}})
+	require.NoError(t, err)
+	require.NoError(t, backend.Open())
+	require.NoError(t, backend.Write(&JobStartedEvent{Event: "job_started", Timestamp: 1}))
+
+	buf := bytes.Buffer{}
+	next, err := backend.Read(0, 10, &buf)
+	require.NoError(t, err)
+	assert.Equal(t, 1, next)
+	assert.Equal(t, "{\"event\":\"job_started\",\"timestamp\":1}\n", buf.String())
+	require.NoError(t, backend.Close())
+}
+
+func Test__CreateLoggerWithFileSink(t *testing.T) {
+	directory := t.TempDir()
+
+	logger, err := CreateLogger(LoggerOptions{
+		Request: &api.JobRequest{
+			JobID:  "job-1",
+			Logger: api.Logger{Method: LoggerMethodPull},
+		},
+		Sinks: []SinkConfig{{Type: SinkTypeFile, Target: directory}},
+	})
+
+	require.NoError(t, err)
+	assert.IsType(t, &MultiBackend{}, logger.Backend)
+
+	logger.LogJobStarted()
+	logger.LogJobFinished("passed")
+	require.NoError(t, logger.Close())
+
+	// The file for the sink is kept after the logger is closed.
+	content, err := os.ReadFile(filepath.Join(directory, "job_log_job-1.json"))
+	require.NoError(t, err)
+	assert.Contains(t, string(content), `"event":"job_started"`)
+	assert.Contains(t, string(content), `"event":"job_finished"`)
+}
+
+func Test__ParseSinkConfig(t *testing.T) {
+	sink, err := ParseSinkConfig("file:/var/log/jobs")
+	require.NoError(t, err)
+	assert.Equal(t, SinkConfig{Type: SinkTypeFile, Target: "/var/log/jobs"}, sink)
+
+	for _, value := range []string{"", "file", "file:", ":/var/log/jobs", "nope:/var/log/jobs"} {
+		_, err := ParseSinkConfig(value)
+		assert.Error(t, err, value)
+	}
+}
+
+type failingBackend struct {
+	failOpen  bool
+	failWrite bool
+	writes    int
+	closed    bool
+}
+
+func (b *failingBackend) Open() error {
+	if b.failOpen {
+		return fmt.Errorf("failed to open")
+	}
+
+	return nil
+}
+
+func (b *failingBackend) Write(interface{}) error {
+	b.writes++
+	if b.failWrite {
+		return fmt.Errorf("failed to write")
+	}
+
+	return nil
+}
+
+func (b *failingBackend) Read(startFrom, maxLines int, writer io.Writer) (int, error) {
+	return startFrom, nil
+}
+
+func (b *failingBackend) Iterate(fn func(event []byte) error) error {
+	return nil
+}
+
+func (b *failingBackend) Close() error {
+	return b.CloseWithOptions(CloseOptions{})
+}
+
+func (b *failingBackend) CloseWithOptions(options CloseOptions) error {
+	b.closed = true
+	if options.OnClose != nil {
+		options.OnClose(false)
+	}
+
+	return nil
+}
+
+/*
+ * A backend whose writes hang until released, like a sink whose collector is not responding.
+ */
+type hangingBackend struct {
+	failingBackend
+	release chan struct{}
+}
+
+func (b *hangingBackend) Write(interface{}) error {
+	<-b.release
+	return nil
+}
+
+func Test__MultiBackendDisablesFileSinkThatFailsToOpen(t *testing.T) {
+	primary, err := NewFileBackend(filepath.Join(t.TempDir(), "primary.json"), DefaultMaxSizeInBytes)
+	require.NoError(t, err)
+
+	// the directory for the sink does not exist
+	fileSink, err := NewFileBackend(filepath.Join(t.TempDir(), "missing", "sink.json"), DefaultMaxSizeInBytes)
+	require.NoError(t, err)
+	assert.Error(t, fileSink.Open())
+
+	backend, err := NewMultiBackend(primary, []NamedBackend{{Name: "file", Backend: fileSink}})
+	require.NoError(t, err)
+	require.NoError(t, backend.Open())
+	require.NoError(t, backend.Write(&JobStartedEvent{Event: "job_started", Timestamp: 1}))
+	require.NoError(t, backend.Write(&JobFinishedEvent{Event: "job_finished", Timestamp: 1, Result: "passed"}))
+
+	buf := bytes.Buffer{}
+	next, err := backend.Read(0, 10, &buf)
+	require.NoError(t, err)
+	assert.Equal(t, 2, next)
+
+	require.NoError(t, backend.Close())
+	assert.NoError(t, fileSink.Close())
+}
@@ -0,0 +1,576 @@
+package eventlogger
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const DefaultOTLPFlushInterval = 5 * time.Second
+const DefaultOTLPServiceName = "semaphore-agent"
+
+// Command output is buffered in memory between flushes.
+// If the collector can't keep up, we drop new log records
+// instead of using an unbounded amount of memory.
+const MaxOTLPBufferedLogRecords = 10000
+
+const otlpScopeName = "github.com/semaphoreci/agent"
+const otlpSpanKindInternal = 1
+const otlpStatusCodeOk = 1
+const otlpStatusCodeError = 2
+const otlpSeverityNumberInfo = 9
+const otlpSeverityNumberError = 17
+
+/*
+ * Exports the job as OpenTelemetry traces and logs,
+ * using the OTLP/HTTP protocol with JSON encoding.
+ *
+ * The job is a span, and each phase and command is a child span.
+ * Commands executed during a phase are children of that phase's span.
+ * Command output is exported as log records, linked to the command span.
+ *
+ * This backend only exports events, so it can't be used to read the job logs back.
+ * It is meant to be used as one of the sinks in a MultiBackend.
+ */
+type OTLPBackend struct {
+	config  OTLPBackendConfig
+	traceID string
+
+	jobSpan     *otlpSpan
+	phases      []*otlpSpan
+	commandSpan *otlpSpan
+
+	finishedSpans  []*otlpSpan
+	logRecords     []*otlpLogRecord
+	droppedRecords int
+	opened         bool
+	closed         bool
+	mu             sync.Mutex
+
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+type OTLPBackendConfig struct {
+	// Base URL for the collector, e.g. http://localhost:4318.
+	// Traces and logs are sent to /v1/traces and /v1/logs.
+	Endpoint      string
+	Headers       map[string]string
+	JobID         string
+	ServiceName   string
+	FlushInterval time.Duration
+	Client        *http.Client
+}
+
+func NewOTLPBackend(config OTLPBackendConfig) (*OTLPBackend, error) {
+	if config.Endpoint == "" {
+		return nil, fmt.Errorf("config.Endpoint is required")
+	}
+
+	if !strings.HasPrefix(config.Endpoint, "http://") && !strings.HasPrefix(config.Endpoint, "https://") {
+		return nil, fmt.Errorf("config.Endpoint must be an http:// or https:// URL")
+	}
+
+	if config.ServiceName == "" {
+		config.ServiceName = DefaultOTLPServiceName
+	}
+
+	if config.FlushInterval == 0 {
+		config.FlushInterval = DefaultOTLPFlushInterval
+	}
+
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	config.Endpoint = strings.TrimSuffix(config.Endpoint, "/")
+
+	traceID, err := randomHexID(16)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OTLPBackend{
+		config:  config,
+		traceID: traceID,
+		stopCh:  make(chan struct{}),
+		doneCh:  make(chan struct{}),
+	}, nil
+}
+
+func (b *OTLPBackend) Open() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.opened {
+		b.opened = true
+		log.Infof("Exporting job %s to %s with trace ID %s", b.config.JobID, b.config.Endpoint, b.traceID)
+		go b.flushLoop()
+	}
+
+	return nil
+}
+
+func (b *OTLPBackend) Write(event interface{}) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil
+	}
+
+	switch e := event.(type) {
+	case *JobStartedEvent:
+		b.jobSpan = b.newSpan("job", "", millisToNanos(e.TimestampMs))
+		b.jobSpan.Attributes = append(b.jobSpan.Attributes, stringAttribute("semaphore.job.id", b.config.JobID))
+
+	case *CommandStartedEvent:
+		b.commandSpan = b.newSpan(e.Directive, b.currentParentID(), millisToNanos(e.TimestampMs))
+		b.commandSpan.Attributes = append(b.commandSpan.Attributes, stringAttribute("semaphore.command.directive", e.Directive))
+
+	case *CommandOutputEvent:
+		b.addLogRecord(e)
+
+	case *CommandFinishedEvent:
+		if b.commandSpan == nil {
+			return nil
+		}
+
+		if e.StartedAtMs != 0 {
+			b.commandSpan.start = millisToNanos(e.StartedAtMs)
+		}
+
+		finishedAt := millisToNanos(e.TimestampMs)
+		if e.FinishedAtMs != 0 {
+			finishedAt = millisToNanos(e.FinishedAtMs)
+		}
+
+		b.commandSpan.Attributes = append(b.commandSpan.Attributes, intAttribute("semaphore.command.exit_code", int64(e.ExitCode)))
+		if e.Signal != "" {
+			b.commandSpan.Attributes = append(b.commandSpan.Attributes, stringAttribute("semaphore.command.signal", e.Signal))
+		}
+
+		if e.OOMKilled {
+			b.commandSpan.Attributes = append(b.commandSpan.Attributes, boolAttribute("semaphore.command.oom_killed", true))
+		}
+		b.endSpan(b.commandSpan, finishedAt, e.ExitCode == 0)
+		b.commandSpan = nil
+
+	case *JobFinishedEvent:
+		if b.jobSpan == nil {
+			return nil
+		}
+
+		// Anything still open ends with the job.
+		finishedAt := millisToNanos(e.TimestampMs)
+		b.endOpenSpans(finishedAt)
+		b.jobSpan.Attributes = append(b.jobSpan.Attributes, stringAttribute("semaphore.job.result", e.Result))
+		b.endSpan(b.jobSpan, finishedAt, e.Result == "passed")
+		b.jobSpan = nil
+	}
+
+	return nil
+}
+
+func (b *OTLPBackend) PhaseStarted(name string, startedAt time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed || b.jobSpan == nil {
+		return
+	}
+
+	b.phases = append(b.phases, b.newSpan(name, b.currentParentID(), startedAt.UnixNano()))
+}
+
+func (b *OTLPBackend) PhaseFinished(name string, exitCode int, finishedAt time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for i := len(b.phases) - 1; i >= 0; i-- {
+		phase := b.phases[i]
+		if phase.Name != name {
+			continue
+		}
+
+		phase.Attributes = append(phase.Attributes, intAttribute("semaphore.phase.exit_code", int64(exitCode)))
+		b.endSpan(phase, finishedAt.UnixNano(), exitCode == 0)
+		b.phases = append(b.phases[:i], b.phases[i+1:]...)
+		return
+	}
+}
+
+func (b *OTLPBackend) Read(startFrom, maxLines int, writer io.Writer) (int, error) {
+	return startFrom, fmt.Errorf("OTLP backend does not support reading")
+}
+
+func (b *OTLPBackend) Iterate(fn func(event []byte) error) error {
+	return fmt.Errorf("OTLP backend does not support reading")
+}
+
+func (b *OTLPBackend) Close() error {
+	return b.CloseWithOptions(CloseOptions{})
+}
+
+func (b *OTLPBackend) CloseWithOptions(options CloseOptions) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+
+	// If the job never finished, we still export what we have.
+	b.closed = true
+	opened := b.opened
+	now := time.Now().UnixNano()
+	b.endOpenSpans(now)
+	if b.jobSpan != nil {
+		b.endSpan(b.jobSpan, now, false)
+		b.jobSpan = nil
+	}
+
+	b.mu.Unlock()
+
+	if opened {
+		close(b.stopCh)
+		<-b.doneCh
+	} else {
+		b.flush()
+	}
+
+	if options.OnClose != nil {
+		options.OnClose(false)
+	}
+
+	return nil
+}
+
+func (b *OTLPBackend) flushLoop() {
+	defer close(b.doneCh)
+
+	ticker := time.NewTicker(b.config.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			b.flush()
+		case <-b.stopCh:
+			b.flush()
+			return
+		}
+	}
+}
+
+func (b *OTLPBackend) flush() {
+	b.mu.Lock()
+	spans := b.finishedSpans
+	records := b.logRecords
+	dropped := b.droppedRecords
+	b.finishedSpans = nil
+	b.logRecords = nil
+	b.droppedRecords = 0
+	b.mu.Unlock()
+
+	if dropped > 0 {
+		log.Warnf("Dropped %d log records for OTLP export - too many records since last flush", dropped)
+	}
+
+	if len(spans) > 0 {
+		if err := b.send("/v1/traces", b.tracesPayload(spans)); err != nil {
+			log.Errorf("Error exporting %d spans to %s: %v", len(spans), b.config.Endpoint, err)
+		}
+	}
+
+	if len(records) > 0 {
+		if err := b.send("/v1/logs", b.logsPayload(records)); err != nil {
+			log.Errorf("Error exporting %d log records to %s: %v", len(records), b.config.Endpoint, err)
+		}
+	}
+}
+
+func (b *OTLPBackend) send(path string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, b.config.Endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	for name, value := range b.config.Headers {
+		request.Header.Set(name, value)
+	}
+
+	response, err := b.config.Client.Do(request)
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("request to %s failed with status %d", path, response.StatusCode)
+	}
+
+	return nil
+}
+
+/*
+ * Callers must hold b.mu.
+ */
+func (b *OTLPBackend) newSpan(name, parentSpanID string, startedAt int64) *otlpSpan {
+	spanID, err := randomHexID(8)
+	if err != nil {
+		log.Errorf("Error generating span ID: %v", err)
+	}
+
+	return &otlpSpan{
+		TraceID:      b.traceID,
+		SpanID:       spanID,
+		ParentSpanID: parentSpanID,
+		Name:         name,
+		Kind:         otlpSpanKindInternal,
+		start:        startedAt,
+	}
+}
+
+/*
+ * Callers must hold b.mu.
+ */
+func (b *OTLPBackend) endSpan(span *otlpSpan, finishedAt int64, ok bool) {
+	span.StartTimeUnixNano = strconv.FormatInt(span.start, 10)
+	span.EndTimeUnixNano = strconv.FormatInt(finishedAt, 10)
+	span.Status = otlpStatus{Code: otlpStatusCodeOk}
+	if !ok {
+		span.Status = otlpStatus{Code: otlpStatusCodeError}
+	}
+
+	b.finishedSpans = append(b.finishedSpans, span)
+}
+
+/*
+ * Callers must hold b.mu.
+ */
+func (b *OTLPBackend) endOpenSpans(finishedAt int64) {
+	if b.commandSpan != nil {
+		b.endSpan(b.commandSpan, finishedAt, false)
+		b.commandSpan = nil
+	}
+
+	for i := len(b.phases) - 1; i >= 0; i-- {
+		b.endSpan(b.phases[i], finishedAt, true)
+	}
+
+	b.phases = nil
+}
+
+/*
+ * Commands and phases are children of the innermost phase, if any.
+ * Callers must hold b.mu.
+ */
+func (b *OTLPBackend) currentParentID() string {
+	if len(b.phases) > 0 {
+		return b.phases[len(b.phases)-1].SpanID
+	}
+
+	if b.jobSpan != nil {
+		return b.jobSpan.SpanID
+	}
+
+	return ""
+}
+
+/*
+ * Callers must hold b.mu.
+ */
+func (b *OTLPBackend) addLogRecord(e *CommandOutputEvent) {
+	if len(b.logRecords) >= MaxOTLPBufferedLogRecords {
+		b.droppedRecords++
+		return
+	}
+
+	spanID := b.currentParentID()
+	if b.commandSpan != nil {
+		spanID = b.commandSpan.SpanID
+	}
+
+	severityNumber, severityText := otlpSeverityNumberInfo, "INFO"
+	if e.Stream == OutputStreamStderr {
+		severityNumber, severityText = otlpSeverityNumberError, "ERROR"
+	}
+
+	timestamp := strconv.FormatInt(millisToNanos(e.TimestampMs), 10)
+	b.logRecords = append(b.logRecords, &otlpLogRecord{
+		TimeUnixNano:         timestamp,
+		ObservedTimeUnixNano: timestamp,
+		SeverityNumber:       severityNumber,
+		SeverityText:         severityText,
+		Body:                 otlpAnyValue{StringValue: &e.Output},
+		TraceID:              b.traceID,
+		SpanID:               spanID,
+	})
+}
+
+func (b *OTLPBackend) resource() otlpResource {
+	attributes := []otlpKeyValue{
+		stringAttribute("service.name", b.config.ServiceName),
+		stringAttribute("semaphore.job.id", b.config.JobID),
+	}
+
+	if hostname, err := os.Hostname(); err == nil {
+		attributes = append(attributes, stringAttribute("host.name", hostname))
+	}
+
+	return otlpResource{Attributes: attributes}
+}
+
+func (b *OTLPBackend) tracesPayload(spans []*otlpSpan) interface{} {
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": b.resource(),
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": otlpScope{Name: otlpScopeName},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+}
+
+func (b *OTLPBackend) logsPayload(records []*otlpLogRecord) interface{} {
+	return map[string]interface{}{
+		"resourceLogs": []interface{}{
+			map[string]interface{}{
+				"resource": b.resource(),
+				"scopeLogs": []interface{}{
+					map[string]interface{}{
+						"scope":      otlpScope{Name: otlpScopeName},
+						"logRecords": records,
+					},
+				},
+			},
+		},
+	}
+}
+
+/*
+ * Headers for the collector use the same format as
+ * the OTEL_EXPORTER_OTLP_HEADERS environment variable: key1=value1,key2=value2.
+ */
+func ParseOTLPHeaders(value string) (map[string]string, error) {
+	headers := map[string]string{}
+	if value == "" {
+		return headers, nil
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		name, headerValue, found := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !found || name == "" {
+			return nil, fmt.Errorf("'%s' is not a valid header", pair)
+		}
+
+		headers[name] = strings.TrimSpace(headerValue)
+	}
+
+	return headers, nil
+}
+
+// OTLP/JSON encodes 64-bit integers as strings,
+// and trace and span IDs as hex strings.
+// See: https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+
+	start int64
+}
+
+type otlpStatus struct {
+	Code int `json:"code"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano         string       `json:"timeUnixNano"`
+	ObservedTimeUnixNano string       `json:"observedTimeUnixNano"`
+	SeverityNumber       int          `json:"severityNumber"`
+	SeverityText         string       `json:"severityText"`
+	Body                 otlpAnyValue `json:"body"`
+	TraceID              string       `json:"traceId"`
+	SpanID               string       `json:"spanId,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+func stringAttribute(key, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: &value}}
+}
+
+func intAttribute(key string, value int64) otlpKeyValue {
+	v := strconv.FormatInt(value, 10)
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{IntValue: &v}}
+}
+
+func boolAttribute(key string, value bool) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{BoolValue: &value}}
+}
+
+func millisToNanos(ms int64) int64 {
+	if ms == 0 {
+		return time.Now().UnixNano()
+	}
+
+	return ms * int64(time.Millisecond)
+}
+
+func randomHexID(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating random ID: %v", err)
+	}
+
+	return hex.EncodeToString(b), nil
+}
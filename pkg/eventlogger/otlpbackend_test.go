@@ -0,0 +1,242 @@
+package eventlogger
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test__OTLPBackendExportsSpansAndLogs(t *testing.T) {
+	collector := newTestCollector()
+	server := httptest.NewServer(collector)
+	defer server.Close()
+
+	backend, err := NewOTLPBackend(OTLPBackendConfig{
+		Endpoint: server.URL,
+		JobID:    "job-1",
+		Headers:  map[string]string{"X-Api-Key": "secret"},
+	})
+
+	require.NoError(t, err)
+
+	primary, _ := NewInMemoryBackend()
+	multiBackend, err := NewMultiBackend(primary, []NamedBackend{{Name: "otlp", Backend: backend}})
+	require.NoError(t, err)
+
+	logger, err := NewLogger(multiBackend)
+	require.NoError(t, err)
+	require.NoError(t, logger.Open())
+
+	logger.LogJobStarted()
+
+	finishPhase := logger.StartPhase(PhasePrepare)
+	finishPhase(0)
+
+	now := time.Now()
+	logger.LogCommandStarted("echo hello")
+	logger.LogCommandOutput("hello\n")
+	logger.LogCommandFinished("echo hello", 0, now, now.Add(time.Second))
+
+	finishPhase = logger.StartPhase(PhaseEpilogues)
+	logger.LogCommandStarted("false")
+	logger.LogCommandFinished("false", 1, now, now)
+	finishPhase(0)
+
+	logger.LogJobFinished("passed")
+	require.NoError(t, logger.Close())
+
+	spans := collector.Spans()
+	require.Len(t, spans, 5)
+
+	byName := map[string]map[string]interface{}{}
+	for _, span := range spans {
+		byName[span["name"].(string)] = span
+	}
+
+	job := byName["job"]
+	require.NotNil(t, job)
+	assert.Len(t, job["traceId"], 32)
+	assert.Len(t, job["spanId"], 16)
+	assert.Nil(t, job["parentSpanId"])
+	assert.Equal(t, float64(otlpStatusCodeOk), job["status"].(map[string]interface{})["code"])
+	assert.Contains(t, attributes(job), "semaphore.job.result=passed")
+
+	// phases and commands outside of phases are children of the job span
+	assert.Equal(t, job["spanId"], byName[PhasePrepare]["parentSpanId"])
+	assert.Equal(t, job["spanId"], byName["echo hello"]["parentSpanId"])
+	assert.Equal(t, job["spanId"], byName[PhaseEpilogues]["parentSpanId"])
+	assert.Contains(t, attributes(byName["echo hello"]), "semaphore.command.exit_code=0")
+
+	// commands executed during a phase are children of the phase span
+	assert.Equal(t, byName[PhaseEpilogues]["spanId"], byName["false"]["parentSpanId"])
+	assert.Contains(t, attributes(byName["false"]), "semaphore.command.exit_code=1")
+	assert.Equal(t, float64(otlpStatusCodeError), byName["false"]["status"].(map[string]interface{})["code"])
+
+	// output is linked to the command span
+	records := collector.LogRecords()
+	require.Len(t, records, 1)
+	assert.Equal(t, "hello\n", records[0]["body"].(map[string]interface{})["stringValue"])
+	assert.Equal(t, job["traceId"], records[0]["traceId"])
+	assert.Equal(t, byName["echo hello"]["spanId"], records[0]["spanId"])
+
+	assert.Equal(t, []string{"secret"}, collector.APIKeys())
+}
+
+func Test__OTLPBackendEndsOpenSpansOnClose(t *testing.T) {
+	collector := newTestCollector()
+	server := httptest.NewServer(collector)
+	defer server.Close()
+
+	backend, err := NewOTLPBackend(OTLPBackendConfig{Endpoint: server.URL, JobID: "job-1"})
+	require.NoError(t, err)
+	require.NoError(t, backend.Open())
+
+	require.NoError(t, backend.Write(&JobStartedEvent{Event: "job_started", TimestampMs: time.Now().UnixMilli()}))
+	backend.PhaseStarted(PhaseStart, time.Now())
+	require.NoError(t, backend.Close())
+
+	spans := collector.Spans()
+	require.Len(t, spans, 2)
+	for _, span := range spans {
+		assert.NotEmpty(t, span["endTimeUnixNano"])
+	}
+}
+
+func Test__OTLPBackendUsesErrorSeverityForStderr(t *testing.T) {
+	collector := newTestCollector()
+	server := httptest.NewServer(collector)
+	defer server.Close()
+
+	backend, err := NewOTLPBackend(OTLPBackendConfig{Endpoint: server.URL, JobID: "job-1"})
+	require.NoError(t, err)
+	require.NoError(t, backend.Open())
+
+	now := time.Now().UnixMilli()
+	require.NoError(t, backend.Write(&CommandOutputEvent{Event: "cmd_output", Output: "out\n", Stream: OutputStreamStdout, TimestampMs: now}))
+	require.NoError(t, backend.Write(&CommandOutputEvent{Event: "cmd_output", Output: "err\n", Stream: OutputStreamStderr, TimestampMs: now}))
+	require.NoError(t, backend.Close())
+
+	records := collector.LogRecords()
+	require.Len(t, records, 2)
+	assert.Equal(t, "INFO", records[0]["severityText"])
+	assert.Equal(t, "ERROR", records[1]["severityText"])
+}
+
+func Test__OTLPBackendValidatesConfig(t *testing.T) {
+	_, err := NewOTLPBackend(OTLPBackendConfig{})
+	assert.ErrorContains(t, err, "config.Endpoint is required")
+
+	_, err = NewOTLPBackend(OTLPBackendConfig{Endpoint: "localhost:4318"})
+	assert.ErrorContains(t, err, "config.Endpoint must be an http:// or https:// URL")
+}
+
+func Test__ParseOTLPHeaders(t *testing.T) {
+	headers, err := ParseOTLPHeaders("api-key=secret, x-tenant = a")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"api-key": "secret", "x-tenant": "a"}, headers)
+
+	headers, err = ParseOTLPHeaders("")
+	require.NoError(t, err)
+	assert.Empty(t, headers)
+
+	_, err = ParseOTLPHeaders("nope")
+	assert.Error(t, err)
+}
+
+func attributes(span map[string]interface{}) []string {
+	result := []string{}
+	list, _ := span["attributes"].([]interface{})
+	for _, item := range list {
+		attribute := item.(map[string]interface{})
+		value := attribute["value"].(map[string]interface{})
+		for _, v := range value {
+			result = append(result, attribute["key"].(string)+"="+v.(string))
+		}
+	}
+
+	return result
+}
+
+type testCollector struct {
+	spans      []map[string]interface{}
+	logRecords []map[string]interface{}
+	apiKeys    []string
+	mu         sync.Mutex
+}
+
+func newTestCollector() *testCollector {
+	return &testCollector{}
+}
+
+func (c *testCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.apiKeys = append(c.apiKeys, r.Header.Get("X-Api-Key"))
+
+	payload := map[string][]struct {
+		ScopeSpans []struct {
+			Spans []map[string]interface{} `json:"spans"`
+		} `json:"scopeSpans"`
+		ScopeLogs []struct {
+			LogRecords []map[string]interface{} `json:"logRecords"`
+		} `json:"scopeLogs"`
+	}{}
+
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/v1/traces":
+		for _, resourceSpans := range payload["resourceSpans"] {
+			for _, scopeSpans := range resourceSpans.ScopeSpans {
+				c.spans = append(c.spans, scopeSpans.Spans...)
+			}
+		}
+	case "/v1/logs":
+		for _, resourceLogs := range payload["resourceLogs"] {
+			for _, scopeLogs := range resourceLogs.ScopeLogs {
+				c.logRecords = append(c.logRecords, scopeLogs.LogRecords...)
+			}
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (c *testCollector) Spans() []map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.spans
+}
+
+func (c *testCollector) LogRecords() []map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.logRecords
+}
+
+func (c *testCollector) APIKeys() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := []string{}
+	for _, key := range c.apiKeys {
+		if key != "" && (len(keys) == 0 || keys[len(keys)-1] != key) {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
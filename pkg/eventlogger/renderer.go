@@ -0,0 +1,572 @@
+package eventlogger
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const RenderFormatText = "text"
+const RenderFormatHTML = "html"
+
+// Values accepted by ParseRenderOptions.
+const (
+	RenderOptionCommandHeaders = "command-headers"
+	RenderOptionTimestamps     = "timestamps"
+	RenderOptionStripANSI      = "strip-ansi"
+	RenderOptionHTML           = "html"
+)
+
+var ValidRenderOptions = []string{
+	RenderOptionCommandHeaders,
+	RenderOptionTimestamps,
+	RenderOptionStripANSI,
+	RenderOptionHTML,
+}
+
+/*
+ * Controls how the JSON job logs are rendered into a human-readable file.
+ * The zero value renders the directives and the raw output, as plain text.
+ */
+type RenderOptions struct {
+	// RenderFormatText or RenderFormatHTML.
+	// If empty, RenderFormatText is used.
+	Format string
+
+	// Include the start time, duration and exit code of each command.
+	CommandHeaders bool
+
+	// Prefix each line of output with the time it was produced.
+	Timestamps bool
+
+	// Remove ANSI escape sequences from the output.
+	// For the HTML format, colours are preserved unless this is set.
+	StripANSI bool
+}
+
+func (o RenderOptions) FileExtension() string {
+	if o.Format == RenderFormatHTML {
+		return "html"
+	}
+
+	return "txt"
+}
+
+/*
+ * Without any options, the logs are rendered exactly like they were
+ * before the options existed: the directives and the raw output, as they are.
+ */
+func (o RenderOptions) plain() bool {
+	return o.Format != RenderFormatHTML && !o.CommandHeaders && !o.Timestamps && !o.StripANSI
+}
+
+func ParseRenderOptions(values []string) (RenderOptions, error) {
+	options := RenderOptions{Format: RenderFormatText}
+	for _, value := range values {
+		switch value {
+		case RenderOptionCommandHeaders:
+			options.CommandHeaders = true
+		case RenderOptionTimestamps:
+			options.Timestamps = true
+		case RenderOptionStripANSI:
+			options.StripANSI = true
+		case RenderOptionHTML:
+			options.Format = RenderFormatHTML
+		default:
+			return RenderOptions{}, fmt.Errorf("unknown rendering option '%s' - allowed options are %v", value, ValidRenderOptions)
+		}
+	}
+
+	return options, nil
+}
+
+// Matches CSI sequences (colours, cursor movement, ...), OSC sequences (window titles, hyperlinks, ...)
+// and the remaining two-character escape sequences.
+var ansiEscapeSequence = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)|\x1b[@-Z\\-_]`)
+var ansiColourSequence = regexp.MustCompile(`^\x1b\[([0-9;]*)m$`)
+
+func StripANSI(s string) string {
+	return ansiEscapeSequence.ReplaceAllString(s, "")
+}
+
+type renderedEvent struct {
+	Event        string `json:"event"`
+	Timestamp    int64  `json:"timestamp"`
+	TimestampMs  int64  `json:"timestamp_ms"`
+	Directive    string `json:"directive"`
+	Output       string `json:"output"`
+	ExitCode     int    `json:"exit_code"`
+	StartedAt    int64  `json:"started_at"`
+	StartedAtMs  int64  `json:"started_at_ms"`
+	FinishedAt   int64  `json:"finished_at"`
+	DurationMs   int64  `json:"duration_ms"`
+	Result       string `json:"result"`
+	OmittedBytes int64  `json:"omitted_bytes"`
+	Signal       string `json:"signal"`
+	CoreDumped   bool   `json:"core_dumped"`
+	OOMKilled    bool   `json:"oom_killed"`
+}
+
+func (e *renderedEvent) time() time.Time {
+	if e.TimestampMs != 0 {
+		return time.UnixMilli(e.TimestampMs).UTC()
+	}
+
+	return time.Unix(e.Timestamp, 0).UTC()
+}
+
+type commandSummary struct {
+	startedAt time.Time
+	duration  time.Duration
+	exitCode  int
+	killedBy  string
+}
+
+func killDetails(event *renderedEvent) string {
+	details := []string{}
+	if event.Signal != "" {
+		details = append(details, event.Signal)
+	}
+
+	if event.CoreDumped {
+		details = append(details, "core dumped")
+	}
+
+	if event.OOMKilled {
+		details = append(details, "out of memory")
+	}
+
+	return strings.Join(details, ", ")
+}
+
+/*
+ * Renders job log events into a writer.
+ * Output chunks don't necessarily end on line boundaries or even
+ * on escape sequence boundaries, so the renderer keeps some state between them.
+ */
+type logRenderer struct {
+	options  RenderOptions
+	writer   *bufio.Writer
+	commands []*commandSummary
+
+	commandIndex  int
+	atLineStart   bool
+	pendingEscape string
+	style         ansiStyle
+	openSpan      bool
+}
+
+func newLogRenderer(writer *bufio.Writer, options RenderOptions) *logRenderer {
+	return &logRenderer{options: options, writer: writer, atLineStart: true}
+}
+
+/*
+ * Headers are written before the output of a command,
+ * but the information for them only comes after it, in the cmd_finished event.
+ * So, before rendering, we go through the events once to collect it.
+ */
+func (r *logRenderer) collectCommandSummaries(backend Backend) error {
+	started := []int{}
+	return backend.Iterate(func(raw []byte) error {
+		event, err := parseRenderedEvent(raw)
+		if err != nil {
+			return err
+		}
+
+		switch event.Event {
+		case "cmd_started":
+			started = append(started, len(r.commands))
+			r.commands = append(r.commands, nil)
+		case "cmd_finished":
+			if len(started) == 0 {
+				return nil
+			}
+
+			startedAt := time.Unix(event.StartedAt, 0).UTC()
+			if event.StartedAtMs != 0 {
+				startedAt = time.UnixMilli(event.StartedAtMs).UTC()
+			}
+
+			duration := time.Duration(event.DurationMs) * time.Millisecond
+			if event.DurationMs == 0 {
+				duration = time.Duration(event.FinishedAt-event.StartedAt) * time.Second
+			}
+
+			r.commands[started[len(started)-1]] = &commandSummary{
+				startedAt: startedAt,
+				duration:  duration,
+				exitCode:  event.ExitCode,
+				killedBy:  killDetails(event),
+			}
+
+			started = started[:len(started)-1]
+		}
+
+		return nil
+	})
+}
+
+func (r *logRenderer) begin() error {
+	if r.options.Format != RenderFormatHTML {
+		return nil
+	}
+
+	_, err := r.writer.WriteString(htmlHeader)
+	return err
+}
+
+func (r *logRenderer) end() error {
+	if r.options.Format != RenderFormatHTML {
+		return nil
+	}
+
+	r.closeSpan()
+	_, err := r.writer.WriteString(htmlFooter)
+	return err
+}
+
+func (r *logRenderer) render(raw []byte) error {
+	event, err := parseRenderedEvent(raw)
+	if err != nil {
+		return err
+	}
+
+	switch event.Event {
+	case "cmd_started":
+		r.command(event.Directive)
+	case "cmd_output":
+		r.output(event.Output, event.time())
+	case "output_truncated":
+		r.finishLine()
+		r.write(fmt.Sprintf("\n[... output truncated: %d bytes omitted ...]\n", event.OmittedBytes), "meta")
+	case "job_finished":
+		if r.options.CommandHeaders {
+			r.finishLine()
+			r.write(fmt.Sprintf("Job finished with result: %s\n", event.Result), "meta")
+		}
+	default:
+		// We can ignore all the other event types here
+	}
+
+	return nil
+}
+
+func (r *logRenderer) command(directive string) {
+	r.finishLine()
+
+	var summary *commandSummary
+	if r.commandIndex < len(r.commands) {
+		summary = r.commands[r.commandIndex]
+	}
+
+	r.commandIndex++
+	r.write(directive, "cmd")
+
+	if r.options.CommandHeaders {
+		r.write(formatSummary(summary), "meta")
+	}
+
+	r.write("\n", "")
+}
+
+func formatSummary(summary *commandSummary) string {
+	if summary == nil {
+		return "  [did not finish]"
+	}
+
+	exitCode := fmt.Sprintf("%d", summary.exitCode)
+	if summary.killedBy != "" {
+		exitCode = fmt.Sprintf("%d (%s)", summary.exitCode, summary.killedBy)
+	}
+
+	return fmt.Sprintf(
+		"  [exit code: %s, duration: %s, started at: %s]",
+		exitCode,
+		summary.duration,
+		summary.startedAt.Format("2006-01-02T15:04:05.000Z"),
+	)
+}
+
+func (r *logRenderer) output(output string, at time.Time) {
+	output = r.pendingEscape + output
+	r.pendingEscape = ""
+
+	// If we need to process escape sequences, and the chunk ends
+	// in the middle of one, we hold on to it until the next chunk arrives.
+	processEscapes := r.options.StripANSI || r.options.Format == RenderFormatHTML
+	if i := strings.LastIndexByte(output, '\x1b'); processEscapes && i >= 0 && len(output)-i < 32 {
+		if loc := ansiEscapeSequence.FindStringIndex(output[i:]); loc == nil || loc[0] != 0 {
+			r.pendingEscape = output[i:]
+			output = output[:i]
+		}
+	}
+
+	if !r.options.Timestamps {
+		r.writeOutput(output)
+		return
+	}
+
+	for len(output) > 0 {
+		if r.atLineStart {
+			r.write("["+at.Format("15:04:05.000")+"] ", "ts")
+		}
+
+		i := strings.IndexByte(output, '\n')
+		if i < 0 {
+			r.writeOutput(output)
+			return
+		}
+
+		r.writeOutput(output[:i+1])
+		output = output[i+1:]
+	}
+}
+
+func (r *logRenderer) writeOutput(output string) {
+	if output == "" {
+		return
+	}
+
+	r.atLineStart = strings.HasSuffix(output, "\n")
+
+	if r.options.StripANSI {
+		output = StripANSI(output)
+	}
+
+	if r.options.Format != RenderFormatHTML {
+		_, _ = r.writer.WriteString(output)
+		return
+	}
+
+	// For HTML, colour sequences become styled spans,
+	// and every other escape sequence is dropped.
+	last := 0
+	for _, loc := range ansiEscapeSequence.FindAllStringIndex(output, -1) {
+		r.writeStyled(output[last:loc[0]])
+		if m := ansiColourSequence.FindStringSubmatch(output[loc[0]:loc[1]]); m != nil {
+			r.style.apply(m[1])
+		}
+
+		last = loc[1]
+	}
+
+	r.writeStyled(output[last:])
+}
+
+func (r *logRenderer) writeStyled(text string) {
+	if text == "" {
+		return
+	}
+
+	r.closeSpan()
+	if css := r.style.css(); css != "" {
+		_, _ = r.writer.WriteString(`<span style="` + css + `">`)
+		r.openSpan = true
+	}
+
+	_, _ = r.writer.WriteString(html.EscapeString(text))
+}
+
+func (r *logRenderer) closeSpan() {
+	if r.openSpan {
+		_, _ = r.writer.WriteString("</span>")
+		r.openSpan = false
+	}
+}
+
+/*
+ * Makes sure what comes next starts in a new line,
+ * and that styles from the previous command's output don't leak into it.
+ * Plain rendering keeps the output untouched.
+ */
+func (r *logRenderer) finishLine() {
+	if r.options.plain() {
+		return
+	}
+
+	r.pendingEscape = ""
+	r.style = ansiStyle{}
+	r.closeSpan()
+
+	if !r.atLineStart {
+		r.write("\n", "")
+	}
+}
+
+func (r *logRenderer) write(text, class string) {
+	r.atLineStart = strings.HasSuffix(text, "\n")
+	if r.options.Format != RenderFormatHTML {
+		_, _ = r.writer.WriteString(text)
+		return
+	}
+
+	r.closeSpan()
+	if class == "" {
+		_, _ = r.writer.WriteString(html.EscapeString(text))
+		return
+	}
+
+	_, _ = r.writer.WriteString(`<span class="` + class + `">` + html.EscapeString(text) + `</span>`)
+}
+
+func parseRenderedEvent(raw []byte) (*renderedEvent, error) {
+	event := renderedEvent{}
+	if err := json.Unmarshal(raw, &event); err != nil {
+		return nil, fmt.Errorf("error unmarshaling log event '%s': %v", string(raw), err)
+	}
+
+	return &event, nil
+}
+
+const htmlHeader = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Job logs</title>
+<style>
+body { background: #1e1e1e; color: #d4d4d4; }
+pre { font-family: monospace; white-space: pre-wrap; }
+.cmd { color: #ffffff; font-weight: bold; }
+.meta, .ts { color: #808080; }
+</style>
+</head>
+<body>
+<pre>`
+
+const htmlFooter = `</pre>
+</body>
+</html>
+`
+
+var ansiPalette = []string{
+	"#000000", "#cd3131", "#0dbc79", "#e5e510", "#2472c8", "#bc3fbc", "#11a8cd", "#e5e5e5",
+	"#666666", "#f14c4c", "#23d18b", "#f5f543", "#3b8eea", "#d670d6", "#29b8db", "#ffffff",
+}
+
+type ansiStyle struct {
+	foreground string
+	background string
+	bold       bool
+	italic     bool
+	underline  bool
+}
+
+func (s *ansiStyle) css() string {
+	rules := []string{}
+	if s.foreground != "" {
+		rules = append(rules, "color: "+s.foreground)
+	}
+
+	if s.background != "" {
+		rules = append(rules, "background-color: "+s.background)
+	}
+
+	if s.bold {
+		rules = append(rules, "font-weight: bold")
+	}
+
+	if s.italic {
+		rules = append(rules, "font-style: italic")
+	}
+
+	if s.underline {
+		rules = append(rules, "text-decoration: underline")
+	}
+
+	return strings.Join(rules, "; ")
+}
+
+/*
+ * Applies the parameters of an SGR (Select Graphic Rendition) sequence.
+ * See: https://en.wikipedia.org/wiki/ANSI_escape_code#SGR_(Select_Graphic_Rendition)_parameters
+ */
+func (s *ansiStyle) apply(parameters string) {
+	if parameters == "" {
+		*s = ansiStyle{}
+		return
+	}
+
+	codes := []int{}
+	for _, p := range strings.Split(parameters, ";") {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			n = 0
+		}
+
+		codes = append(codes, n)
+	}
+
+	for i := 0; i < len(codes); i++ {
+		code := codes[i]
+		switch {
+		case code == 0:
+			*s = ansiStyle{}
+		case code == 1:
+			s.bold = true
+		case code == 3:
+			s.italic = true
+		case code == 4:
+			s.underline = true
+		case code == 22:
+			s.bold = false
+		case code == 23:
+			s.italic = false
+		case code == 24:
+			s.underline = false
+		case code >= 30 && code <= 37:
+			s.foreground = ansiPalette[code-30]
+		case code >= 90 && code <= 97:
+			s.foreground = ansiPalette[code-90+8]
+		case code == 39:
+			s.foreground = ""
+		case code >= 40 && code <= 47:
+			s.background = ansiPalette[code-40]
+		case code >= 100 && code <= 107:
+			s.background = ansiPalette[code-100+8]
+		case code == 49:
+			s.background = ""
+		case code == 38 || code == 48:
+			colour, consumed := extendedColour(codes[i+1:])
+			i += consumed
+			if code == 38 {
+				s.foreground = colour
+			} else {
+				s.background = colour
+			}
+		}
+	}
+}
+
+/*
+ * Handles 256-colour (5;n) and true colour (2;r;g;b) parameters.
+ * Returns the colour and how many parameters were used.
+ */
+func extendedColour(codes []int) (string, int) {
+	if len(codes) >= 2 && codes[0] == 5 {
+		n := codes[1]
+		switch {
+		case n >= 0 && n < 16:
+			return ansiPalette[n], 2
+		case n >= 16 && n < 232:
+			n -= 16
+			levels := []int{0, 95, 135, 175, 215, 255}
+			return fmt.Sprintf("#%02x%02x%02x", levels[n/36], levels[(n/6)%6], levels[n%6]), 2
+		case n >= 232 && n < 256:
+			gray := 8 + (n-232)*10
+			return fmt.Sprintf("#%02x%02x%02x", gray, gray, gray), 2
+		}
+
+		return "", 2
+	}
+
+	if len(codes) >= 4 && codes[0] == 2 {
+		return fmt.Sprintf("#%02x%02x%02x", codes[1]&0xff, codes[2]&0xff, codes[3]&0xff), 4
+	}
+
+	return "", len(codes)
+}
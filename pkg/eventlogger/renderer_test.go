@@ -0,0 +1,199 @@
+package eventlogger
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test__RenderWithCommandHeaders(t *testing.T) {
+	output := render(t, RenderOptions{CommandHeaders: true}, func(backend *FileBackend) {
+		startedAt := time.Date(2026, 1, 2, 3, 4, 5, 6000000, time.UTC)
+		writeEvents(t, backend,
+			&JobStartedEvent{Event: "job_started"},
+			&CommandStartedEvent{Event: "cmd_started", Directive: "echo hello"},
+			&CommandOutputEvent{Event: "cmd_output", Output: "hello"},
+			&CommandFinishedEvent{
+				Event:       "cmd_finished",
+				Directive:   "echo hello",
+				ExitCode:    0,
+				StartedAtMs: startedAt.UnixMilli(),
+				DurationMs:  1500,
+			},
+			&CommandStartedEvent{Event: "cmd_started", Directive: "false"},
+			&CommandFinishedEvent{
+				Event:      "cmd_finished",
+				Directive:  "false",
+				ExitCode:   1,
+				StartedAt:  int(startedAt.Unix()),
+				FinishedAt: int(startedAt.Unix()) + 2,
+			},
+			&CommandStartedEvent{Event: "cmd_started", Directive: "sleep 1000"},
+			&JobFinishedEvent{Event: "job_finished", Result: "stopped"},
+		)
+	})
+
+	assert.Equal(t, strings.Join([]string{
+		"echo hello  [exit code: 0, duration: 1.5s, started at: 2026-01-02T03:04:05.006Z]",
+		"hello",
+		"false  [exit code: 1, duration: 2s, started at: 2026-01-02T03:04:05.000Z]",
+		"sleep 1000  [did not finish]",
+		"Job finished with result: stopped",
+		"",
+	}, "\n"), output)
+}
+
+func Test__RenderWithCommandHeadersForKilledCommands(t *testing.T) {
+	output := render(t, RenderOptions{CommandHeaders: true}, func(backend *FileBackend) {
+		startedAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+		writeEvents(t, backend,
+			&CommandStartedEvent{Event: "cmd_started", Directive: "make test"},
+			&CommandFinishedEvent{
+				Event:       "cmd_finished",
+				Directive:   "make test",
+				ExitCode:    137,
+				StartedAtMs: startedAt.UnixMilli(),
+				DurationMs:  1000,
+				Signal:      "SIGKILL",
+				OOMKilled:   true,
+			},
+		)
+	})
+
+	assert.Equal(t, "make test  [exit code: 137 (SIGKILL, out of memory), duration: 1s, started at: 2026-01-02T03:04:05.000Z]\n", output)
+}
+
+func Test__RenderWithTimestamps(t *testing.T) {
+	at := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	output := render(t, RenderOptions{Timestamps: true}, func(backend *FileBackend) {
+		writeEvents(t, backend,
+			&CommandStartedEvent{Event: "cmd_started", Directive: "echo hello"},
+			&CommandOutputEvent{Event: "cmd_output", Output: "hel", TimestampMs: at.UnixMilli()},
+			&CommandOutputEvent{Event: "cmd_output", Output: "lo\nworld\n", TimestampMs: at.Add(time.Second).UnixMilli()},
+			&CommandOutputEvent{Event: "cmd_output", Output: "!\n", TimestampMs: at.Add(2 * time.Second).UnixMilli()},
+		)
+	})
+
+	assert.Equal(t, strings.Join([]string{
+		"echo hello",
+		"[03:04:05.000] hello",
+		"[03:04:06.000] world",
+		"[03:04:07.000] !",
+		"",
+	}, "\n"), output)
+}
+
+func Test__RenderStrippingANSI(t *testing.T) {
+	output := render(t, RenderOptions{StripANSI: true}, func(backend *FileBackend) {
+		writeEvents(t, backend,
+			&CommandStartedEvent{Event: "cmd_started", Directive: "ls --color"},
+			&CommandOutputEvent{Event: "cmd_output", Output: "\x1b[1;34mdir\x1b[0m file\n"},
+
+			// escape sequence split between two chunks
+			&CommandOutputEvent{Event: "cmd_output", Output: "\x1b[3"},
+			&CommandOutputEvent{Event: "cmd_output", Output: "2mgreen\x1b[0m\n"},
+
+			// window title
+			&CommandOutputEvent{Event: "cmd_output", Output: "\x1b]0;title\x07done\n"},
+		)
+	})
+
+	assert.Equal(t, "ls --color\ndir file\ngreen\ndone\n", output)
+}
+
+func Test__RenderKeepsANSIByDefault(t *testing.T) {
+	output := render(t, RenderOptions{}, func(backend *FileBackend) {
+		writeEvents(t, backend,
+			&CommandStartedEvent{Event: "cmd_started", Directive: "ls --color"},
+			&CommandOutputEvent{Event: "cmd_output", Output: "\x1b[3"},
+			&CommandOutputEvent{Event: "cmd_output", Output: "2mgreen\x1b[0m\n"},
+		)
+	})
+
+	assert.Equal(t, "ls --color\n\x1b[32mgreen\x1b[0m\n", output)
+}
+
+func Test__RenderWithoutOptionsKeepsTheOutputUntouched(t *testing.T) {
+	output := render(t, RenderOptions{}, func(backend *FileBackend) {
+		writeEvents(t, backend,
+			&CommandStartedEvent{Event: "cmd_started", Directive: "echo -n hello"},
+			&CommandOutputEvent{Event: "cmd_output", Output: "hello"},
+			&CommandFinishedEvent{Event: "cmd_finished", Directive: "echo -n hello"},
+			&CommandStartedEvent{Event: "cmd_started", Directive: "yes | head -c 10"},
+			&CommandOutputEvent{Event: "cmd_output", Output: "y\ny\ny"},
+			&OutputTruncatedEvent{Event: "output_truncated", OmittedBytes: 4},
+			&CommandFinishedEvent{Event: "cmd_finished", Directive: "yes | head -c 10"},
+			&JobFinishedEvent{Event: "job_finished", Result: "passed"},
+		)
+	})
+
+	assert.Equal(t, "echo -n hello\nhelloyes | head -c 10\ny\ny\ny\n[... output truncated: 4 bytes omitted ...]\n", output)
+}
+
+func Test__RenderHTML(t *testing.T) {
+	output := render(t, RenderOptions{Format: RenderFormatHTML}, func(backend *FileBackend) {
+		writeEvents(t, backend,
+			&CommandStartedEvent{Event: "cmd_started", Directive: "echo '<b>'"},
+			&CommandOutputEvent{Event: "cmd_output", Output: "<b>\n\x1b[1;31mred"},
+			&CommandOutputEvent{Event: "cmd_output", Output: " still red\x1b[0m plain\n"},
+			&CommandOutputEvent{Event: "cmd_output", Output: "\x1b[38;5;196mextended\x1b[39m \x1b[48;2;1;2;3mtrue colour\n"},
+			&CommandStartedEvent{Event: "cmd_started", Directive: "echo next"},
+		)
+	})
+
+	assert.True(t, strings.HasPrefix(output, "<!DOCTYPE html>"))
+	assert.True(t, strings.HasSuffix(output, "</html>\n"))
+	assert.Contains(t, output, `<span class="cmd">echo &#39;&lt;b&gt;&#39;</span>`)
+	assert.Contains(t, output, "&lt;b&gt;\n")
+	assert.Contains(t, output, `<span style="color: #cd3131; font-weight: bold">red</span>`)
+	assert.Contains(t, output, `<span style="color: #cd3131; font-weight: bold"> still red</span> plain`)
+	assert.Contains(t, output, `<span style="color: #ff0000">extended</span>`)
+
+	// styles don't leak into the next command
+	assert.Contains(t, output, `<span style="background-color: #010203">true colour`+"\n"+`</span><span class="cmd">echo next</span>`)
+}
+
+func Test__ParseRenderOptions(t *testing.T) {
+	options, err := ParseRenderOptions([]string{})
+	require.NoError(t, err)
+	assert.Equal(t, RenderOptions{Format: RenderFormatText}, options)
+	assert.Equal(t, "txt", options.FileExtension())
+
+	options, err = ParseRenderOptions([]string{"html", "timestamps", "strip-ansi", "command-headers"})
+	require.NoError(t, err)
+	assert.Equal(t, RenderOptions{Format: RenderFormatHTML, Timestamps: true, StripANSI: true, CommandHeaders: true}, options)
+	assert.Equal(t, "html", options.FileExtension())
+
+	_, err = ParseRenderOptions([]string{"nope"})
+	assert.ErrorContains(t, err, "unknown rendering option 'nope'")
+}
+
+func render(t *testing.T, options RenderOptions, fn func(*FileBackend)) string {
+	backend, err := NewFileBackend(filepath.Join(t.TempDir(), "logs.json"), DefaultMaxSizeInBytes)
+	require.NoError(t, err)
+	require.NoError(t, backend.Open())
+	logger, err := NewLogger(backend)
+	require.NoError(t, err)
+
+	fn(backend)
+
+	file, err := logger.GenerateRenderedFileIn(t.TempDir(), options)
+	require.NoError(t, err)
+	require.NoError(t, logger.Close())
+
+	content, err := os.ReadFile(file)
+	require.NoError(t, err)
+	return string(content)
+}
+
+func writeEvents(t *testing.T, backend Backend, events ...interface{}) {
+	for _, event := range events {
+		require.NoError(t, backend.Write(event))
+	}
+}
@@ -0,0 +1,125 @@
+package eventlogger
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Writes the JSON events for each job into a file in the target directory.
+// Unlike the file used by the pull logger, this file is kept after the job finishes.
+const SinkTypeFile = "file"
+
+// Exports the job as OpenTelemetry traces and logs to the OTLP/HTTP collector in the target URL.
+// Headers for the collector can be specified with the OTEL_EXPORTER_OTLP_HEADERS environment variable,
+// and the service name with OTEL_SERVICE_NAME.
+const SinkTypeOTLP = "otlp"
+
+var ValidSinkTypes = []string{
+	SinkTypeFile,
+	SinkTypeOTLP,
+}
+
+// Job IDs are used in file and directory names,
+// so we only accept IDs that can't escape the directory they are written to.
+var validJobID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+func IsValidJobID(jobID string) bool {
+	return validJobID.MatchString(jobID)
+}
+
+/*
+ * Additional destinations for job events,
+ * on top of the one specified in the job request.
+ */
+type SinkConfig struct {
+	Type   string
+	Target string
+}
+
+func (c SinkConfig) String() string {
+	return c.Type + ":" + c.Target
+}
+
+/*
+ * Sinks are specified in the format <type>:<target>,
+ * e.g. file:/var/log/semaphore-jobs.
+ */
+func ParseSinkConfig(value string) (SinkConfig, error) {
+	sinkType, target, found := strings.Cut(value, ":")
+	if !found || sinkType == "" || target == "" {
+		return SinkConfig{}, fmt.Errorf("sink '%s' is not in the format <type>:<target>", value)
+	}
+
+	for _, validType := range ValidSinkTypes {
+		if sinkType == validType {
+			return SinkConfig{Type: sinkType, Target: target}, nil
+		}
+	}
+
+	return SinkConfig{}, fmt.Errorf("unknown sink type '%s' - allowed types are %v", sinkType, ValidSinkTypes)
+}
+
+func createSink(options LoggerOptions, config SinkConfig) (Backend, error) {
+	switch config.Type {
+	case SinkTypeFile:
+		if !IsValidJobID(options.Request.JobID) {
+			return nil, fmt.Errorf("invalid job ID '%s'", options.Request.JobID)
+		}
+
+		// #nosec
+		if err := os.MkdirAll(config.Target, 0750); err != nil {
+			return nil, fmt.Errorf("error creating directory '%s': %v", config.Target, err)
+		}
+
+		return NewFileBackendWithOptions(FileBackendOptions{
+			Path:           filepath.Join(config.Target, fmt.Sprintf("job_log_%s.json", options.Request.JobID)),
+			MaxSizeInBytes: math.MaxInt32,
+			KeepOnClose:    true,
+		})
+
+	case SinkTypeOTLP:
+		headers, err := ParseOTLPHeaders(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"))
+		if err != nil {
+			return nil, fmt.Errorf("error parsing OTEL_EXPORTER_OTLP_HEADERS: %v", err)
+		}
+
+		return NewOTLPBackend(OTLPBackendConfig{
+			Endpoint:    config.Target,
+			Headers:     headers,
+			JobID:       options.Request.JobID,
+			ServiceName: os.Getenv("OTEL_SERVICE_NAME"),
+		})
+
+	default:
+		return nil, fmt.Errorf("unknown sink type '%s'", config.Type)
+	}
+}
+
+/*
+ * If no sinks are configured, the primary backend is used directly.
+ * A sink that can't be created is skipped, since sinks should never prevent a job from running.
+ */
+func withSinks(primary Backend, options LoggerOptions) (Backend, error) {
+	if len(options.Sinks) == 0 {
+		return primary, nil
+	}
+
+	sinks := []NamedBackend{}
+	for _, config := range options.Sinks {
+		backend, err := createSink(options, config)
+		if err != nil {
+			log.Errorf("Error creating job log sink '%s' - skipping it: %v", config, err)
+			continue
+		}
+
+		sinks = append(sinks, NamedBackend{Name: config.String(), Backend: backend})
+	}
+
+	return NewMultiBackend(primary, sinks)
+}
@@ -0,0 +1,195 @@
+package eventlogger
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// Keep the beginning of the logs, and drop everything after the limit.
+	TrimStrategyHead = "head"
+
+	// Keep the beginning and the end of the logs, and drop what's in the middle.
+	// The end of the logs is usually where the failure is.
+	TrimStrategyHeadAndTail = "head-and-tail"
+)
+
+/*
+ * TailBuffer keeps the most recent serialized events in memory,
+ * up to maxSizeInBytes. When a new event does not fit,
+ * the oldest events are dropped until it does.
+ */
+type TailBuffer struct {
+	maxSizeInBytes int
+	size           int
+	events         [][]byte
+	active         bool
+	omittedEvents  int
+	omittedBytes   int
+	trimmed        bool
+}
+
+func NewTailBuffer(maxSizeInBytes int) *TailBuffer {
+	return &TailBuffer{maxSizeInBytes: maxSizeInBytes, events: [][]byte{}}
+}
+
+/*
+ * Creates the tail buffer for a backend using TrimStrategyHeadAndTail.
+ * If tailSizeInBytes is not specified, half of maxSizeInBytes is used.
+ */
+func newTailBufferFor(maxSizeInBytes, tailSizeInBytes int) (*TailBuffer, error) {
+	if maxSizeInBytes <= 1 {
+		return nil, fmt.Errorf("options.MaxSizeInBytes must be greater than 1 when using '%s'", TrimStrategyHeadAndTail)
+	}
+
+	if tailSizeInBytes == 0 {
+		tailSizeInBytes = maxSizeInBytes / 2
+	}
+
+	if tailSizeInBytes < 1 || tailSizeInBytes >= maxSizeInBytes {
+		return nil, fmt.Errorf("options.TailSizeInBytes must be between 1 and %d", maxSizeInBytes-1)
+	}
+
+	return NewTailBuffer(tailSizeInBytes), nil
+}
+
+func (b *TailBuffer) Append(event []byte) {
+	b.active = true
+	b.events = append(b.events, event)
+	b.size += len(event)
+	b.Fit(b.maxSizeInBytes)
+}
+
+/*
+ * Drops the oldest events until the buffer fits in maxSizeInBytes.
+ * If the newest event alone does not fit, the beginning of its output is cut instead,
+ * so the end of the logs is never lost completely.
+ * What is dropped is included in the next truncation marker.
+ */
+func (b *TailBuffer) Fit(maxSizeInBytes int) {
+	for b.size > maxSizeInBytes && len(b.events) > 1 {
+		b.drop()
+	}
+
+	if b.size <= maxSizeInBytes || len(b.events) == 0 {
+		return
+	}
+
+	event := b.events[0]
+	truncated := truncateOutputEvent(event, maxSizeInBytes)
+	if truncated == nil {
+		b.drop()
+		return
+	}
+
+	b.events[0] = truncated
+	b.size = len(truncated)
+	b.omittedBytes += len(event) - len(truncated)
+	b.trimmed = true
+}
+
+func (b *TailBuffer) drop() {
+	dropped := b.events[0]
+	b.events = b.events[1:]
+	b.size -= len(dropped)
+	b.omittedEvents++
+	b.omittedBytes += len(dropped)
+	b.trimmed = true
+}
+
+/*
+ * Cuts the beginning of the output of a serialized cmd_output event,
+ * until the event fits in maxSizeInBytes. Returns nil for other events,
+ * or if the event does not fit even without any output.
+ */
+func truncateOutputEvent(event []byte, maxSizeInBytes int) []byte {
+	var outputEvent CommandOutputEvent
+	if err := json.Unmarshal(event, &outputEvent); err != nil || outputEvent.Event != "cmd_output" {
+		return nil
+	}
+
+	for {
+		jsonBytes, err := json.Marshal(&outputEvent)
+		if err != nil {
+			return nil
+		}
+
+		jsonBytes = append(jsonBytes, '\n')
+		excess := len(jsonBytes) - maxSizeInBytes
+		if excess <= 0 {
+			return jsonBytes
+		}
+
+		if outputEvent.Output == "" {
+			return nil
+		}
+
+		// Escaped characters take more space in the event than in the output,
+		// so cutting the excess might not be enough, and we need to go again.
+		outputEvent.Output = cutBeginning(outputEvent.Output, excess)
+	}
+}
+
+// Cuts at least n bytes from the beginning of s, without splitting a character.
+func cutBeginning(s string, n int) string {
+	if n >= len(s) {
+		return ""
+	}
+
+	for n < len(s) && !utf8.RuneStart(s[n]) {
+		n++
+	}
+
+	return s[n:]
+}
+
+// Active returns true if events were appended since the last drain.
+func (b *TailBuffer) Active() bool {
+	return b.active
+}
+
+// Omitted returns how many events and bytes were dropped since the last drain.
+func (b *TailBuffer) Omitted() (int, int) {
+	return b.omittedEvents, b.omittedBytes
+}
+
+// TruncationMarker returns the serialized output_truncated event
+// that should go before the events in the buffer, or nil if nothing was dropped since the last drain.
+func (b *TailBuffer) TruncationMarker() ([]byte, error) {
+	if b.omittedEvents == 0 && b.omittedBytes == 0 {
+		return nil, nil
+	}
+
+	now := time.Now()
+	marker, err := json.Marshal(&OutputTruncatedEvent{
+		Event:         "output_truncated",
+		Timestamp:     int(now.Unix()),
+		TimestampMs:   now.UnixMilli(),
+		OmittedEvents: b.omittedEvents,
+		OmittedBytes:  b.omittedBytes,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return append(marker, '\n'), nil
+}
+
+// Trimmed returns true if any event was ever dropped from the buffer.
+func (b *TailBuffer) Trimmed() bool {
+	return b.trimmed
+}
+
+// Drain returns all the events in the buffer, and empties it.
+func (b *TailBuffer) Drain() [][]byte {
+	events := b.events
+	b.events = [][]byte{}
+	b.size = 0
+	b.active = false
+	b.omittedEvents = 0
+	b.omittedBytes = 0
+	return events
+}
@@ -0,0 +1,70 @@
+package eventlogger
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test__TailBuffer(t *testing.T) {
+	outputEvent := func(output string) []byte {
+		jsonBytes, err := json.Marshal(&CommandOutputEvent{Event: "cmd_output", Timestamp: 1, Output: output})
+		require.NoError(t, err)
+		return append(jsonBytes, '\n')
+	}
+
+	t.Run("drops the oldest events", func(t *testing.T) {
+		buffer := NewTailBuffer(150)
+		buffer.Append(outputEvent("first\n"))
+		buffer.Append(outputEvent("second\n"))
+		buffer.Append(outputEvent("third\n"))
+
+		events := buffer.Drain()
+		require.Len(t, events, 2)
+		assert.Contains(t, string(events[0]), "second")
+		assert.Contains(t, string(events[1]), "third")
+	})
+
+	t.Run("cuts the beginning of the output of an event bigger than the buffer", func(t *testing.T) {
+		buffer := NewTailBuffer(100)
+		buffer.Append(outputEvent("first\n"))
+		buffer.Append(outputEvent(strings.Repeat("a", 200) + "\tlast line\n"))
+
+		marker, err := buffer.TruncationMarker()
+		require.NoError(t, err)
+		assert.Contains(t, string(marker), `"omitted_events":1`)
+
+		events := buffer.Drain()
+		require.Len(t, events, 1)
+		assert.LessOrEqual(t, len(events[0]), 100)
+
+		var event CommandOutputEvent
+		require.NoError(t, json.Unmarshal(events[0], &event))
+		assert.True(t, strings.HasSuffix(event.Output, "aaa\tlast line\n"))
+	})
+
+	t.Run("does not split characters", func(t *testing.T) {
+		buffer := NewTailBuffer(80)
+		buffer.Append(outputEvent(strings.Repeat("é", 100)))
+
+		events := buffer.Drain()
+		require.Len(t, events, 1)
+
+		var event CommandOutputEvent
+		require.NoError(t, json.Unmarshal(events[0], &event))
+		assert.NotEmpty(t, event.Output)
+		assert.Equal(t, strings.Repeat("é", len(event.Output)/2), event.Output)
+	})
+
+	t.Run("drops other events bigger than the buffer", func(t *testing.T) {
+		jsonBytes, err := json.Marshal(&CommandStartedEvent{Event: "cmd_started", Timestamp: 1, Directive: strings.Repeat("a", 200)})
+		require.NoError(t, err)
+
+		buffer := NewTailBuffer(100)
+		buffer.Append(append(jsonBytes, '\n'))
+		assert.Empty(t, buffer.Drain())
+	})
+}
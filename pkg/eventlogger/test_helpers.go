@@ -22,9 +22,35 @@ func TransformToObjects(events []string) ([]interface{}, error) {
 		case eventType == "cmd_started":
 			objects = append(objects, &CommandStartedEvent{Event: eventType, Directive: object["directive"].(string)})
 		case eventType == "cmd_output":
-			objects = append(objects, &CommandOutputEvent{Event: eventType, Output: object["output"].(string)})
+			stream, _ := object["stream"].(string)
+			objects = append(objects, &CommandOutputEvent{Event: eventType, Output: object["output"].(string), Stream: stream})
 		case eventType == "cmd_finished":
-			objects = append(objects, &CommandFinishedEvent{Event: eventType, ExitCode: int(object["exit_code"].(float64))})
+			signal, _ := object["signal"].(string)
+			oomKilled, _ := object["oom_killed"].(bool)
+			objects = append(objects, &CommandFinishedEvent{Event: eventType, ExitCode: int(object["exit_code"].(float64)), Signal: signal, OOMKilled: oomKilled})
+		case eventType == "env_changed":
+			envChanged := &EnvironmentChangedEvent{}
+			if err := json.Unmarshal([]byte(event), envChanged); err != nil {
+				return []interface{}{}, err
+			}
+
+			objects = append(objects, envChanged)
+		case eventType == "attach_started":
+			attachStarted := &AttachStartedEvent{}
+			if err := json.Unmarshal([]byte(event), attachStarted); err != nil {
+				return []interface{}{}, err
+			}
+
+			objects = append(objects, attachStarted)
+		case eventType == "attach_finished":
+			attachFinished := &AttachFinishedEvent{}
+			if err := json.Unmarshal([]byte(event), attachFinished); err != nil {
+				return []interface{}{}, err
+			}
+
+			objects = append(objects, attachFinished)
+		case eventType == "output_truncated":
+			objects = append(objects, &OutputTruncatedEvent{Event: eventType, OmittedEvents: int(object["omitted_events"].(float64))})
 		}
 	}
 
@@ -66,7 +92,19 @@ func SimplifyLogEvents(events []interface{}, options SimplifyOptions) ([]string,
 				output = ""
 			}
 
-			simplified = append(simplified, fmt.Sprintf("Exit Code: %d", e.ExitCode))
+			if e.Signal != "" {
+				simplified = append(simplified, fmt.Sprintf("Exit Code: %d (%s)", e.ExitCode, e.Signal))
+			} else {
+				simplified = append(simplified, fmt.Sprintf("Exit Code: %d", e.ExitCode))
+			}
+		case *OutputTruncatedEvent:
+			simplified = append(simplified, fmt.Sprintf("output_truncated: %d events", e.OmittedEvents))
+		case *EnvironmentChangedEvent:
+			simplified = append(simplified, fmt.Sprintf("env_changed: added=%v changed=%v removed=%v directory=%s", e.Added, e.Changed, e.Removed, e.Directory))
+		case *AttachStartedEvent:
+			simplified = append(simplified, fmt.Sprintf("attach_started: %s", e.User))
+		case *AttachFinishedEvent:
+			simplified = append(simplified, fmt.Sprintf("attach_finished: %s, exit code %d", e.User, e.ExitCode))
 		default:
 			return []string{}, fmt.Errorf("unknown shell event")
 		}
@@ -0,0 +1,120 @@
+package executors
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	shell "github.com/semaphoreci/agent/pkg/shell"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+ * Executors that allow an additional interactive shell to be opened
+ * in the same context the job commands run in - same host, container or pod -
+ * with the job's environment variables loaded. Used for debugging running jobs.
+ */
+type Attachable interface {
+	// Starts the interactive shell, in a terminal of the given size.
+	Attach(cols, rows uint16) (AttachedShell, error)
+}
+
+/*
+ * The interactive shell started for an attach session.
+ * Reading and writing go to its terminal.
+ */
+type AttachedShell interface {
+	io.ReadWriteCloser
+
+	Resize(cols, rows uint16) error
+
+	// Waits for the shell to exit, and returns its exit code.
+	Wait() int
+
+	// Ends the shell, making Wait() return.
+	Kill() error
+}
+
+/*
+ * Most executors attach by starting a command in the agent's host,
+ * which opens the shell in the job's context, e.g. through "podman exec".
+ */
+type attachedCommand struct {
+	cmd *exec.Cmd
+	tty *os.File
+}
+
+func startAttachedCommand(cmd *exec.Cmd, cols, rows uint16) (AttachedShell, error) {
+	tty, err := shell.StartPTYWithSize(cmd, cols, rows)
+	if err != nil {
+		return nil, err
+	}
+
+	return &attachedCommand{cmd: cmd, tty: tty}, nil
+}
+
+func (a *attachedCommand) Read(p []byte) (int, error) {
+	return a.tty.Read(p)
+}
+
+func (a *attachedCommand) Write(p []byte) (int, error) {
+	return a.tty.Write(p)
+}
+
+func (a *attachedCommand) Close() error {
+	return a.tty.Close()
+}
+
+func (a *attachedCommand) Resize(cols, rows uint16) error {
+	return shell.ResizePTY(a.tty, cols, rows)
+}
+
+func (a *attachedCommand) Wait() int {
+	err := a.cmd.Wait()
+	if err == nil {
+		return 0
+	}
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		log.Errorf("Error waiting for attached shell: %v", err)
+		return 1
+	}
+
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+
+	return exitErr.ExitCode()
+}
+
+func (a *attachedCommand) Kill() error {
+	err := a.cmd.Process.Kill()
+	if err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return err
+	}
+
+	return nil
+}
+
+/*
+ * The script used to start an attached shell.
+ * The environment files are sourced first, and then, the interactive shell
+ * replaces the one running the script, so it receives the signals directly.
+ */
+func attachScript(adapter shell.Adapter, envFiles []string, executable string, args []string) string {
+	if len(args) == 0 {
+		args = adapter.DefaultArgs()
+	}
+
+	instructions := []string{}
+	for _, envFile := range envFiles {
+		instructions = append(instructions, adapter.Source(envFile))
+	}
+
+	instructions = append(instructions, strings.Join(append([]string{"exec", executable}, args...), " "))
+	return strings.Join(instructions, "; ")
+}
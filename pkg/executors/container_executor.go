@@ -0,0 +1,469 @@
+package executors
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"time"
+
+	api "github.com/semaphoreci/agent/pkg/api"
+	"github.com/semaphoreci/agent/pkg/config"
+	"github.com/semaphoreci/agent/pkg/docker"
+	eventlogger "github.com/semaphoreci/agent/pkg/eventlogger"
+	shell "github.com/semaphoreci/agent/pkg/shell"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+ * What the executors managing the job containers themselves - docker and podman -
+ * have in common. They embed it, and only differ in how the containers
+ * are created, and in how files are written into the main container.
+ */
+type containerExecutor struct {
+	Logger     *eventlogger.Logger
+	Shell      *shell.Shell
+	jobRequest *api.JobRequest
+
+	tmpDirectory        string
+	envTmpfsPath        string
+	dockerConfiguration api.Compose
+	resourcePrefix      string
+	mainContainerName   string
+	exposeKvmDevice     bool
+	fileInjections      []config.FileInjection
+	failOnMissingFiles  bool
+	shellExecutable     string
+	shellArgs           []string
+	outputLimits        shell.OutputLimits
+	terminal            shell.Terminal
+	lastTermination     *shell.Termination
+
+	// Writes a file in the main container without writing it to the host's disk first.
+	// The file should only be readable by the container's user.
+	writeFile func(path string, content []byte) error
+}
+
+type containerExecutorOptions struct {
+	ExposeKvmDevice    bool
+	FileInjections     []config.FileInjection
+	FailOnMissingFiles bool
+	ShellExecutable    string
+	ShellArgs          []string
+	OutputLimits       shell.OutputLimits
+	Terminal           shell.Terminal
+}
+
+func newContainerExecutor(request *api.JobRequest, logger *eventlogger.Logger, options containerExecutorOptions) containerExecutor {
+	return containerExecutor{
+		Logger:              logger,
+		jobRequest:          request,
+		envTmpfsPath:        ContainerEnvTmpfsPath,
+		dockerConfiguration: request.Compose,
+		exposeKvmDevice:     options.ExposeKvmDevice,
+		fileInjections:      options.FileInjections,
+		failOnMissingFiles:  options.FailOnMissingFiles,
+		shellExecutable:     options.ShellExecutable,
+		shellArgs:           options.ShellArgs,
+		outputLimits:        options.OutputLimits,
+		terminal:            options.Terminal,
+	}
+}
+
+func (e *containerExecutor) envFileName() string {
+	return filepath.Join(e.envTmpfsPath, ".env")
+}
+
+func (e *containerExecutor) containerShell() string {
+	if e.shellExecutable == "" {
+		return shell.ShellBash
+	}
+
+	return e.shellExecutable
+}
+
+/*
+ * Containers are named after the job, so they don't clash
+ * with the ones from other jobs running in the same host.
+ */
+func (e *containerExecutor) containerName(name string) string {
+	return e.resourcePrefix + "-" + name
+}
+
+/*
+ * The script for the attached shell, which runs in the main container,
+ * with the job's environment file sourced.
+ */
+func (e *containerExecutor) attachShellScript() (string, error) {
+	if e.Shell == nil {
+		return "", fmt.Errorf("the job container is not running")
+	}
+
+	return attachScript(e.Shell.Adapter, []string{e.envFileName()}, e.containerShell(), e.shellArgs), nil
+}
+
+func (e *containerExecutor) prepare(executorName string) int {
+	if runtime.GOOS == "windows" {
+		log.Errorf("%s executor is not supported in Windows", executorName)
+		return 1
+	}
+
+	if len(e.dockerConfiguration.Containers) == 0 {
+		log.Errorf("No containers specified for the %s executor", executorName)
+		return 1
+	}
+
+	/*
+	 * The directory is created for the job, and mounted in the main container.
+	 * Since the container user may not be the agent's user, the directory
+	 * is readable by everyone, so the container can read the commands written into it.
+	 * The environment variables and files for the job are not written into it,
+	 * but into an in-memory filesystem in the container, by the container's user.
+	 */
+	tmpDirectory, err := os.MkdirTemp("", "semaphore-job-")
+	if err != nil {
+		log.Errorf("Error creating temporary directory: %v", err)
+		return 1
+	}
+
+	e.tmpDirectory = tmpDirectory
+
+	// #nosec
+	err = os.Chmod(e.tmpDirectory, 0755)
+	if err != nil {
+		log.Errorf("Error changing permissions of temporary directory: %v", err)
+		return 1
+	}
+
+	e.resourcePrefix = filepath.Base(e.tmpDirectory)
+	if e.jobRequest.JobID != "" {
+		e.resourcePrefix = "semaphore-job-" + e.jobRequest.JobID
+	}
+
+	e.mainContainerName = e.containerName(e.dockerConfiguration.Containers[0].Name)
+
+	err = e.executeHostCommands()
+	if err != nil {
+		return 1
+	}
+
+	filesToInject, err := e.findValidFilesToInject()
+	if err != nil {
+		log.Errorf("Error injecting files: %v", err)
+		return 1
+	}
+
+	e.fileInjections = filesToInject
+	return 0
+}
+
+func (e *containerExecutor) findValidFilesToInject() ([]config.FileInjection, error) {
+	filesToInject := []config.FileInjection{}
+	for _, fileInjection := range e.fileInjections {
+		err := fileInjection.CheckFileExists()
+		if err == nil {
+			filesToInject = append(filesToInject, fileInjection)
+		} else {
+			if e.failOnMissingFiles {
+				return nil, err
+			}
+
+			log.Warningf("Error injecting file %s - ignoring it: %v", fileInjection.HostPath, err)
+		}
+	}
+
+	return filesToInject, nil
+}
+
+func (e *containerExecutor) executeHostCommands() error {
+	for _, c := range e.dockerConfiguration.HostSetupCommands {
+		log.Debug("Executing Host Command:", c.Directive)
+
+		// #nosec
+		cmd := exec.Command("bash", "-c", c.Directive)
+
+		out, err := cmd.CombinedOutput()
+		log.Debug(string(out))
+
+		if err != nil {
+			log.Errorf("Error: %v", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e *containerExecutor) setUpSSHJumpPoint(script string) int {
+	err := InjectEntriesToAuthorizedKeys(e.jobRequest.SSHPublicKeys)
+	if err != nil {
+		log.Errorf("Failed to inject authorized keys: %+v", err)
+		return 1
+	}
+
+	err = SetUpSSHJumpPoint(script)
+	if err != nil {
+		log.Errorf("Failed to set up SSH jump point: %+v", err)
+		return 1
+	}
+
+	return 0
+}
+
+/*
+ * Resolves the credentials for the registries the images are pulled from,
+ * and gives them to the executor, which decides how they reach the container runtime.
+ */
+func (e *containerExecutor) setUpImagePullCredentials(use func(*docker.DockerConfig) error) int {
+	if len(e.dockerConfiguration.ImagePullCredentials) == 0 {
+		return 0
+	}
+
+	directive := "Setting up image pull credentials"
+	commandStartedAt := time.Now()
+	exitCode := 0
+	e.Logger.LogCommandStarted(directive)
+
+	defer func() {
+		e.Logger.LogCommandFinished(directive, exitCode, commandStartedAt, time.Now())
+	}()
+
+	dockerConfig, err := docker.NewDockerConfig(e.dockerConfiguration.ImagePullCredentials)
+	if err != nil {
+		e.Logger.LogCommandOutput(fmt.Sprintf("Failed to resolve image pull credentials: %v\n", err))
+		exitCode = 1
+		return exitCode
+	}
+
+	servers := []string{}
+	for server := range dockerConfig.Auths {
+		servers = append(servers, server)
+	}
+
+	sort.Strings(servers)
+	for _, server := range servers {
+		e.Logger.LogCommandOutput(fmt.Sprintf("Setting up credentials for %s\n", server))
+	}
+
+	err = use(dockerConfig)
+	if err != nil {
+		e.Logger.LogCommandOutput(fmt.Sprintf("Failed to set up image pull credentials: %v\n", err))
+		exitCode = 1
+		return exitCode
+	}
+
+	return exitCode
+}
+
+/*
+ * Only the images not present locally are pulled,
+ * so customers can use cached images.
+ */
+func (e *containerExecutor) pullImages(directive string, pullImage func(image string) error) int {
+	log.Debug("Pulling images")
+	commandStartedAt := time.Now()
+	exitCode := 0
+	e.Logger.LogCommandStarted(directive)
+
+	defer func() {
+		e.Logger.LogCommandFinished(directive, exitCode, commandStartedAt, time.Now())
+	}()
+
+	pulled := map[string]bool{}
+	for _, container := range e.dockerConfiguration.Containers {
+		if pulled[container.Image] {
+			continue
+		}
+
+		pulled[container.Image] = true
+		err := pullImage(container.Image)
+		if err != nil {
+			log.Errorf("Pull failed: %v", err)
+			e.Logger.LogCommandOutput(err.Error() + "\n")
+			exitCode = 1
+			return exitCode
+		}
+	}
+
+	log.Infof("Pull finished. Exit Code: %d", exitCode)
+	return exitCode
+}
+
+func (e *containerExecutor) ExportEnvVars(envVars []api.EnvVar, hostEnvVars []config.HostEnvVar) int {
+	commandStartedAt := time.Now()
+	directive := "Exporting environment variables"
+	exitCode := 0
+
+	e.Logger.LogCommandStarted(directive)
+
+	defer func() {
+		e.Logger.LogCommandFinished(directive, exitCode, commandStartedAt, time.Now())
+	}()
+
+	environment, err := shell.CreateEnvironment(envVars, hostEnvVars)
+	if err != nil {
+		log.Errorf("Error creating environment: %v", err)
+		exitCode = 1
+		return exitCode
+	}
+
+	envFileName := e.envFileName()
+	err = e.writeFile(envFileName, []byte(environment.ToScriptFor(e.Shell.Adapter, func(name string) {
+		e.Logger.LogCommandOutput(fmt.Sprintf("Exporting %s\n", name))
+	})))
+
+	if err != nil {
+		log.Errorf("Error writing environment file: %v", err)
+		exitCode = 255
+		return exitCode
+	}
+
+	cmd := e.Shell.Adapter.Source(envFileName)
+	exitCode = e.RunCommand(cmd, true, "")
+	if exitCode != 0 {
+		return exitCode
+	}
+
+	cmd = fmt.Sprintf("echo '%s' >> %s", cmd, e.Shell.Adapter.ProfilePath())
+	exitCode = e.RunCommand(cmd, true, "")
+	return exitCode
+}
+
+func (e *containerExecutor) InjectFiles(files []api.File) int {
+	directive := "Injecting Files"
+	commandStartedAt := time.Now()
+	exitCode := 0
+
+	e.Logger.LogCommandStarted(directive)
+
+	defer func() {
+		e.Logger.LogCommandFinished(directive, exitCode, commandStartedAt, time.Now())
+	}()
+
+	for _, f := range files {
+		e.Logger.LogCommandOutput(fmt.Sprintf("Injecting %s with file mode %s\n", f.Path, f.Mode))
+
+		content, err := f.Decode()
+		if err != nil {
+			e.Logger.LogCommandOutput("Failed to decode the content of the file.\n")
+			exitCode = 1
+			return exitCode
+		}
+
+		tmpPath := filepath.Join(e.envTmpfsPath, "file")
+		err = e.writeFile(tmpPath, content)
+		if err != nil {
+			e.Logger.LogCommandOutput(err.Error() + "\n")
+			exitCode = 255
+			return exitCode
+		}
+
+		destPath := f.Path
+		if f.Path[0] != '/' && f.Path[0] != '~' {
+			destPath = "~/" + f.Path
+		}
+
+		exitCode = e.RunCommand(fmt.Sprintf("mkdir -p %s", path.Dir(destPath)), true, "")
+		if exitCode != 0 {
+			e.Logger.LogCommandOutput(fmt.Sprintf("Failed to create destination path %s\n", destPath))
+			return exitCode
+		}
+
+		exitCode = e.RunCommand(fmt.Sprintf("cp %s %s", tmpPath, destPath), true, "")
+		if exitCode != 0 {
+			e.Logger.LogCommandOutput(fmt.Sprintf("Failed to move to destination path %s %s\n", tmpPath, destPath))
+			return exitCode
+		}
+
+		exitCode = e.RunCommand(fmt.Sprintf("chmod %s %s", f.Mode, destPath), true, "")
+		if exitCode != 0 {
+			e.Logger.LogCommandOutput(fmt.Sprintf("Failed to set file mode to %s\n", f.Mode))
+			return exitCode
+		}
+	}
+
+	return exitCode
+}
+
+func (e *containerExecutor) GetOutputFromCommand(command string) (string, int) {
+	out := bytes.Buffer{}
+	p := e.Shell.NewProcessWithOutput(command, func(output string) {
+		out.WriteString(output)
+	})
+
+	p.Run()
+	return out.String(), p.ExitCode
+}
+
+func (e *containerExecutor) RunCommand(command string, silent bool, alias string) int {
+	return e.RunCommandWithOptions(CommandOptions{
+		Command: command,
+		Silent:  silent,
+		Alias:   alias,
+		Warning: "",
+	})
+}
+
+func (e *containerExecutor) RunCommandWithOptions(options CommandOptions) int {
+	directive := options.Command
+	if options.Alias != "" {
+		directive = options.Alias
+	}
+
+	outputLimits := e.outputLimits
+	if options.Silent {
+		outputLimits = shell.OutputLimits{}
+	}
+
+	p := e.Shell.NewProcessWithConfig(shell.Config{
+		Command:      options.Command,
+		Shell:        e.Shell,
+		StoragePath:  e.Shell.StoragePath,
+		OutputLimits: outputLimits,
+		OnOutput: func(output string) {
+			if !options.Silent {
+				e.Logger.LogCommandOutput(output)
+			}
+		},
+	})
+
+	if !options.Silent {
+		e.Logger.LogCommandStarted(directive)
+
+		if options.Alias != "" {
+			e.Logger.LogCommandOutput(fmt.Sprintf("Running: %s\n", options.Command))
+		}
+
+		if options.Warning != "" {
+			e.Logger.LogCommandOutput(fmt.Sprintf("Warning: %s\n", options.Warning))
+		}
+	}
+
+	p.Run()
+	e.lastTermination = p.Termination
+
+	if !options.Silent {
+		e.Logger.LogCommandFinishedWithTermination(directive, p.ExitCode, p.StartedAt, p.FinishedAt, commandTermination(p.Termination))
+	}
+
+	return p.ExitCode
+}
+
+func (e *containerExecutor) LastCommandTermination() *shell.Termination {
+	return e.lastTermination
+}
+
+func (e *containerExecutor) closeShell() {
+	log.Debug("Starting the process killing procedure")
+
+	if e.Shell != nil {
+		err := e.Shell.Close()
+		if err != nil {
+			log.Errorf("Process killing procedure returned an error %+v\n", err)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package executors
+
+/*
+ * Where the in-memory filesystem for the job's environment and files
+ * is mounted in the main container. Anyone can write to it, like /tmp,
+ * since we don't know which user the container uses, but the files
+ * written into it are only readable by the user that writes them.
+ */
+const ContainerEnvTmpfsPath = "/run/semaphore-env"
+const ContainerEnvTmpfsOptions = "mode=1777"
+
+/*
+ * The command executed in the container to write a file from its stdin.
+ * Since it runs as the container's user, the file is owned by that user,
+ * and it never touches the host's disk.
+ */
+func writeFileInContainerArgs(filePath string) []string {
+	return []string{"sh", "-c", `umask 077 && cat > "$0"`, filePath}
+}
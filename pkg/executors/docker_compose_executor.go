@@ -36,12 +36,33 @@ type DockerComposeExecutor struct {
 	exposeKvmDevice           bool
 	fileInjections            []config.FileInjection
 	FailOnMissingFiles        bool
+	shellExecutable           string
+	shellArgs                 []string
+	outputLimits              shell.OutputLimits
+	terminal                  shell.Terminal
+	envInTmpfs                bool
+	lastTermination           *shell.Termination
 }
 
 type DockerComposeExecutorOptions struct {
 	ExposeKvmDevice    bool
 	FileInjections     []config.FileInjection
 	FailOnMissingFiles bool
+
+	// The shell started in the main container. If empty, bash is used.
+	ShellExecutable string
+	ShellArgs       []string
+
+	// Applied to what each command prints, as relayed by docker compose.
+	OutputLimits shell.OutputLimits
+
+	// docker compose gives the container the size of its own PTY, and TERM is passed with -e.
+	Terminal shell.Terminal
+
+	// Deliver the environment variables and files through an in-memory filesystem
+	// mounted in the main container, instead of files in the host.
+	// Without it, only containers running as root or as the agent's user can read them.
+	EnvInTmpfs bool
 }
 
 func NewDockerComposeExecutor(request *api.JobRequest, logger *eventlogger.Logger, options DockerComposeExecutorOptions) *DockerComposeExecutor {
@@ -52,22 +73,82 @@ func NewDockerComposeExecutor(request *api.JobRequest, logger *eventlogger.Logge
 		exposeKvmDevice:           options.ExposeKvmDevice,
 		fileInjections:            options.FileInjections,
 		FailOnMissingFiles:        options.FailOnMissingFiles,
+		shellExecutable:           options.ShellExecutable,
+		shellArgs:                 options.ShellArgs,
+		outputLimits:              options.OutputLimits,
+		terminal:                  options.Terminal,
+		envInTmpfs:                options.EnvInTmpfs,
 		dockerComposeManifestPath: "/tmp/docker-compose.yml",
-		tmpDirectory:              "/tmp/agent-temp-directory", // make a better random name
 
 		// during testing the name main gets taken up, if we make it random we avoid headaches
 		mainContainerName: request.Compose.Containers[0].Name,
 	}
 }
 
+func (e *DockerComposeExecutor) envFileName() string {
+	if e.envInTmpfs {
+		return filepath.Join(ContainerEnvTmpfsPath, ".env")
+	}
+
+	return filepath.Join(e.tmpDirectory, ".env")
+}
+
+func (e *DockerComposeExecutor) containerShell() string {
+	if e.shellExecutable == "" {
+		return shell.ShellBash
+	}
+
+	return e.shellExecutable
+}
+
+func (e *DockerComposeExecutor) Attach(cols, rows uint16) (AttachedShell, error) {
+	cmd, err := e.AttachCommand()
+	if err != nil {
+		return nil, err
+	}
+
+	return startAttachedCommand(cmd, cols, rows)
+}
+
+/*
+ * The attached shell runs in the main container, with the job's environment file sourced.
+ */
+func (e *DockerComposeExecutor) AttachCommand() (*exec.Cmd, error) {
+	if e.Shell == nil {
+		return nil, fmt.Errorf("the job container is not running")
+	}
+
+	script := attachScript(e.Shell.Adapter, []string{e.envFileName()}, e.containerShell(), e.shellArgs)
+
+	// #nosec
+	return exec.Command("docker", "exec", "-i", "-t", e.mainContainerName, e.containerShell(), "-c", script), nil
+}
+
 func (e *DockerComposeExecutor) Prepare() int {
 	if runtime.GOOS == "windows" {
 		log.Error("docker-compose executor is not supported in Windows")
 		return 1
 	}
 
-	err := os.MkdirAll(e.tmpDirectory, os.ModePerm)
+	/*
+	 * The directory is created for the job, and mounted in the main container.
+	 * Since the container user may not be the agent's user, the directory
+	 * is readable by everyone, so the container can read the commands written into it.
+	 * The environment variables and files for the job are only written into it
+	 * if the in-memory filesystem is not used, and then, only the agent's user can read them.
+	 */
+	tmpDirectory, err := os.MkdirTemp("", "semaphore-job-")
+	if err != nil {
+		log.Errorf("Error creating temporary directory: %v", err)
+		return 1
+	}
+
+	e.tmpDirectory = tmpDirectory
+
+	// #nosec
+	err = os.Chmod(e.tmpDirectory, 0755)
 	if err != nil {
+		log.Errorf("Error changing permissions of temporary directory: %v", err)
 		return 1
 	}
 
@@ -91,7 +172,16 @@ func (e *DockerComposeExecutor) Prepare() int {
 		return 1
 	}
 
-	compose := ConstructDockerComposeFile(e.dockerConfiguration, e.exposeKvmDevice, filesToInject)
+	composeOptions := DockerComposeFileOptions{
+		ExposeKvmDevice: e.exposeKvmDevice,
+		FileInjections:  filesToInject,
+	}
+
+	if e.envInTmpfs {
+		composeOptions.TmpfsMounts = []string{ContainerEnvTmpfsPath + ":" + ContainerEnvTmpfsOptions}
+	}
+
+	compose := ConstructDockerComposeFileWithOptions(e.dockerConfiguration, composeOptions)
 	log.Debug("Compose File:")
 	log.Debug(compose)
 
@@ -151,34 +241,7 @@ func (e *DockerComposeExecutor) setUpSSHJumpPoint() int {
 		return 1
 	}
 
-	script := strings.Join([]string{
-		`#!/bin/bash`,
-		``,
-		`cd /tmp`,
-		``,
-		`echo -n "Waiting for the container to start up"`,
-		``,
-		`while true; do`,
-		`  docker exec -i ` + e.mainContainerName + ` true 2>/dev/null`,
-		``,
-		`  if [ $? == 0 ]; then`,
-		`    echo ""`,
-		``,
-		`    break`,
-		`  else`,
-		`    sleep 3`,
-		`    echo -n "."`,
-		`  fi`,
-		`done`,
-		``,
-		`if [ $# -eq 0 ]; then`,
-		`  docker exec -ti ` + e.mainContainerName + ` bash --login`,
-		`else`,
-		`  docker exec -i ` + e.mainContainerName + ` "$@"`,
-		`fi`,
-	}, "\n")
-
-	err = SetUpSSHJumpPoint(script)
+	err = SetUpSSHJumpPoint(cliSSHJumpPointScript("docker", e.mainContainerName))
 	if err != nil {
 		log.Errorf("Failed to set up SSH jump point: %+v", err)
 		return 1
@@ -214,19 +277,19 @@ func (e *DockerComposeExecutor) composeExecutableAndArgs() (string, []string) {
 }
 
 func (e *DockerComposeExecutor) startBashSession() int {
-	commandStartedAt := int(time.Now().Unix())
+	commandStartedAt := time.Now()
 	directive := "Starting the docker image..."
 	exitCode := 0
 
 	e.Logger.LogCommandStarted(directive)
 
 	defer func() {
-		commandFinishedAt := int(time.Now().Unix())
+		commandFinishedAt := time.Now()
 
 		e.Logger.LogCommandFinished(directive, exitCode, commandStartedAt, commandFinishedAt)
 	}()
 
-	e.Logger.LogCommandOutput("Starting a new bash session.\n")
+	e.Logger.LogCommandOutput(fmt.Sprintf("Starting a new %s session.\n", filepath.Base(e.containerShell())))
 
 	log.Debug("Starting stateful shell")
 
@@ -244,10 +307,21 @@ func (e *DockerComposeExecutor) startBashSession() int {
 		"/var/run/docker.sock:/var/run/docker.sock",
 		"-v",
 		fmt.Sprintf("%s:%s:ro", e.tmpDirectory, e.tmpDirectory),
-		e.mainContainerName,
-		"bash",
 	)
 
+	/*
+	 * The size of the container's terminal follows the size of the PTY
+	 * docker compose runs in, but TERM needs to be passed explicitly.
+	 */
+	if e.terminal.Type != "" {
+		args = append(args, "-e", "TERM="+e.terminal.Type)
+	}
+
+	args = append(args, e.mainContainerName, e.containerShell())
+
+	args = append(args, e.shellArgs...)
+	adapter := shell.AdapterFor(e.containerShell())
+
 	shell, err := shell.NewShellFromExecAndArgs(executable, args, e.tmpDirectory)
 	if err != nil {
 		log.Errorf("Failed to start stateful shell err: %+v", err)
@@ -259,6 +333,8 @@ func (e *DockerComposeExecutor) startBashSession() int {
 		return exitCode
 	}
 
+	shell.Adapter = adapter
+	shell.Terminal = e.terminal
 	err = shell.Start()
 	if err != nil {
 		log.Errorf("Failed to start stateful shell err: %+v", err)
@@ -281,7 +357,7 @@ func (e *DockerComposeExecutor) injectImagePullSecrets() int {
 	}
 
 	directive := "Setting up image pull credentials"
-	commandStartedAt := int(time.Now().Unix())
+	commandStartedAt := time.Now()
 	exitCode := 0
 	e.Logger.LogCommandStarted(directive)
 
@@ -315,7 +391,7 @@ func (e *DockerComposeExecutor) injectImagePullSecrets() int {
 		}
 	}
 
-	commandFinishedAt := int(time.Now().Unix())
+	commandFinishedAt := time.Now()
 	e.Logger.LogCommandFinished(directive, exitCode, commandStartedAt, commandFinishedAt)
 
 	return exitCode
@@ -444,7 +520,7 @@ func (e *DockerComposeExecutor) injectImagePullSecretsForGCR(envVars []api.EnvVa
 		tmpPath := fmt.Sprintf("%s/file", e.tmpDirectory)
 
 		// #nosec
-		err = ioutil.WriteFile(tmpPath, []byte(content), 0644)
+		err = ioutil.WriteFile(tmpPath, []byte(content), 0600)
 		if err != nil {
 			e.Logger.LogCommandOutput(err.Error() + "\n")
 			return 1
@@ -529,7 +605,7 @@ func (e *DockerComposeExecutor) injectImagePullSecretsForGCR(envVars []api.EnvVa
 func (e *DockerComposeExecutor) pullDockerImages() int {
 	log.Debug("Pulling docker images")
 	directive := "Pulling docker images..."
-	commandStartedAt := int(time.Now().Unix())
+	commandStartedAt := time.Now()
 	e.SubmitDockerStats("compose.docker.pull.rate")
 	e.Logger.LogCommandStarted(directive)
 
@@ -591,22 +667,22 @@ func (e *DockerComposeExecutor) pullDockerImages() int {
 
 	log.Infof("Docker pull finished. Exit Code: %d", exitCode)
 
-	commandFinishedAt := int(time.Now().Unix())
-	e.SubmitDockerPullTime(commandFinishedAt - commandStartedAt)
+	commandFinishedAt := time.Now()
+	e.SubmitDockerPullTime(int(commandFinishedAt.Sub(commandStartedAt).Seconds()))
 	e.Logger.LogCommandFinished(directive, exitCode, commandStartedAt, commandFinishedAt)
 
 	return exitCode
 }
 
 func (e *DockerComposeExecutor) ExportEnvVars(envVars []api.EnvVar, hostEnvVars []config.HostEnvVar) int {
-	commandStartedAt := int(time.Now().Unix())
+	commandStartedAt := time.Now()
 	directive := "Exporting environment variables"
 	exitCode := 0
 
 	e.Logger.LogCommandStarted(directive)
 
 	defer func() {
-		commandFinishedAt := int(time.Now().Unix())
+		commandFinishedAt := time.Now()
 
 		e.Logger.LogCommandFinished(directive, exitCode, commandStartedAt, commandFinishedAt)
 	}()
@@ -618,23 +694,30 @@ func (e *DockerComposeExecutor) ExportEnvVars(envVars []api.EnvVar, hostEnvVars
 		return exitCode
 	}
 
-	envFileName := filepath.Join(e.tmpDirectory, ".env")
-	err = environment.ToFile(envFileName, func(name string) {
+	envFileName := e.envFileName()
+	callback := func(name string) {
 		e.Logger.LogCommandOutput(fmt.Sprintf("Exporting %s\n", name))
-	})
+	}
+
+	if e.envInTmpfs {
+		err = e.writeFileInContainer(envFileName, environment.ToScriptFor(e.Shell.Adapter, callback))
+	} else {
+		err = environment.ToFileFor(envFileName, e.Shell.Adapter, callback)
+	}
 
 	if err != nil {
+		log.Errorf("Error writing environment file: %v", err)
 		exitCode = 255
 		return exitCode
 	}
 
-	cmd := fmt.Sprintf("source %s", envFileName)
+	cmd := e.Shell.Adapter.Source(envFileName)
 	exitCode = e.RunCommand(cmd, true, "")
 	if exitCode != 0 {
 		return exitCode
 	}
 
-	cmd = fmt.Sprintf("echo 'source %s' >> ~/.bash_profile", envFileName)
+	cmd = fmt.Sprintf("echo '%s' >> %s", cmd, e.Shell.Adapter.ProfilePath())
 	exitCode = e.RunCommand(cmd, true, "")
 	if exitCode != 0 {
 		return exitCode
@@ -643,9 +726,28 @@ func (e *DockerComposeExecutor) ExportEnvVars(envVars []api.EnvVar, hostEnvVars
 	return exitCode
 }
 
+/*
+ * Writes a file in the main container without writing it to the host's disk first.
+ * The file is only readable by the container's user.
+ */
+func (e *DockerComposeExecutor) writeFileInContainer(path, content string) error {
+	args := append([]string{"exec", "-i", e.mainContainerName}, writeFileInContainerArgs(path)...)
+
+	// #nosec
+	cmd := exec.Command("docker", args...)
+	cmd.Stdin = strings.NewReader(content)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error writing %s in container: %v - %s", path, err, output)
+	}
+
+	return nil
+}
+
 func (e *DockerComposeExecutor) InjectFiles(files []api.File) int {
 	directive := "Injecting Files"
-	commandStartedAt := int(time.Now().Unix())
+	commandStartedAt := time.Now()
 	exitCode := 0
 
 	e.Logger.LogCommandStarted(directive)
@@ -664,9 +766,14 @@ func (e *DockerComposeExecutor) InjectFiles(files []api.File) int {
 		}
 
 		tmpPath := fmt.Sprintf("%s/file", e.tmpDirectory)
+		if e.envInTmpfs {
+			tmpPath = filepath.Join(ContainerEnvTmpfsPath, "file")
+			err = e.writeFileInContainer(tmpPath, string(content))
+		} else {
+			// #nosec
+			err = ioutil.WriteFile(tmpPath, []byte(content), 0600)
+		}
 
-		// #nosec
-		err = ioutil.WriteFile(tmpPath, []byte(content), 0644)
 		if err != nil {
 			e.Logger.LogCommandOutput(err.Error() + "\n")
 			exitCode = 255
@@ -706,7 +813,7 @@ func (e *DockerComposeExecutor) InjectFiles(files []api.File) int {
 		}
 	}
 
-	commandFinishedAt := int(time.Now().Unix())
+	commandFinishedAt := time.Now()
 
 	e.Logger.LogCommandFinished(directive, exitCode, commandStartedAt, commandFinishedAt)
 
@@ -738,10 +845,21 @@ func (e *DockerComposeExecutor) RunCommandWithOptions(options CommandOptions) in
 		directive = options.Alias
 	}
 
-	p := e.Shell.NewProcessWithOutput(options.Command, func(output string) {
-		if !options.Silent {
-			e.Logger.LogCommandOutput(output)
-		}
+	outputLimits := e.outputLimits
+	if options.Silent {
+		outputLimits = shell.OutputLimits{}
+	}
+
+	p := e.Shell.NewProcessWithConfig(shell.Config{
+		Command:      options.Command,
+		Shell:        e.Shell,
+		StoragePath:  e.Shell.StoragePath,
+		OutputLimits: outputLimits,
+		OnOutput: func(output string) {
+			if !options.Silent {
+				e.Logger.LogCommandOutput(output)
+			}
+		},
 	})
 
 	if !options.Silent {
@@ -757,14 +875,19 @@ func (e *DockerComposeExecutor) RunCommandWithOptions(options CommandOptions) in
 	}
 
 	p.Run()
+	e.lastTermination = p.Termination
 
 	if !options.Silent {
-		e.Logger.LogCommandFinished(directive, p.ExitCode, p.StartedAt, p.FinishedAt)
+		e.Logger.LogCommandFinishedWithTermination(directive, p.ExitCode, p.StartedAt, p.FinishedAt, commandTermination(p.Termination))
 	}
 
 	return p.ExitCode
 }
 
+func (e *DockerComposeExecutor) LastCommandTermination() *shell.Termination {
+	return e.lastTermination
+}
+
 func (e *DockerComposeExecutor) Stop() int {
 	log.Debug("Starting the process killing procedure")
 
@@ -796,6 +919,10 @@ func (e *DockerComposeExecutor) Cleanup() int {
 		log.Errorf("Error removing docker resources: %v - %s", err, output)
 	}
 
+	if err := shell.RemoveSecretDirectory(e.tmpDirectory); err != nil {
+		log.Errorf("Error removing %s: %v", e.tmpDirectory, err)
+	}
+
 	return 0
 }
 
@@ -12,13 +12,30 @@ type DockerComposeFile struct {
 	configuration   api.Compose
 	exposeKvmDevice bool
 	fileInjections  []config.FileInjection
+	tmpfsMounts     []string
+}
+
+type DockerComposeFileOptions struct {
+	ExposeKvmDevice bool
+	FileInjections  []config.FileInjection
+
+	// In-memory filesystems mounted in the main container.
+	TmpfsMounts []string
 }
 
 func ConstructDockerComposeFile(conf api.Compose, exposeKvmDevice bool, fileInjections []config.FileInjection) string {
+	return ConstructDockerComposeFileWithOptions(conf, DockerComposeFileOptions{
+		ExposeKvmDevice: exposeKvmDevice,
+		FileInjections:  fileInjections,
+	})
+}
+
+func ConstructDockerComposeFileWithOptions(conf api.Compose, options DockerComposeFileOptions) string {
 	f := DockerComposeFile{
 		configuration:   conf,
-		exposeKvmDevice: exposeKvmDevice,
-		fileInjections:  fileInjections,
+		exposeKvmDevice: options.ExposeKvmDevice,
+		fileInjections:  options.FileInjections,
+		tmpfsMounts:     options.TmpfsMounts,
 	}
 	return f.Construct()
 }
@@ -97,5 +114,12 @@ func (f *DockerComposeFile) ServiceWithLinks(c api.Container, links []api.Contai
 		}
 	}
 
+	if len(f.tmpfsMounts) > 0 {
+		result += "    tmpfs:\n"
+		for _, mount := range f.tmpfsMounts {
+			result += fmt.Sprintf("      - %s\n", mount)
+		}
+	}
+
 	return result
 }
@@ -62,3 +62,27 @@ services:
 	compose := ConstructDockerComposeFile(conf, true, []config.FileInjection{})
 	assert.Equal(t, expected, compose)
 }
+
+func Test__DockerComposeFileConstructionWithTmpfs(t *testing.T) {
+	conf := api.Compose{
+		Containers: []api.Container{
+			{Name: "main", Image: "ruby:2.6"},
+		},
+	}
+
+	expected := `version: "2.0"
+
+services:
+  main:
+    image: ruby:2.6
+    tmpfs:
+      - /run/semaphore-env:mode=1777
+
+`
+
+	compose := ConstructDockerComposeFileWithOptions(conf, DockerComposeFileOptions{
+		TmpfsMounts: []string{"/run/semaphore-env:mode=1777"},
+	})
+
+	assert.Equal(t, expected, compose)
+}
@@ -0,0 +1,583 @@
+package executors
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	api "github.com/semaphoreci/agent/pkg/api"
+	"github.com/semaphoreci/agent/pkg/config"
+	"github.com/semaphoreci/agent/pkg/docker"
+	eventlogger "github.com/semaphoreci/agent/pkg/eventlogger"
+	shell "github.com/semaphoreci/agent/pkg/shell"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+ * Runs the job in containers, like the docker compose executor,
+ * but manages them through the Docker Engine API, without docker compose.
+ * The first container is the main one, where the commands run,
+ * and the others are started alongside it, in a network created for the job,
+ * reachable using their names as hostnames.
+ */
+type DockerExecutor struct {
+	containerExecutor
+
+	client          *docker.Client
+	socket          string
+	dockerConfig    *docker.DockerConfig
+	networkID       string
+	containerIDs    []string
+	mainContainerID string
+}
+
+type DockerExecutorOptions struct {
+	// The unix socket the Docker daemon listens on.
+	// If empty, docker.DefaultSocket is used.
+	Socket string
+
+	ExposeKvmDevice    bool
+	FileInjections     []config.FileInjection
+	FailOnMissingFiles bool
+
+	// The shell started in the main container. If empty, bash is used.
+	ShellExecutable string
+	ShellArgs       []string
+
+	// Applied to what each command prints in the main container.
+	OutputLimits shell.OutputLimits
+
+	// Applied to the TTY the Engine API allocates for the main container, and to its TERM.
+	Terminal shell.Terminal
+}
+
+// The label used to identify the resources created for a job.
+const DockerExecutorJobLabel = "com.semaphoreci.job"
+
+func NewDockerExecutor(request *api.JobRequest, logger *eventlogger.Logger, options DockerExecutorOptions) *DockerExecutor {
+	socket := options.Socket
+	if socket == "" {
+		socket = docker.DefaultSocket
+	}
+
+	e := &DockerExecutor{
+		containerExecutor: newContainerExecutor(request, logger, containerExecutorOptions{
+			ExposeKvmDevice:    options.ExposeKvmDevice,
+			FileInjections:     options.FileInjections,
+			FailOnMissingFiles: options.FailOnMissingFiles,
+			ShellExecutable:    options.ShellExecutable,
+			ShellArgs:          options.ShellArgs,
+			OutputLimits:       options.OutputLimits,
+			Terminal:           options.Terminal,
+		}),
+		client: docker.NewClient(socket),
+		socket: socket,
+	}
+
+	e.writeFile = e.writeFileInContainer
+	return e
+}
+
+func (e *DockerExecutor) Attach(cols, rows uint16) (AttachedShell, error) {
+	script, err := e.attachShellScript()
+	if err != nil {
+		return nil, err
+	}
+
+	config := docker.ExecConfig{
+		Cmd:          []string{e.containerShell(), "-c", script},
+		Tty:          true,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+	}
+
+	if e.terminal.Type != "" {
+		config.Env = []string{"TERM=" + e.terminal.Type}
+	}
+
+	id, err := e.client.CreateExec(e.mainContainerID, config)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := e.client.StartExec(id, true)
+	if err != nil {
+		return nil, err
+	}
+
+	attached := &dockerAttachedShell{client: e.client, execID: id, conn: conn, killed: make(chan struct{})}
+	err = attached.Resize(cols, rows)
+	if err != nil {
+		log.Warnf("Error resizing attached shell: %v", err)
+	}
+
+	return attached, nil
+}
+
+// How often we check if the attached shell exited.
+const DockerAttachPollInterval = 200 * time.Millisecond
+
+/*
+ * An attached shell exec'd in the main container through the Engine API.
+ * The API can't kill exec'd processes, so killing the shell only closes
+ * its connection; anything left running is removed with the container.
+ */
+type dockerAttachedShell struct {
+	client   *docker.Client
+	execID   string
+	conn     *docker.HijackedConn
+	killed   chan struct{}
+	killOnce sync.Once
+}
+
+func (a *dockerAttachedShell) Read(p []byte) (int, error) {
+	return a.conn.Read(p)
+}
+
+func (a *dockerAttachedShell) Write(p []byte) (int, error) {
+	return a.conn.Write(p)
+}
+
+func (a *dockerAttachedShell) Close() error {
+	return a.conn.Close()
+}
+
+func (a *dockerAttachedShell) Resize(cols, rows uint16) error {
+	return a.client.ResizeExec(a.execID, cols, rows)
+}
+
+func (a *dockerAttachedShell) Wait() int {
+	for {
+		select {
+		case <-a.killed:
+			return 137
+
+		case <-time.After(DockerAttachPollInterval):
+			state, err := a.client.InspectExec(a.execID)
+			if err != nil {
+				log.Errorf("Error waiting for attached shell: %v", err)
+				return 1
+			}
+
+			if !state.Running && state.ExitCode != nil {
+				return *state.ExitCode
+			}
+		}
+	}
+}
+
+func (a *dockerAttachedShell) Kill() error {
+	a.killOnce.Do(func() {
+		close(a.killed)
+	})
+
+	err := a.conn.Close()
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+
+	return nil
+}
+
+func (e *DockerExecutor) Prepare() int {
+	exitCode := e.prepare("docker")
+	if exitCode != 0 {
+		return exitCode
+	}
+
+	return e.setUpSSHJumpPoint(e.sshJumpPointScript())
+}
+
+/*
+ * The jump point opens the shell through the agent itself,
+ * since the docker CLI may not be available in the host.
+ */
+func (e *DockerExecutor) sshJumpPointScript() string {
+	agent, err := os.Executable()
+	if err != nil {
+		log.Warnf("Error finding the agent's executable: %v", err)
+		agent = "agent"
+	}
+
+	execCommand := fmt.Sprintf(`"%s" docker-exec "%s" %s`, agent, e.socket, e.mainContainerName)
+	ttyExecCommand := fmt.Sprintf(`"%s" docker-exec --tty "%s" %s`, agent, e.socket, e.mainContainerName)
+	return containerSSHJumpPointScript(execCommand, ttyExecCommand)
+}
+
+func (e *DockerExecutor) Start() int {
+	exitCode := e.setUpImagePullCredentials(e.keepImagePullCredentials)
+	if exitCode != 0 {
+		log.Error("Failed to set up image pull credentials")
+		return exitCode
+	}
+
+	exitCode = e.pullImages("Pulling docker images...", e.pullImage)
+	if exitCode != 0 {
+		log.Error("Failed to pull images")
+		return exitCode
+	}
+
+	return e.startContainers()
+}
+
+/*
+ * The credentials are not stored anywhere.
+ * They are sent to the Docker daemon with each pull request.
+ */
+func (e *DockerExecutor) keepImagePullCredentials(dockerConfig *docker.DockerConfig) error {
+	e.dockerConfig = dockerConfig
+	return nil
+}
+
+func (e *DockerExecutor) pullImage(image string) error {
+	exists, err := e.client.ImageExists(image)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		e.Logger.LogCommandOutput(fmt.Sprintf("Image %s is already present\n", image))
+		return nil
+	}
+
+	e.Logger.LogCommandOutput(fmt.Sprintf("Pulling %s...\n", image))
+
+	return e.client.PullImage(image, e.dockerConfig.RegistryAuthFor(image), func(progress docker.PullProgress) {
+		// Progress messages are sent for every chunk, which would flood the job log.
+		if progress.Progress != "" {
+			return
+		}
+
+		log.Debugf("Pull %s: %s", image, progress.String())
+		e.Logger.LogCommandOutput(progress.String() + "\n")
+	})
+}
+
+func (e *DockerExecutor) startContainers() int {
+	commandStartedAt := time.Now()
+	directive := "Starting the docker image..."
+	exitCode := 0
+
+	e.Logger.LogCommandStarted(directive)
+
+	defer func() {
+		e.Logger.LogCommandFinished(directive, exitCode, commandStartedAt, time.Now())
+	}()
+
+	err := e.createNetwork()
+	if err == nil {
+		err = e.startSidecarContainers()
+	}
+
+	if err == nil {
+		err = e.createMainContainer()
+	}
+
+	if err == nil {
+		err = e.startShell()
+	}
+
+	if err != nil {
+		log.Errorf("Failed to start the docker image: %v", err)
+		e.Logger.LogCommandOutput("Failed to start the docker image\n")
+		e.Logger.LogCommandOutput(err.Error() + "\n")
+		exitCode = 1
+	}
+
+	return exitCode
+}
+
+func (e *DockerExecutor) createNetwork() error {
+	id, err := e.client.CreateNetwork(e.resourcePrefix, e.labels())
+	if err != nil {
+		return err
+	}
+
+	e.networkID = id
+	return nil
+}
+
+func (e *DockerExecutor) startSidecarContainers() error {
+	for _, container := range e.dockerConfiguration.Containers[1:] {
+		e.Logger.LogCommandOutput(fmt.Sprintf("Starting %s...\n", container.Name))
+
+		containerConfig, err := e.containerConfig(container)
+		if err != nil {
+			return err
+		}
+
+		if container.Command != "" {
+			containerConfig.Cmd, err = splitCommand(container.Command)
+			if err != nil {
+				return fmt.Errorf("invalid command for %s: %v", container.Name, err)
+			}
+		}
+
+		id, err := e.createContainer(e.containerName(container.Name), containerConfig)
+		if err != nil {
+			return err
+		}
+
+		err = e.client.StartContainer(id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+ * Like with "docker compose run", the main container's command is the shell,
+ * so the image's entrypoint still applies. The container is only started
+ * once the stateful shell is attached to it.
+ */
+func (e *DockerExecutor) createMainContainer() error {
+	main := e.dockerConfiguration.Containers[0]
+	containerConfig, err := e.containerConfig(main)
+	if err != nil {
+		return err
+	}
+
+	containerConfig.Cmd = append([]string{e.containerShell()}, e.shellArgs...)
+	containerConfig.Tty = true
+	containerConfig.OpenStdin = true
+	containerConfig.AttachStdin = true
+	containerConfig.AttachStdout = true
+	containerConfig.AttachStderr = true
+
+	if e.terminal.Type != "" {
+		containerConfig.Env = append(containerConfig.Env, "TERM="+e.terminal.Type)
+	}
+
+	containerConfig.HostConfig.Binds = append(containerConfig.HostConfig.Binds,
+		fmt.Sprintf("%s:/var/run/docker.sock", e.socket),
+		fmt.Sprintf("%s:%s:ro", e.tmpDirectory, e.tmpDirectory),
+	)
+
+	containerConfig.HostConfig.Tmpfs = map[string]string{e.envTmpfsPath: ContainerEnvTmpfsOptions}
+
+	for _, fileInjection := range e.fileInjections {
+		containerConfig.HostConfig.Binds = append(containerConfig.HostConfig.Binds,
+			fmt.Sprintf("%s:%s", fileInjection.HostPath, fileInjection.Destination),
+		)
+	}
+
+	e.mainContainerID, err = e.createContainer(e.mainContainerName, containerConfig)
+	return err
+}
+
+func (e *DockerExecutor) containerConfig(container api.Container) (docker.ContainerConfig, error) {
+	containerConfig := docker.ContainerConfig{
+		Image:  container.Image,
+		User:   container.User,
+		Labels: e.labels(),
+		HostConfig: docker.HostConfig{
+			NetworkMode: e.resourcePrefix,
+		},
+		NetworkingConfig: docker.NetworkingConfig{
+			EndpointsConfig: map[string]docker.EndpointSettings{
+				e.resourcePrefix: {Aliases: []string{container.Name}},
+			},
+		},
+	}
+
+	if e.exposeKvmDevice {
+		containerConfig.HostConfig.Devices = []docker.DeviceMapping{
+			{PathOnHost: "/dev/kvm", PathInContainer: "/dev/kvm", CgroupPermissions: "rwm"},
+		}
+	}
+
+	if container.Entrypoint != "" {
+		entrypoint, err := splitCommand(container.Entrypoint)
+		if err != nil {
+			return containerConfig, fmt.Errorf("invalid entrypoint for %s: %v", container.Name, err)
+		}
+
+		containerConfig.Entrypoint = entrypoint
+	}
+
+	for _, envVar := range container.EnvVars {
+		value, err := envVar.Decode()
+		if err != nil {
+			return containerConfig, fmt.Errorf("error decoding %s for %s: %v", envVar.Name, container.Name, err)
+		}
+
+		containerConfig.Env = append(containerConfig.Env, fmt.Sprintf("%s=%s", envVar.Name, value))
+	}
+
+	return containerConfig, nil
+}
+
+// Containers are tracked as soon as they are created, so they are removed even if they fail to start.
+func (e *DockerExecutor) createContainer(name string, containerConfig docker.ContainerConfig) (string, error) {
+	id, err := e.client.CreateContainer(name, containerConfig)
+	if err != nil {
+		return "", err
+	}
+
+	e.containerIDs = append(e.containerIDs, id)
+	return id, nil
+}
+
+func (e *DockerExecutor) labels() map[string]string {
+	return map[string]string{DockerExecutorJobLabel: e.jobRequest.JobID}
+}
+
+/*
+ * The stateful shell is the main container's process,
+ * so we attach to the container before starting it, and talk to the shell
+ * through the TTY the Engine API gives us for it.
+ */
+func (e *DockerExecutor) startShell() error {
+	e.Logger.LogCommandOutput(fmt.Sprintf("Starting a new %s session.\n", filepath.Base(e.containerShell())))
+
+	log.Debug("Starting stateful shell")
+
+	conn, err := e.client.AttachContainer(e.mainContainerID)
+	if err != nil {
+		return err
+	}
+
+	err = e.client.StartContainer(e.mainContainerID)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+
+	if e.terminal.HasSize() {
+		err = e.client.ResizeContainer(e.mainContainerID, e.terminal.Cols, e.terminal.Rows)
+		if err != nil {
+			log.Warnf("Error resizing the main container's TTY: %v", err)
+		}
+	}
+
+	shell, err := shell.NewShellFromExecAndArgs(e.containerShell(), nil, e.tmpDirectory)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+
+	shell.Terminal = e.terminal
+	err = shell.StartInTerminal(conn)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+
+	e.Shell = shell
+	return nil
+}
+
+func (e *DockerExecutor) writeFileInContainer(path string, content []byte) error {
+	exitCode, output, err := e.client.Exec(e.mainContainerID, writeFileInContainerArgs(path), bytes.NewReader(content))
+	if err != nil {
+		return fmt.Errorf("error writing %s in container: %v - %s", path, err, output)
+	}
+
+	if exitCode != 0 {
+		return fmt.Errorf("error writing %s in container: exit code %d - %s", path, exitCode, output)
+	}
+
+	return nil
+}
+
+func (e *DockerExecutor) Stop() int {
+	e.closeShell()
+	return e.Cleanup()
+}
+
+/*
+ * Removes everything created for the job.
+ * Resources that fail to be removed are kept, so cleaning up can be retried.
+ */
+func (e *DockerExecutor) Cleanup() int {
+	log.Info("Cleaning up docker resources")
+
+	remaining := []string{}
+	for i := len(e.containerIDs) - 1; i >= 0; i-- {
+		id := e.containerIDs[i]
+		if err := e.client.RemoveContainer(id); err != nil {
+			log.Errorf("Error removing container: %v", err)
+			remaining = append([]string{id}, remaining...)
+		}
+	}
+
+	e.containerIDs = remaining
+
+	if e.networkID != "" {
+		if err := e.client.RemoveNetwork(e.networkID); err != nil {
+			log.Errorf("Error removing network: %v", err)
+		} else {
+			e.networkID = ""
+		}
+	}
+
+	if err := shell.RemoveSecretDirectory(e.tmpDirectory); err != nil {
+		log.Errorf("Error removing %s: %v", e.tmpDirectory, err)
+	}
+
+	return 0
+}
+
+/*
+ * Splits a command into words, like a POSIX shell would,
+ * handling quotes and escapes, but without expanding anything.
+ */
+func splitCommand(command string) ([]string, error) {
+	words := []string{}
+	current := strings.Builder{}
+	inWord := false
+	var quote rune
+	escaped := false
+
+	for _, c := range command {
+		switch {
+		case escaped:
+			current.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				current.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, current.String())
+				current.Reset()
+				inWord = false
+			}
+		default:
+			current.WriteRune(c)
+			inWord = true
+		}
+	}
+
+	if escaped {
+		return nil, fmt.Errorf("unfinished escape in '%s'", command)
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unclosed quote in '%s'", command)
+	}
+
+	if inWord {
+		words = append(words, current.String())
+	}
+
+	return words, nil
+}
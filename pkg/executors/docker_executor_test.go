@@ -0,0 +1,335 @@
+package executors
+
+import (
+	"encoding/base64"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	api "github.com/semaphoreci/agent/pkg/api"
+	"github.com/semaphoreci/agent/pkg/config"
+	"github.com/semaphoreci/agent/pkg/docker"
+	"github.com/semaphoreci/agent/pkg/docker/dockertest"
+	eventlogger "github.com/semaphoreci/agent/pkg/eventlogger"
+	"github.com/semaphoreci/agent/pkg/shell"
+	assert "github.com/stretchr/testify/assert"
+	require "github.com/stretchr/testify/require"
+)
+
+func dockerExecutorRequest() *api.JobRequest {
+	return &api.JobRequest{
+		JobID: "1234",
+		Compose: api.Compose{
+			Containers: []api.Container{
+				{
+					Name:       "main",
+					Image:      "ruby:3.2",
+					Entrypoint: "/docker-entrypoint.sh",
+				},
+				{
+					Name:    "db",
+					Image:   "postgres:9.6",
+					Command: `postgres -c "max_connections=200"`,
+					User:    "postgres",
+					EnvVars: []api.EnvVar{
+						{Name: "FOO", Value: base64.StdEncoding.EncodeToString([]byte("BAR"))},
+					},
+				},
+				{
+					Name:  "cache",
+					Image: "redis",
+				},
+			},
+		},
+	}
+}
+
+func Test__DockerExecutor__StartsContainersThroughEngineAPI(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("docker executor is not supported in Windows")
+	}
+
+	engine, err := dockertest.NewFakeEngine()
+	require.NoError(t, err)
+	defer engine.Close()
+
+	engine.AddImage("ruby:3.2")
+
+	testLogger, testLoggerBackend := eventlogger.DefaultTestLogger()
+	e := NewDockerExecutor(dockerExecutorRequest(), testLogger, DockerExecutorOptions{
+		Socket:          engine.Socket,
+		ExposeKvmDevice: true,
+		Terminal:        shell.Terminal{Type: "xterm-256color"},
+	})
+
+	require.Equal(t, 0, e.Prepare())
+	assert.DirExists(t, e.tmpDirectory)
+	assert.Equal(t, "semaphore-job-1234-main", e.mainContainerName)
+
+	require.Equal(t, 0, e.pullImages("Pulling docker images...", e.pullImage))
+	assert.Equal(t, []string{"postgres:9.6", "redis:latest"}, engine.Pulls())
+
+	require.NoError(t, e.createNetwork())
+	require.NoError(t, e.startSidecarContainers())
+	require.NoError(t, e.createMainContainer())
+
+	assert.Equal(t, []string{"semaphore-job-1234"}, engine.Networks())
+
+	containers := engine.Containers()
+	require.Len(t, containers, 3)
+
+	// sidecars are started right away
+	db := containers[0]
+	assert.Equal(t, "semaphore-job-1234-db", db.Name)
+	assert.True(t, db.Running)
+	assert.Equal(t, "postgres:9.6", db.Config.Image)
+	assert.Equal(t, []string{"postgres", "-c", "max_connections=200"}, db.Config.Cmd)
+	assert.Equal(t, "postgres", db.Config.User)
+	assert.Equal(t, []string{"FOO=BAR"}, db.Config.Env)
+	assert.Equal(t, map[string]string{DockerExecutorJobLabel: "1234"}, db.Config.Labels)
+	assert.Equal(t, "semaphore-job-1234", db.Config.HostConfig.NetworkMode)
+	assert.Equal(t, []string{"db"}, db.Config.NetworkingConfig.EndpointsConfig["semaphore-job-1234"].Aliases)
+	assert.Equal(t, []docker.DeviceMapping{{PathOnHost: "/dev/kvm", PathInContainer: "/dev/kvm", CgroupPermissions: "rwm"}}, db.Config.HostConfig.Devices)
+
+	cache := containers[1]
+	assert.Equal(t, "semaphore-job-1234-cache", cache.Name)
+	assert.True(t, cache.Running)
+	assert.Empty(t, cache.Config.Cmd)
+
+	// the main container is only started when the shell attaches to it
+	main := containers[2]
+	assert.Equal(t, "semaphore-job-1234-main", main.Name)
+	assert.False(t, main.Running)
+	assert.Equal(t, []string{"/docker-entrypoint.sh"}, main.Config.Entrypoint)
+	assert.Equal(t, []string{"bash"}, main.Config.Cmd)
+	assert.Equal(t, []string{"TERM=xterm-256color"}, main.Config.Env)
+	assert.True(t, main.Config.Tty)
+	assert.True(t, main.Config.OpenStdin)
+	assert.Equal(t, []string{"main"}, main.Config.NetworkingConfig.EndpointsConfig["semaphore-job-1234"].Aliases)
+	assert.Equal(t, []string{
+		engine.Socket + ":/var/run/docker.sock",
+		e.tmpDirectory + ":" + e.tmpDirectory + ":ro",
+	}, main.Config.HostConfig.Binds)
+
+	// the environment and files for the job are only written into an in-memory filesystem
+	assert.Equal(t, map[string]string{"/run/semaphore-env": "mode=1777"}, main.Config.HostConfig.Tmpfs)
+
+	simplifiedEvents, err := testLoggerBackend.SimplifiedEvents(true, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"directive: Pulling docker images...",
+		"Image ruby:3.2 is already present\n",
+		"Pulling postgres:9.6...\n",
+		"9.6: Pulling from postgres\n",
+		"a1b2c3: Pulling fs layer\n",
+		"a1b2c3: Pull complete\n",
+		"Status: Downloaded newer image for postgres:9.6\n",
+		"Pulling redis...\n",
+		"latest: Pulling from redis\n",
+		"a1b2c3: Pulling fs layer\n",
+		"a1b2c3: Pull complete\n",
+		"Status: Downloaded newer image for redis:latest\n",
+		"Exit Code: 0",
+		"Starting db...\n",
+		"Starting cache...\n",
+	}, simplifiedEvents)
+
+	// everything created for the job is removed
+	tmpDirectory := e.tmpDirectory
+	assert.Equal(t, 0, e.Cleanup())
+	assert.Empty(t, engine.Containers())
+	assert.Empty(t, engine.Networks())
+	assert.NoDirExists(t, tmpDirectory)
+
+	// cleaning up again does nothing
+	assert.Equal(t, 0, e.Cleanup())
+}
+
+func Test__DockerExecutor__RunsJobThroughEngineAPI(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("docker executor is not supported in Windows")
+	}
+
+	// the shell runs in the host, so changes to the profile go to a temporary home
+	t.Setenv("HOME", t.TempDir())
+
+	engine, err := dockertest.NewFakeEngine()
+	require.NoError(t, err)
+	defer engine.Close()
+
+	engine.AddImage("ruby:3.2")
+
+	testLogger, testLoggerBackend := eventlogger.DefaultTestLogger()
+	e := NewDockerExecutor(dockerExecutorRequest(), testLogger, DockerExecutorOptions{Socket: engine.Socket})
+
+	// the in-memory filesystem of the container is in the host too
+	e.envTmpfsPath = t.TempDir()
+
+	require.Equal(t, 0, e.Prepare())
+	require.Equal(t, 0, e.Start())
+	require.NotNil(t, e.Shell)
+
+	// the SSH jump point goes through the agent, instead of the docker CLI
+	agent, err := os.Executable()
+	require.NoError(t, err)
+	assert.Contains(t, e.sshJumpPointScript(), `"`+agent+`" docker-exec --tty "`+engine.Socket+`" semaphore-job-1234-main bash --login`)
+
+	e.ExportEnvVars([]api.EnvVar{{Name: "A", Value: base64.StdEncoding.EncodeToString([]byte("B"))}}, []config.HostEnvVar{})
+	e.RunCommand("echo $A", false, "")
+
+	// the environment is written by the container's user, and only readable by it
+	info, err := os.Stat(e.envFileName())
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	injectedPath := filepath.Join(t.TempDir(), "secret")
+	e.InjectFiles([]api.File{{Path: injectedPath, Content: base64.StdEncoding.EncodeToString([]byte("hello")), Mode: "0640"}})
+	info, err = os.Stat(injectedPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+
+	// attached shells are exec'd in the main container, with the job's environment
+	attached, err := e.Attach(80, 24)
+	require.NoError(t, err)
+	_, err = attached.Write([]byte("echo \"attached $A\"; exit 5\n"))
+	require.NoError(t, err)
+
+	output, err := io.ReadAll(attached)
+	require.NoError(t, err)
+	assert.Contains(t, string(output), "attached B")
+	assert.Equal(t, 5, attached.Wait())
+	_ = attached.Close()
+
+	tmpDirectory := e.tmpDirectory
+	assert.Equal(t, 0, e.Stop())
+	assert.NoDirExists(t, tmpDirectory)
+	assert.Empty(t, engine.Containers())
+
+	simplifiedEvents, err := testLoggerBackend.SimplifiedEvents(true, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"directive: Pulling docker images...",
+		"Image ruby:3.2 is already present\nPulling postgres:9.6...\n9.6: Pulling from postgres\na1b2c3: Pulling fs layer\na1b2c3: Pull complete\nStatus: Downloaded newer image for postgres:9.6\nPulling redis...\nlatest: Pulling from redis\na1b2c3: Pulling fs layer\na1b2c3: Pull complete\nStatus: Downloaded newer image for redis:latest\n",
+		"Exit Code: 0",
+		"directive: Starting the docker image...",
+		"Starting db...\nStarting cache...\nStarting a new bash session.\n",
+		"Exit Code: 0",
+		"directive: Exporting environment variables",
+		"Exporting A\n",
+		"Exit Code: 0",
+		"directive: echo $A",
+		"B\n",
+		"Exit Code: 0",
+		"directive: Injecting Files",
+		"Injecting " + injectedPath + " with file mode 0640\n",
+		"Exit Code: 0",
+	}, simplifiedEvents)
+}
+
+func Test__DockerExecutor__UsesImagePullCredentials(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("docker executor is not supported in Windows")
+	}
+
+	engine, err := dockertest.NewFakeEngine()
+	require.NoError(t, err)
+	defer engine.Close()
+
+	request := dockerExecutorRequest()
+	request.Compose.Containers = request.Compose.Containers[:1]
+	request.Compose.Containers[0].Image = "registry.example.com/ruby:3.2"
+	request.Compose.ImagePullCredentials = imagePullCredentials(api.ImagePullCredentialsStrategyGenericDocker,
+		api.EnvVar{Name: "DOCKER_USERNAME", Value: "user"},
+		api.EnvVar{Name: "DOCKER_PASSWORD", Value: "pass"},
+		api.EnvVar{Name: "DOCKER_URL", Value: "registry.example.com"},
+	)
+
+	testLogger, testLoggerBackend := eventlogger.DefaultTestLogger()
+	e := NewDockerExecutor(request, testLogger, DockerExecutorOptions{Socket: engine.Socket})
+	require.Equal(t, 0, e.Prepare())
+	defer e.Cleanup()
+
+	require.Equal(t, 0, e.setUpImagePullCredentials(e.keepImagePullCredentials))
+	require.Equal(t, 0, e.pullImages("Pulling docker images...", e.pullImage))
+
+	auth := docker.RegistryAuth{Username: "user", Password: "pass", ServerAddress: "registry.example.com"}
+	expectedAuth, _ := auth.Encode()
+	assert.Equal(t, expectedAuth, engine.AuthFor("registry.example.com/ruby:3.2"))
+
+	simplifiedEvents, err := testLoggerBackend.SimplifiedEvents(true, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"directive: Setting up image pull credentials",
+		"Setting up credentials for registry.example.com\n",
+		"Exit Code: 0",
+		"directive: Pulling docker images...",
+		"Pulling registry.example.com/ruby:3.2...\n3.2: Pulling from registry.example.com/ruby\na1b2c3: Pulling fs layer\na1b2c3: Pull complete\nStatus: Downloaded newer image for registry.example.com/ruby:3.2\n",
+		"Exit Code: 0",
+	}, simplifiedEvents)
+}
+
+func Test__DockerExecutor__PullFailure(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("docker executor is not supported in Windows")
+	}
+
+	engine, err := dockertest.NewFakeEngine()
+	require.NoError(t, err)
+	defer engine.Close()
+
+	engine.PullErrors["postgres:9.6"] = "manifest for postgres:9.6 not found"
+
+	testLogger, testLoggerBackend := eventlogger.DefaultTestLogger()
+	e := NewDockerExecutor(dockerExecutorRequest(), testLogger, DockerExecutorOptions{Socket: engine.Socket})
+	defer e.Cleanup()
+
+	assertStartFailsPullingImages(t, e, testLoggerBackend, "Pulling docker images...",
+		"Pulling ruby:3.2...\n3.2: Pulling from ruby\na1b2c3: Pulling fs layer\na1b2c3: Pull complete\nStatus: Downloaded newer image for ruby:3.2\nPulling postgres:9.6...\n9.6: Pulling from postgres\nerror pulling image postgres:9.6: manifest for postgres:9.6 not found\n",
+	)
+
+	assert.Nil(t, e.Shell)
+	assert.Equal(t, []string{"ruby:3.2", "postgres:9.6"}, engine.Pulls())
+	assert.Empty(t, engine.Containers())
+}
+
+func Test__DockerExecutor__DaemonNotRunning(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("docker executor is not supported in Windows")
+	}
+
+	testLogger, _ := eventlogger.DefaultTestLogger()
+	e := NewDockerExecutor(dockerExecutorRequest(), testLogger, DockerExecutorOptions{Socket: "/tmp/does-not-exist.sock"})
+	require.Equal(t, 0, e.Prepare())
+
+	tmpDirectory := e.tmpDirectory
+	assert.Equal(t, 1, e.Start())
+	assert.Equal(t, 0, e.Stop())
+
+	_, err := os.Stat(tmpDirectory)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func Test__SplitCommand(t *testing.T) {
+	cases := map[string][]string{
+		"":                                 {},
+		"postgres start":                   {"postgres", "start"},
+		"  bash  -c   'sleep 10; exit 1' ": {"bash", "-c", "sleep 10; exit 1"},
+		`echo "a \"quoted\" word" b\ c`:    {"echo", `a "quoted" word`, "b c"},
+		`echo '' ""`:                       {"echo", "", ""},
+		`echo 'no \escapes'`:               {"echo", `no \escapes`},
+	}
+
+	for command, expected := range cases {
+		words, err := splitCommand(command)
+		require.NoError(t, err, command)
+		assert.Equal(t, expected, words, command)
+	}
+
+	_, err := splitCommand(`echo 'unclosed`)
+	assert.ErrorContains(t, err, "unclosed quote")
+
+	_, err = splitCommand(`echo \`)
+	assert.ErrorContains(t, err, "unfinished escape")
+}
@@ -0,0 +1,125 @@
+package executors
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+ * Environment files hold the decoded secrets of a job, so they are kept
+ * in a directory only the agent's user can access, created for each job.
+ */
+func createEnvDirectory() (string, error) {
+	directory, err := os.MkdirTemp("", "semaphore-job-env-")
+	if err != nil {
+		return "", fmt.Errorf("error creating environment directory: %v", err)
+	}
+
+	return directory, nil
+}
+
+/*
+ * Keeps track of the lines the agent appends to a profile file,
+ * so they can be removed from it when the job is done.
+ */
+type profileChanges struct {
+	path    string
+	lines   []string
+	created bool
+}
+
+func (p *profileChanges) Append(profilePath, line string) error {
+	path, err := expandHome(profilePath)
+	if err != nil {
+		return err
+	}
+
+	if p.path != "" && p.path != path {
+		return fmt.Errorf("profile changes are already tracked for %s", p.path)
+	}
+
+	_, err = os.Stat(path)
+	created := errors.Is(err, fs.ErrNotExist)
+
+	// #nosec
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	if _, err := file.WriteString(line + "\n"); err != nil {
+		return err
+	}
+
+	if p.path == "" {
+		p.path = path
+		p.created = created
+	}
+
+	p.lines = append(p.lines, line)
+	return nil
+}
+
+/*
+ * Removes the last occurrence of each line added.
+ * Everything else in the file is kept as it is.
+ * If the file didn't exist before, and nothing else was written to it, it is removed.
+ */
+func (p *profileChanges) Revert() error {
+	if len(p.lines) == 0 {
+		return nil
+	}
+
+	// #nosec
+	content, err := os.ReadFile(p.path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			p.lines = nil
+			return nil
+		}
+
+		return err
+	}
+
+	lines := strings.SplitAfter(string(content), "\n")
+	for i := len(p.lines) - 1; i >= 0; i-- {
+		for j := len(lines) - 1; j >= 0; j-- {
+			if strings.TrimSuffix(lines[j], "\n") == p.lines[i] {
+				lines = append(lines[:j], lines[j+1:]...)
+				break
+			}
+		}
+	}
+
+	p.lines = nil
+	reverted := strings.Join(lines, "")
+	if reverted == "" && p.created {
+		return os.Remove(p.path)
+	}
+
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(p.path, []byte(reverted), info.Mode().Perm())
+}
+
+func expandHome(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("error finding home directory: %v", err)
+	}
+
+	return filepath.Join(home, strings.TrimPrefix(path, "~")), nil
+}
@@ -0,0 +1,69 @@
+package executors
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	assert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test__CreateEnvDirectory(t *testing.T) {
+	directory, err := createEnvDirectory()
+	require.NoError(t, err)
+	defer os.RemoveAll(directory)
+
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(directory)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+	}
+}
+
+func Test__ProfileChanges(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	profilePath := filepath.Join(home, ".bash_profile")
+
+	t.Run("only the lines added are removed", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(profilePath, []byte("source /etc/a\nsource /tmp/b\n"), 0640))
+
+		profile := profileChanges{}
+		require.NoError(t, profile.Append("~/.bash_profile", "source /tmp/b"))
+		require.NoError(t, profile.Append("~/.bash_profile", "source /tmp/c"))
+
+		// something else changes the profile while the job runs
+		file, err := os.OpenFile(profilePath, os.O_WRONLY|os.O_APPEND, 0)
+		require.NoError(t, err)
+		_, err = file.WriteString("export B=1\n")
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+
+		require.NoError(t, profile.Revert())
+		content, err := os.ReadFile(profilePath)
+		require.NoError(t, err)
+		assert.Equal(t, "source /etc/a\nsource /tmp/b\nexport B=1\n", string(content))
+
+		if runtime.GOOS != "windows" {
+			info, err := os.Stat(profilePath)
+			require.NoError(t, err)
+			assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+		}
+
+		// reverting again does nothing
+		require.NoError(t, profile.Revert())
+		require.NoError(t, os.Remove(profilePath))
+	})
+
+	t.Run("profile created by the agent is removed", func(t *testing.T) {
+		profile := profileChanges{}
+		require.NoError(t, profile.Append("~/.bash_profile", "source /tmp/b"))
+		assert.FileExists(t, profilePath)
+
+		require.NoError(t, profile.Revert())
+		assert.NoFileExists(t, profilePath)
+	})
+}
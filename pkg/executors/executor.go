@@ -3,6 +3,8 @@ package executors
 import (
 	api "github.com/semaphoreci/agent/pkg/api"
 	"github.com/semaphoreci/agent/pkg/config"
+	eventlogger "github.com/semaphoreci/agent/pkg/eventlogger"
+	shell "github.com/semaphoreci/agent/pkg/shell"
 )
 
 type Executor interface {
@@ -13,6 +15,9 @@ type Executor interface {
 	RunCommand(string, bool, string) int
 	RunCommandWithOptions(options CommandOptions) int
 	GetOutputFromCommand(string) (string, int)
+
+	// How the last command executed was killed, if it was.
+	LastCommandTermination() *shell.Termination
 	Stop() int
 	Cleanup() int
 }
@@ -24,6 +29,21 @@ type CommandOptions struct {
 	Warning string
 }
 
+func commandTermination(termination *shell.Termination) *eventlogger.CommandTermination {
+	if termination == nil {
+		return nil
+	}
+
+	return &eventlogger.CommandTermination{
+		Signal:     termination.Signal,
+		CoreDumped: termination.CoreDumped,
+		OOMKilled:  termination.OOMKilled,
+	}
+}
+
 const ExecutorTypeShell = "shell"
 const ExecutorTypeDockerCompose = "dockercompose"
+const ExecutorTypeDocker = "docker"
+const ExecutorTypePodman = "podman"
+const ExecutorTypeSSH = "ssh"
 const ExecutorKubernetes = "kubernetes"
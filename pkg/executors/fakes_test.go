@@ -0,0 +1,86 @@
+package executors
+
+import (
+	"encoding/base64"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	api "github.com/semaphoreci/agent/pkg/api"
+	eventlogger "github.com/semaphoreci/agent/pkg/eventlogger"
+	assert "github.com/stretchr/testify/assert"
+	require "github.com/stretchr/testify/require"
+)
+
+/*
+ * The podman and ssh executors are tested with bash scripts
+ * replacing the CLIs they call. The scripts record what they were called with
+ * in files next to them, which are read with fakeExecutableOutput().
+ */
+func writeFakeExecutable(t *testing.T, directory, name, script string) string {
+	executable := filepath.Join(directory, name)
+	require.NoError(t, os.WriteFile(executable, []byte(script), 0700))
+	return executable
+}
+
+func fakeExecutableOutput(t *testing.T, executable, name string) []string {
+	// #nosec
+	content, err := os.ReadFile(filepath.Join(filepath.Dir(executable), name))
+	if os.IsNotExist(err) {
+		return []string{}
+	}
+
+	require.NoError(t, err)
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+}
+
+func imagePullCredentials(strategy string, envVars ...api.EnvVar) []api.ImagePullCredentials {
+	encoded := []api.EnvVar{
+		{Name: "DOCKER_CREDENTIAL_TYPE", Value: base64.StdEncoding.EncodeToString([]byte(strategy))},
+	}
+
+	for _, envVar := range envVars {
+		encoded = append(encoded, api.EnvVar{Name: envVar.Name, Value: base64.StdEncoding.EncodeToString([]byte(envVar.Value))})
+	}
+
+	return []api.ImagePullCredentials{{EnvVars: encoded}}
+}
+
+/*
+ * Images are pulled when the executor starts,
+ * so a pull failure makes it fail to start.
+ */
+func assertStartFailsPullingImages(t *testing.T, e Executor, backend *eventlogger.InMemoryBackend, directive, output string) {
+	require.Equal(t, 0, e.Prepare())
+	assert.Equal(t, 1, e.Start())
+
+	simplifiedEvents, err := backend.SimplifiedEvents(true, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"directive: " + directive, output, "Exit Code: 1"}, simplifiedEvents)
+}
+
+type attachableExecutor interface {
+	Executor
+	AttachCommand() (*exec.Cmd, error)
+}
+
+/*
+ * Debug sessions can only attach to the job once the executor is started.
+ * The expected arguments are only known after that.
+ */
+func assertAttachCommand(t *testing.T, e attachableExecutor, notRunningError string, expectedArgs func() []string) {
+	require.Equal(t, 0, e.Prepare())
+	defer e.Cleanup()
+
+	_, err := e.AttachCommand()
+	assert.ErrorContains(t, err, notRunningError)
+
+	require.Equal(t, 0, e.Start())
+	defer e.Stop()
+
+	cmd, err := e.AttachCommand()
+	require.NoError(t, err)
+	assert.Equal(t, expectedArgs(), cmd.Args)
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"time"
 
@@ -26,6 +27,10 @@ type KubernetesExecutor struct {
 	imagePullSecret string
 	logger          *eventlogger.Logger
 	Shell           *shell.Shell
+	lastTermination *shell.Termination
+	terminal        shell.Terminal
+	shellExecutable string
+	shellArgs       []string
 
 	// If the executor is stopped before it even starts, we need to cancel it.
 	cancelFunc context.CancelFunc
@@ -35,7 +40,26 @@ type KubernetesExecutor struct {
 	initialEnvironmentExposed bool
 }
 
+type KubernetesExecutorOptions struct {
+	Config kubernetes.Config
+
+	// kubectl gives the container the size of its own PTY, and TERM is set with env.
+	Terminal shell.Terminal
+
+	// The shell started in the main container of the pod.
+	// By default, bash is used as a login shell.
+	ShellExecutable string
+	ShellArgs       []string
+}
+
+// The environment secret is mounted in the main container of the pod.
+const kubernetesEnvFile = "/tmp/injected/.env"
+
 func NewKubernetesExecutor(jobRequest *api.JobRequest, logger *eventlogger.Logger, k8sConfig kubernetes.Config) (*KubernetesExecutor, error) {
+	return NewKubernetesExecutorWithOptions(jobRequest, logger, KubernetesExecutorOptions{Config: k8sConfig})
+}
+
+func NewKubernetesExecutorWithOptions(jobRequest *api.JobRequest, logger *eventlogger.Logger, options KubernetesExecutorOptions) (*KubernetesExecutor, error) {
 	clientset, err := kubernetes.NewInClusterClientset()
 	if err != nil {
 		log.Warnf("No in-cluster configuration found - using ~/.kube/config...")
@@ -46,27 +70,38 @@ func NewKubernetesExecutor(jobRequest *api.JobRequest, logger *eventlogger.Logge
 		}
 	}
 
-	k8sClient, err := kubernetes.NewKubernetesClient(clientset, k8sConfig)
+	k8sClient, err := kubernetes.NewKubernetesClient(clientset, options.Config)
 	if err != nil {
 		return nil, err
 	}
 
 	return &KubernetesExecutor{
-		k8sClient:  k8sClient,
-		jobRequest: jobRequest,
-		logger:     logger,
+		k8sClient:       k8sClient,
+		jobRequest:      jobRequest,
+		logger:          logger,
+		terminal:        options.Terminal,
+		shellExecutable: options.ShellExecutable,
+		shellArgs:       options.ShellArgs,
 	}, nil
 }
 
+func (e *KubernetesExecutor) containerShell() string {
+	if e.shellExecutable == "" {
+		return shell.ShellBash
+	}
+
+	return e.shellExecutable
+}
+
 func (e *KubernetesExecutor) Prepare() int {
-	commandStartedAt := int(time.Now().Unix())
+	commandStartedAt := time.Now()
 	directive := "Creating Kubernetes resources for job..."
 	exitCode := 0
 
 	e.logger.LogCommandStarted(directive)
 
 	defer func() {
-		commandFinishedAt := int(time.Now().Unix())
+		commandFinishedAt := time.Now()
 		e.logger.LogCommandFinished(directive, exitCode, commandStartedAt, commandFinishedAt)
 	}()
 
@@ -113,14 +148,14 @@ func (e *KubernetesExecutor) Prepare() int {
 }
 
 func (e *KubernetesExecutor) Start() int {
-	commandStartedAt := int(time.Now().Unix())
+	commandStartedAt := time.Now()
 	directive := "Starting shell session..."
 	exitCode := 0
 
 	e.logger.LogCommandStarted(directive)
 
 	defer func() {
-		commandFinishedAt := int(time.Now().Unix())
+		commandFinishedAt := time.Now()
 		e.logger.LogCommandFinished(directive, exitCode, commandStartedAt, commandFinishedAt)
 	}()
 
@@ -140,7 +175,7 @@ func (e *KubernetesExecutor) Start() int {
 	}
 
 	e.logger.LogCommandOutput("Pod is ready.\n")
-	e.logger.LogCommandOutput("Starting a new bash session in the pod...\n")
+	e.logger.LogCommandOutput(fmt.Sprintf("Starting a new %s session in the pod...\n", filepath.Base(e.containerShell())))
 
 	// #nosec
 	executable := "kubectl"
@@ -151,10 +186,25 @@ func (e *KubernetesExecutor) Start() int {
 		"-c",
 		"main",
 		"--",
-		"bash",
-		"--login",
 	}
 
+	/*
+	 * kubectl keeps the size of the container's terminal in sync
+	 * with the size of the PTY it runs in, but TERM needs to be passed explicitly.
+	 */
+	if e.terminal.Type != "" {
+		args = append(args, "env", "TERM="+e.terminal.Type)
+	}
+
+	adapter := shell.AdapterFor(e.containerShell())
+	shellArgs := e.shellArgs
+	if len(shellArgs) == 0 {
+		shellArgs = adapter.DefaultArgs()
+	}
+
+	args = append(args, e.containerShell())
+	args = append(args, shellArgs...)
+
 	shell, err := shell.NewShellFromExecAndArgs(executable, args, os.TempDir())
 	if err != nil {
 		log.Errorf("Failed to create shell: %v", err)
@@ -165,6 +215,8 @@ func (e *KubernetesExecutor) Start() int {
 		return exitCode
 	}
 
+	shell.Adapter = adapter
+	shell.Terminal = e.terminal
 	err = shell.Start()
 	if err != nil {
 		log.Errorf("Failed to start shell err: %+v", err)
@@ -227,14 +279,14 @@ func (e *KubernetesExecutor) Start() int {
 //   - On the second call, the environment variables (currently, just the job result) need to be exported
 //     through commands executed through the PTY.
 func (e *KubernetesExecutor) ExportEnvVars(envVars []api.EnvVar, hostEnvVars []config.HostEnvVar) int {
-	commandStartedAt := int(time.Now().Unix())
+	commandStartedAt := time.Now()
 	directive := "Exporting environment variables"
 	exitCode := 0
 
 	e.logger.LogCommandStarted(directive)
 
 	defer func() {
-		commandFinishedAt := int(time.Now().Unix())
+		commandFinishedAt := time.Now()
 		e.logger.LogCommandFinished(directive, exitCode, commandStartedAt, commandFinishedAt)
 		e.initialEnvironmentExposed = true
 	}()
@@ -268,7 +320,7 @@ func (e *KubernetesExecutor) ExportEnvVars(envVars []api.EnvVar, hostEnvVars []c
 	// First call of this function.
 	// In this case, a secret with all the environment variables has been exposed in the pod spec,
 	// so all we need to do here is to source that file through the PTY session.
-	exitCode = e.RunCommand("source /tmp/injected/.env", true, "")
+	exitCode = e.RunCommand(e.Shell.Adapter.Source(kubernetesEnvFile), true, "")
 	if exitCode != 0 {
 		log.Errorf("Error sourcing environment file")
 		return exitCode
@@ -282,14 +334,14 @@ func (e *KubernetesExecutor) ExportEnvVars(envVars []api.EnvVar, hostEnvVars []c
 // Here, we just need to move the files to their correct location.
 func (e *KubernetesExecutor) InjectFiles(files []api.File) int {
 	directive := "Injecting Files"
-	commandStartedAt := int(time.Now().Unix())
+	commandStartedAt := time.Now()
 	exitCode := 0
 	output := ""
 
 	e.logger.LogCommandStarted(directive)
 
 	defer func() {
-		commandFinishedAt := int(time.Now().Unix())
+		commandFinishedAt := time.Now()
 		e.logger.LogCommandFinished(directive, exitCode, commandStartedAt, commandFinishedAt)
 	}()
 
@@ -404,14 +456,43 @@ func (e *KubernetesExecutor) RunCommandWithOptions(options CommandOptions) int {
 	}
 
 	p.Run()
+	e.lastTermination = p.Termination
 
 	if !options.Silent {
-		e.logger.LogCommandFinished(directive, p.ExitCode, p.StartedAt, p.FinishedAt)
+		e.logger.LogCommandFinishedWithTermination(directive, p.ExitCode, p.StartedAt, p.FinishedAt, commandTermination(p.Termination))
 	}
 
 	return p.ExitCode
 }
 
+func (e *KubernetesExecutor) Attach(cols, rows uint16) (AttachedShell, error) {
+	cmd, err := e.AttachCommand()
+	if err != nil {
+		return nil, err
+	}
+
+	return startAttachedCommand(cmd, cols, rows)
+}
+
+/*
+ * The attached shell runs in the main container of the job pod,
+ * with the environment file injected in the pod sourced.
+ */
+func (e *KubernetesExecutor) AttachCommand() (*exec.Cmd, error) {
+	if e.Shell == nil || e.podName == "" {
+		return nil, fmt.Errorf("the job pod is not running")
+	}
+
+	script := attachScript(e.Shell.Adapter, []string{kubernetesEnvFile}, e.containerShell(), e.shellArgs)
+
+	// #nosec
+	return exec.Command("kubectl", "exec", "-it", e.podName, "-c", "main", "--", e.containerShell(), "-c", script), nil
+}
+
+func (e *KubernetesExecutor) LastCommandTermination() *shell.Termination {
+	return e.lastTermination
+}
+
 func (e *KubernetesExecutor) Stop() int {
 	log.Debug("Starting the process killing procedure")
 
@@ -0,0 +1,439 @@
+package executors
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	api "github.com/semaphoreci/agent/pkg/api"
+	"github.com/semaphoreci/agent/pkg/config"
+	"github.com/semaphoreci/agent/pkg/docker"
+	eventlogger "github.com/semaphoreci/agent/pkg/eventlogger"
+	shell "github.com/semaphoreci/agent/pkg/shell"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+ * Runs the job containers with podman, for hosts without a Docker daemon.
+ * The containers run in a pod created for the job, so they share the network,
+ * and each container name resolves to the pod itself. When the agent doesn't
+ * run as root, podman runs rootless, without any privileged process involved.
+ */
+type PodmanExecutor struct {
+	containerExecutor
+
+	executable      string
+	secretDirectory string
+	podCreated      bool
+}
+
+type PodmanExecutorOptions struct {
+	// The podman executable. If empty, podman is used.
+	Executable string
+
+	ExposeKvmDevice    bool
+	FileInjections     []config.FileInjection
+	FailOnMissingFiles bool
+
+	// The shell started in the main container. If empty, bash is used.
+	ShellExecutable string
+	ShellArgs       []string
+
+	// Applied to what each command prints, as relayed by podman.
+	OutputLimits shell.OutputLimits
+
+	// podman gives the container the size of its own PTY, and TERM is passed with --env.
+	Terminal shell.Terminal
+}
+
+func NewPodmanExecutor(request *api.JobRequest, logger *eventlogger.Logger, options PodmanExecutorOptions) *PodmanExecutor {
+	executable := options.Executable
+	if executable == "" {
+		executable = "podman"
+	}
+
+	e := &PodmanExecutor{
+		containerExecutor: newContainerExecutor(request, logger, containerExecutorOptions{
+			ExposeKvmDevice:    options.ExposeKvmDevice,
+			FileInjections:     options.FileInjections,
+			FailOnMissingFiles: options.FailOnMissingFiles,
+			ShellExecutable:    options.ShellExecutable,
+			ShellArgs:          options.ShellArgs,
+			OutputLimits:       options.OutputLimits,
+			Terminal:           options.Terminal,
+		}),
+		executable: executable,
+	}
+
+	e.writeFile = e.writeFileInContainer
+	return e
+}
+
+func (e *PodmanExecutor) command(args ...string) *exec.Cmd {
+	// #nosec
+	return exec.Command(e.executable, args...)
+}
+
+func (e *PodmanExecutor) Attach(cols, rows uint16) (AttachedShell, error) {
+	cmd, err := e.AttachCommand()
+	if err != nil {
+		return nil, err
+	}
+
+	return startAttachedCommand(cmd, cols, rows)
+}
+
+func (e *PodmanExecutor) AttachCommand() (*exec.Cmd, error) {
+	script, err := e.attachShellScript()
+	if err != nil {
+		return nil, err
+	}
+
+	return e.command("exec", "-i", "-t", e.mainContainerName, e.containerShell(), "-c", script), nil
+}
+
+func (e *PodmanExecutor) Prepare() int {
+	exitCode := e.prepare("podman")
+	if exitCode != 0 {
+		return exitCode
+	}
+
+	/*
+	 * The credentials and the environment variables for the containers
+	 * are given to podman through files, since arguments are visible to everyone.
+	 * They are kept apart from the directory mounted in the main container.
+	 */
+	secretDirectory, err := createEnvDirectory()
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	e.secretDirectory = secretDirectory
+	return e.setUpSSHJumpPoint(cliSSHJumpPointScript(e.executable, e.mainContainerName))
+}
+
+func (e *PodmanExecutor) Start() int {
+	// Once the containers are running, the credentials
+	// and the files with their environment variables are not needed anymore.
+	defer func() {
+		if err := shell.RemoveSecretDirectory(e.secretDirectory); err != nil {
+			log.Errorf("Error removing %s: %v", e.secretDirectory, err)
+		}
+	}()
+
+	exitCode := e.setUpImagePullCredentials(e.writeAuthFile)
+	if exitCode != 0 {
+		log.Error("Failed to set up image pull credentials")
+		return exitCode
+	}
+
+	exitCode = e.pullImages("Pulling images...", e.pullImage)
+	if exitCode != 0 {
+		log.Error("Failed to pull images")
+		return exitCode
+	}
+
+	return e.startContainers()
+}
+
+func (e *PodmanExecutor) authFileName() string {
+	return filepath.Join(e.secretDirectory, "auth.json")
+}
+
+/*
+ * Podman reads the credentials from a file in the same format as Docker's config.json.
+ */
+func (e *PodmanExecutor) writeAuthFile(dockerConfig *docker.DockerConfig) error {
+	content, err := json.Marshal(dockerConfig)
+	if err != nil {
+		return fmt.Errorf("error encoding image pull credentials: %v", err)
+	}
+
+	err = os.WriteFile(e.authFileName(), content, 0600)
+	if err != nil {
+		return fmt.Errorf("error writing image pull credentials: %v", err)
+	}
+
+	return nil
+}
+
+func (e *PodmanExecutor) pullImage(image string) error {
+	if e.command("image", "exists", image).Run() == nil {
+		e.Logger.LogCommandOutput(fmt.Sprintf("Image %s is already present\n", image))
+		return nil
+	}
+
+	e.Logger.LogCommandOutput(fmt.Sprintf("Pulling %s...\n", image))
+
+	args := []string{"pull"}
+	if _, err := os.Stat(e.authFileName()); err == nil {
+		args = append(args, "--authfile", e.authFileName())
+	}
+
+	cmd := e.command(append(args, image)...)
+	output, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	cmd.Stderr = cmd.Stdout
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("error pulling image %s: %v", image, err)
+	}
+
+	scanner := bufio.NewScanner(output)
+	for scanner.Scan() {
+		log.Debugf("Pull %s: %s", image, scanner.Text())
+		e.Logger.LogCommandOutput(scanner.Text() + "\n")
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("error pulling image %s: %v", image, err)
+	}
+
+	return nil
+}
+
+func (e *PodmanExecutor) startContainers() int {
+	commandStartedAt := time.Now()
+	directive := "Starting the containers..."
+	exitCode := 0
+
+	e.Logger.LogCommandStarted(directive)
+
+	defer func() {
+		e.Logger.LogCommandFinished(directive, exitCode, commandStartedAt, time.Now())
+	}()
+
+	err := e.createPod()
+	if err == nil {
+		err = e.startSidecarContainers()
+	}
+
+	if err == nil {
+		err = e.startShell()
+	}
+
+	if err != nil {
+		log.Errorf("Failed to start the containers: %v", err)
+		e.Logger.LogCommandOutput("Failed to start the containers\n")
+		e.Logger.LogCommandOutput(err.Error() + "\n")
+		exitCode = 1
+	}
+
+	return exitCode
+}
+
+/*
+ * The pod is named after the job, like its containers.
+ * Containers in a pod reach each other through localhost,
+ * so every container name is added as a hostname for it,
+ * like container names work as hostnames with docker compose.
+ */
+func (e *PodmanExecutor) createPod() error {
+	args := []string{"pod", "create", "--name", e.resourcePrefix, "--label", DockerExecutorJobLabel + "=" + e.jobRequest.JobID}
+	for _, container := range e.dockerConfiguration.Containers {
+		args = append(args, "--add-host", container.Name+":127.0.0.1")
+	}
+
+	output, err := e.command(args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error creating pod %s: %v - %s", e.resourcePrefix, err, strings.TrimSpace(string(output)))
+	}
+
+	e.podCreated = true
+	return nil
+}
+
+func (e *PodmanExecutor) startSidecarContainers() error {
+	for _, container := range e.dockerConfiguration.Containers[1:] {
+		e.Logger.LogCommandOutput(fmt.Sprintf("Starting %s...\n", container.Name))
+
+		args, err := e.runArgs(container)
+		if err != nil {
+			return err
+		}
+
+		args = append([]string{"run", "--detach"}, args...)
+		args = append(args, container.Image)
+
+		if container.Command != "" {
+			command, err := splitCommand(container.Command)
+			if err != nil {
+				return fmt.Errorf("invalid command for %s: %v", container.Name, err)
+			}
+
+			args = append(args, command...)
+		}
+
+		output, err := e.command(args...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("error starting %s: %v - %s", container.Name, err, strings.TrimSpace(string(output)))
+		}
+	}
+
+	return nil
+}
+
+/*
+ * The arguments for "podman run" shared by all containers, up to the image.
+ */
+func (e *PodmanExecutor) runArgs(container api.Container) ([]string, error) {
+	args := []string{
+		"--pod", e.resourcePrefix,
+		"--name", e.containerName(container.Name),
+		"--label", DockerExecutorJobLabel + "=" + e.jobRequest.JobID,
+	}
+
+	if container.User != "" {
+		args = append(args, "--user", container.User)
+	}
+
+	if e.exposeKvmDevice {
+		args = append(args, "--device", "/dev/kvm:/dev/kvm")
+	}
+
+	if container.Entrypoint != "" {
+		entrypoint, err := splitCommand(container.Entrypoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid entrypoint for %s: %v", container.Name, err)
+		}
+
+		// A JSON array allows the entrypoint to have arguments.
+		encoded, _ := json.Marshal(entrypoint)
+		args = append(args, "--entrypoint", string(encoded))
+	}
+
+	if len(container.EnvVars) > 0 {
+		envFile, err := e.writeContainerEnvFile(container)
+		if err != nil {
+			return nil, err
+		}
+
+		args = append(args, "--env-file", envFile)
+	}
+
+	return args, nil
+}
+
+func (e *PodmanExecutor) writeContainerEnvFile(container api.Container) (string, error) {
+	content := strings.Builder{}
+	for _, envVar := range container.EnvVars {
+		value, err := envVar.Decode()
+		if err != nil {
+			return "", fmt.Errorf("error decoding %s for %s: %v", envVar.Name, container.Name, err)
+		}
+
+		if bytes.ContainsAny(value, "\r\n") {
+			return "", fmt.Errorf("%s for %s has multiple lines, which is not supported", envVar.Name, container.Name)
+		}
+
+		content.WriteString(fmt.Sprintf("%s=%s\n", envVar.Name, value))
+	}
+
+	envFile := filepath.Join(e.secretDirectory, container.Name+".env")
+	err := os.WriteFile(envFile, []byte(content.String()), 0600)
+	if err != nil {
+		return "", fmt.Errorf("error writing environment for %s: %v", container.Name, err)
+	}
+
+	return envFile, nil
+}
+
+/*
+ * Like with "docker compose run", the stateful shell is the main container's process.
+ */
+func (e *PodmanExecutor) startShell() error {
+	main := e.dockerConfiguration.Containers[0]
+	e.Logger.LogCommandOutput(fmt.Sprintf("Starting a new %s session.\n", filepath.Base(e.containerShell())))
+
+	log.Debug("Starting stateful shell")
+
+	args, err := e.runArgs(main)
+	if err != nil {
+		return err
+	}
+
+	args = append([]string{"run", "--interactive", "--tty"}, args...)
+	args = append(args, "--volume", fmt.Sprintf("%s:%s:ro", e.tmpDirectory, e.tmpDirectory))
+	args = append(args, "--tmpfs", e.envTmpfsPath+":"+ContainerEnvTmpfsOptions)
+	for _, fileInjection := range e.fileInjections {
+		args = append(args, "--volume", fmt.Sprintf("%s:%s", fileInjection.HostPath, fileInjection.Destination))
+	}
+
+	/*
+	 * The size of the container's terminal follows the size of the PTY
+	 * podman runs in, but TERM needs to be passed explicitly.
+	 */
+	if e.terminal.Type != "" {
+		args = append(args, "--env", "TERM="+e.terminal.Type)
+	}
+
+	args = append(args, main.Image, e.containerShell())
+	args = append(args, e.shellArgs...)
+
+	adapter := shell.AdapterFor(e.containerShell())
+	shell, err := shell.NewShellFromExecAndArgs(e.executable, args, e.tmpDirectory)
+	if err != nil {
+		return err
+	}
+
+	shell.Adapter = adapter
+	shell.Terminal = e.terminal
+	err = shell.Start()
+	if err != nil {
+		return err
+	}
+
+	e.Shell = shell
+	return nil
+}
+
+func (e *PodmanExecutor) writeFileInContainer(path string, content []byte) error {
+	args := append([]string{"exec", "-i", e.mainContainerName}, writeFileInContainerArgs(path)...)
+	cmd := e.command(args...)
+	cmd.Stdin = bytes.NewReader(content)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error writing %s in container: %v - %s", path, err, output)
+	}
+
+	return nil
+}
+
+func (e *PodmanExecutor) Stop() int {
+	e.closeShell()
+	return e.Cleanup()
+}
+
+/*
+ * Removing the pod removes all its containers.
+ */
+func (e *PodmanExecutor) Cleanup() int {
+	log.Info("Cleaning up podman resources")
+
+	if e.podCreated {
+		output, err := e.command("pod", "rm", "--force", "--ignore", e.resourcePrefix).CombinedOutput()
+		if err != nil {
+			log.Errorf("Error removing pod %s: %v - %s", e.resourcePrefix, err, output)
+		} else {
+			e.podCreated = false
+		}
+	}
+
+	for _, directory := range []string{e.secretDirectory, e.tmpDirectory} {
+		if err := shell.RemoveSecretDirectory(directory); err != nil {
+			log.Errorf("Error removing %s: %v", directory, err)
+		}
+	}
+
+	return 0
+}
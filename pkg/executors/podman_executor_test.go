@@ -0,0 +1,266 @@
+package executors
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	api "github.com/semaphoreci/agent/pkg/api"
+	"github.com/semaphoreci/agent/pkg/config"
+	eventlogger "github.com/semaphoreci/agent/pkg/eventlogger"
+	assert "github.com/stretchr/testify/assert"
+	require "github.com/stretchr/testify/require"
+)
+
+/*
+ * A podman replacement that records how it was called.
+ * The interactive container runs the shell in the host, like the commands executed in it,
+ * and the environment files given to the containers are kept.
+ */
+const fakePodmanScript = `#!/bin/bash
+dir=$(dirname "$0")
+echo "$*" >> "$dir/calls"
+
+args=("$@")
+for i in "${!args[@]}"; do
+  if [ "${args[$i]}" == "--env-file" ]; then
+    cat "${args[$((i+1))]}" >> "$dir/envs"
+  fi
+  if [ "${args[$i]}" == "--authfile" ]; then
+    cat "${args[$((i+1))]}" >> "$dir/auths"
+  fi
+done
+
+case "$1" in
+  image)
+    grep -qxF "$3" "$dir/images" 2>/dev/null
+    exit $?
+    ;;
+  pull)
+    image="${@: -1}"
+    if [ "$image" == "broken:1.0" ]; then
+      echo "Error: initializing source docker://$image: manifest unknown" >&2
+      exit 125
+    fi
+    echo "Trying to pull $image..." >&2
+    echo "Writing manifest to image destination" >&2
+    echo "$image" >> "$dir/images"
+    ;;
+  run)
+    if [ "$2" == "--detach" ]; then
+      echo "0123456789ab"
+      exit 0
+    fi
+    exec "${@: -1}"
+    ;;
+  exec)
+    shift 3
+    exec "$@"
+    ;;
+esac
+`
+
+func setupFakePodman(t *testing.T) string {
+	directory := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(directory, "images"), []byte("ruby:3.2\n"), 0600))
+	return writeFakeExecutable(t, directory, "podman", fakePodmanScript)
+}
+
+func Test__PodmanExecutor(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("podman executor is not supported in Windows")
+	}
+
+	// the shell runs in the host, so changes to the profile go to a temporary home
+	t.Setenv("HOME", t.TempDir())
+
+	injectedFile := filepath.Join(t.TempDir(), "injected")
+	require.NoError(t, os.WriteFile(injectedFile, []byte("hello"), 0600))
+
+	executable := setupFakePodman(t)
+	testLogger, testLoggerBackend := eventlogger.DefaultTestLogger()
+	e := NewPodmanExecutor(dockerExecutorRequest(), testLogger, PodmanExecutorOptions{
+		Executable:     executable,
+		FileInjections: []config.FileInjection{{HostPath: injectedFile, Destination: "/tmp/injected"}},
+	})
+
+	// the in-memory filesystem of the container is in the host too
+	e.envTmpfsPath = t.TempDir()
+
+	require.Equal(t, 0, e.Prepare())
+	assert.Equal(t, "semaphore-job-1234", e.resourcePrefix)
+	assert.Equal(t, "semaphore-job-1234-main", e.mainContainerName)
+
+	require.Equal(t, 0, e.Start())
+	require.NotNil(t, e.Shell)
+
+	// the environment files for the containers are removed once they start
+	assert.NoDirExists(t, e.secretDirectory)
+	assert.Equal(t, []string{"FOO=BAR"}, fakeExecutableOutput(t, executable, "envs"))
+
+	e.ExportEnvVars([]api.EnvVar{{Name: "A", Value: base64.StdEncoding.EncodeToString([]byte("B"))}}, []config.HostEnvVar{})
+	e.RunCommand("echo $A", false, "")
+
+	// the environment is written by the container's user, and only readable by it
+	info, err := os.Stat(e.envFileName())
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	injectedPath := filepath.Join(t.TempDir(), "secret")
+	e.InjectFiles([]api.File{{Path: injectedPath, Content: base64.StdEncoding.EncodeToString([]byte("hello")), Mode: "0640"}})
+	info, err = os.Stat(injectedPath)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+
+	tmpDirectory := e.tmpDirectory
+	assert.Equal(t, 0, e.Stop())
+	assert.NoDirExists(t, tmpDirectory)
+
+	label := "--label " + DockerExecutorJobLabel + "=1234"
+	assert.Equal(t, []string{
+		"image exists ruby:3.2",
+		"image exists postgres:9.6",
+		"pull postgres:9.6",
+		"image exists redis",
+		"pull redis",
+		"pod create --name semaphore-job-1234 " + label + " --add-host main:127.0.0.1 --add-host db:127.0.0.1 --add-host cache:127.0.0.1",
+		"run --detach --pod semaphore-job-1234 --name semaphore-job-1234-db " + label + " --user postgres --env-file " + filepath.Join(e.secretDirectory, "db.env") + " postgres:9.6 postgres -c max_connections=200",
+		"run --detach --pod semaphore-job-1234 --name semaphore-job-1234-cache " + label + " redis",
+		"run --interactive --tty --pod semaphore-job-1234 --name semaphore-job-1234-main " + label + ` --entrypoint ["/docker-entrypoint.sh"]` +
+			" --volume " + tmpDirectory + ":" + tmpDirectory + ":ro --tmpfs " + e.envTmpfsPath + ":mode=1777 --volume " + injectedFile + ":/tmp/injected ruby:3.2 bash",
+		`exec -i semaphore-job-1234-main sh -c umask 077 && cat > "$0" ` + e.envFileName(),
+		`exec -i semaphore-job-1234-main sh -c umask 077 && cat > "$0" ` + filepath.Join(e.envTmpfsPath, "file"),
+		"pod rm --force --ignore semaphore-job-1234",
+	}, fakeExecutableOutput(t, executable, "calls"))
+
+	simplifiedEvents, err := testLoggerBackend.SimplifiedEvents(true, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"directive: Pulling images...",
+		"Image ruby:3.2 is already present\nPulling postgres:9.6...\nTrying to pull postgres:9.6...\nWriting manifest to image destination\nPulling redis...\nTrying to pull redis...\nWriting manifest to image destination\n",
+		"Exit Code: 0",
+		"directive: Starting the containers...",
+		"Starting db...\nStarting cache...\nStarting a new bash session.\n",
+		"Exit Code: 0",
+		"directive: Exporting environment variables",
+		"Exporting A\n",
+		"Exit Code: 0",
+		"directive: echo $A",
+		"B\n",
+		"Exit Code: 0",
+		"directive: Injecting Files",
+		"Injecting " + injectedPath + " with file mode 0640\n",
+		"Exit Code: 0",
+	}, simplifiedEvents)
+}
+
+func Test__PodmanExecutor__UsesImagePullCredentials(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("podman executor is not supported in Windows")
+	}
+
+	executable := setupFakePodman(t)
+	request := dockerExecutorRequest()
+	request.Compose.Containers = request.Compose.Containers[1:2]
+	request.Compose.ImagePullCredentials = imagePullCredentials(api.ImagePullCredentialsStrategyDockerHub,
+		api.EnvVar{Name: "DOCKERHUB_USERNAME", Value: "user"},
+		api.EnvVar{Name: "DOCKERHUB_PASSWORD", Value: "pass"},
+	)
+
+	testLogger, testLoggerBackend := eventlogger.DefaultTestLogger()
+	e := NewPodmanExecutor(request, testLogger, PodmanExecutorOptions{Executable: executable})
+	require.Equal(t, 0, e.Prepare())
+	defer e.Cleanup()
+
+	require.Equal(t, 0, e.setUpImagePullCredentials(e.writeAuthFile))
+	require.Equal(t, 0, e.pullImages("Pulling images...", e.pullImage))
+
+	info, err := os.Stat(e.authFileName())
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	assert.Equal(t, []string{
+		"image exists postgres:9.6",
+		"pull --authfile " + e.authFileName() + " postgres:9.6",
+	}, fakeExecutableOutput(t, executable, "calls"))
+
+	assert.Equal(t, []string{
+		`{"auths":{"docker.io":{"username":"user","password":"pass","auth":"dXNlcjpwYXNz"}}}`,
+	}, fakeExecutableOutput(t, executable, "auths"))
+
+	simplifiedEvents, err := testLoggerBackend.SimplifiedEvents(true, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"directive: Setting up image pull credentials",
+		"Setting up credentials for docker.io\n",
+		"Exit Code: 0",
+		"directive: Pulling images...",
+		"Pulling postgres:9.6...\nTrying to pull postgres:9.6...\nWriting manifest to image destination\n",
+		"Exit Code: 0",
+	}, simplifiedEvents)
+}
+
+func Test__PodmanExecutor__PullFailure(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("podman executor is not supported in Windows")
+	}
+
+	executable := setupFakePodman(t)
+	request := dockerExecutorRequest()
+	request.Compose.Containers[1].Image = "broken:1.0"
+
+	testLogger, testLoggerBackend := eventlogger.DefaultTestLogger()
+	e := NewPodmanExecutor(request, testLogger, PodmanExecutorOptions{Executable: executable})
+	assertStartFailsPullingImages(t, e, testLoggerBackend, "Pulling images...",
+		"Image ruby:3.2 is already present\nPulling broken:1.0...\nError: initializing source docker://broken:1.0: manifest unknown\nerror pulling image broken:1.0: exit status 125\n",
+	)
+
+	assert.Nil(t, e.Shell)
+	assert.NoDirExists(t, e.secretDirectory)
+	assert.Equal(t, 0, e.Stop())
+
+	// no pod was created, so there's nothing to remove
+	assert.Equal(t, []string{
+		"image exists ruby:3.2",
+		"image exists broken:1.0",
+		"pull broken:1.0",
+	}, fakeExecutableOutput(t, executable, "calls"))
+}
+
+func Test__PodmanExecutor__MultilineContainerEnvVarsAreRejected(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("podman executor is not supported in Windows")
+	}
+
+	executable := setupFakePodman(t)
+	request := dockerExecutorRequest()
+	request.Compose.Containers[1].EnvVars = []api.EnvVar{
+		{Name: "KEY", Value: base64.StdEncoding.EncodeToString([]byte("line1\nline2"))},
+	}
+
+	testLogger, _ := eventlogger.DefaultTestLogger()
+	e := NewPodmanExecutor(request, testLogger, PodmanExecutorOptions{Executable: executable})
+	require.Equal(t, 0, e.Prepare())
+	defer e.Cleanup()
+
+	_, err := e.runArgs(request.Compose.Containers[1])
+	assert.ErrorContains(t, err, "KEY for db has multiple lines, which is not supported")
+}
+
+func Test__PodmanExecutor__AttachCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("podman executor is not supported in Windows")
+	}
+
+	executable := setupFakePodman(t)
+	testLogger, _ := eventlogger.DefaultTestLogger()
+	e := NewPodmanExecutor(dockerExecutorRequest(), testLogger, PodmanExecutorOptions{Executable: executable})
+	assertAttachCommand(t, e, "the job container is not running", func() []string {
+		return []string{
+			executable, "exec", "-i", "-t", "semaphore-job-1234-main", "bash", "-c",
+			"source " + e.envFileName() + "; exec bash --login",
+		}
+	})
+}
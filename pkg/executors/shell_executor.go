@@ -4,9 +4,11 @@ import (
 	"bytes"
 	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	api "github.com/semaphoreci/agent/pkg/api"
@@ -24,17 +26,68 @@ type ShellExecutor struct {
 	tmpDirectory            string
 	hasSSHJumpPoint         bool
 	shouldUpdateBashProfile bool
-	cleanupAfterClose       []string
+	shellExecutable         string
+	shellArgs               []string
+	disablePTY              bool
+	trackEnvironment        bool
+	outputLimits            shell.OutputLimits
+	terminal                shell.Terminal
+	lastTermination         *shell.Termination
+
+	// The environment files created for the job, sourced by attached shells.
+	envDirectory string
+	envFiles     []string
+	envFilesLock sync.Mutex
+
+	// The lines appended to the profile file, removed when the job is done.
+	profile profileChanges
+}
+
+type ShellExecutorOptions struct {
+	SelfHosted bool
+
+	// If empty, bash is used on Linux and macOS, and PowerShell on Windows.
+	ShellExecutable string
+
+	// If empty, the default arguments for the shell are used.
+	ShellArgs []string
+
+	// Run commands without a PTY, reporting stdout and stderr separately.
+	// Only used on Linux and macOS, since Windows never uses a PTY.
+	DisablePTY bool
+
+	// Emit env_changed events for commands that change the environment.
+	TrackEnvironmentChanges bool
+
+	// Without a PTY, stdout and stderr are limited separately.
+	OutputLimits shell.OutputLimits
+
+	// Size and type of the local PTY the commands run in. Not used if DisablePTY is set.
+	Terminal shell.Terminal
 }
 
 func NewShellExecutor(request *api.JobRequest, logger *eventlogger.Logger, selfHosted bool) *ShellExecutor {
+	return NewShellExecutorWithOptions(request, logger, ShellExecutorOptions{SelfHosted: selfHosted})
+}
+
+func NewShellExecutorWithOptions(request *api.JobRequest, logger *eventlogger.Logger, options ShellExecutorOptions) *ShellExecutor {
+	executable := options.ShellExecutable
+	if executable == "" {
+		executable = shell.Executable()
+	}
+
 	return &ShellExecutor{
 		Logger:                  logger,
 		jobRequest:              request,
 		tmpDirectory:            os.TempDir(),
-		hasSSHJumpPoint:         !selfHosted,
-		shouldUpdateBashProfile: !selfHosted,
-		cleanupAfterClose:       []string{},
+		hasSSHJumpPoint:         !options.SelfHosted,
+		shouldUpdateBashProfile: !options.SelfHosted,
+		shellExecutable:         executable,
+		shellArgs:               options.ShellArgs,
+		disablePTY:              options.DisablePTY,
+		trackEnvironment:        options.TrackEnvironmentChanges,
+		outputLimits:            options.OutputLimits,
+		terminal:                options.Terminal,
 	}
 }
 
@@ -74,12 +127,13 @@ func (e *ShellExecutor) setUpSSHJumpPoint() int {
 }
 
 func (e *ShellExecutor) Start() int {
-	sh, err := shell.NewShell(e.tmpDirectory)
+	sh, err := e.newShell()
 	if err != nil {
 		log.Debug(sh)
 		return 1
 	}
 
+	sh.TrackEnvironment = e.trackEnvironment
 	e.Shell = sh
 
 	err = e.Shell.Start()
@@ -91,6 +145,31 @@ func (e *ShellExecutor) Start() int {
 	return 0
 }
 
+/*
+ * Without a PTY, each command runs in a new shell, so we don't use
+ * the default arguments, which would read the profile files every time.
+ */
+func (e *ShellExecutor) newShell() (*shell.Shell, error) {
+	if !e.disablePTY || runtime.GOOS == "windows" {
+		sh, err := shell.NewLocalShell(e.shellExecutable, e.shellArgs, e.tmpDirectory)
+		if err != nil {
+			return nil, err
+		}
+
+		sh.Terminal = e.terminal
+		return sh, nil
+	}
+
+	sh, err := shell.NewShellFromExecAndArgs(e.shellExecutable, e.shellArgs, e.tmpDirectory)
+	if err != nil {
+		return nil, err
+	}
+
+	sh.DisablePTY = true
+	sh.DetectOOMKills = true
+	return sh, nil
+}
+
 func (e *ShellExecutor) envFileName() string {
 	//
 	// On Windows, we do not use the environment file at all during the job,
@@ -99,21 +178,21 @@ func (e *ShellExecutor) envFileName() string {
 	// the file has to be suffixed with the .ps1 suffix.
 	//
 	if runtime.GOOS == "windows" {
-		return filepath.Join(e.tmpDirectory, fmt.Sprintf(".env-%d.ps1", time.Now().UnixNano()))
+		return filepath.Join(e.envDirectory, fmt.Sprintf(".env-%d.ps1", time.Now().UnixNano()))
 	}
 
-	return filepath.Join(e.tmpDirectory, fmt.Sprintf(".env-%d", time.Now().UnixNano()))
+	return filepath.Join(e.envDirectory, fmt.Sprintf(".env-%d", time.Now().UnixNano()))
 }
 
 func (e *ShellExecutor) ExportEnvVars(envVars []api.EnvVar, hostEnvVars []config.HostEnvVar) int {
-	commandStartedAt := int(time.Now().Unix())
+	commandStartedAt := time.Now()
 	directive := "Exporting environment variables"
 	exitCode := 0
 
 	e.Logger.LogCommandStarted(directive)
 
 	defer func() {
-		commandFinishedAt := int(time.Now().Unix())
+		commandFinishedAt := time.Now()
 
 		e.Logger.LogCommandFinished(directive, exitCode, commandStartedAt, commandFinishedAt)
 	}()
@@ -130,9 +209,17 @@ func (e *ShellExecutor) ExportEnvVars(envVars []api.EnvVar, hostEnvVars []config
 	 * since we keep track of the environment in-memory due to the lack of a PTY,
 	 * But we still need the file to be created for debug sessions.
 	 */
+	if e.envDirectory == "" {
+		e.envDirectory, err = createEnvDirectory()
+		if err != nil {
+			log.Error(err)
+			exitCode = 1
+			return exitCode
+		}
+	}
+
 	envFileName := e.envFileName()
-	e.cleanupAfterClose = append(e.cleanupAfterClose, envFileName)
-	err = environment.ToFile(envFileName, func(name string) {
+	err = environment.ToFileFor(envFileName, e.Shell.Adapter, func(name string) {
 		e.Logger.LogCommandOutput(fmt.Sprintf("Exporting %s\n", name))
 	})
 
@@ -141,6 +228,10 @@ func (e *ShellExecutor) ExportEnvVars(envVars []api.EnvVar, hostEnvVars []config
 		return exitCode
 	}
 
+	e.envFilesLock.Lock()
+	e.envFiles = append(e.envFiles, envFileName)
+	e.envFilesLock.Unlock()
+
 	/*
 	 * In windows, no PTY is used, so we don't source the environment file.
 	 * Instead, we keep track of the environment changes in the shell object itself.
@@ -151,16 +242,17 @@ func (e *ShellExecutor) ExportEnvVars(envVars []api.EnvVar, hostEnvVars []config
 		return exitCode
 	}
 
-	cmd := fmt.Sprintf("source %s", envFileName)
+	cmd := e.Shell.Adapter.Source(envFileName)
 	exitCode = e.RunCommand(cmd, true, "")
 	if exitCode != 0 {
 		return exitCode
 	}
 
 	if e.shouldUpdateBashProfile {
-		cmd = fmt.Sprintf("echo 'source %s' >> ~/.bash_profile", envFileName)
-		exitCode = e.RunCommand(cmd, true, "")
-		if exitCode != 0 {
+		err = e.profile.Append(e.Shell.Adapter.ProfilePath(), cmd)
+		if err != nil {
+			log.Errorf("Error updating profile: %v", err)
+			exitCode = 1
 			return exitCode
 		}
 	}
@@ -170,7 +262,7 @@ func (e *ShellExecutor) ExportEnvVars(envVars []api.EnvVar, hostEnvVars []config
 
 func (e *ShellExecutor) InjectFiles(files []api.File) int {
 	directive := "Injecting Files"
-	commandStartedAt := int(time.Now().Unix())
+	commandStartedAt := time.Now()
 	exitCode := 0
 
 	e.Logger.LogCommandStarted(directive)
@@ -232,7 +324,7 @@ func (e *ShellExecutor) InjectFiles(files []api.File) int {
 		}
 	}
 
-	commandFinishedAt := int(time.Now().Unix())
+	commandFinishedAt := time.Now()
 
 	e.Logger.LogCommandFinished(directive, exitCode, commandStartedAt, commandFinishedAt)
 
@@ -265,10 +357,13 @@ func (e *ShellExecutor) RunCommandWithOptions(options CommandOptions) int {
 		directive = options.Alias
 	}
 
-	p := e.Shell.NewProcessWithOutput(options.Command, func(output string) {
-		if !options.Silent {
-			e.Logger.LogCommandOutput(output)
-		}
+	p := e.Shell.NewProcessWithConfig(shell.Config{
+		Command:      options.Command,
+		Shell:        e.Shell,
+		StoragePath:  e.Shell.StoragePath,
+		OnOutput:     e.outputConsumer(options, eventlogger.OutputStreamStdout),
+		OnStderr:     e.stderrConsumer(options),
+		OutputLimits: e.outputLimitsFor(options),
 	})
 
 	if !options.Silent {
@@ -284,14 +379,92 @@ func (e *ShellExecutor) RunCommandWithOptions(options CommandOptions) int {
 	}
 
 	p.Run()
+	e.lastTermination = p.Termination
 
 	if !options.Silent {
-		e.Logger.LogCommandFinished(directive, p.ExitCode, p.StartedAt, p.FinishedAt)
+		if changes := p.EnvironmentChanges; changes != nil {
+			e.Logger.LogEnvironmentChanged(directive, changes.Added, changes.Changed, changes.Removed, changes.Directory)
+		}
+
+		e.Logger.LogCommandFinishedWithTermination(directive, p.ExitCode, p.StartedAt, p.FinishedAt, commandTermination(p.Termination))
 	}
 
 	return p.ExitCode
 }
 
+func (e *ShellExecutor) LastCommandTermination() *shell.Termination {
+	return e.lastTermination
+}
+
+func (e *ShellExecutor) Attach(cols, rows uint16) (AttachedShell, error) {
+	cmd, err := e.AttachCommand()
+	if err != nil {
+		return nil, err
+	}
+
+	return startAttachedCommand(cmd, cols, rows)
+}
+
+/*
+ * The attached shell runs in the agent's host, in the directory the job shell started in,
+ * with all the environment files created for the job sourced, in the order they were created.
+ */
+func (e *ShellExecutor) AttachCommand() (*exec.Cmd, error) {
+	if runtime.GOOS == "windows" {
+		return nil, fmt.Errorf("attaching to a job is not supported on Windows")
+	}
+
+	if e.Shell == nil {
+		return nil, fmt.Errorf("the job shell is not running")
+	}
+
+	e.envFilesLock.Lock()
+	script := attachScript(e.Shell.Adapter, e.envFiles, e.shellExecutable, e.shellArgs)
+	e.envFilesLock.Unlock()
+
+	// #nosec
+	cmd := exec.Command(e.shellExecutable, "-c", script)
+	cmd.Dir = e.Shell.Cwd
+	return cmd, nil
+}
+
+/*
+ * The output is only split into streams when the PTY is disabled.
+ * With a PTY, or on Windows, stdout and stderr are merged.
+ */
+func (e *ShellExecutor) separateOutputStreams() bool {
+	return runtime.GOOS != "windows" && e.disablePTY
+}
+
+func (e *ShellExecutor) outputConsumer(options CommandOptions, stream string) func(string) {
+	if !e.separateOutputStreams() {
+		stream = ""
+	}
+
+	return func(output string) {
+		if !options.Silent {
+			e.Logger.LogCommandOutputFromStream(output, stream)
+		}
+	}
+}
+
+func (e *ShellExecutor) stderrConsumer(options CommandOptions) func(string) {
+	if !e.separateOutputStreams() {
+		return nil
+	}
+
+	return e.outputConsumer(options, eventlogger.OutputStreamStderr)
+}
+
+// The output of silent commands is never logged, so there's nothing to limit.
+func (e *ShellExecutor) outputLimitsFor(options CommandOptions) shell.OutputLimits {
+	if options.Silent {
+		return shell.OutputLimits{}
+	}
+
+	return e.outputLimits
+}
+
 func (e *ShellExecutor) Stop() int {
 	log.Debug("Starting the process killing procedure")
 
@@ -317,10 +490,18 @@ func (e *ShellExecutor) Stop() int {
 }
 
 func (e *ShellExecutor) Cleanup() int {
-	for _, resource := range e.cleanupAfterClose {
-		if err := os.Remove(resource); err != nil {
-			log.Errorf("Error removing %s: %v\n", resource, err)
-		}
+	e.envFilesLock.Lock()
+	defer e.envFilesLock.Unlock()
+
+	if err := shell.RemoveSecretDirectory(e.envDirectory); err != nil {
+		log.Errorf("Error removing environment files in %s: %v", e.envDirectory, err)
+	}
+
+	e.envDirectory = ""
+	e.envFiles = nil
+
+	if err := e.profile.Revert(); err != nil {
+		log.Errorf("Error reverting changes to profile: %v", err)
 	}
 
 	return 0
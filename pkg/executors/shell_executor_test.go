@@ -14,8 +14,10 @@ import (
 	api "github.com/semaphoreci/agent/pkg/api"
 	"github.com/semaphoreci/agent/pkg/config"
 	eventlogger "github.com/semaphoreci/agent/pkg/eventlogger"
+	shell "github.com/semaphoreci/agent/pkg/shell"
 	testsupport "github.com/semaphoreci/agent/test/support"
 	assert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var UnicodeOutput1 = `特定の伝説に拠る物語の由来については諸説存在し。特定の伝説に拠る物語の由来については諸説存在し。特定の伝説に拠る物語の由来については諸説存在し。`
@@ -346,6 +348,214 @@ func Test__ShellExecutor__StoppingRunningJob(t *testing.T) {
 	})
 }
 
+func Test__ShellExecutor__SeparateOutputStreamsWithoutPTY(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	testLogger, testLoggerBackend := eventlogger.DefaultTestLogger()
+	e := NewShellExecutorWithOptions(basicRequest(), testLogger, ShellExecutorOptions{SelfHosted: true, DisablePTY: true})
+	assert.Zero(t, e.Prepare())
+	assert.Zero(t, e.Start())
+
+	assert.Zero(t, e.ExportEnvVars([]api.EnvVar{}, []config.HostEnvVar{{Name: "A", Value: "AAA"}}))
+	assert.Zero(t, e.RunCommand("echo $A", false, ""))
+	assert.Zero(t, e.RunCommand("echo oops >&2", false, ""))
+	assert.Equal(t, 1, e.RunCommand("sleep 30 & false", false, ""))
+	assert.Zero(t, e.Stop())
+	assert.Zero(t, e.Cleanup())
+
+	streams := []string{}
+	for _, event := range testLoggerBackend.Events {
+		if output, ok := event.(*eventlogger.CommandOutputEvent); ok {
+			streams = append(streams, output.Stream+": "+output.Output)
+		}
+	}
+
+	// messages from the agent itself don't come from any stream
+	assert.Equal(t, []string{
+		": Exporting A\n",
+		"stdout: AAA\n",
+		"stderr: oops\n",
+	}, streams)
+}
+
+func Test__ShellExecutor__TracksEnvironmentChanges(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	for _, disablePTY := range []bool{false, true} {
+		testLogger, testLoggerBackend := eventlogger.DefaultTestLogger()
+		e := NewShellExecutorWithOptions(basicRequest(), testLogger, ShellExecutorOptions{
+			SelfHosted:              true,
+			DisablePTY:              disablePTY,
+			TrackEnvironmentChanges: true,
+		})
+
+		assert.Zero(t, e.Prepare())
+		assert.Zero(t, e.Start())
+		assert.Zero(t, e.ExportEnvVars([]api.EnvVar{}, []config.HostEnvVar{{Name: "SECRET", Value: "hunter2"}}))
+		assert.Zero(t, e.RunCommand("echo hello", false, ""))
+		assert.Zero(t, e.RunCommand("export PATH=$PATH:/opt/bin; export NEW_VAR=1; unset SECRET; cd /tmp", false, ""))
+		assert.Zero(t, e.Stop())
+
+		simplifiedEvents, err := testLoggerBackend.SimplifiedEvents(false, false)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{
+			"directive: Exporting environment variables",
+			"Exit Code: 0",
+			"directive: echo hello",
+			"Exit Code: 0",
+			"directive: export PATH=$PATH:/opt/bin; export NEW_VAR=1; unset SECRET; cd /tmp",
+			"env_changed: added=[NEW_VAR] changed=[PATH] removed=[SECRET] directory=/tmp",
+			"Exit Code: 0",
+		}, simplifiedEvents, "disablePTY=%v", disablePTY)
+
+		for _, event := range testLoggerBackend.Events {
+			if changed, ok := event.(*eventlogger.EnvironmentChangedEvent); ok {
+				assert.NotContains(t, fmt.Sprintf("%v", changed), "hunter2")
+			}
+		}
+	}
+}
+
+func Test__ShellExecutor__LimitsOutput(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	testLogger, testLoggerBackend := eventlogger.DefaultTestLogger()
+	e := NewShellExecutorWithOptions(basicRequest(), testLogger, ShellExecutorOptions{
+		SelfHosted: true,
+		OutputLimits: shell.OutputLimits{
+			MaxBytesPerCommand:    20,
+			TailBytes:             10,
+			CollapseRepeatedLines: true,
+		},
+	})
+
+	assert.Zero(t, e.Prepare())
+	assert.Zero(t, e.Start())
+	assert.Zero(t, e.RunCommand("for i in $(seq 1 100); do echo same; done", false, ""))
+	assert.Zero(t, e.RunCommand("seq 1 100", false, ""))
+	assert.Zero(t, e.Stop())
+
+	simplifiedEvents, err := testLoggerBackend.SimplifiedEvents(true, true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"directive: for i in $(seq 1 100); do echo same; done",
+		"same\n[previous line repeated 99 more times]\n",
+		"Exit Code: 0",
+		"directive: seq 1 100",
+		"1\n2\n3\n4\n5\n[output limit of 20 bytes reached - omitting the rest of the output, except for the last 10 bytes]\n[275 bytes omitted]\n99\n100\n",
+		"Exit Code: 0",
+	}, simplifiedEvents)
+}
+
+func Test__ShellExecutor__ReportsSignals(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	// Only without a PTY the agent waits for the process killed by the signal.
+	testLogger, testLoggerBackend := eventlogger.DefaultTestLogger()
+	e := NewShellExecutorWithOptions(basicRequest(), testLogger, ShellExecutorOptions{SelfHosted: true, DisablePTY: true})
+	assert.Zero(t, e.Prepare())
+	assert.Zero(t, e.Start())
+
+	assert.Equal(t, 137, e.RunCommand("kill -KILL $$", false, ""))
+	assert.Equal(t, "SIGKILL", e.LastCommandTermination().Signal)
+	assert.Equal(t, 137, e.RunCommand("exit 137", false, ""))
+	assert.Nil(t, e.LastCommandTermination())
+	assert.Zero(t, e.Stop())
+
+	simplifiedEvents, err := testLoggerBackend.SimplifiedEvents(false, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"directive: kill -KILL $$",
+		"Exit Code: 137 (SIGKILL)",
+		"directive: exit 137",
+		"Exit Code: 137",
+	}, simplifiedEvents)
+}
+
+func Test__ShellExecutor__AttachCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	e, _ := setupShellExecutor(t, true)
+	assert.Zero(t, e.ExportEnvVars([]api.EnvVar{}, []config.HostEnvVar{{Name: "A", Value: "AAA"}}))
+	assert.Zero(t, e.ExportEnvVars([]api.EnvVar{}, []config.HostEnvVar{{Name: "B", Value: "BBB"}}))
+
+	// the attached shell has the environment of the job
+	cmd, err := e.AttachCommand()
+	require.NoError(t, err)
+	cmd.Stdin = strings.NewReader("echo $A $B\n")
+	output, err := cmd.Output()
+	require.NoError(t, err)
+	assert.Equal(t, "AAA BBB\n", string(output))
+
+	assert.Zero(t, e.Stop())
+}
+
+func Test__ShellExecutor__UsesTerminal(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	testsupport.SetupTestLogs()
+	testLogger, testLoggerBackend := eventlogger.DefaultTestLogger()
+	e := NewShellExecutorWithOptions(basicRequest(), testLogger, ShellExecutorOptions{
+		SelfHosted: true,
+		Terminal:   shell.Terminal{Cols: 200, Rows: 50, Type: "xterm-256color"},
+	})
+
+	assert.Zero(t, e.Prepare())
+	assert.Zero(t, e.Start())
+	assert.Zero(t, e.RunCommand("stty size; echo $TERM", false, ""))
+	assert.Zero(t, e.Stop())
+
+	simplifiedEvents, err := testLoggerBackend.SimplifiedEvents(true, true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"directive: stty size; echo $TERM",
+		"50 200\nxterm-256color\n",
+		"Exit Code: 0",
+	}, simplifiedEvents)
+}
+
+func Test__ShellExecutor__RemovesEnvironmentFilesAndProfileChanges(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	e, _ := setupShellExecutor(t, false)
+	assert.Zero(t, e.ExportEnvVars([]api.EnvVar{}, []config.HostEnvVar{{Name: "SECRET", Value: "hunter2"}}))
+
+	// the environment file is only readable by the agent's user
+	require.Len(t, e.envFiles, 1)
+	info, err := os.Stat(e.envFiles[0])
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	info, err = os.Stat(e.envDirectory)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	profile, err := os.ReadFile(filepath.Join(home, ".bash_profile"))
+	require.NoError(t, err)
+	assert.Equal(t, "source "+e.envFiles[0]+"\n", string(profile))
+
+	envDirectory := e.envDirectory
+	assert.Zero(t, e.Stop())
+	assert.NoDirExists(t, envDirectory)
+	assert.NoFileExists(t, filepath.Join(home, ".bash_profile"))
+}
+
 func Test__ShellExecutor__LargeCommandOutput(t *testing.T) {
 	e, testLoggerBackend := setupShellExecutor(t, true)
 
@@ -0,0 +1,752 @@
+package executors
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	api "github.com/semaphoreci/agent/pkg/api"
+	"github.com/semaphoreci/agent/pkg/config"
+	eventlogger "github.com/semaphoreci/agent/pkg/eventlogger"
+	shell "github.com/semaphoreci/agent/pkg/shell"
+	log "github.com/sirupsen/logrus"
+)
+
+const DefaultSSHPort = 22
+
+/*
+ * A remote machine the SSH executor can run jobs on.
+ */
+type SSHHost struct {
+	User string
+	Host string
+	Port int
+}
+
+/*
+ * Parses a host in the [user@]host[:port] format.
+ */
+func ParseSSHHost(value string) (SSHHost, error) {
+	host := SSHHost{Port: DefaultSSHPort}
+
+	rest := value
+	if i := strings.LastIndex(rest, "@"); i != -1 {
+		host.User = rest[:i]
+		rest = rest[i+1:]
+		if host.User == "" {
+			return SSHHost{}, fmt.Errorf("%s is not a valid SSH host: empty user", value)
+		}
+	}
+
+	if i := strings.LastIndex(rest, ":"); i != -1 {
+		port, err := strconv.Atoi(rest[i+1:])
+		if err != nil || port <= 0 || port > 65535 {
+			return SSHHost{}, fmt.Errorf("%s is not a valid SSH host: invalid port '%s'", value, rest[i+1:])
+		}
+
+		host.Port = port
+		rest = rest[:i]
+	}
+
+	if rest == "" || strings.ContainsAny(rest, " \t/") {
+		return SSHHost{}, fmt.Errorf("%s is not a valid SSH host: invalid hostname", value)
+	}
+
+	host.Host = rest
+	return host, nil
+}
+
+// The destination given to ssh and scp.
+func (h SSHHost) Destination() string {
+	if h.User == "" {
+		return h.Host
+	}
+
+	return h.User + "@" + h.Host
+}
+
+func (h SSHHost) String() string {
+	return fmt.Sprintf("%s:%d", h.Destination(), h.Port)
+}
+
+/*
+ * Runs the job in a remote machine, for hosts where the agent can't be installed.
+ * The stateful shell is started through ssh, and since the agent and the remote
+ * machine don't share a filesystem, commands are sent to it encoded in base64,
+ * and files are copied to it with scp. Everything the job needs in the remote
+ * machine is kept in a temporary directory, removed when the job finishes.
+ */
+type SSHExecutor struct {
+	Logger     *eventlogger.Logger
+	Shell      *shell.Shell
+	jobRequest *api.JobRequest
+
+	hosts              []SSHHost
+	host               *SSHHost
+	identityFile       string
+	knownHostsFile     string
+	acceptNewHostKeys  bool
+	sshExecutable      string
+	scpExecutable      string
+	localDirectory     string
+	remoteDirectory    string
+	fileInjections     []config.FileInjection
+	failOnMissingFiles bool
+	shellExecutable    string
+	shellArgs          []string
+	outputLimits       shell.OutputLimits
+	terminal           shell.Terminal
+	lastTermination    *shell.Termination
+}
+
+type SSHExecutorOptions struct {
+	// The machines the job can run on. One that accepts the connection is picked at random.
+	Hosts []SSHHost
+
+	// The private key used to authenticate. If empty, the ssh defaults are used.
+	IdentityFile string
+
+	// The known hosts file used to verify the remote machines.
+	// If empty, the ssh defaults are used.
+	KnownHostsFile string
+
+	// Accept the keys of remote machines not in the known hosts file,
+	// and add them to it. Otherwise, connecting to them fails.
+	AcceptNewHostKeys bool
+
+	// The ssh and scp executables. If empty, ssh and scp are used.
+	SSHExecutable string
+	SCPExecutable string
+
+	FileInjections     []config.FileInjection
+	FailOnMissingFiles bool
+
+	// The shell started in the remote machine. If empty, bash is used.
+	ShellExecutable string
+	ShellArgs       []string
+
+	// Applied to the output each command sends back through ssh.
+	OutputLimits shell.OutputLimits
+
+	// ssh gives the remote PTY the size of the local one, and forwards TERM.
+	Terminal shell.Terminal
+}
+
+func NewSSHExecutor(request *api.JobRequest, logger *eventlogger.Logger, options SSHExecutorOptions) *SSHExecutor {
+	sshExecutable := options.SSHExecutable
+	if sshExecutable == "" {
+		sshExecutable = "ssh"
+	}
+
+	scpExecutable := options.SCPExecutable
+	if scpExecutable == "" {
+		scpExecutable = "scp"
+	}
+
+	return &SSHExecutor{
+		Logger:             logger,
+		jobRequest:         request,
+		hosts:              options.Hosts,
+		identityFile:       options.IdentityFile,
+		knownHostsFile:     options.KnownHostsFile,
+		acceptNewHostKeys:  options.AcceptNewHostKeys,
+		sshExecutable:      sshExecutable,
+		scpExecutable:      scpExecutable,
+		fileInjections:     options.FileInjections,
+		failOnMissingFiles: options.FailOnMissingFiles,
+		shellExecutable:    options.ShellExecutable,
+		shellArgs:          options.ShellArgs,
+		outputLimits:       options.OutputLimits,
+		terminal:           options.Terminal,
+	}
+}
+
+func (e *SSHExecutor) remoteShell() string {
+	if e.shellExecutable == "" {
+		return shell.ShellBash
+	}
+
+	return e.shellExecutable
+}
+
+func (e *SSHExecutor) remoteEnvFileName() string {
+	return path.Join(e.remoteDirectory, ".env")
+}
+
+/*
+ * Options shared by ssh and scp. The agent can't answer any prompts,
+ * so the connection fails instead of asking for a password or passphrase.
+ */
+func (e *SSHExecutor) options() []string {
+	options := []string{
+		"-o", "BatchMode=yes",
+		"-o", "ConnectTimeout=10",
+		"-o", "ServerAliveInterval=15",
+	}
+
+	if e.identityFile != "" {
+		options = append(options, "-i", e.identityFile, "-o", "IdentitiesOnly=yes")
+	}
+
+	if e.knownHostsFile != "" {
+		options = append(options, "-o", "UserKnownHostsFile="+e.knownHostsFile)
+	}
+
+	/*
+	 * The job's secrets are sent to the remote machine,
+	 * so unknown machines are only trusted if explicitly allowed.
+	 */
+	if e.acceptNewHostKeys {
+		options = append(options, "-o", "StrictHostKeyChecking=accept-new")
+	} else {
+		options = append(options, "-o", "StrictHostKeyChecking=yes")
+	}
+
+	return options
+}
+
+/*
+ * The arguments for ssh, up to the remote command.
+ */
+func (e *SSHExecutor) sshArgs(host SSHHost, flags ...string) []string {
+	args := append(flags, e.options()...)
+	return append(args, "-p", strconv.Itoa(host.Port), host.Destination())
+}
+
+func (e *SSHExecutor) sshCommand(host SSHHost, command string) *exec.Cmd {
+	// #nosec
+	return exec.Command(e.sshExecutable, append(e.sshArgs(host), command)...)
+}
+
+/*
+ * The remote command is interpreted by the remote user's shell,
+ * so the arguments given to it need to be quoted.
+ */
+func sshQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'"'"'`) + "'"
+}
+
+/*
+ * Paths given by the job can be relative to the remote user's home directory,
+ * so a leading ~ is left for the remote shell to expand.
+ */
+var homePrefix = regexp.MustCompile(`^~[a-zA-Z0-9._-]*(/|$)`)
+
+func sshQuotePath(value string) string {
+	prefix := homePrefix.FindString(value)
+	if prefix == value {
+		return value
+	}
+
+	return prefix + sshQuote(strings.TrimPrefix(value, prefix))
+}
+
+func (e *SSHExecutor) Attach(cols, rows uint16) (AttachedShell, error) {
+	cmd, err := e.AttachCommand()
+	if err != nil {
+		return nil, err
+	}
+
+	return startAttachedCommand(cmd, cols, rows)
+}
+
+/*
+ * The attached shell runs in the same remote machine,
+ * with the job's environment file sourced.
+ */
+func (e *SSHExecutor) AttachCommand() (*exec.Cmd, error) {
+	if e.Shell == nil || e.host == nil {
+		return nil, fmt.Errorf("the job SSH session is not running")
+	}
+
+	// #nosec
+	return exec.Command(e.sshExecutable, append(e.sshArgs(*e.host, "-tt"), e.attachRemoteCommand())...), nil
+}
+
+func (e *SSHExecutor) attachRemoteCommand() string {
+	adapter := shell.AdapterFor(e.remoteShell())
+	script := attachScript(adapter, []string{e.remoteEnvFileName()}, e.remoteShell(), e.shellArgs)
+	return fmt.Sprintf("%s -c %s", e.remoteShell(), sshQuote(script))
+}
+
+func (e *SSHExecutor) Prepare() int {
+	if runtime.GOOS == "windows" {
+		log.Error("SSH executor is not supported in Windows")
+		return 1
+	}
+
+	if len(e.hosts) == 0 {
+		log.Error("No hosts specified for the SSH executor")
+		return 1
+	}
+
+	/*
+	 * Files are written to this directory before being copied
+	 * to the remote machine, and removed right after that.
+	 */
+	localDirectory, err := createEnvDirectory()
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	e.localDirectory = localDirectory
+
+	filesToInject, err := e.findValidFilesToInject()
+	if err != nil {
+		log.Errorf("Error injecting files: %v", err)
+		return 1
+	}
+
+	e.fileInjections = filesToInject
+	return 0
+}
+
+func (e *SSHExecutor) findValidFilesToInject() ([]config.FileInjection, error) {
+	filesToInject := []config.FileInjection{}
+	for _, fileInjection := range e.fileInjections {
+		err := fileInjection.CheckFileExists()
+		if err == nil {
+			filesToInject = append(filesToInject, fileInjection)
+		} else {
+			if e.failOnMissingFiles {
+				return nil, err
+			}
+
+			log.Warningf("Error injecting file %s - ignoring it: %v", fileInjection.HostPath, err)
+		}
+	}
+
+	return filesToInject, nil
+}
+
+func (e *SSHExecutor) Start() int {
+	commandStartedAt := time.Now()
+	directive := "Starting the SSH session..."
+	exitCode := 0
+
+	e.Logger.LogCommandStarted(directive)
+
+	defer func() {
+		e.Logger.LogCommandFinished(directive, exitCode, commandStartedAt, time.Now())
+	}()
+
+	err := e.connect()
+	if err == nil {
+		err = e.setUpSSHJumpPoint()
+	}
+
+	if err == nil {
+		err = e.startShell()
+	}
+
+	if err == nil {
+		err = e.injectConfiguredFiles()
+	}
+
+	if err != nil {
+		log.Errorf("Failed to start the SSH session: %v", err)
+		e.Logger.LogCommandOutput("Failed to start the SSH session\n")
+		e.Logger.LogCommandOutput(err.Error() + "\n")
+		exitCode = 1
+	}
+
+	return exitCode
+}
+
+/*
+ * The hosts are tried in random order, so the jobs are spread across them,
+ * and a machine that is down doesn't fail the job if another one is up.
+ * The temporary directory for the job is created in the first one that answers.
+ */
+func (e *SSHExecutor) connect() error {
+	hosts := make([]SSHHost, len(e.hosts))
+	copy(hosts, e.hosts)
+
+	// #nosec
+	rand.Shuffle(len(hosts), func(i, j int) {
+		hosts[i], hosts[j] = hosts[j], hosts[i]
+	})
+
+	for _, host := range hosts {
+		e.Logger.LogCommandOutput(fmt.Sprintf("Connecting to %s...\n", host))
+
+		cmd := e.sshCommand(host, `mktemp -d "${TMPDIR:-/tmp}/semaphore-job-XXXXXX"`)
+		stderr := bytes.Buffer{}
+		cmd.Stderr = &stderr
+
+		output, err := cmd.Output()
+		directory := strings.TrimSpace(string(output))
+		if err != nil || directory == "" {
+			log.Warningf("Failed to connect to %s: %v - %s", host, err, strings.TrimSpace(stderr.String()))
+			e.Logger.LogCommandOutput(fmt.Sprintf("Failed to connect to %s: %s\n", host, strings.TrimSpace(stderr.String())))
+			continue
+		}
+
+		host := host
+		e.host = &host
+		e.remoteDirectory = directory
+		log.Infof("Running job in %s, using %s", host, directory)
+		return nil
+	}
+
+	return fmt.Errorf("none of the SSH hosts are reachable")
+}
+
+/*
+ * Debug sessions open a shell in the same remote machine.
+ */
+func (e *SSHExecutor) setUpSSHJumpPoint() error {
+	err := InjectEntriesToAuthorizedKeys(e.jobRequest.SSHPublicKeys)
+	if err != nil {
+		return fmt.Errorf("failed to inject authorized keys: %v", err)
+	}
+
+	quote := func(args []string) string {
+		quoted := []string{e.sshExecutable}
+		for _, arg := range args {
+			quoted = append(quoted, sshQuote(arg))
+		}
+
+		return strings.Join(quoted, " ")
+	}
+
+	script := strings.Join([]string{
+		`#!/bin/bash`,
+		``,
+		`if [ $# -eq 0 ]; then`,
+		`  ` + quote(append(e.sshArgs(*e.host, "-tt"), e.attachRemoteCommand())),
+		`else`,
+		`  ` + quote(e.sshArgs(*e.host)) + ` "$@"`,
+		`fi`,
+	}, "\n")
+
+	err = SetUpSSHJumpPoint(script)
+	if err != nil {
+		return fmt.Errorf("failed to set up SSH jump point: %v", err)
+	}
+
+	return nil
+}
+
+/*
+ * The stateful shell runs in a PTY allocated in the remote machine.
+ * The size of the local PTY and TERM are forwarded by ssh.
+ */
+func (e *SSHExecutor) startShell() error {
+	e.Logger.LogCommandOutput(fmt.Sprintf("Starting a new %s session.\n", filepath.Base(e.remoteShell())))
+
+	log.Debug("Starting stateful shell")
+
+	adapter := shell.AdapterFor(e.remoteShell())
+	shellArgs := e.shellArgs
+	if len(shellArgs) == 0 {
+		shellArgs = adapter.DefaultArgs()
+	}
+
+	command := strings.Join(append([]string{e.remoteShell()}, shellArgs...), " ")
+	args := append(e.sshArgs(*e.host, "-tt"), command)
+
+	shell, err := shell.NewShellFromExecAndArgs(e.sshExecutable, args, e.localDirectory)
+	if err != nil {
+		return err
+	}
+
+	shell.Adapter = adapter
+	shell.Terminal = e.terminal
+	err = shell.Start()
+	if err != nil {
+		return err
+	}
+
+	e.Shell = shell
+	return nil
+}
+
+/*
+ * The files configured in the agent are copied to the remote machine,
+ * keeping their permissions.
+ */
+func (e *SSHExecutor) injectConfiguredFiles() error {
+	for _, fileInjection := range e.fileInjections {
+		err := e.copyToRemote(fileInjection.HostPath, fileInjection.Destination)
+		if err != nil {
+			return fmt.Errorf("error injecting %s: %v", fileInjection.HostPath, err)
+		}
+	}
+
+	return nil
+}
+
+/*
+ * Copies a local file into the job's remote directory.
+ */
+func (e *SSHExecutor) upload(localPath, name string) error {
+	remotePath := path.Join(e.remoteDirectory, name)
+
+	args := []string{"-q", "-P", strconv.Itoa(e.host.Port)}
+	args = append(args, e.options()...)
+	args = append(args, localPath, e.host.Destination()+":"+remotePath)
+
+	// #nosec
+	output, err := exec.Command(e.scpExecutable, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error copying file to %s: %v - %s", e.host, err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+/*
+ * Writes the content into a local file only readable by the agent,
+ * copies it into the job's remote directory, and removes the local file.
+ */
+func (e *SSHExecutor) uploadContent(content []byte, name string) error {
+	localPath := filepath.Join(e.localDirectory, name)
+	err := os.WriteFile(localPath, content, 0600)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err := shell.RemoveSecretFile(localPath); err != nil {
+			log.Errorf("Error removing %s: %v", localPath, err)
+		}
+	}()
+
+	return e.upload(localPath, name)
+}
+
+/*
+ * The file is copied into the job's remote directory first, and moved
+ * to its destination by the shell, so paths relative to the home directory work.
+ */
+func (e *SSHExecutor) copyToRemote(localPath, destination string) error {
+	err := e.upload(localPath, "file")
+	if err != nil {
+		return err
+	}
+
+	return e.moveToDestination(path.Join(e.remoteDirectory, "file"), destination)
+}
+
+func (e *SSHExecutor) moveToDestination(remotePath, destination string) error {
+	output, exitCode := e.GetOutputFromCommand(fmt.Sprintf("mkdir -p %s", sshQuotePath(path.Dir(destination))))
+	if exitCode != 0 {
+		return fmt.Errorf("failed to create destination path %s: %s", path.Dir(destination), output)
+	}
+
+	output, exitCode = e.GetOutputFromCommand(fmt.Sprintf("mv %s %s", sshQuote(remotePath), sshQuotePath(destination)))
+	if exitCode != 0 {
+		return fmt.Errorf("failed to move to destination path %s: %s", destination, output)
+	}
+
+	return nil
+}
+
+/*
+ * The environment file is copied to the remote machine and sourced.
+ * The remote profile is not changed, since the machine is shared with other jobs,
+ * so attached shells source the file themselves.
+ */
+func (e *SSHExecutor) ExportEnvVars(envVars []api.EnvVar, hostEnvVars []config.HostEnvVar) int {
+	commandStartedAt := time.Now()
+	directive := "Exporting environment variables"
+	exitCode := 0
+
+	e.Logger.LogCommandStarted(directive)
+
+	defer func() {
+		e.Logger.LogCommandFinished(directive, exitCode, commandStartedAt, time.Now())
+	}()
+
+	environment, err := shell.CreateEnvironment(envVars, hostEnvVars)
+	if err != nil {
+		log.Errorf("Error creating environment: %v", err)
+		exitCode = 1
+		return exitCode
+	}
+
+	script := environment.ToScriptFor(e.Shell.Adapter, func(name string) {
+		e.Logger.LogCommandOutput(fmt.Sprintf("Exporting %s\n", name))
+	})
+
+	err = e.uploadContent([]byte(script), path.Base(e.remoteEnvFileName()))
+	if err != nil {
+		log.Errorf("Error copying environment file: %v", err)
+		exitCode = 255
+		return exitCode
+	}
+
+	exitCode = e.RunCommand(e.Shell.Adapter.Source(e.remoteEnvFileName()), true, "")
+	return exitCode
+}
+
+func (e *SSHExecutor) InjectFiles(files []api.File) int {
+	directive := "Injecting Files"
+	commandStartedAt := time.Now()
+	exitCode := 0
+
+	e.Logger.LogCommandStarted(directive)
+
+	defer func() {
+		e.Logger.LogCommandFinished(directive, exitCode, commandStartedAt, time.Now())
+	}()
+
+	for _, f := range files {
+		e.Logger.LogCommandOutput(fmt.Sprintf("Injecting %s with file mode %s\n", f.Path, f.Mode))
+
+		content, err := f.Decode()
+		if err != nil {
+			e.Logger.LogCommandOutput("Failed to decode the content of the file.\n")
+			exitCode = 1
+			return exitCode
+		}
+
+		err = e.uploadContent(content, "file")
+		if err != nil {
+			e.Logger.LogCommandOutput(err.Error() + "\n")
+			exitCode = 255
+			return exitCode
+		}
+
+		destPath := f.Path
+		if f.Path[0] != '/' && f.Path[0] != '~' {
+			destPath = "~/" + f.Path
+		}
+
+		err = e.moveToDestination(path.Join(e.remoteDirectory, "file"), destPath)
+		if err != nil {
+			e.Logger.LogCommandOutput(err.Error() + "\n")
+			exitCode = 1
+			return exitCode
+		}
+
+		exitCode = e.RunCommand(fmt.Sprintf("chmod %s %s", sshQuote(f.Mode), sshQuotePath(destPath)), true, "")
+		if exitCode != 0 {
+			e.Logger.LogCommandOutput(fmt.Sprintf("Failed to set file mode to %s\n", f.Mode))
+			return exitCode
+		}
+	}
+
+	return exitCode
+}
+
+func (e *SSHExecutor) GetOutputFromCommand(command string) (string, int) {
+	out := bytes.Buffer{}
+	p := e.Shell.NewProcessWithConfig(shell.Config{
+		UseBase64Encoding: true,
+		Command:           command,
+		Shell:             e.Shell,
+		OnOutput: func(output string) {
+			out.WriteString(output)
+		},
+	})
+
+	p.Run()
+	return out.String(), p.ExitCode
+}
+
+func (e *SSHExecutor) RunCommand(command string, silent bool, alias string) int {
+	return e.RunCommandWithOptions(CommandOptions{
+		Command: command,
+		Silent:  silent,
+		Alias:   alias,
+		Warning: "",
+	})
+}
+
+func (e *SSHExecutor) RunCommandWithOptions(options CommandOptions) int {
+	directive := options.Command
+	if options.Alias != "" {
+		directive = options.Alias
+	}
+
+	outputLimits := e.outputLimits
+	if options.Silent {
+		outputLimits = shell.OutputLimits{}
+	}
+
+	// The remote machine can't read the files written by the agent.
+	p := e.Shell.NewProcessWithConfig(shell.Config{
+		UseBase64Encoding: true,
+		Command:           options.Command,
+		Shell:             e.Shell,
+		OutputLimits:      outputLimits,
+		OnOutput: func(output string) {
+			if !options.Silent {
+				e.Logger.LogCommandOutput(output)
+			}
+		},
+	})
+
+	if !options.Silent {
+		e.Logger.LogCommandStarted(directive)
+
+		if options.Alias != "" {
+			e.Logger.LogCommandOutput(fmt.Sprintf("Running: %s\n", options.Command))
+		}
+
+		if options.Warning != "" {
+			e.Logger.LogCommandOutput(fmt.Sprintf("Warning: %s\n", options.Warning))
+		}
+	}
+
+	p.Run()
+	e.lastTermination = p.Termination
+
+	if !options.Silent {
+		e.Logger.LogCommandFinishedWithTermination(directive, p.ExitCode, p.StartedAt, p.FinishedAt, commandTermination(p.Termination))
+	}
+
+	return p.ExitCode
+}
+
+func (e *SSHExecutor) LastCommandTermination() *shell.Termination {
+	return e.lastTermination
+}
+
+func (e *SSHExecutor) Stop() int {
+	log.Debug("Starting the process killing procedure")
+
+	if e.Shell != nil {
+		err := e.Shell.Close()
+		if err != nil {
+			log.Errorf("Process killing procedure returned an error %+v\n", err)
+		}
+	}
+
+	return e.Cleanup()
+}
+
+/*
+ * The remote directory holds the job's environment,
+ * so it is removed through a new connection, even if the shell is gone.
+ */
+func (e *SSHExecutor) Cleanup() int {
+	log.Info("Cleaning up SSH executor resources")
+
+	if e.host != nil && e.remoteDirectory != "" {
+		output, err := e.sshCommand(*e.host, "rm -rf "+sshQuote(e.remoteDirectory)).CombinedOutput()
+		if err != nil {
+			log.Errorf("Error removing %s from %s: %v - %s", e.remoteDirectory, e.host, err, output)
+		} else {
+			e.remoteDirectory = ""
+		}
+	}
+
+	if err := shell.RemoveSecretDirectory(e.localDirectory); err != nil {
+		log.Errorf("Error removing %s: %v", e.localDirectory, err)
+	}
+
+	return 0
+}
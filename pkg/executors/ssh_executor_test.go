@@ -0,0 +1,357 @@
+package executors
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	api "github.com/semaphoreci/agent/pkg/api"
+	"github.com/semaphoreci/agent/pkg/config"
+	eventlogger "github.com/semaphoreci/agent/pkg/eventlogger"
+	assert "github.com/stretchr/testify/assert"
+	require "github.com/stretchr/testify/require"
+)
+
+/*
+ * An ssh replacement that runs the remote command in the local host,
+ * recording the destination and the command it was called with.
+ * Destinations containing "unreachable" refuse the connection.
+ */
+const fakeSSHScript = `#!/bin/bash
+dir=$(dirname "$0")
+
+while [ $# -gt 0 ]; do
+  case "$1" in
+    -o|-p|-i) shift 2 ;;
+    -*) shift ;;
+    *) break ;;
+  esac
+done
+
+destination="$1"
+shift
+
+echo "$destination $*" >> "$dir/calls"
+if [[ "$destination" == *unreachable* ]]; then
+  echo "ssh: connect to host $destination port 22: Connection refused" >&2
+  exit 255
+fi
+
+exec bash -c "$*"
+`
+
+/*
+ * An scp replacement that copies the file in the local host.
+ */
+const fakeSCPScript = `#!/bin/bash
+dir=$(dirname "$0")
+
+while [ $# -gt 0 ]; do
+  case "$1" in
+    -o|-P|-i) shift 2 ;;
+    -*) shift ;;
+    *) break ;;
+  esac
+done
+
+echo "$(basename "$1") $2" >> "$dir/copies"
+cp "$1" "${2#*:}"
+`
+
+func setupFakeSSH(t *testing.T) (string, string) {
+	directory := t.TempDir()
+	return writeFakeExecutable(t, directory, "ssh", fakeSSHScript), writeFakeExecutable(t, directory, "scp", fakeSCPScript)
+}
+
+func Test__SSHExecutor(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("SSH executor is not supported in Windows")
+	}
+
+	// the remote shell runs in the host, so a temporary home is used
+	t.Setenv("HOME", t.TempDir())
+
+	destinationDirectory := t.TempDir()
+	injectedFile := filepath.Join(t.TempDir(), "injected")
+	require.NoError(t, os.WriteFile(injectedFile, []byte("hello"), 0600))
+
+	ssh, scp := setupFakeSSH(t)
+	testLogger, testLoggerBackend := eventlogger.DefaultTestLogger()
+	e := NewSSHExecutor(&api.JobRequest{JobID: "1234"}, testLogger, SSHExecutorOptions{
+		Hosts:          []SSHHost{{User: "semaphore", Host: "build-1", Port: 2222}},
+		SSHExecutable:  ssh,
+		SCPExecutable:  scp,
+		FileInjections: []config.FileInjection{{HostPath: injectedFile, Destination: filepath.Join(destinationDirectory, "configured")}},
+	})
+
+	require.Equal(t, 0, e.Prepare())
+	require.Equal(t, 0, e.Start())
+	require.NotNil(t, e.Shell)
+	assert.Equal(t, "build-1", e.host.Host)
+	assert.DirExists(t, e.remoteDirectory)
+
+	e.ExportEnvVars([]api.EnvVar{{Name: "A", Value: base64.StdEncoding.EncodeToString([]byte("B"))}}, []config.HostEnvVar{})
+	e.RunCommand("echo $A", false, "")
+
+	// the remote shell does not interpret the path
+	fromJob := filepath.Join(destinationDirectory, "from job $(touch pwned)")
+	e.InjectFiles([]api.File{{
+		Path:    fromJob,
+		Content: base64.StdEncoding.EncodeToString([]byte("world")),
+		Mode:    "0640",
+	}})
+
+	// the environment is only readable by the remote user
+	info, err := os.Stat(e.remoteEnvFileName())
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// #nosec
+	content, err := os.ReadFile(filepath.Join(destinationDirectory, "configured"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(content))
+
+	// #nosec
+	content, err = os.ReadFile(fromJob)
+	require.NoError(t, err)
+	assert.Equal(t, "world", string(content))
+
+	info, err = os.Stat(fromJob)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+
+	remoteDirectory := e.remoteDirectory
+	localDirectory := e.localDirectory
+	assert.Equal(t, 0, e.Stop())
+	assert.NoDirExists(t, remoteDirectory)
+	assert.NoDirExists(t, localDirectory)
+
+	assert.Equal(t, []string{
+		`semaphore@build-1 mktemp -d "${TMPDIR:-/tmp}/semaphore-job-XXXXXX"`,
+		"semaphore@build-1 bash --login",
+		"semaphore@build-1 rm -rf '" + remoteDirectory + "'",
+	}, fakeExecutableOutput(t, ssh, "calls"))
+
+	destination := "semaphore@build-1:" + remoteDirectory
+	assert.Equal(t, []string{
+		"injected " + destination + "/file",
+		".env " + destination + "/.env",
+		"file " + destination + "/file",
+	}, fakeExecutableOutput(t, ssh, "copies"))
+
+	simplifiedEvents, err := testLoggerBackend.SimplifiedEvents(true, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"directive: Starting the SSH session...",
+		"Connecting to semaphore@build-1:2222...\nStarting a new bash session.\n",
+		"Exit Code: 0",
+		"directive: Exporting environment variables",
+		"Exporting A\n",
+		"Exit Code: 0",
+		"directive: echo $A",
+		"B\n",
+		"Exit Code: 0",
+		"directive: Injecting Files",
+		"Injecting " + fromJob + " with file mode 0640\n",
+		"Exit Code: 0",
+	}, simplifiedEvents)
+}
+
+func Test__SSHExecutor__UsesReachableHost(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("SSH executor is not supported in Windows")
+	}
+
+	t.Setenv("HOME", t.TempDir())
+
+	ssh, scp := setupFakeSSH(t)
+	testLogger, _ := eventlogger.DefaultTestLogger()
+	e := NewSSHExecutor(&api.JobRequest{}, testLogger, SSHExecutorOptions{
+		Hosts: []SSHHost{
+			{Host: "unreachable-1", Port: 22},
+			{Host: "build-1", Port: 22},
+			{Host: "unreachable-2", Port: 22},
+		},
+		SSHExecutable: ssh,
+		SCPExecutable: scp,
+	})
+
+	require.Equal(t, 0, e.Prepare())
+	require.Equal(t, 0, e.Start())
+	assert.Equal(t, "build-1", e.host.Host)
+	assert.Equal(t, 0, e.Stop())
+}
+
+func Test__SSHExecutor__NoReachableHost(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("SSH executor is not supported in Windows")
+	}
+
+	ssh, scp := setupFakeSSH(t)
+	testLogger, testLoggerBackend := eventlogger.DefaultTestLogger()
+	e := NewSSHExecutor(&api.JobRequest{}, testLogger, SSHExecutorOptions{
+		Hosts:         []SSHHost{{Host: "unreachable", Port: 22}},
+		SSHExecutable: ssh,
+		SCPExecutable: scp,
+	})
+
+	require.Equal(t, 0, e.Prepare())
+	assert.Equal(t, 1, e.Start())
+	assert.Nil(t, e.Shell)
+
+	localDirectory := e.localDirectory
+	assert.Equal(t, 0, e.Stop())
+	assert.NoDirExists(t, localDirectory)
+
+	// nothing was created in the remote machine, so there's nothing to remove
+	assert.Equal(t, []string{
+		`unreachable mktemp -d "${TMPDIR:-/tmp}/semaphore-job-XXXXXX"`,
+	}, fakeExecutableOutput(t, ssh, "calls"))
+
+	simplifiedEvents, err := testLoggerBackend.SimplifiedEvents(true, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"directive: Starting the SSH session...",
+		"Connecting to unreachable:22...\nFailed to connect to unreachable:22: ssh: connect to host unreachable port 22: Connection refused\nFailed to start the SSH session\nnone of the SSH hosts are reachable\n",
+		"Exit Code: 1",
+	}, simplifiedEvents)
+}
+
+func Test__SSHExecutor__AttachCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("SSH executor is not supported in Windows")
+	}
+
+	t.Setenv("HOME", t.TempDir())
+
+	ssh, scp := setupFakeSSH(t)
+	testLogger, _ := eventlogger.DefaultTestLogger()
+	e := NewSSHExecutor(&api.JobRequest{}, testLogger, SSHExecutorOptions{
+		Hosts:          []SSHHost{{User: "semaphore", Host: "build-1", Port: 2222}},
+		IdentityFile:   "/home/agent/.ssh/id_ed25519",
+		KnownHostsFile: "/home/agent/.ssh/known_hosts",
+		SSHExecutable:  ssh,
+		SCPExecutable:  scp,
+	})
+
+	assertAttachCommand(t, e, "the job SSH session is not running", func() []string {
+		return []string{
+			ssh, "-tt",
+			"-o", "BatchMode=yes",
+			"-o", "ConnectTimeout=10",
+			"-o", "ServerAliveInterval=15",
+			"-i", "/home/agent/.ssh/id_ed25519",
+			"-o", "IdentitiesOnly=yes",
+			"-o", "UserKnownHostsFile=/home/agent/.ssh/known_hosts",
+			"-o", "StrictHostKeyChecking=yes",
+			"-p", "2222", "semaphore@build-1",
+			"bash -c 'source " + e.remoteEnvFileName() + "; exec bash --login'",
+		}
+	})
+}
+
+func Test__SSHExecutor__OnlyTrustsKnownHosts(t *testing.T) {
+	testLogger, _ := eventlogger.DefaultTestLogger()
+	hosts := []SSHHost{{Host: "build-1", Port: 22}}
+
+	// unknown machines are rejected, unless explicitly allowed
+	e := NewSSHExecutor(&api.JobRequest{}, testLogger, SSHExecutorOptions{Hosts: hosts})
+	assert.Equal(t, []string{
+		"-o", "BatchMode=yes",
+		"-o", "ConnectTimeout=10",
+		"-o", "ServerAliveInterval=15",
+		"-o", "StrictHostKeyChecking=yes",
+	}, e.options())
+
+	e = NewSSHExecutor(&api.JobRequest{}, testLogger, SSHExecutorOptions{
+		Hosts:             hosts,
+		KnownHostsFile:    "/home/agent/.ssh/known_hosts",
+		AcceptNewHostKeys: true,
+	})
+
+	assert.Equal(t, []string{
+		"-o", "BatchMode=yes",
+		"-o", "ConnectTimeout=10",
+		"-o", "ServerAliveInterval=15",
+		"-o", "UserKnownHostsFile=/home/agent/.ssh/known_hosts",
+		"-o", "StrictHostKeyChecking=accept-new",
+	}, e.options())
+}
+
+func Test__SSHQuotePath(t *testing.T) {
+	cases := map[string]string{
+		"/tmp/a b":        `'/tmp/a b'`,
+		"/tmp/$(id)":      `'/tmp/$(id)'`,
+		"~":               `~`,
+		"~/a'b":           `~/'a'"'"'b'`,
+		"~semaphore/file": `~semaphore/'file'`,
+		"~;id/file":       `'~;id/file'`,
+	}
+
+	for value, expected := range cases {
+		assert.Equal(t, expected, sshQuotePath(value), value)
+	}
+}
+
+func Test__ParseSSHHost(t *testing.T) {
+	cases := map[string]SSHHost{
+		"build-1":                  {Host: "build-1", Port: 22},
+		"semaphore@build-1":        {User: "semaphore", Host: "build-1", Port: 22},
+		"semaphore@10.0.0.1:2222":  {User: "semaphore", Host: "10.0.0.1", Port: 2222},
+		"build-1.example.com:2200": {Host: "build-1.example.com", Port: 2200},
+	}
+
+	for value, expected := range cases {
+		host, err := ParseSSHHost(value)
+		require.NoError(t, err, value)
+		assert.Equal(t, expected, host, value)
+	}
+
+	for _, value := range []string{"", "@build-1", "build-1:", "build-1:ssh", "build-1:70000", "semaphore@", "build 1"} {
+		_, err := ParseSSHHost(value)
+		assert.Error(t, err, value)
+	}
+}
+
+/*
+ * Runs a job against a real SSH server, if one is available:
+ *
+ *   SEMAPHORE_AGENT_TEST_SSH_HOST=user@localhost:22 \
+ *   SEMAPHORE_AGENT_TEST_SSH_IDENTITY_FILE=~/.ssh/id_ed25519 \
+ *   go test ./pkg/executors -run Test__SSHExecutor__RealServer
+ */
+func Test__SSHExecutor__RealServer(t *testing.T) {
+	value := os.Getenv("SEMAPHORE_AGENT_TEST_SSH_HOST")
+	if value == "" || runtime.GOOS == "windows" {
+		t.Skip("SEMAPHORE_AGENT_TEST_SSH_HOST is not set")
+	}
+
+	host, err := ParseSSHHost(value)
+	require.NoError(t, err)
+
+	testLogger, testLoggerBackend := eventlogger.DefaultTestLogger()
+	e := NewSSHExecutor(&api.JobRequest{}, testLogger, SSHExecutorOptions{
+		Hosts:        []SSHHost{host},
+		IdentityFile: os.Getenv("SEMAPHORE_AGENT_TEST_SSH_IDENTITY_FILE"),
+	})
+
+	require.Equal(t, 0, e.Prepare())
+	require.Equal(t, 0, e.Start())
+
+	e.ExportEnvVars([]api.EnvVar{{Name: "A", Value: base64.StdEncoding.EncodeToString([]byte("B"))}}, []config.HostEnvVar{})
+	e.InjectFiles([]api.File{{Path: "semaphore-ssh-executor-test", Content: base64.StdEncoding.EncodeToString([]byte("hello")), Mode: "0600"}})
+	e.RunCommand("echo $A; cat ~/semaphore-ssh-executor-test; rm ~/semaphore-ssh-executor-test", false, "")
+
+	remoteDirectory := e.remoteDirectory
+	assert.Equal(t, 0, e.Stop())
+
+	output, err := e.sshCommand(host, "test -d "+sshQuote(remoteDirectory)).CombinedOutput()
+	assert.Error(t, err, string(output))
+
+	simplifiedEvents, err := testLoggerBackend.SimplifiedEvents(true, true)
+	require.NoError(t, err)
+	assert.Contains(t, strings.Join(simplifiedEvents, ""), "directive: echo $A; cat ~/semaphore-ssh-executor-test; rm ~/semaphore-ssh-executor-testB\nhello")
+}
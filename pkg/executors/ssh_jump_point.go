@@ -3,6 +3,7 @@ package executors
 import (
 	"os"
 	"runtime"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -21,7 +22,7 @@ func SetUpSSHJumpPoint(script string) error {
 	path := "/tmp/ssh_jump_point"
 
 	// #nosec
-	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
@@ -30,3 +31,43 @@ func SetUpSSHJumpPoint(script string) error {
 	_ = f.Close()
 	return err
 }
+
+/*
+ * The jump point for the executors running the job in a container.
+ * It waits for the container to start, and opens a shell in it.
+ * The commands given run what follows them in the container,
+ * e.g. "podman exec -i main", and with a TTY, "podman exec -ti main".
+ */
+func containerSSHJumpPointScript(execCommand, ttyExecCommand string) string {
+	return strings.Join([]string{
+		`#!/bin/bash`,
+		``,
+		`cd /tmp`,
+		``,
+		`echo -n "Waiting for the container to start up"`,
+		``,
+		`while true; do`,
+		`  ` + execCommand + ` true 2>/dev/null`,
+		``,
+		`  if [ $? == 0 ]; then`,
+		`    echo ""`,
+		``,
+		`    break`,
+		`  else`,
+		`    sleep 3`,
+		`    echo -n "."`,
+		`  fi`,
+		`done`,
+		``,
+		`if [ $# -eq 0 ]; then`,
+		`  ` + ttyExecCommand + ` bash --login`,
+		`else`,
+		`  ` + execCommand + ` "$@"`,
+		`fi`,
+	}, "\n")
+}
+
+// The jump point for the executors running the job in a container through a container CLI.
+func cliSSHJumpPointScript(cli, containerName string) string {
+	return containerSSHJumpPointScript(cli+" exec -i "+containerName, cli+" exec -ti "+containerName)
+}
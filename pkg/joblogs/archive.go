@@ -0,0 +1,327 @@
+package joblogs
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/semaphoreci/agent/pkg/compression"
+	"github.com/semaphoreci/agent/pkg/eventlogger"
+	log "github.com/sirupsen/logrus"
+)
+
+const JSONLogsFileName = "job_log.json"
+const PlainTextLogsFileName = "job_log.txt"
+
+/*
+ * Keeps a local copy of the logs for every job the agent runs.
+ * Each job gets its own directory, named after the job ID,
+ * with the JSON event log and its plain-text rendering.
+ *
+ * Every time a new job is stored, the archive:
+ *   - compresses the entries for all previous jobs.
+ *   - removes entries older than MaxAge.
+ *   - removes the oldest entries until the archive is below MaxSizeInBytes.
+ *
+ * The entry for the job that was just stored is never removed.
+ */
+type Archive struct {
+	Config ArchiveConfig
+	mu     sync.Mutex
+}
+
+type ArchiveConfig struct {
+	Directory string
+
+	// Entries older than this are removed.
+	// Zero means entries are never removed because of their age.
+	MaxAge time.Duration
+
+	// When the archive goes above this size,
+	// the oldest entries are removed.
+	// Zero means entries are never removed because of the archive size.
+	MaxSizeInBytes int64
+}
+
+type entry struct {
+	jobID      string
+	path       string
+	modifiedAt time.Time
+	size       int64
+}
+
+func NewArchive(config ArchiveConfig) (*Archive, error) {
+	if config.Directory == "" {
+		return nil, fmt.Errorf("config.Directory must be specified")
+	}
+
+	if config.MaxAge < 0 {
+		return nil, fmt.Errorf("config.MaxAge can't be negative")
+	}
+
+	if config.MaxSizeInBytes < 0 {
+		return nil, fmt.Errorf("config.MaxSizeInBytes can't be negative")
+	}
+
+	// #nosec
+	if err := os.MkdirAll(config.Directory, 0750); err != nil {
+		return nil, fmt.Errorf("error creating directory '%s': %v", config.Directory, err)
+	}
+
+	return &Archive{Config: config}, nil
+}
+
+/*
+ * Stores the logs for a job in the archive, and applies the retention rules.
+ * This needs to be called before the logger is closed,
+ * since closing it removes the logs from disk.
+ */
+func (a *Archive) Store(jobID string, logger *eventlogger.Logger) error {
+	// Job IDs are used as directory names, so they can't escape the archive directory.
+	if !eventlogger.IsValidJobID(jobID) {
+		return fmt.Errorf("invalid job ID '%s'", jobID)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	jobDirectory := filepath.Join(a.Config.Directory, jobID)
+
+	// If the job was already archived before, we replace it.
+	if err := os.RemoveAll(jobDirectory); err != nil {
+		return fmt.Errorf("error removing previous entry for job '%s': %v", jobID, err)
+	}
+
+	// #nosec
+	if err := os.MkdirAll(jobDirectory, 0750); err != nil {
+		return fmt.Errorf("error creating directory '%s': %v", jobDirectory, err)
+	}
+
+	if err := a.storeJSONLogs(jobDirectory, logger); err != nil {
+		return err
+	}
+
+	if err := a.storePlainTextLogs(jobDirectory, logger); err != nil {
+		return err
+	}
+
+	log.Infof("Stored logs for job '%s' in %s", jobID, jobDirectory)
+	a.applyRetention(jobID)
+	return nil
+}
+
+func (a *Archive) storeJSONLogs(jobDirectory string, logger *eventlogger.Logger) error {
+	fileName := filepath.Join(jobDirectory, JSONLogsFileName)
+
+	// #nosec
+	file, err := os.Create(fileName)
+	if err != nil {
+		return fmt.Errorf("error creating file '%s': %v", fileName, err)
+	}
+
+	defer file.Close()
+
+	writer := bufio.NewWriterSize(file, 64*1024)
+	err = logger.Backend.Iterate(func(event []byte) error {
+		if _, err := writer.Write(event); err != nil {
+			return err
+		}
+
+		return writer.WriteByte('\n')
+	})
+
+	if err != nil {
+		return fmt.Errorf("error writing JSON logs to '%s': %v", fileName, err)
+	}
+
+	return writer.Flush()
+}
+
+func (a *Archive) storePlainTextLogs(jobDirectory string, logger *eventlogger.Logger) error {
+	tmpFileName, err := logger.GeneratePlainTextFileIn(jobDirectory)
+	if err != nil {
+		return fmt.Errorf("error generating plain text logs: %v", err)
+	}
+
+	fileName := filepath.Join(jobDirectory, PlainTextLogsFileName)
+	if err := os.Rename(tmpFileName, fileName); err != nil {
+		_ = os.Remove(tmpFileName)
+		return fmt.Errorf("error renaming '%s' to '%s': %v", tmpFileName, fileName, err)
+	}
+
+	return nil
+}
+
+/*
+ * Errors here are only logged, since a failure
+ * to clean up older entries shouldn't affect the job.
+ */
+func (a *Archive) applyRetention(currentJobID string) {
+	entries, err := a.listEntries()
+	if err != nil {
+		log.Errorf("Error listing job log archive entries: %v", err)
+		return
+	}
+
+	var totalSize int64
+	remaining := []entry{}
+
+	for _, e := range entries {
+		if e.jobID == currentJobID {
+			totalSize += e.size
+			remaining = append(remaining, e)
+			continue
+		}
+
+		if a.Config.MaxAge > 0 && time.Since(e.modifiedAt) > a.Config.MaxAge {
+			a.remove(e, "older than retention period")
+			continue
+		}
+
+		if err := compressEntry(e.path); err != nil {
+			log.Errorf("Error compressing logs in %s: %v", e.path, err)
+		}
+
+		size, err := directorySize(e.path)
+		if err != nil {
+			log.Errorf("Error determining size of %s: %v", e.path, err)
+		}
+
+		e.size = size
+		totalSize += size
+		remaining = append(remaining, e)
+	}
+
+	if a.Config.MaxSizeInBytes == 0 {
+		return
+	}
+
+	// Entries are sorted from oldest to newest,
+	// so we remove from the beginning until we are below the limit.
+	for _, e := range remaining {
+		if totalSize <= a.Config.MaxSizeInBytes {
+			return
+		}
+
+		if e.jobID == currentJobID {
+			continue
+		}
+
+		a.remove(e, "archive above maximum size")
+		totalSize -= e.size
+	}
+
+	if totalSize > a.Config.MaxSizeInBytes {
+		log.Warnf("Job log archive is %d bytes, above the maximum of %d bytes", totalSize, a.Config.MaxSizeInBytes)
+	}
+}
+
+func (a *Archive) remove(e entry, reason string) {
+	log.Infof("Removing archived logs for job '%s': %s", e.jobID, reason)
+	if err := os.RemoveAll(e.path); err != nil {
+		log.Errorf("Error removing %s: %v", e.path, err)
+	}
+}
+
+/*
+ * Returns all the entries in the archive, sorted from oldest to newest.
+ */
+func (a *Archive) listEntries() ([]entry, error) {
+	dirEntries, err := os.ReadDir(a.Config.Directory)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []entry{}
+	for _, dirEntry := range dirEntries {
+		if !dirEntry.IsDir() {
+			continue
+		}
+
+		info, err := dirEntry.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		path := filepath.Join(a.Config.Directory, dirEntry.Name())
+		size, err := directorySize(path)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry{
+			jobID:      dirEntry.Name(),
+			path:       path,
+			modifiedAt: info.ModTime(),
+			size:       size,
+		})
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].modifiedAt.Before(entries[j].modifiedAt)
+	})
+
+	return entries, nil
+}
+
+/*
+ * Compresses all the files in an entry that are not compressed yet.
+ * The modification time of the entry directory is preserved,
+ * since we use it to determine the age of the entry.
+ */
+func compressEntry(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	files, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if file.IsDir() || strings.HasSuffix(file.Name(), ".gz") {
+			continue
+		}
+
+		fileName := filepath.Join(path, file.Name())
+		if _, err := compression.Compress(fileName); err != nil {
+			return err
+		}
+
+		if err := os.Remove(fileName); err != nil {
+			return err
+		}
+	}
+
+	return os.Chtimes(path, info.ModTime(), info.ModTime())
+}
+
+func directorySize(path string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(path, func(_ string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		size += info.Size()
+		return nil
+	})
+
+	return size, err
+}
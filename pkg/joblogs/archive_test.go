@@ -0,0 +1,137 @@
+package joblogs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/semaphoreci/agent/pkg/eventlogger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test__StoreKeepsJSONAndPlainTextLogs(t *testing.T) {
+	archive, err := NewArchive(ArchiveConfig{Directory: t.TempDir()})
+	require.NoError(t, err)
+
+	logger := createLogger(t, "hello")
+	require.NoError(t, archive.Store("job-1", logger))
+
+	jsonLogs, err := os.ReadFile(filepath.Join(archive.Config.Directory, "job-1", JSONLogsFileName))
+	require.NoError(t, err)
+	assert.Contains(t, string(jsonLogs), `"event":"job_started"`)
+	assert.Contains(t, string(jsonLogs), `"output":"hello\n"`)
+	assert.Contains(t, string(jsonLogs), `"event":"job_finished"`)
+
+	plainTextLogs, err := os.ReadFile(filepath.Join(archive.Config.Directory, "job-1", PlainTextLogsFileName))
+	require.NoError(t, err)
+	assert.Equal(t, "echo hello\nhello\n", string(plainTextLogs))
+}
+
+func Test__StoreCompressesPreviousEntries(t *testing.T) {
+	archive, err := NewArchive(ArchiveConfig{Directory: t.TempDir()})
+	require.NoError(t, err)
+
+	require.NoError(t, archive.Store("job-1", createLogger(t, "hello")))
+	require.NoError(t, archive.Store("job-2", createLogger(t, "hello")))
+
+	assert.ElementsMatch(t, []string{JSONLogsFileName + ".gz", PlainTextLogsFileName + ".gz"}, filesIn(t, archive, "job-1"))
+	assert.ElementsMatch(t, []string{JSONLogsFileName, PlainTextLogsFileName}, filesIn(t, archive, "job-2"))
+}
+
+func Test__StoreRemovesOldEntries(t *testing.T) {
+	archive, err := NewArchive(ArchiveConfig{Directory: t.TempDir(), MaxAge: time.Hour})
+	require.NoError(t, err)
+
+	require.NoError(t, archive.Store("job-1", createLogger(t, "hello")))
+	require.NoError(t, archive.Store("job-2", createLogger(t, "hello")))
+
+	twoHoursAgo := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(archive.Config.Directory, "job-1"), twoHoursAgo, twoHoursAgo))
+
+	require.NoError(t, archive.Store("job-3", createLogger(t, "hello")))
+	assert.ElementsMatch(t, []string{"job-2", "job-3"}, entriesIn(t, archive))
+}
+
+func Test__StoreKeepsArchiveBelowMaxSize(t *testing.T) {
+	archive, err := NewArchive(ArchiveConfig{Directory: t.TempDir(), MaxSizeInBytes: 1024})
+	require.NoError(t, err)
+
+	for i, jobID := range []string{"job-1", "job-2", "job-3"} {
+		require.NoError(t, archive.Store(jobID, createLogger(t, "hello")))
+
+		// Make sure entries have different modification times
+		at := time.Now().Add(time.Duration(i-10) * time.Minute)
+		require.NoError(t, os.Chtimes(filepath.Join(archive.Config.Directory, jobID), at, at))
+	}
+
+	// A big entry that goes above the limit by itself is kept,
+	// but all the other ones are removed.
+	require.NoError(t, archive.Store("job-4", createLogger(t, string(make([]byte, 2048)))))
+	assert.Equal(t, []string{"job-4"}, entriesIn(t, archive))
+}
+
+func Test__StoreRejectsInvalidJobIDs(t *testing.T) {
+	archive, err := NewArchive(ArchiveConfig{Directory: t.TempDir()})
+	require.NoError(t, err)
+
+	for _, jobID := range []string{"", ".", "..", "../job-1", "job/1"} {
+		assert.Error(t, archive.Store(jobID, createLogger(t, "hello")), jobID)
+	}
+
+	assert.Empty(t, entriesIn(t, archive))
+}
+
+func Test__NewArchiveValidatesConfig(t *testing.T) {
+	_, err := NewArchive(ArchiveConfig{})
+	assert.ErrorContains(t, err, "config.Directory must be specified")
+
+	_, err = NewArchive(ArchiveConfig{Directory: t.TempDir(), MaxAge: -time.Second})
+	assert.ErrorContains(t, err, "config.MaxAge can't be negative")
+
+	_, err = NewArchive(ArchiveConfig{Directory: t.TempDir(), MaxSizeInBytes: -1})
+	assert.ErrorContains(t, err, "config.MaxSizeInBytes can't be negative")
+}
+
+func createLogger(t *testing.T, output string) *eventlogger.Logger {
+	backend, err := eventlogger.NewFileBackend(filepath.Join(t.TempDir(), "job_log.json"), eventlogger.DefaultMaxSizeInBytes)
+	require.NoError(t, err)
+
+	logger, err := eventlogger.NewLogger(backend)
+	require.NoError(t, err)
+	require.NoError(t, logger.Open())
+	t.Cleanup(func() { _ = logger.Close() })
+
+	now := time.Now()
+	logger.LogJobStarted()
+	logger.LogCommandStarted("echo hello")
+	logger.LogCommandOutput(output + "\n")
+	logger.LogCommandFinished("echo hello", 0, now, now)
+	logger.LogJobFinished("passed")
+	return logger
+}
+
+func filesIn(t *testing.T, archive *Archive, jobID string) []string {
+	entries, err := os.ReadDir(filepath.Join(archive.Config.Directory, jobID))
+	require.NoError(t, err)
+
+	names := []string{}
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+
+	return names
+}
+
+func entriesIn(t *testing.T, archive *Archive) []string {
+	entries, err := archive.listEntries()
+	require.NoError(t, err)
+
+	names := []string{}
+	for _, e := range entries {
+		names = append(names, e.jobID)
+	}
+
+	return names
+}
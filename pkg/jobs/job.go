@@ -15,12 +15,15 @@ import (
 	api "github.com/semaphoreci/agent/pkg/api"
 	"github.com/semaphoreci/agent/pkg/compression"
 	"github.com/semaphoreci/agent/pkg/config"
+	"github.com/semaphoreci/agent/pkg/docker"
 	eventlogger "github.com/semaphoreci/agent/pkg/eventlogger"
 	executors "github.com/semaphoreci/agent/pkg/executors"
 	httputils "github.com/semaphoreci/agent/pkg/httputils"
+	"github.com/semaphoreci/agent/pkg/joblogs"
 	"github.com/semaphoreci/agent/pkg/kubernetes"
 	"github.com/semaphoreci/agent/pkg/listener/selfhostedapi"
 	"github.com/semaphoreci/agent/pkg/retry"
+	"github.com/semaphoreci/agent/pkg/shell"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -47,6 +50,8 @@ type Job struct {
 	Finished       bool
 	UploadJobLogs  string
 	UserAgent      string
+	LogsArchive    *joblogs.Archive
+	LogsRendering  eventlogger.RenderOptions
 }
 
 type JobOptions struct {
@@ -64,8 +69,26 @@ type JobOptions struct {
 	KubernetesImageValidator         *kubernetes.ImageValidator
 	KubernetesDefaultImage           string
 	UploadJobLogs                    string
+	JobLogsArchive                   *joblogs.Archive
+	LoggerSinks                      []eventlogger.SinkConfig
+	LoggerStateFile                  string
+	JobLogsRendering                 eventlogger.RenderOptions
+	JobLogsCompression               *compression.Options
 	RefreshTokenFn                   func() (string, error)
 	UserAgent                        string
+	ShellExecutable                  string
+	ShellArgs                        []string
+	DisablePTY                       bool
+	TrackEnvChanges                  bool
+	OutputLimits                     shell.OutputLimits
+	Terminal                         shell.Terminal
+	DockerComposeEnvInTmpfs          bool
+	PodmanExecutor                   bool
+	SSHExecutor                      bool
+	SSHHosts                         []executors.SSHHost
+	SSHIdentityFile                  string
+	SSHKnownHostsFile                string
+	SSHAcceptNewHostKeys             bool
 }
 
 func NewJob(request *api.JobRequest, client *http.Client) (*Job, error) {
@@ -97,15 +120,20 @@ func NewJobWithOptions(options *JobOptions) (*Job, error) {
 		JobLogArchived: false,
 		Stopped:        false,
 		UploadJobLogs:  options.UploadJobLogs,
+		LogsArchive:    options.JobLogsArchive,
+		LogsRendering:  options.JobLogsRendering,
 	}
 
 	if options.Logger != nil {
 		job.Logger = options.Logger
 	} else {
 		l, err := eventlogger.CreateLogger(eventlogger.LoggerOptions{
-			Request:        options.Request,
-			RefreshTokenFn: options.RefreshTokenFn,
-			UserAgent:      options.UserAgent,
+			Request:              options.Request,
+			RefreshTokenFn:       options.RefreshTokenFn,
+			UserAgent:            options.UserAgent,
+			Sinks:                options.LoggerSinks,
+			HTTPBackendStateFile: options.LoggerStateFile,
+			OnDiskCompression:    options.JobLogsCompression,
 		})
 
 		if err != nil {
@@ -135,28 +163,99 @@ func CreateExecutor(request *api.JobRequest, logger *eventlogger.Logger, jobOpti
 			namespace = "default"
 		}
 
-		return executors.NewKubernetesExecutor(request, logger, kubernetes.Config{
-			Namespace:                 namespace,
-			ImageValidator:            jobOptions.KubernetesImageValidator,
-			PodSpecDecoratorConfigMap: jobOptions.PodSpecDecoratorConfigMap,
-			PodPollingAttempts:        jobOptions.KubernetesPodStartTimeoutSeconds,
-			Labels:                    jobOptions.KubernetesLabels,
-			PodPollingInterval:        time.Second,
-			DefaultImage:              jobOptions.KubernetesDefaultImage,
+		return executors.NewKubernetesExecutorWithOptions(request, logger, executors.KubernetesExecutorOptions{
+			Config: kubernetes.Config{
+				Namespace:                 namespace,
+				ImageValidator:            jobOptions.KubernetesImageValidator,
+				PodSpecDecoratorConfigMap: jobOptions.PodSpecDecoratorConfigMap,
+				PodPollingAttempts:        jobOptions.KubernetesPodStartTimeoutSeconds,
+				Labels:                    jobOptions.KubernetesLabels,
+				PodPollingInterval:        time.Second,
+				DefaultImage:              jobOptions.KubernetesDefaultImage,
+			},
+			Terminal:        TerminalForJob(request, jobOptions.Terminal),
+			ShellExecutable: jobOptions.ShellExecutable,
+			ShellArgs:       jobOptions.ShellArgs,
 		})
 	}
 
-	switch request.Executor {
+	executorType := request.Executor
+
+	// Agents that can't run shell jobs locally run them in the remote machines.
+	// Jobs using containers still need a container runtime in the agent's host.
+	if jobOptions.SSHExecutor && executorType == executors.ExecutorTypeShell {
+		log.Infof("Using %s executor instead of %s executor", executors.ExecutorTypeSSH, executorType)
+		executorType = executors.ExecutorTypeSSH
+	}
+
+	// Hosts without a Docker daemon run the jobs that use containers with podman.
+	if jobOptions.PodmanExecutor && (executorType == executors.ExecutorTypeDockerCompose || executorType == executors.ExecutorTypeDocker) {
+		log.Infof("Using %s executor instead of %s executor", executors.ExecutorTypePodman, executorType)
+		executorType = executors.ExecutorTypePodman
+	}
+
+	switch executorType {
 	case executors.ExecutorTypeShell:
-		return executors.NewShellExecutor(request, logger, jobOptions.SelfHosted), nil
+		return executors.NewShellExecutorWithOptions(request, logger, executors.ShellExecutorOptions{
+			SelfHosted:              jobOptions.SelfHosted,
+			ShellExecutable:         jobOptions.ShellExecutable,
+			ShellArgs:               jobOptions.ShellArgs,
+			DisablePTY:              jobOptions.DisablePTY,
+			TrackEnvironmentChanges: jobOptions.TrackEnvChanges,
+			OutputLimits:            OutputLimitsForJob(request, jobOptions.OutputLimits),
+			Terminal:                TerminalForJob(request, jobOptions.Terminal),
+		}), nil
 	case executors.ExecutorTypeDockerCompose:
 		executorOptions := executors.DockerComposeExecutorOptions{
 			ExposeKvmDevice:    jobOptions.ExposeKvmDevice,
 			FileInjections:     jobOptions.FileInjections,
 			FailOnMissingFiles: jobOptions.FailOnMissingFiles,
+			ShellExecutable:    jobOptions.ShellExecutable,
+			ShellArgs:          jobOptions.ShellArgs,
+			OutputLimits:       OutputLimitsForJob(request, jobOptions.OutputLimits),
+			Terminal:           TerminalForJob(request, jobOptions.Terminal),
+			EnvInTmpfs:         jobOptions.DockerComposeEnvInTmpfs,
 		}
 
 		return executors.NewDockerComposeExecutor(request, logger, executorOptions), nil
+	case executors.ExecutorTypeDocker:
+		return executors.NewDockerExecutor(request, logger, executors.DockerExecutorOptions{
+			Socket:             docker.SocketFromEnvironment(),
+			ExposeKvmDevice:    jobOptions.ExposeKvmDevice,
+			FileInjections:     jobOptions.FileInjections,
+			FailOnMissingFiles: jobOptions.FailOnMissingFiles,
+			ShellExecutable:    jobOptions.ShellExecutable,
+			ShellArgs:          jobOptions.ShellArgs,
+			OutputLimits:       OutputLimitsForJob(request, jobOptions.OutputLimits),
+			Terminal:           TerminalForJob(request, jobOptions.Terminal),
+		}), nil
+	case executors.ExecutorTypePodman:
+		return executors.NewPodmanExecutor(request, logger, executors.PodmanExecutorOptions{
+			ExposeKvmDevice:    jobOptions.ExposeKvmDevice,
+			FileInjections:     jobOptions.FileInjections,
+			FailOnMissingFiles: jobOptions.FailOnMissingFiles,
+			ShellExecutable:    jobOptions.ShellExecutable,
+			ShellArgs:          jobOptions.ShellArgs,
+			OutputLimits:       OutputLimitsForJob(request, jobOptions.OutputLimits),
+			Terminal:           TerminalForJob(request, jobOptions.Terminal),
+		}), nil
+	case executors.ExecutorTypeSSH:
+		if len(jobOptions.SSHHosts) == 0 {
+			return nil, fmt.Errorf("no SSH hosts configured for the ssh executor")
+		}
+
+		return executors.NewSSHExecutor(request, logger, executors.SSHExecutorOptions{
+			Hosts:              jobOptions.SSHHosts,
+			IdentityFile:       jobOptions.SSHIdentityFile,
+			KnownHostsFile:     jobOptions.SSHKnownHostsFile,
+			AcceptNewHostKeys:  jobOptions.SSHAcceptNewHostKeys,
+			FileInjections:     jobOptions.FileInjections,
+			FailOnMissingFiles: jobOptions.FailOnMissingFiles,
+			ShellExecutable:    jobOptions.ShellExecutable,
+			ShellArgs:          jobOptions.ShellArgs,
+			OutputLimits:       OutputLimitsForJob(request, jobOptions.OutputLimits),
+			Terminal:           TerminalForJob(request, jobOptions.Terminal),
+		}), nil
 	default:
 		return nil, fmt.Errorf("unknown executor type")
 	}
@@ -279,13 +378,17 @@ func (job *Job) RunWithOptions(options RunOptions) {
 }
 
 func (job *Job) PrepareEnvironment() int {
+	finishPhase := job.Logger.StartPhase(eventlogger.PhasePrepare)
 	exitCode := job.Executor.Prepare()
+	finishPhase(exitCode)
 	if exitCode != 0 {
 		log.Error("Failed to prepare executor")
 		return exitCode
 	}
 
+	finishPhase = job.Logger.StartPhase(eventlogger.PhaseStart)
 	exitCode = job.Executor.Start()
+	finishPhase(exitCode)
 	if exitCode != 0 {
 		log.Error("Failed to start executor")
 		return exitCode
@@ -303,13 +406,17 @@ func (job *Job) envVar(name string) string {
 }
 
 func (job *Job) RunRegularCommands(options RunOptions) string {
+	finishPhase := job.Logger.StartPhase(eventlogger.PhaseExportEnvVars)
 	exitCode := job.Executor.ExportEnvVars(job.Request.EnvVars, options.EnvVars)
+	finishPhase(exitCode)
 	if exitCode != 0 {
 		log.Error("Failed to export env vars")
 		return JobFailed
 	}
 
+	finishPhase = job.Logger.StartPhase(eventlogger.PhaseInjectFiles)
 	exitCode = job.Executor.InjectFiles(job.Request.Files)
+	finishPhase(exitCode)
 	if exitCode != 0 {
 		log.Error("Failed to inject files")
 		return JobFailed
@@ -335,9 +442,17 @@ func (job *Job) RunRegularCommands(options RunOptions) string {
 	// Job was stopped from the job itself.
 	// Here, we need to know which job status to report.
 	// We use the SEMAPHORE_JOB_RESULT environment variable for that.
-	if exitCode == 130 {
-		job.Stopped = true
-		return job.handleStopExitCode()
+	// A command interrupted by SIGINT also exits with 130, but that's just a failure.
+	// We can only tell them apart without a PTY, where the agent waits for the command itself.
+	// In a PTY, the shell drops the rest of the instruction when the command is killed by SIGINT,
+	// so a 130 we get from it always comes from a command exiting with it.
+	if exitCode == shell.SelfStopExitCode {
+		if !job.Executor.LastCommandTermination().Interrupted() {
+			job.Stopped = true
+			return job.handleStopExitCode()
+		}
+
+		log.Info("Regular commands were interrupted by SIGINT")
 	}
 
 	if exitCode == 0 {
@@ -353,7 +468,7 @@ func (job *Job) handleStopExitCode() string {
 	directive := "Checking job result"
 	job.Logger.LogCommandStarted(directive)
 	defer func() {
-		now := int(time.Now().Unix())
+		now := time.Now()
 		job.Logger.LogCommandFinished(directive, 0, now, now)
 	}()
 
@@ -424,6 +539,11 @@ func (job *Job) runPostJobHook(options RunOptions) {
 }
 
 func (job *Job) handleEpilogues(result string) {
+	// Epilogue failures don't affect the job result,
+	// so the phase always succeeds. The exit codes are in the command spans.
+	finishPhase := job.Logger.StartPhase(eventlogger.PhaseEpilogues)
+	defer finishPhase(0)
+
 	envVars := []api.EnvVar{
 		{Name: "SEMAPHORE_JOB_RESULT", Value: base64.RawStdEncoding.EncodeToString([]byte(result))},
 	}
@@ -475,6 +595,11 @@ func (job *Job) RunCommandsUntilFirstFailure(commands []api.Command) int {
 }
 
 func (job *Job) Teardown(result string, epiloguesExecuted bool, callbackRetryAttempts int) (string, error) {
+	// The teardown phase ends with the job_finished event,
+	// since the logger is closed before the teardown is over.
+	finishPhase := job.Logger.StartPhase(eventlogger.PhaseTeardown)
+	defer finishPhase(0)
+
 	// if job was stopped during the epilogues, result should be stopped
 	if epiloguesExecuted && job.Stopped {
 		result = JobStopped
@@ -517,7 +642,7 @@ func (job *Job) teardownWithCallbacks(result string, callbackRetryAttempts int)
 	// We use the open executor to upload the job logs as
 	// an artifact, in case it is above the acceptable limit.
 	err = job.Logger.CloseWithOptions(eventlogger.CloseOptions{
-		OnClose: job.uploadLogsAsArtifact,
+		OnClose: job.onLoggerClose,
 	})
 
 	if err != nil {
@@ -545,7 +670,7 @@ func (job *Job) teardownWithNoCallbacks(result string) error {
 	// We use the open executor to upload the job logs as an artifact,
 	// in case it has been trimmed during streaming.
 	err := job.Logger.CloseWithOptions(eventlogger.CloseOptions{
-		OnClose: job.uploadLogsAsArtifact,
+		OnClose: job.onLoggerClose,
 	})
 
 	if err != nil {
@@ -605,10 +730,10 @@ func (job *Job) findFileSize(fileName string) (int64, error) {
 }
 
 func (job *Job) prepareArtifactForUpload() (string, error) {
-	log.Info("Converting job logs to plain-text format...")
-	rawFileName, err := job.Logger.GeneratePlainTextFile()
+	log.Infof("Converting job logs to %s format...", job.LogsRendering.FileExtension())
+	rawFileName, err := job.Logger.GenerateRenderedFileIn(os.TempDir(), job.LogsRendering)
 	if err != nil {
-		return "", fmt.Errorf("error converting '%s' to plain text: %v", rawFileName, err)
+		return "", fmt.Errorf("error converting '%s' to %s: %v", rawFileName, job.LogsRendering.FileExtension(), err)
 	}
 
 	//
@@ -650,6 +775,25 @@ func (job *Job) prepareArtifactForUpload() (string, error) {
 	return compressedFile, nil
 }
 
+/*
+ * Called right before the logger removes the job logs from disk,
+ * so everything that needs them must happen here.
+ */
+func (job *Job) onLoggerClose(trimmed bool) {
+	job.archiveLogs()
+	job.uploadLogsAsArtifact(trimmed)
+}
+
+func (job *Job) archiveLogs() {
+	if job.LogsArchive == nil {
+		return
+	}
+
+	if err := job.LogsArchive.Store(job.Request.JobID, job.Logger); err != nil {
+		log.Errorf("Error storing job logs in local archive: %v", err)
+	}
+}
+
 func (job *Job) uploadLogsAsArtifact(trimmed bool) {
 	if job.UploadJobLogs == config.UploadJobLogsConditionNever {
 		log.Info("upload-job-logs=never - not uploading job logs as job artifact.")
@@ -685,7 +829,7 @@ func (job *Job) uploadLogsAsArtifact(trimmed bool) {
 		return
 	}
 
-	args := []string{"push", "job", file, "-d", "agent/job_logs.txt"}
+	args := []string{"push", "job", file, "-d", "agent/job_logs." + job.LogsRendering.FileExtension()}
 
 	// #nosec
 	cmd := exec.Command(path, args...)
@@ -15,6 +15,7 @@ import (
 	"github.com/semaphoreci/agent/pkg/api"
 	"github.com/semaphoreci/agent/pkg/config"
 	eventlogger "github.com/semaphoreci/agent/pkg/eventlogger"
+	executors "github.com/semaphoreci/agent/pkg/executors"
 	testsupport "github.com/semaphoreci/agent/test/support"
 	"github.com/stretchr/testify/assert"
 )
@@ -591,6 +592,66 @@ func Test__StopJobWithExitCode(t *testing.T) {
 	})
 }
 
+func Test__CommandInterruptedBySIGINTDoesNotStopJob(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	testLogger, testLoggerBackend := eventlogger.DefaultTestLogger()
+	request := &api.JobRequest{
+		EnvVars: []api.EnvVar{},
+		Commands: []api.Command{
+			{Directive: "kill -INT $$"},
+			{Directive: testsupport.Output("hello")},
+		},
+		Callbacks: api.Callbacks{
+			Finished:         "https://httpbin.org/status/200",
+			TeardownFinished: "https://httpbin.org/status/200",
+		},
+		Logger: api.Logger{
+			Method: eventlogger.LoggerMethodPush,
+		},
+	}
+
+	// Without a PTY, the agent knows the command was killed by SIGINT.
+	job, err := NewJobWithOptions(&JobOptions{
+		Request:    request,
+		Client:     http.DefaultClient,
+		Logger:     testLogger,
+		DisablePTY: true,
+	})
+
+	assert.Nil(t, err)
+
+	job.Run()
+
+	assert.False(t, job.Stopped)
+	assert.Eventually(t, func() bool { return job.Finished }, 5*time.Second, 1*time.Second)
+
+	simplifiedEvents, err := testLoggerBackend.SimplifiedEvents(true, false)
+	assert.Nil(t, err)
+
+	assert.Equal(t, []string{
+		"job_started",
+
+		"directive: Exporting environment variables",
+		"Exit Code: 0",
+
+		"directive: Injecting Files",
+		"Exit Code: 0",
+
+		"directive: kill -INT $$",
+		"Exit Code: 130 (SIGINT)",
+
+		// the job is not stopped, so the epilogues run
+		"directive: Exporting environment variables",
+		"Exporting SEMAPHORE_JOB_RESULT\n",
+		"Exit Code: 0",
+
+		"job_finished: failed",
+	}, simplifiedEvents)
+}
+
 func Test__StopJobWithExitCodeWithResultSetToPassed(t *testing.T) {
 	if runtime.GOOS == "windows" {
 		t.Skip()
@@ -1469,3 +1530,57 @@ func Test__UsePreJobHookAndFailOnError(t *testing.T) {
 
 	os.Remove(hook)
 }
+
+func Test__CreateExecutor__PodmanExecutor(t *testing.T) {
+	testLogger, _ := eventlogger.DefaultTestLogger()
+	request := &api.JobRequest{
+		Compose: api.Compose{
+			Containers: []api.Container{{Name: "main", Image: "ruby:3.2"}},
+		},
+	}
+
+	// jobs can ask for it
+	request.Executor = executors.ExecutorTypePodman
+	executor, err := CreateExecutor(request, testLogger, JobOptions{})
+	assert.NoError(t, err)
+	assert.IsType(t, &executors.PodmanExecutor{}, executor)
+
+	// the agent can use it for all jobs that use containers
+	for _, executorType := range []string{executors.ExecutorTypeDockerCompose, executors.ExecutorTypeDocker} {
+		request.Executor = executorType
+		executor, err = CreateExecutor(request, testLogger, JobOptions{PodmanExecutor: true})
+		assert.NoError(t, err)
+		assert.IsType(t, &executors.PodmanExecutor{}, executor)
+	}
+
+	request.Executor = executors.ExecutorTypeShell
+	executor, err = CreateExecutor(request, testLogger, JobOptions{PodmanExecutor: true})
+	assert.NoError(t, err)
+	assert.IsType(t, &executors.ShellExecutor{}, executor)
+}
+
+func Test__CreateExecutor__SSHExecutor(t *testing.T) {
+	testLogger, _ := eventlogger.DefaultTestLogger()
+	hosts := []executors.SSHHost{{Host: "build-1", Port: 22}}
+
+	// jobs can ask for it
+	request := &api.JobRequest{Executor: executors.ExecutorTypeSSH}
+	executor, err := CreateExecutor(request, testLogger, JobOptions{SSHHosts: hosts})
+	assert.NoError(t, err)
+	assert.IsType(t, &executors.SSHExecutor{}, executor)
+
+	_, err = CreateExecutor(request, testLogger, JobOptions{})
+	assert.ErrorContains(t, err, "no SSH hosts configured")
+
+	// the agent can use it for shell jobs
+	request.Executor = executors.ExecutorTypeShell
+	executor, err = CreateExecutor(request, testLogger, JobOptions{SSHExecutor: true, SSHHosts: hosts})
+	assert.NoError(t, err)
+	assert.IsType(t, &executors.SSHExecutor{}, executor)
+
+	// but jobs using containers keep their executor
+	request.Executor = executors.ExecutorTypeDocker
+	executor, err = CreateExecutor(request, testLogger, JobOptions{SSHExecutor: true, SSHHosts: hosts})
+	assert.NoError(t, err)
+	assert.IsType(t, &executors.DockerExecutor{}, executor)
+}
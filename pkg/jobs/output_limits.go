@@ -0,0 +1,49 @@
+package jobs
+
+import (
+	api "github.com/semaphoreci/agent/pkg/api"
+	"github.com/semaphoreci/agent/pkg/shell"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+ * Each limit set in the job request replaces the agent's, and a negative one removes it.
+ * If the limits that come out of that are not valid, the job gets the agent's limits.
+ */
+func OutputLimitsForJob(request *api.JobRequest, agentLimits shell.OutputLimits) shell.OutputLimits {
+	overrides := request.OutputLimits
+	if overrides == nil {
+		return agentLimits
+	}
+
+	limits := agentLimits
+	limits.MaxBytesPerCommand = overrideLimit(limits.MaxBytesPerCommand, overrides.MaxBytesPerCommand)
+	limits.TailBytes = overrideLimit(limits.TailBytes, overrides.TailBytes)
+	limits.MaxBytesPerSecond = overrideLimit(limits.MaxBytesPerSecond, overrides.MaxBytesPerSecond)
+	if overrides.CollapseRepeatedLines != nil {
+		limits.CollapseRepeatedLines = *overrides.CollapseRepeatedLines
+	}
+
+	// The tail is useless without a limit, so it is dropped together with it.
+	if limits.MaxBytesPerCommand == 0 {
+		limits.TailBytes = 0
+	}
+
+	if err := limits.Validate(); err != nil {
+		log.Errorf("Invalid output limits for job %s: %v - using the agent's output limits", request.JobID, err)
+		return agentLimits
+	}
+
+	return limits
+}
+
+func overrideLimit(value, override int) int {
+	switch {
+	case override < 0:
+		return 0
+	case override > 0:
+		return override
+	default:
+		return value
+	}
+}
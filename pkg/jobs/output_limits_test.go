@@ -0,0 +1,42 @@
+package jobs
+
+import (
+	"testing"
+
+	"github.com/semaphoreci/agent/pkg/api"
+	"github.com/semaphoreci/agent/pkg/shell"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test__OutputLimitsForJob(t *testing.T) {
+	agentLimits := shell.OutputLimits{
+		MaxBytesPerCommand: 1000,
+		TailBytes:          100,
+		MaxBytesPerSecond:  500,
+	}
+
+	collapse := true
+
+	// no overrides
+	assert.Equal(t, agentLimits, OutputLimitsForJob(&api.JobRequest{}, agentLimits))
+
+	// zero values keep the agent's configuration
+	assert.Equal(t, shell.OutputLimits{
+		MaxBytesPerCommand:    2000,
+		TailBytes:             100,
+		MaxBytesPerSecond:     500,
+		CollapseRepeatedLines: true,
+	}, OutputLimitsForJob(&api.JobRequest{
+		OutputLimits: &api.OutputLimits{MaxBytesPerCommand: 2000, CollapseRepeatedLines: &collapse},
+	}, agentLimits))
+
+	// negative values remove limits, and the tail goes away with the byte cap
+	assert.Equal(t, shell.OutputLimits{}, OutputLimitsForJob(&api.JobRequest{
+		OutputLimits: &api.OutputLimits{MaxBytesPerCommand: -1, MaxBytesPerSecond: -1},
+	}, agentLimits))
+
+	// invalid overrides are ignored
+	assert.Equal(t, agentLimits, OutputLimitsForJob(&api.JobRequest{
+		OutputLimits: &api.OutputLimits{MaxBytesPerCommand: 50},
+	}, agentLimits))
+}
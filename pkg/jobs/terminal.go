@@ -0,0 +1,47 @@
+package jobs
+
+import (
+	"math"
+
+	api "github.com/semaphoreci/agent/pkg/api"
+	"github.com/semaphoreci/agent/pkg/shell"
+	log "github.com/sirupsen/logrus"
+)
+
+/*
+ * Columns, rows and type are taken from the job request when set there,
+ * and from the agent's terminal otherwise. If that gives a size that doesn't fit
+ * in a PTY, only one of columns and rows, or a TERM value that isn't valid,
+ * the agent's terminal is used as is, instead of a mix of both.
+ */
+func TerminalForJob(request *api.JobRequest, agentTerminal shell.Terminal) shell.Terminal {
+	overrides := request.Terminal
+	if overrides == nil {
+		return agentTerminal
+	}
+
+	if overrides.Columns < 0 || overrides.Columns > math.MaxUint16 || overrides.Rows < 0 || overrides.Rows > math.MaxUint16 {
+		log.Errorf("Invalid terminal size for job %s: %dx%d - using the agent's terminal", request.JobID, overrides.Columns, overrides.Rows)
+		return agentTerminal
+	}
+
+	terminal := agentTerminal
+	if overrides.Columns > 0 {
+		terminal.Cols = uint16(overrides.Columns)
+	}
+
+	if overrides.Rows > 0 {
+		terminal.Rows = uint16(overrides.Rows)
+	}
+
+	if overrides.Type != "" {
+		terminal.Type = overrides.Type
+	}
+
+	if err := terminal.Validate(); err != nil {
+		log.Errorf("Invalid terminal for job %s: %v - using the agent's terminal", request.JobID, err)
+		return agentTerminal
+	}
+
+	return terminal
+}
@@ -0,0 +1,39 @@
+package jobs
+
+import (
+	"testing"
+
+	"github.com/semaphoreci/agent/pkg/api"
+	"github.com/semaphoreci/agent/pkg/shell"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test__TerminalForJob(t *testing.T) {
+	agentTerminal := shell.Terminal{Cols: 120, Rows: 40, Type: "xterm"}
+
+	// no overrides
+	assert.Equal(t, agentTerminal, TerminalForJob(&api.JobRequest{}, agentTerminal))
+
+	// zero values keep the agent's configuration
+	assert.Equal(t, shell.Terminal{Cols: 200, Rows: 40, Type: "xterm-256color"}, TerminalForJob(&api.JobRequest{
+		Terminal: &api.Terminal{Columns: 200, Type: "xterm-256color"},
+	}, agentTerminal))
+
+	// a size can be set for agents without one
+	assert.Equal(t, shell.Terminal{Cols: 200, Rows: 50}, TerminalForJob(&api.JobRequest{
+		Terminal: &api.Terminal{Columns: 200, Rows: 50},
+	}, shell.Terminal{}))
+
+	// invalid overrides are ignored
+	assert.Equal(t, agentTerminal, TerminalForJob(&api.JobRequest{
+		Terminal: &api.Terminal{Columns: 70000},
+	}, agentTerminal))
+
+	assert.Equal(t, shell.Terminal{}, TerminalForJob(&api.JobRequest{
+		Terminal: &api.Terminal{Columns: 200},
+	}, shell.Terminal{}))
+
+	assert.Equal(t, agentTerminal, TerminalForJob(&api.JobRequest{
+		Terminal: &api.Terminal{Type: "not valid"},
+	}, agentTerminal))
+}
@@ -5,7 +5,6 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"time"
@@ -188,30 +187,14 @@ func (c *KubernetesClient) CreateSecret(name string, jobRequest *api.JobRequest)
 		return fmt.Errorf("error creating environment: %v", err)
 	}
 
-	envFileName := filepath.Join(os.TempDir(), ".env")
-	err = environment.ToFile(envFileName, nil)
-	if err != nil {
-		return fmt.Errorf("error creating temporary environment file: %v", err)
-	}
-
-	// #nosec
-	envFile, err := os.Open(envFileName)
-	if err != nil {
-		return fmt.Errorf("error opening environment file for reading: %v", err)
-	}
-
-	defer envFile.Close()
-
-	env, err := ioutil.ReadAll(envFile)
-	if err != nil {
-		return fmt.Errorf("error reading environment file: %v", err)
-	}
+	// The environment is never written to disk, since it contains secrets.
+	env := environment.ToScriptFor(shell.AdapterFor(shell.Executable()), nil)
 
 	// We don't allow the secret to be changed after its creation.
 	immutable := true
 
 	// We use one key for the environment variables.
-	data := map[string]string{".env": string(env)}
+	data := map[string]string{".env": env}
 
 	// And one key for each file injected in the job definition.
 	// K8s doesn't allow many special characters in a secret's key; it uses [-._a-zA-Z0-9]+ for validation.
@@ -1,6 +1,7 @@
 package listener
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
@@ -12,7 +13,11 @@ import (
 	"time"
 
 	"github.com/semaphoreci/agent/pkg/api"
+	"github.com/semaphoreci/agent/pkg/compression"
 	"github.com/semaphoreci/agent/pkg/config"
+	"github.com/semaphoreci/agent/pkg/eventlogger"
+	"github.com/semaphoreci/agent/pkg/executors"
+	"github.com/semaphoreci/agent/pkg/joblogs"
 	jobs "github.com/semaphoreci/agent/pkg/jobs"
 	"github.com/semaphoreci/agent/pkg/kubernetes"
 	selfhostedapi "github.com/semaphoreci/agent/pkg/listener/selfhostedapi"
@@ -49,6 +54,24 @@ func StartJobProcessor(httpClient *http.Client, apiClient *selfhostedapi.API, co
 		KubernetesPodStartTimeoutSeconds: config.KubernetesPodStartTimeoutSeconds,
 		KubernetesLabels:                 config.KubernetesLabels,
 		KubernetesDefaultImage:           config.KubernetesDefaultImage,
+		JobLogsArchive:                   config.JobLogsArchive,
+		JobLogSinks:                      config.JobLogSinks,
+		JobLogsRendering:                 config.JobLogsRendering,
+		JobLogsCompression:               config.JobLogsCompression,
+		StateDirectory:                   config.StateDirectory,
+		ShellExecutable:                  config.ShellExecutable,
+		ShellArgs:                        config.ShellArgs,
+		DisablePTY:                       config.DisablePTY,
+		TrackEnvChanges:                  config.TrackEnvChanges,
+		OutputLimits:                     config.OutputLimits,
+		Terminal:                         config.Terminal,
+		DockerComposeEnvInTmpfs:          config.DockerComposeEnvInTmpfs,
+		PodmanExecutor:                   config.PodmanExecutor,
+		SSHExecutor:                      config.SSHExecutor,
+		SSHHosts:                         config.SSHHosts,
+		SSHIdentityFile:                  config.SSHIdentityFile,
+		SSHKnownHostsFile:                config.SSHKnownHostsFile,
+		SSHAcceptNewHostKeys:             config.SSHAcceptNewHostKeys,
 	}
 
 	go p.Start()
@@ -71,6 +94,7 @@ type JobProcessor struct {
 	LastSuccessfulSync time.Time
 	InterruptedAt      int64
 	ShutdownReason     ShutdownReason
+	ResumedJobs        []ResumedJob
 	mutex              sync.Mutex
 	forceSyncCh        chan (bool)
 
@@ -96,12 +120,136 @@ type JobProcessor struct {
 	KubernetesPodStartTimeoutSeconds int
 	KubernetesLabels                 map[string]string
 	KubernetesDefaultImage           string
+	JobLogsArchive                   *joblogs.Archive
+	JobLogSinks                      []eventlogger.SinkConfig
+	JobLogsRendering                 eventlogger.RenderOptions
+	JobLogsCompression               *compression.Options
+	StateDirectory                   string
+	ShellExecutable                  string
+	ShellArgs                        []string
+	DisablePTY                       bool
+	TrackEnvChanges                  bool
+	OutputLimits                     shell.OutputLimits
+	Terminal                         shell.Terminal
+	DockerComposeEnvInTmpfs          bool
+	PodmanExecutor                   bool
+	SSHExecutor                      bool
+	SSHHosts                         []executors.SSHHost
+	SSHIdentityFile                  string
+	SSHKnownHostsFile                string
+	SSHAcceptNewHostKeys             bool
 }
 
 func (p *JobProcessor) Start() {
+	p.resumeInterruptedJobs()
 	go p.SyncLoop()
 }
 
+func (p *JobProcessor) httpBackendStateFile(jobID string) string {
+	if p.StateDirectory == "" {
+		return ""
+	}
+
+	return eventlogger.HTTPBackendStateFile(p.StateDirectory, jobID)
+}
+
+// A job interrupted by an agent restart, still waiting to be reported as finished.
+type ResumedJob struct {
+	JobID  string
+	Result selfhostedapi.JobResult
+}
+
+/*
+ * If the agent was restarted in the middle of a job,
+ * the HTTP backend for that job left its state behind.
+ * Before we start syncing, we finish pushing the logs for those jobs,
+ * and report them as finished, so the API doesn't wait for them forever.
+ * Only one finished job is reported in each sync,
+ * so the resumed jobs are reported one after the other.
+ */
+func (p *JobProcessor) resumeInterruptedJobs() {
+	if p.StateDirectory == "" {
+		return
+	}
+
+	stateFiles, err := eventlogger.FindHTTPBackendStateFiles(p.StateDirectory)
+	if err != nil {
+		log.Errorf("Error looking for interrupted jobs in %s: %v", p.StateDirectory, err)
+		return
+	}
+
+	for _, stateFile := range stateFiles {
+		if job := p.resumeInterruptedJob(stateFile); job != nil {
+			p.ResumedJobs = append(p.ResumedJobs, *job)
+		}
+	}
+
+	p.reportNextResumedJob()
+}
+
+func (p *JobProcessor) reportNextResumedJob() {
+	if len(p.ResumedJobs) == 0 {
+		return
+	}
+
+	job := p.ResumedJobs[0]
+	p.ResumedJobs = p.ResumedJobs[1:]
+
+	log.Infof("Reporting interrupted job %s as %s", job.JobID, job.Result)
+	p.CurrentJobID = job.JobID
+	p.CurrentJobResult = job.Result
+	p.State = selfhostedapi.AgentStateFinishedJob
+}
+
+func (p *JobProcessor) resumeInterruptedJob(stateFile string) *ResumedJob {
+	backend, err := eventlogger.ResumeHTTPBackend(stateFile, eventlogger.HTTPBackendConfig{
+		UserAgent:             p.UserAgent,
+		LinesPerRequest:       eventlogger.MaxLinesPerRequest,
+		FlushTimeoutInSeconds: eventlogger.DefaultFlushTimeoutInSeconds,
+		RefreshTokenFn: func() (string, error) {
+			return p.APIClient.RefreshToken()
+		},
+	})
+
+	if err != nil {
+		log.Errorf("Could not resume pushing logs from %s - discarding it: %v", stateFile, err)
+		_ = os.Remove(stateFile)
+		return nil
+	}
+
+	jobID := backend.JobID()
+	result := interruptedJobResult(backend)
+	log.Infof("Job %s was interrupted by an agent restart - pushing its remaining logs", jobID)
+
+	if err := backend.Close(); err != nil {
+		log.Errorf("Error closing logs for job %s: %v", jobID, err)
+	}
+
+	return &ResumedJob{JobID: jobID, Result: result}
+}
+
+/*
+ * If the job finished before the agent was restarted,
+ * its result is in the logs. Otherwise, it failed.
+ */
+func interruptedJobResult(backend eventlogger.Backend) selfhostedapi.JobResult {
+	result := selfhostedapi.JobResult(selfhostedapi.JobResultFailed)
+	err := backend.Iterate(func(event []byte) error {
+		e := eventlogger.JobFinishedEvent{}
+		if json.Unmarshal(event, &e) == nil && e.Event == "job_finished" && e.Result != "" {
+			result = selfhostedapi.JobResult(e.Result)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		log.Errorf("Error finding result for interrupted job: %v", err)
+	}
+
+	return result
+}
+
 func (p *JobProcessor) SyncLoop() {
 	for {
 		if p.StopSync {
@@ -194,6 +342,7 @@ func (p *JobProcessor) ProcessSyncResponse(response *selfhostedapi.SyncResponse)
 func (p *JobProcessor) RunJob(jobID string) {
 	p.State = selfhostedapi.AgentStateStartingJob
 	p.CurrentJobID = jobID
+	eventlogger.SetCurrentJobID(jobID)
 
 	jobRequest, err := p.getJobWithRetries(p.CurrentJobID)
 	if err != nil {
@@ -216,7 +365,25 @@ func (p *JobProcessor) RunJob(jobID string) {
 		KubernetesImageValidator:         p.KubernetesImageValidator,
 		KubernetesDefaultImage:           p.KubernetesDefaultImage,
 		UploadJobLogs:                    p.UploadJobLogs,
+		JobLogsArchive:                   p.JobLogsArchive,
+		LoggerSinks:                      p.JobLogSinks,
+		JobLogsRendering:                 p.JobLogsRendering,
+		JobLogsCompression:               p.JobLogsCompression,
+		LoggerStateFile:                  p.httpBackendStateFile(jobID),
 		UserAgent:                        p.UserAgent,
+		ShellExecutable:                  p.ShellExecutable,
+		ShellArgs:                        p.ShellArgs,
+		DisablePTY:                       p.DisablePTY,
+		TrackEnvChanges:                  p.TrackEnvChanges,
+		OutputLimits:                     p.OutputLimits,
+		Terminal:                         p.Terminal,
+		DockerComposeEnvInTmpfs:          p.DockerComposeEnvInTmpfs,
+		PodmanExecutor:                   p.PodmanExecutor,
+		SSHExecutor:                      p.SSHExecutor,
+		SSHHosts:                         p.SSHHosts,
+		SSHIdentityFile:                  p.SSHIdentityFile,
+		SSHKnownHostsFile:                p.SSHKnownHostsFile,
+		SSHAcceptNewHostKeys:             p.SSHAcceptNewHostKeys,
 		RefreshTokenFn: func() (string, error) {
 			return p.APIClient.RefreshToken()
 		},
@@ -289,9 +456,11 @@ func (p *JobProcessor) JobFinished(result selfhostedapi.JobResult) {
 
 func (p *JobProcessor) WaitForJobs() {
 	p.CurrentJobID = ""
+	eventlogger.SetCurrentJobID("")
 	p.CurrentJob = nil
 	p.CurrentJobResult = ""
 	p.State = selfhostedapi.AgentStateWaitingForJobs
+	p.reportNextResumedJob()
 }
 
 func (p *JobProcessor) SetupInterruptHandler() {
@@ -7,12 +7,16 @@ import (
 	"os"
 	"time"
 
+	"github.com/semaphoreci/agent/pkg/compression"
 	"github.com/semaphoreci/agent/pkg/config"
 	"github.com/semaphoreci/agent/pkg/eventlogger"
+	"github.com/semaphoreci/agent/pkg/executors"
+	"github.com/semaphoreci/agent/pkg/joblogs"
 	"github.com/semaphoreci/agent/pkg/kubernetes"
 	selfhostedapi "github.com/semaphoreci/agent/pkg/listener/selfhostedapi"
 	osinfo "github.com/semaphoreci/agent/pkg/osinfo"
 	"github.com/semaphoreci/agent/pkg/retry"
+	"github.com/semaphoreci/agent/pkg/shell"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -52,6 +56,25 @@ type Config struct {
 	KubernetesPodStartTimeoutSeconds int
 	KubernetesLabels                 map[string]string
 	KubernetesDefaultImage           string
+	JobLogsArchive                   *joblogs.Archive
+	JobLogSinks                      []eventlogger.SinkConfig
+	JobLogsRendering                 eventlogger.RenderOptions
+	JobLogsCompression               *compression.Options
+	AgentLogFormat                   string
+	StateDirectory                   string
+	ShellExecutable                  string
+	ShellArgs                        []string
+	DisablePTY                       bool
+	TrackEnvChanges                  bool
+	OutputLimits                     shell.OutputLimits
+	Terminal                         shell.Terminal
+	DockerComposeEnvInTmpfs          bool
+	PodmanExecutor                   bool
+	SSHExecutor                      bool
+	SSHHosts                         []executors.SSHHost
+	SSHIdentityFile                  string
+	SSHKnownHostsFile                string
+	SSHAcceptNewHostKeys             bool
 }
 
 func Start(httpClient *http.Client, config Config) (*Listener, error) {
@@ -61,7 +84,7 @@ func Start(httpClient *http.Client, config Config) (*Listener, error) {
 	}
 
 	listener.DisplayHelloMessage()
-	setCustomLogFormatter(config.AgentName)
+	setCustomLogFormatter(config.AgentLogFormat, config.AgentName)
 
 	log.Info("Starting Agent")
 	log.Info("Registering Agent")
@@ -73,7 +96,7 @@ func Start(httpClient *http.Client, config Config) (*Listener, error) {
 	// We re-set the agent name in the custom log formatter,
 	// to ensure that names assigned by the Semaphore control plane
 	// are also added to the agent's custom log formatter, after registration.
-	setCustomLogFormatter(listener.Config.AgentName)
+	setCustomLogFormatter(listener.Config.AgentLogFormat, listener.Config.AgentName)
 
 	log.Info("Starting to poll for jobs")
 	jobProcessor, err := StartJobProcessor(httpClient, listener.Client, listener.Config)
@@ -86,23 +109,22 @@ func Start(httpClient *http.Client, config Config) (*Listener, error) {
 	return listener, nil
 }
 
-func setCustomLogFormatter(agentName string) {
+func setCustomLogFormatter(format, agentName string) {
 	// If the name is a URL, which will be followed by the Semaphore control plane.
 	// The actual name used for the agent will be returned by the Semaphore
 	// control in the registration response. So, while the name is a URL,
 	// we initially the URL host in the log context until we get a name from the Semaphore control plane.
 	if u, err := url.ParseRequestURI(agentName); err == nil {
-		formatter := eventlogger.CustomFormatter{
-			AgentName: fmt.Sprintf("[%s]", u.Host),
-		}
+		agentName = fmt.Sprintf("[%s]", u.Host)
+	}
 
-		log.SetFormatter(&formatter)
-		return
+	formatter, err := eventlogger.NewAgentLogFormatter(format, agentName)
+	if err != nil {
+		log.Errorf("Error creating log formatter: %v - using text format", err)
+		formatter = &eventlogger.CustomFormatter{AgentName: agentName}
 	}
 
-	// If it's not a URL, just use the name itself.
-	formatter := eventlogger.CustomFormatter{AgentName: agentName}
-	log.SetFormatter(&formatter)
+	log.SetFormatter(formatter)
 }
 
 // only used during tests
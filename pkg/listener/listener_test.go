@@ -6,6 +6,7 @@ import (
 	"math/rand"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -948,3 +949,91 @@ func Test__ReportsFailedToConstructJob(t *testing.T) {
 	hubMockServer.Close()
 	loghubMockServer.Close()
 }
+
+func Test__ResumesJobsInterruptedByRestart(t *testing.T) {
+	testsupport.SetupTestLogs()
+
+	loghubMockServer := testsupport.NewLoghubMockServer()
+	loghubMockServer.Init()
+
+	hubMockServer := testsupport.NewHubMockServer()
+	hubMockServer.Init()
+
+	// The previous agent pushed the first 2 events of two jobs
+	// before being restarted, so the rest of their logs were never pushed.
+	// The first one passed, and the second one was still running.
+	stateDirectory := t.TempDir()
+	jobs := map[string][]string{
+		"job-passed": {
+			`{"event":"job_started","timestamp":1}`,
+			`{"event":"cmd_started","timestamp":1,"directive":"echo hello"}`,
+			`{"event":"cmd_output","timestamp":1,"output":"hello\n"}`,
+			`{"event":"cmd_finished","timestamp":1,"directive":"echo hello","exit_code":0,"started_at":1,"finished_at":1}`,
+			`{"event":"job_finished","timestamp":1,"result":"passed"}`,
+		},
+		"job-running": {
+			`{"event":"job_started","timestamp":1}`,
+			`{"event":"cmd_started","timestamp":1,"directive":"sleep 1000"}`,
+			`{"event":"cmd_output","timestamp":1,"output":"zzz\n"}`,
+		},
+	}
+
+	stateFiles := []string{}
+	logsPaths := []string{}
+	for jobID, events := range jobs {
+		logsPath := filepath.Join(stateDirectory, jobID+".json")
+		assert.Nil(t, os.WriteFile(logsPath, []byte(strings.Join(events, "\n")+"\n"), 0600))
+
+		state := eventlogger.HTTPBackendState{
+			JobID:     jobID,
+			Path:      logsPath,
+			StartFrom: 2,
+			URL:       loghubMockServer.URL(),
+			Token:     "doesnotmatter",
+		}
+
+		stateFile := eventlogger.HTTPBackendStateFile(stateDirectory, state.JobID)
+		assert.Nil(t, state.Save(stateFile))
+		stateFiles = append(stateFiles, stateFile)
+		logsPaths = append(logsPaths, logsPath)
+	}
+
+	config := Config{
+		AgentName:          fmt.Sprintf("agent-name-%d", rand.Intn(10000000)),
+		DisconnectAfterJob: false,
+		ExitOnShutdown:     false,
+		Endpoint:           hubMockServer.Host(),
+		Token:              "token",
+		RegisterRetryLimit: 5,
+		Scheme:             "http",
+		EnvVars:            []config.HostEnvVar{},
+		FileInjections:     []config.FileInjection{},
+		UploadJobLogs:      config.UploadJobLogsConditionNever,
+		AgentVersion:       testsupport.AgentVersionExpected,
+		UserAgent:          fmt.Sprintf("SemaphoreAgent/%s", testsupport.AgentVersionExpected),
+		StateDirectory:     stateDirectory,
+	}
+
+	listener, err := Start(http.DefaultClient, config)
+	assert.Nil(t, err)
+
+	// each job is reported separately
+	assert.Eventually(t, func() bool { return len(hubMockServer.GetFinishedJobs()) == 2 }, 15*time.Second, 100*time.Millisecond)
+	assert.Equal(t, map[string]selfhostedapi.JobResult{
+		"job-passed":  selfhostedapi.JobResult(selfhostedapi.JobResultPassed),
+		"job-running": selfhostedapi.JobResult(selfhostedapi.JobResultFailed),
+	}, hubMockServer.GetFinishedJobs())
+
+	assert.Len(t, loghubMockServer.GetLogs(), 4)
+	for _, stateFile := range stateFiles {
+		assert.NoFileExists(t, stateFile)
+	}
+
+	for _, logsPath := range logsPaths {
+		assert.NoFileExists(t, logsPath)
+	}
+
+	listener.Stop()
+	hubMockServer.Close()
+	loghubMockServer.Close()
+}
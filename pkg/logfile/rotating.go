@@ -0,0 +1,126 @@
+package logfile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const DefaultMaxFiles = 5
+
+/*
+ * An io.Writer for the agent's own log that rotates the file when it grows above a size.
+ * When rotating, <path> becomes <path>.1, <path>.1 becomes <path>.2, and so on,
+ * and files above MaxFiles are removed.
+ */
+type RotatingFile struct {
+	Config RotatingFileConfig
+
+	file *os.File
+	size int64
+	mu   sync.Mutex
+}
+
+type RotatingFileConfig struct {
+	Path string
+
+	// If zero, the file is never rotated.
+	MaxSizeInBytes int64
+
+	// How many rotated files are kept, besides the current one.
+	// If zero, DefaultMaxFiles is used.
+	MaxFiles int
+}
+
+func NewRotatingFile(config RotatingFileConfig) (*RotatingFile, error) {
+	if config.Path == "" {
+		return nil, fmt.Errorf("config.Path is required")
+	}
+
+	if config.MaxSizeInBytes < 0 {
+		return nil, fmt.Errorf("config.MaxSizeInBytes must be greater than or equal to 0")
+	}
+
+	if config.MaxFiles < 0 {
+		return nil, fmt.Errorf("config.MaxFiles must be greater than or equal to 0")
+	}
+
+	if config.MaxFiles == 0 {
+		config.MaxFiles = DefaultMaxFiles
+	}
+
+	f := &RotatingFile{Config: config}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	// #nosec
+	file, err := os.OpenFile(f.Config.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = fileInfo.Size()
+	return nil
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// We never split a write between two files,
+	// so a log line is never broken in two.
+	if f.Config.MaxSizeInBytes > 0 && f.size > 0 && f.size+int64(len(p)) > f.Config.MaxSizeInBytes {
+		if err := f.rotate(); err != nil {
+			return 0, fmt.Errorf("error rotating %s: %v", f.Config.Path, err)
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	_ = os.Remove(RotatedPath(f.Config.Path, f.Config.MaxFiles))
+	for i := f.Config.MaxFiles - 1; i >= 1; i-- {
+		from := RotatedPath(f.Config.Path, i)
+		if _, err := os.Stat(from); err == nil {
+			if err := os.Rename(from, RotatedPath(f.Config.Path, i+1)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := os.Rename(f.Config.Path, RotatedPath(f.Config.Path, 1)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return f.open()
+}
+
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
+
+func RotatedPath(path string, i int) string {
+	return filepath.Clean(fmt.Sprintf("%s.%d", path, i))
+}
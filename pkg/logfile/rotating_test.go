@@ -0,0 +1,112 @@
+package logfile
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test__RotatingFileRotatesAboveMaxSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent_log")
+	f, err := NewRotatingFile(RotatingFileConfig{Path: path, MaxSizeInBytes: 20, MaxFiles: 2})
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		_, err := f.Write([]byte(fmt.Sprintf("line %d ....\n", i)))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, f.Close())
+
+	// each line is 13 bytes, so each file only holds one line,
+	// and only the 2 most recent rotated files are kept.
+	assert.Equal(t, "line 4 ....\n", readFile(t, path))
+	assert.Equal(t, "line 3 ....\n", readFile(t, RotatedPath(path, 1)))
+	assert.Equal(t, "line 2 ....\n", readFile(t, RotatedPath(path, 2)))
+	assert.NoFileExists(t, RotatedPath(path, 3))
+}
+
+func Test__RotatingFileAppendsToExistingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent_log")
+	require.NoError(t, os.WriteFile(path, []byte("old\n"), 0600))
+
+	f, err := NewRotatingFile(RotatingFileConfig{Path: path, MaxSizeInBytes: 10})
+	require.NoError(t, err)
+
+	_, err = f.Write([]byte("new\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "old\nnew\n", readFile(t, path))
+
+	// the existing content counts towards the size
+	_, err = f.Write([]byte("newer\n"))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	assert.Equal(t, "newer\n", readFile(t, path))
+	assert.Equal(t, "old\nnew\n", readFile(t, RotatedPath(path, 1)))
+}
+
+func Test__RotatingFileWithoutMaxSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent_log")
+	f, err := NewRotatingFile(RotatingFileConfig{Path: path})
+	require.NoError(t, err)
+
+	for i := 0; i < 100; i++ {
+		_, err := f.Write([]byte("abcdefghijklmnopqrstuvwxyz\n"))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, f.Close())
+	assert.Equal(t, strings.Repeat("abcdefghijklmnopqrstuvwxyz\n", 100), readFile(t, path))
+	assert.NoFileExists(t, RotatedPath(path, 1))
+}
+
+func Test__RotatingFileValidatesConfig(t *testing.T) {
+	_, err := NewRotatingFile(RotatingFileConfig{})
+	assert.ErrorContains(t, err, "config.Path is required")
+
+	_, err = NewRotatingFile(RotatingFileConfig{Path: "/tmp/agent_log", MaxSizeInBytes: -1})
+	assert.ErrorContains(t, err, "config.MaxSizeInBytes must be greater than or equal to 0")
+}
+
+func Test__Tail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent_log")
+
+	lines := []string{}
+	for i := 0; i < 10000; i++ {
+		lines = append(lines, fmt.Sprintf("line %d\n", i))
+	}
+
+	require.NoError(t, os.WriteFile(path, []byte(strings.Join(lines, "")), 0600))
+
+	for _, n := range []int{0, 1, 2, 5000, 9999, 10000, 20000} {
+		expected := lines
+		if n < len(lines) {
+			expected = lines[len(lines)-n:]
+		}
+
+		w := new(bytes.Buffer)
+		require.NoError(t, Tail(path, n, w))
+		assert.Equal(t, strings.Join(expected, ""), w.String(), "lines=%d", n)
+	}
+
+	// last line without a newline
+	require.NoError(t, os.WriteFile(path, []byte("a\nb\nc"), 0600))
+	w := new(bytes.Buffer)
+	require.NoError(t, Tail(path, 2, w))
+	assert.Equal(t, "b\nc", w.String())
+
+	assert.Error(t, Tail(filepath.Join(t.TempDir(), "nope"), 1, new(bytes.Buffer)))
+}
+
+func readFile(t *testing.T, path string) string {
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return string(content)
+}
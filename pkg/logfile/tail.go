@@ -0,0 +1,77 @@
+package logfile
+
+import (
+	"io"
+	"os"
+)
+
+const tailChunkSize = 64 * 1024
+
+/*
+ * Writes the last N lines of a file into the writer,
+ * reading the file backwards, so we don't need to go through
+ * the whole file when it is big.
+ */
+func Tail(path string, lines int, writer io.Writer) error {
+	// #nosec
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	end := fileInfo.Size()
+	start := end
+	if lines <= 0 {
+		return nil
+	}
+	newlines := 0
+	buffer := make([]byte, tailChunkSize)
+
+	// The last line usually ends with a newline, which doesn't start a new line.
+	if end > 0 {
+		last := make([]byte, 1)
+		if _, err := file.ReadAt(last, end-1); err != nil {
+			return err
+		}
+
+		if last[0] == '\n' {
+			newlines--
+		}
+	}
+
+	for start > 0 && newlines < lines {
+		chunkSize := int64(tailChunkSize)
+		if start < chunkSize {
+			chunkSize = start
+		}
+
+		start -= chunkSize
+		chunk := buffer[:chunkSize]
+		if _, err := file.ReadAt(chunk, start); err != nil {
+			return err
+		}
+
+		// Find where the line we want begins, going backwards in the chunk.
+		for i := len(chunk) - 1; i >= 0; i-- {
+			if chunk[i] != '\n' {
+				continue
+			}
+
+			newlines++
+			if newlines == lines {
+				start += int64(i) + 1
+				break
+			}
+		}
+	}
+
+	_, err = io.Copy(writer, io.NewSectionReader(file, start, end-start))
+	return err
+}
@@ -0,0 +1,342 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	mux "github.com/gorilla/mux"
+	websocket "github.com/gorilla/websocket"
+	executors "github.com/semaphoreci/agent/pkg/executors"
+	jobs "github.com/semaphoreci/agent/pkg/jobs"
+	log "github.com/sirupsen/logrus"
+)
+
+// The terminal size used if the client doesn't specify one.
+const AttachDefaultCols = 80
+const AttachDefaultRows = 24
+
+// How long we wait for a message to be sent to the client.
+const AttachWriteTimeout = 10 * time.Second
+
+// How often we ping the client, to prevent proxies from closing the connection.
+const AttachPingInterval = 15 * time.Second
+
+// How often we check if the job is still running.
+// Attached shells are not allowed to outlive the job.
+const AttachJobCheckInterval = time.Second
+
+// After the attached shell exits, how long we wait for its remaining output.
+const AttachOutputFlushTimeout = time.Second
+
+const AttachMessageResize = "resize"
+const AttachMessageExit = "exit"
+
+/*
+ * Binary messages carry the terminal input and output.
+ * Text messages carry these control messages, encoded as JSON:
+ *
+ * - {"type": "resize", "cols": 120, "rows": 40}, from the client, when its terminal is resized.
+ * - {"type": "exit", "exit_code": 0}, from the server, when the attached shell exits.
+ */
+type AttachMessage struct {
+	Type     string `json:"type"`
+	Cols     uint16 `json:"cols,omitempty"`
+	Rows     uint16 `json:"rows,omitempty"`
+	ExitCode *int   `json:"exit_code,omitempty"`
+}
+
+var attachUpgrader = websocket.Upgrader{
+	// Requests are authenticated with the Authorization header, and not with cookies,
+	// so there's no risk in accepting requests from other origins.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+/*
+ * Opens an additional interactive shell in the context the job commands run in,
+ * and connects it to the client using a WebSocket. The initial size of the terminal
+ * can be specified with the cols and rows query parameters.
+ * The token used must identify the user, with the "sub" claim,
+ * since every attach session is recorded in the job log.
+ */
+func (s *Server) AttachToJob(w http.ResponseWriter, r *http.Request) {
+	jobID := mux.Vars(r)["job_id"]
+	job := s.findJob(w, jobID, "attach to")
+	if job == nil {
+		return
+	}
+
+	user := requestUser(r)
+	if user == "" {
+		log.Warnf("Attempt to attach to '%s' with a token that does not identify the user", jobID)
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintf(w, `{"message": "the authorization token does not identify the user"}`)
+		return
+	}
+
+	if job.Finished || job.Stopped {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, `{"message": "job %s is not running"}`, jobID)
+		return
+	}
+
+	attachable, ok := job.Executor.(executors.Attachable)
+	if !ok {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		fmt.Fprintf(w, `{"message": "the executor for job %s does not support attaching"}`, jobID)
+		return
+	}
+
+	cols, rows, err := attachSize(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"message": "%v"}`, err)
+		return
+	}
+
+	attachedShell, err := attachable.Attach(cols, rows)
+	if err != nil {
+		log.Warnf("Could not attach to '%s': %v", jobID, err)
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprintf(w, `{"message": "%v"}`, err)
+		return
+	}
+
+	// The upgrader writes the error response itself.
+	conn, err := attachUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Errorf("Error upgrading attach request for '%s': %v", jobID, err)
+		_ = attachedShell.Kill()
+		_ = attachedShell.Wait()
+		_ = attachedShell.Close()
+		return
+	}
+
+	// The deadlines set by the server are meant for regular requests.
+	_ = conn.NetConn().SetDeadline(time.Time{})
+
+	session := &attachSession{
+		id:            newAttachSessionID(),
+		user:          user,
+		remoteAddress: r.RemoteAddr,
+		job:           job,
+		conn:          conn,
+		shell:         attachedShell,
+	}
+
+	session.run()
+}
+
+func attachSize(r *http.Request) (uint16, uint16, error) {
+	cols, err := attachDimension(r, "cols", AttachDefaultCols)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	rows, err := attachDimension(r, "rows", AttachDefaultRows)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return cols, rows, nil
+}
+
+func attachDimension(r *http.Request, name string, defaultValue uint16) (uint16, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	n, err := strconv.ParseUint(value, 10, 16)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid %s '%s'", name, value)
+	}
+
+	return uint16(n), nil
+}
+
+func newAttachSessionID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+type attachSession struct {
+	id            string
+	user          string
+	remoteAddress string
+	job           *jobs.Job
+	conn          *websocket.Conn
+	shell         executors.AttachedShell
+	writeLock     sync.Mutex
+	terminateOnce sync.Once
+}
+
+func (a *attachSession) run() {
+	startedAt := time.Now()
+	jobID := a.job.Request.JobID
+
+	log.Infof("User '%s' attached to job '%s' from %s - session %s", a.user, jobID, a.remoteAddress, a.id)
+	a.job.Logger.LogAttachStarted(a.id, a.user, a.remoteAddress)
+
+	done := make(chan struct{})
+	outputDone := make(chan struct{})
+	go a.forwardInput()
+	go a.watch(done)
+	go func() {
+		a.forwardOutput()
+		close(outputDone)
+	}()
+
+	exitCode := a.shell.Wait()
+	close(done)
+
+	// Processes started in the attached shell can keep the terminal open,
+	// so we don't wait forever for the output to finish.
+	select {
+	case <-outputDone:
+	case <-time.After(AttachOutputFlushTimeout):
+	}
+
+	_ = a.shell.Close()
+
+	finishedAt := time.Now()
+	log.Infof("User '%s' detached from job '%s' - session %s, exit code %d", a.user, jobID, a.id, exitCode)
+	a.job.Logger.LogAttachFinished(a.id, a.user, exitCode, startedAt, finishedAt)
+
+	a.sendExit(exitCode)
+	_ = a.conn.Close()
+}
+
+func (a *attachSession) forwardOutput() {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := a.shell.Read(buf)
+		if n > 0 {
+			if writeErr := a.write(websocket.BinaryMessage, buf[:n]); writeErr != nil {
+				log.Debugf("Error sending output for session %s: %v", a.id, writeErr)
+				a.terminate()
+				return
+			}
+		}
+
+		// Once the shell exits, reading from its terminal fails.
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (a *attachSession) forwardInput() {
+	for {
+		messageType, data, err := a.conn.ReadMessage()
+		if err != nil {
+			log.Debugf("Connection for session %s closed: %v", a.id, err)
+			a.terminate()
+			return
+		}
+
+		switch messageType {
+		case websocket.BinaryMessage:
+			if _, err := a.shell.Write(data); err != nil {
+				log.Debugf("Error writing input for session %s: %v", a.id, err)
+				return
+			}
+
+		case websocket.TextMessage:
+			a.handleControlMessage(data)
+		}
+	}
+}
+
+func (a *attachSession) handleControlMessage(data []byte) {
+	message := AttachMessage{}
+	if err := json.Unmarshal(data, &message); err != nil {
+		log.Warnf("Invalid control message for session %s: %v", a.id, err)
+		return
+	}
+
+	switch message.Type {
+	case AttachMessageResize:
+		if message.Cols == 0 || message.Rows == 0 {
+			log.Warnf("Invalid terminal size for session %s: %dx%d", a.id, message.Cols, message.Rows)
+			return
+		}
+
+		if err := a.shell.Resize(message.Cols, message.Rows); err != nil {
+			log.Warnf("Error resizing terminal for session %s: %v", a.id, err)
+		}
+
+	default:
+		log.Warnf("Unknown control message for session %s: '%s'", a.id, message.Type)
+	}
+}
+
+/*
+ * Keeps the connection alive, and ends the session
+ * if the job stops running before the attached shell exits.
+ */
+func (a *attachSession) watch(done chan struct{}) {
+	pingTicker := time.NewTicker(AttachPingInterval)
+	defer pingTicker.Stop()
+
+	jobTicker := time.NewTicker(AttachJobCheckInterval)
+	defer jobTicker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+
+		case <-pingTicker.C:
+			err := a.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(AttachWriteTimeout))
+			if err != nil {
+				log.Debugf("Error pinging client for session %s: %v", a.id, err)
+				a.terminate()
+				return
+			}
+
+		case <-jobTicker.C:
+			if a.job.Finished || a.job.Stopped {
+				log.Infof("Job '%s' is not running anymore - ending session %s", a.job.Request.JobID, a.id)
+				a.terminate()
+				return
+			}
+		}
+	}
+}
+
+func (a *attachSession) sendExit(exitCode int) {
+	message, _ := json.Marshal(AttachMessage{Type: AttachMessageExit, ExitCode: &exitCode})
+	if err := a.write(websocket.TextMessage, message); err != nil {
+		log.Debugf("Error sending exit code for session %s: %v", a.id, err)
+		return
+	}
+
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	_ = a.conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(AttachWriteTimeout))
+}
+
+func (a *attachSession) write(messageType int, data []byte) error {
+	a.writeLock.Lock()
+	defer a.writeLock.Unlock()
+
+	_ = a.conn.SetWriteDeadline(time.Now().Add(AttachWriteTimeout))
+	return a.conn.WriteMessage(messageType, data)
+}
+
+func (a *attachSession) terminate() {
+	a.terminateOnce.Do(func() {
+		if err := a.shell.Kill(); err != nil {
+			log.Errorf("Error killing attached shell for session %s: %v", a.id, err)
+		}
+	})
+}
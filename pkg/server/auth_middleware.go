@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -17,6 +18,11 @@ import (
 //   fmt.Printf(tokenString)
 //
 
+type contextKey string
+
+// The claims of the token used in the request are kept in its context.
+const claimsContextKey contextKey = "jwt-claims"
+
 func CreateJwtMiddleware(jwtSecret []byte) func(http.HandlerFunc) http.HandlerFunc {
 	return func(next http.HandlerFunc) http.HandlerFunc {
 		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
@@ -56,7 +62,21 @@ func CreateJwtMiddleware(jwtSecret []byte) func(http.HandlerFunc) http.HandlerFu
 				return
 			}
 
-			next(w, req)
+			next(w, req.WithContext(context.WithValue(req.Context(), claimsContextKey, token.Claims)))
 		})
 	}
 }
+
+/*
+ * The user a request was made by, taken from the "sub" claim of its token.
+ * Empty, if the token has no "sub" claim.
+ */
+func requestUser(req *http.Request) string {
+	claims, ok := req.Context().Value(claimsContextKey).(jwt.MapClaims)
+	if !ok {
+		return ""
+	}
+
+	user, _ := claims["sub"].(string)
+	return user
+}
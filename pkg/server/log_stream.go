@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	mux "github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// How often we check the job log for new lines
+// when there is nothing new to send to the client.
+const LogStreamPollInterval = 200 * time.Millisecond
+
+// How many lines we read from the job log at once.
+const LogStreamBatchSize = 1000
+
+// If nothing is sent for this long, we send a comment line,
+// to prevent proxies from closing the connection.
+const LogStreamKeepAliveInterval = 15 * time.Second
+
+// The server uses a short write timeout for all requests,
+// so we keep pushing the write deadline forward while streaming.
+const LogStreamWriteTimeout = 30 * time.Second
+
+/*
+ * Streams the job logs using server-sent events (SSE).
+ * Each line in the job log is sent as a separate event,
+ * using the line number as the event ID, so clients can
+ * resume from where they stopped with the Last-Event-ID header.
+ * The stream ends after the job_finished event is sent,
+ * or when the client disconnects.
+ */
+func (s *Server) StreamJobLogs(w http.ResponseWriter, r *http.Request) {
+	jobID := mux.Vars(r)["job_id"]
+	job := s.findJobForLogs(w, jobID)
+	if job == nil {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Errorf("Streaming is not supported by the response writer")
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, `{"message": "streaming is not supported"}`)
+		return
+	}
+
+	startFrom, err := streamStartingLine(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"message": "%v"}`, err)
+		return
+	}
+
+	controller := http.NewResponseController(w)
+	extendWriteDeadline(controller)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	lastSentAt := time.Now()
+	for {
+		buf := bytes.Buffer{}
+		next, err := job.Logger.Backend.Read(startFrom, LogStreamBatchSize, &buf)
+		if err != nil {
+			log.Errorf("Error reading logs for job '%s' from line %d: %v", jobID, startFrom, err)
+			return
+		}
+
+		lineNumber := startFrom
+		scanner := bufio.NewScanner(&buf)
+		scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+		for scanner.Scan() {
+			line := scanner.Bytes()
+			extendWriteDeadline(controller)
+			fmt.Fprintf(w, "id: %d\ndata: %s\n\n", lineNumber, line)
+			lineNumber++
+
+			if isJobFinishedEvent(line) {
+				flusher.Flush()
+				return
+			}
+		}
+
+		if next > startFrom {
+			flusher.Flush()
+			lastSentAt = time.Now()
+			startFrom = next
+			continue
+		}
+
+		if time.Since(lastSentAt) > LogStreamKeepAliveInterval {
+			extendWriteDeadline(controller)
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+			lastSentAt = time.Now()
+		}
+
+		select {
+		case <-r.Context().Done():
+			log.Debugf("Client for job '%s' log stream disconnected", jobID)
+			return
+		case <-time.After(LogStreamPollInterval):
+		}
+	}
+}
+
+/*
+ * Clients that reconnect send the ID of the last event they received,
+ * so we continue from the line right after it.
+ * Otherwise, the start_from query parameter is used, like in the non-streaming endpoint.
+ */
+func streamStartingLine(r *http.Request) (int, error) {
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		n, err := strconv.Atoi(lastEventID)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid Last-Event-ID '%s'", lastEventID)
+		}
+
+		return n + 1, nil
+	}
+
+	startFromQuery := r.URL.Query().Get("start_from")
+	if startFromQuery == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(startFromQuery)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid start_from '%s'", startFromQuery)
+	}
+
+	return n, nil
+}
+
+func isJobFinishedEvent(line []byte) bool {
+	event := struct {
+		Event string `json:"event"`
+	}{}
+
+	if err := json.Unmarshal(line, &event); err != nil {
+		return false
+	}
+
+	return event.Event == "job_finished"
+}
+
+func extendWriteDeadline(controller *http.ResponseController) {
+	// Not all response writers support deadlines, e.g. httptest.ResponseRecorder.
+	// In that case, there's no timeout to extend, so we just ignore the error.
+	_ = controller.SetWriteDeadline(time.Now().Add(LogStreamWriteTimeout))
+}
@@ -18,7 +18,9 @@ import (
 
 	api "github.com/semaphoreci/agent/pkg/api"
 	"github.com/semaphoreci/agent/pkg/config"
+	"github.com/semaphoreci/agent/pkg/eventlogger"
 	jobs "github.com/semaphoreci/agent/pkg/jobs"
+	"github.com/semaphoreci/agent/pkg/logfile"
 	slices "github.com/semaphoreci/agent/pkg/slices"
 	log "github.com/sirupsen/logrus"
 )
@@ -43,6 +45,7 @@ type ServerConfig struct {
 	TLSKeyPath            string
 	Version               string
 	LogFile               io.Writer
+	LogFilePath           string
 	JWTSecret             []byte
 	HTTPClient            *http.Client
 	PreJobHookPath        string
@@ -84,6 +87,8 @@ func NewServer(config ServerConfig) *Server {
 	router.HandleFunc("/status", jwtMiddleware(server.Status)).Methods("GET")
 	router.HandleFunc("/jobs", jwtMiddleware(server.Run)).Methods("POST")
 	router.HandleFunc("/jobs/{job_id}/log", jwtMiddleware(server.JobLogs)).Methods("GET")
+	router.HandleFunc("/jobs/{job_id}/log/stream", jwtMiddleware(server.StreamJobLogs)).Methods("GET")
+	router.HandleFunc("/jobs/{job_id}/attach", jwtMiddleware(server.AttachToJob)).Methods("GET")
 
 	// The path /stop is the new standard, /jobs/terminate is here to support the legacy system.
 	router.HandleFunc("/stop", jwtMiddleware(server.Stop)).Methods("POST")
@@ -140,26 +145,47 @@ func (s *Server) isAlive(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "yes")
 }
 
-func (s *Server) JobLogs(w http.ResponseWriter, r *http.Request) {
-	w.Header().Add("Content-Type", "text/plain")
+/*
+ * Finds the job we should serve logs for.
+ * If it can't be found, the appropriate response is written, and nil is returned.
+ */
+func (s *Server) findJobForLogs(w http.ResponseWriter, jobID string) *jobs.Job {
+	return s.findJob(w, jobID, "fetch logs for")
+}
 
-	jobID := mux.Vars(r)["job_id"]
+/*
+ * Finds the job a request is for. The action is only used for logging.
+ * If it can't be found, the appropriate response is written, and nil is returned.
+ */
+func (s *Server) findJob(w http.ResponseWriter, jobID, action string) *jobs.Job {
+	job := s.ActiveJob
 
-	// If no jobs have been received yet, we have no logs.
-	if s.ActiveJob == nil {
-		log.Warnf("Attempt to fetch logs for '%s' before any job is received", jobID)
+	// If no jobs have been received yet, there's nothing to serve.
+	if job == nil {
+		log.Warnf("Attempt to %s '%s' before any job is received", action, jobID)
 		w.WriteHeader(http.StatusNotFound)
 		fmt.Fprintf(w, `{"message": "job %s is not running"}`, jobID)
-		return
+		return nil
 	}
 
 	// Here, we know that a job was scheduled.
 	// We need to ensure the ID in the request matches the one executing.
-	runningJobID := s.ActiveJob.Request.JobID
+	runningJobID := job.Request.JobID
 	if runningJobID != jobID {
-		log.Warnf("Attempt to fetch logs for '%s', but job '%s' is the one running", jobID, runningJobID)
+		log.Warnf("Attempt to %s '%s', but job '%s' is the one running", action, jobID, runningJobID)
 		w.WriteHeader(http.StatusForbidden)
 		fmt.Fprintf(w, `{"message": "job %s is not running"}`, jobID)
+		return nil
+	}
+
+	return job
+}
+
+func (s *Server) JobLogs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "text/plain")
+
+	jobID := mux.Vars(r)["job_id"]
+	if s.findJobForLogs(w, jobID) == nil {
 		return
 	}
 
@@ -181,10 +207,28 @@ func (s *Server) JobLogs(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+/*
+ * Serves the agent logs. The lines query parameter
+ * can be used to only get the last N lines of the logs.
+ */
 func (s *Server) AgentLogs(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Content-Type", "text/plain")
 
-	logsPath := filepath.Join(os.TempDir(), "agent_log")
+	logsPath := s.Config.LogFilePath
+	if logsPath == "" {
+		logsPath = filepath.Join(os.TempDir(), "agent_log")
+	}
+
+	if linesQuery := r.URL.Query().Get("lines"); linesQuery != "" {
+		lines, err := strconv.Atoi(linesQuery)
+		if err != nil || lines < 0 {
+			http.Error(w, fmt.Sprintf("invalid lines '%s'", linesQuery), http.StatusBadRequest)
+			return
+		}
+
+		s.tailAgentLogs(w, logsPath, lines)
+		return
+	}
 
 	// #nosec
 	logfile, err := os.Open(logsPath)
@@ -205,6 +249,17 @@ func (s *Server) AgentLogs(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (s *Server) tailAgentLogs(w http.ResponseWriter, logsPath string, lines int) {
+	if _, err := os.Stat(logsPath); err != nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	if err := logfile.Tail(logsPath, lines, w); err != nil {
+		log.Errorf("Error writing agent logs: %v", err)
+	}
+}
+
 func (s *Server) Run(w http.ResponseWriter, r *http.Request) {
 	s.activeJobLock.Lock()
 	defer s.activeJobLock.Unlock()
@@ -252,6 +307,7 @@ func (s *Server) Run(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	eventlogger.SetCurrentJobID(request.JobID)
 	log.Infof("Creating new job for %s", request.JobID)
 	job, err := jobs.NewJobWithOptions(&jobs.JobOptions{
 		Request:         request,
@@ -1,18 +1,30 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/gorilla/websocket"
 	"github.com/semaphoreci/agent/pkg/api"
+	"github.com/semaphoreci/agent/pkg/config"
+	"github.com/semaphoreci/agent/pkg/eventlogger"
+	"github.com/semaphoreci/agent/pkg/executors"
+	"github.com/semaphoreci/agent/pkg/jobs"
+	"github.com/semaphoreci/agent/pkg/slices"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test__JobLogs(t *testing.T) {
@@ -47,6 +59,219 @@ func Test__JobLogs(t *testing.T) {
 	})
 }
 
+func Test__StreamJobLogs(t *testing.T) {
+	dummyKey := "dummykey"
+	testServer := NewServer(ServerConfig{
+		HTTPClient: http.DefaultClient,
+		JWTSecret:  []byte(dummyKey),
+	})
+
+	token, err := generateToken(dummyKey)
+	require.NoError(t, err)
+
+	httpServer := httptest.NewServer(testServer.router)
+	defer httpServer.Close()
+
+	t.Run("no token -> 401", func(t *testing.T) {
+		code, _ := streamLogs(t, httpServer.URL, "job-0", "", nil)
+		assert.Equal(t, http.StatusUnauthorized, code)
+	})
+
+	t.Run("no active job -> 404", func(t *testing.T) {
+		code, _ := streamLogs(t, httpServer.URL, "job-0", token, nil)
+		assert.Equal(t, http.StatusNotFound, code)
+	})
+
+	logger, _ := eventlogger.DefaultTestLogger()
+	defer logger.Close()
+
+	testServer.ActiveJob = &jobs.Job{
+		Request: &api.JobRequest{JobID: "job-0"},
+		Logger:  logger,
+	}
+
+	t.Run("job running and job on request do not match -> 403", func(t *testing.T) {
+		code, _ := streamLogs(t, httpServer.URL, "id-not-matching", token, nil)
+		assert.Equal(t, http.StatusForbidden, code)
+	})
+
+	t.Run("streams logs until job is finished", func(t *testing.T) {
+		logger.LogJobStarted()
+
+		go func() {
+			for i := 0; i < 5; i++ {
+				time.Sleep(100 * time.Millisecond)
+				logger.LogCommandOutput(fmt.Sprintf("hello %d\n", i))
+			}
+
+			logger.LogJobFinished("passed")
+		}()
+
+		code, events := streamLogs(t, httpServer.URL, "job-0", token, nil)
+		require.Equal(t, http.StatusOK, code)
+		require.Len(t, events, 7)
+		assert.Contains(t, events[0], `"event":"job_started"`)
+		assert.Contains(t, events[1], `hello 0`)
+		assert.Contains(t, events[5], `hello 4`)
+		assert.Contains(t, events[6], `"event":"job_finished"`)
+	})
+
+	t.Run("resumes from Last-Event-ID", func(t *testing.T) {
+		code, events := streamLogs(t, httpServer.URL, "job-0", token, map[string]string{"Last-Event-ID": "4"})
+		require.Equal(t, http.StatusOK, code)
+		require.Len(t, events, 2)
+		assert.Contains(t, events[0], `hello 4`)
+		assert.Contains(t, events[1], `"event":"job_finished"`)
+	})
+
+	t.Run("bad Last-Event-ID -> 400", func(t *testing.T) {
+		code, _ := streamLogs(t, httpServer.URL, "job-0", token, map[string]string{"Last-Event-ID": "nope"})
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+
+	t.Run("non-streaming endpoint serves the same logs", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/jobs/job-0/log?start_from=5", nil)
+		req.Header.Add("Authorization", "Token "+token)
+		rr := httptest.NewRecorder()
+		testServer.router.ServeHTTP(rr, req)
+
+		require.Equal(t, http.StatusOK, rr.Code)
+		lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n")
+		require.Len(t, lines, 2)
+		assert.Contains(t, lines[0], `hello 4`)
+		assert.Contains(t, lines[1], `"event":"job_finished"`)
+	})
+}
+
+func Test__AttachToJob(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	dummyKey := "dummykey"
+	testServer := NewServer(ServerConfig{
+		HTTPClient: http.DefaultClient,
+		JWTSecret:  []byte(dummyKey),
+	})
+
+	token, err := generateToken(dummyKey)
+	require.NoError(t, err)
+	userToken, err := generateTokenForUser(dummyKey, "jane")
+	require.NoError(t, err)
+
+	httpServer := httptest.NewServer(testServer.router)
+	defer httpServer.Close()
+
+	t.Run("no active job -> 404", func(t *testing.T) {
+		_, code := attach(t, httpServer.URL, "job-0", "", userToken)
+		assert.Equal(t, http.StatusNotFound, code)
+	})
+
+	logger, backend := eventlogger.DefaultTestLogger()
+	defer logger.Close()
+
+	request := &api.JobRequest{JobID: "job-0"}
+	executor := executors.NewShellExecutor(request, logger, true)
+	require.Zero(t, executor.Prepare())
+	require.Zero(t, executor.Start())
+	require.Zero(t, executor.ExportEnvVars([]api.EnvVar{}, []config.HostEnvVar{{Name: "A", Value: "AAA"}}))
+	defer executor.Stop()
+
+	job := &jobs.Job{Request: request, Logger: logger, Executor: executor}
+	testServer.ActiveJob = job
+
+	t.Run("job running and job on request do not match -> 403", func(t *testing.T) {
+		_, code := attach(t, httpServer.URL, "id-not-matching", "", userToken)
+		assert.Equal(t, http.StatusForbidden, code)
+	})
+
+	t.Run("token does not identify the user -> 403", func(t *testing.T) {
+		_, code := attach(t, httpServer.URL, "job-0", "", token)
+		assert.Equal(t, http.StatusForbidden, code)
+	})
+
+	t.Run("bad terminal size -> 400", func(t *testing.T) {
+		_, code := attach(t, httpServer.URL, "job-0", "cols=nope", userToken)
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+
+	t.Run("opens a shell with the job environment", func(t *testing.T) {
+		conn, code := attach(t, httpServer.URL, "job-0", "cols=100&rows=30", userToken)
+		require.Equal(t, http.StatusSwitchingProtocols, code)
+		defer conn.Close()
+
+		require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, []byte("stty size\n")))
+		readAttachOutputUntil(t, conn, "30 100")
+
+		require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"type": "resize", "cols": 120, "rows": 40}`)))
+		require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, []byte("stty size; echo $A; exit 3\n")))
+
+		output, exitCode := readAttachSession(t, conn)
+		assert.Contains(t, output, "40 120")
+		assert.Contains(t, output, "AAA")
+		assert.Equal(t, 3, exitCode)
+
+		simplifiedEvents, err := backend.SimplifiedEvents(false, false)
+		require.NoError(t, err)
+		assert.Contains(t, simplifiedEvents, "attach_started: jane")
+		assert.Contains(t, simplifiedEvents, "attach_finished: jane, exit code 3")
+	})
+
+	t.Run("shell is killed when the client disconnects", func(t *testing.T) {
+		conn, code := attach(t, httpServer.URL, "job-0", "", userToken)
+		require.Equal(t, http.StatusSwitchingProtocols, code)
+		conn.Close()
+
+		assert.Eventually(t, func() bool {
+			simplifiedEvents, _ := backend.SimplifiedEvents(false, false)
+			return slices.Contains(simplifiedEvents, "attach_finished: jane, exit code 137")
+		}, 5*time.Second, 100*time.Millisecond)
+	})
+
+	t.Run("job is not running anymore -> 409", func(t *testing.T) {
+		job.Finished = true
+		_, code := attach(t, httpServer.URL, "job-0", "", userToken)
+		assert.Equal(t, http.StatusConflict, code)
+	})
+}
+
+func Test__AgentLogs(t *testing.T) {
+	dummyKey := "dummykey"
+	logFilePath := filepath.Join(t.TempDir(), "agent.log")
+	testServer := NewServer(ServerConfig{
+		HTTPClient:  http.DefaultClient,
+		JWTSecret:   []byte(dummyKey),
+		LogFilePath: logFilePath,
+	})
+
+	token, err := generateToken(dummyKey)
+	require.NoError(t, err)
+
+	t.Run("no log file -> 404", func(t *testing.T) {
+		code, _ := getAgentLogs(t, testServer, "", token)
+		assert.Equal(t, http.StatusNotFound, code)
+	})
+
+	require.NoError(t, os.WriteFile(logFilePath, []byte("line 1\nline 2\nline 3\n"), 0600))
+
+	t.Run("whole file from the configured path", func(t *testing.T) {
+		code, body := getAgentLogs(t, testServer, "", token)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "line 1\nline 2\nline 3\n", body.String())
+	})
+
+	t.Run("last N lines", func(t *testing.T) {
+		code, body := getAgentLogs(t, testServer, "?lines=2", token)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "line 2\nline 3\n", body.String())
+	})
+
+	t.Run("bad lines -> 400", func(t *testing.T) {
+		code, _ := getAgentLogs(t, testServer, "?lines=abc", token)
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+}
+
 func Test__ServerStatus(t *testing.T) {
 	dummyKey := "dummykey"
 	testServer := NewServer(ServerConfig{
@@ -185,6 +410,86 @@ func getLogs(t *testing.T, testServer *Server, jobID, token string) (int, *bytes
 	return rr.Code, rr.Body
 }
 
+func getAgentLogs(t *testing.T, testServer *Server, query, token string) (int, *bytes.Buffer) {
+	req, _ := http.NewRequest("GET", "/agent_logs"+query, nil)
+	req.Header.Add("Authorization", "Token "+token)
+	rr := httptest.NewRecorder()
+	testServer.router.ServeHTTP(rr, req)
+	return rr.Code, rr.Body
+}
+
+/*
+ * Returns the data of all the events received in the stream.
+ */
+func streamLogs(t *testing.T, URL, jobID, token string, headers map[string]string) (int, []string) {
+	req, _ := http.NewRequest("GET", fmt.Sprintf("%s/jobs/%s/log/stream", URL, jobID), nil)
+	req.Header.Add("Authorization", "Token "+token)
+	for k, v := range headers {
+		req.Header.Add(k, v)
+	}
+
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if !assert.NoError(t, err) {
+		return -1, nil
+	}
+
+	defer resp.Body.Close()
+
+	events := []string{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+			events = append(events, data)
+		}
+	}
+
+	assert.NoError(t, scanner.Err())
+	return resp.StatusCode, events
+}
+
+func attach(t *testing.T, URL, jobID, query, token string) (*websocket.Conn, int) {
+	url := fmt.Sprintf("ws%s/jobs/%s/attach?%s", strings.TrimPrefix(URL, "http"), jobID, query)
+	conn, response, err := websocket.DefaultDialer.Dial(url, http.Header{"Authorization": []string{"Token " + token}})
+	if err != nil {
+		require.NotNil(t, response)
+		return nil, response.StatusCode
+	}
+
+	return conn, response.StatusCode
+}
+
+func readAttachOutputUntil(t *testing.T, conn *websocket.Conn, expected string) {
+	output := strings.Builder{}
+	for !strings.Contains(output.String(), expected) {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(10*time.Second)))
+		messageType, data, err := conn.ReadMessage()
+		require.NoError(t, err)
+		require.Equal(t, websocket.BinaryMessage, messageType)
+		output.Write(data)
+	}
+}
+
+func readAttachSession(t *testing.T, conn *websocket.Conn) (string, int) {
+	output := strings.Builder{}
+	for {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(10*time.Second)))
+		messageType, data, err := conn.ReadMessage()
+		require.NoError(t, err)
+
+		if messageType == websocket.BinaryMessage {
+			output.Write(data)
+			continue
+		}
+
+		message := AttachMessage{}
+		require.NoError(t, json.Unmarshal(data, &message))
+		require.Equal(t, AttachMessageExit, message.Type)
+		require.NotNil(t, message.ExitCode)
+		return output.String(), *message.ExitCode
+	}
+}
+
 func postJob(t *testing.T, testServer *Server, jobReq *api.JobRequest, token string, i int) (int, *bytes.Buffer) {
 	jobRequest := jobReq
 	if jobRequest == nil {
@@ -231,6 +536,18 @@ func countBodies(bodies []string, body string) int {
 	return count
 }
 
+func generateTokenForUser(key, user string) (string, error) {
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub": user,
+		"iat": now.Unix(),
+		"nbf": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	})
+
+	return token.SignedString([]byte(key))
+}
+
 func generateToken(key string) (string, error) {
 	now := time.Now()
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
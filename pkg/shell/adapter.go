@@ -0,0 +1,186 @@
+package shell
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+/*
+ * Shells don't agree on how to source a file, how to silence the prompt,
+ * or which profile file is read on login. An adapter knows how to
+ * build those instructions for a particular shell.
+ */
+type Adapter interface {
+	Name() string
+
+	// The arguments used to start the shell, if none are configured.
+	DefaultArgs() []string
+
+	// Instruction to execute a file in the current shell.
+	Source(path string) string
+
+	// Instruction to execute a base64-encoded script in the current shell.
+	SourceBase64(encoded string) string
+
+	// Instruction to export an environment variable.
+	Export(name, value string) string
+
+	// Instructions used to remove the prompt when the shell is started.
+	SilencePrompt() []string
+
+	// The profile file read by a login shell.
+	ProfilePath() string
+}
+
+const (
+	ShellBash       = "bash"
+	ShellZsh        = "zsh"
+	ShellSh         = "sh"
+	ShellPowershell = "powershell"
+)
+
+/*
+ * Finds the adapter for a shell executable, using its name.
+ * Unknown shells are expected to be POSIX-compatible.
+ */
+func AdapterFor(executable string) Adapter {
+	name := strings.TrimSuffix(filepath.Base(executable), ".exe")
+
+	switch name {
+	case ShellBash:
+		return &bashAdapter{}
+	case ShellZsh:
+		return &zshAdapter{}
+	case ShellPowershell, "pwsh":
+		return &powershellAdapter{}
+	default:
+		return &posixAdapter{}
+	}
+}
+
+type bashAdapter struct{}
+
+func (a *bashAdapter) Name() string {
+	return ShellBash
+}
+
+func (a *bashAdapter) DefaultArgs() []string {
+	return []string{"--login"}
+}
+
+func (a *bashAdapter) Source(path string) string {
+	return fmt.Sprintf("source %s", path)
+}
+
+func (a *bashAdapter) SourceBase64(encoded string) string {
+	return fmt.Sprintf("source <(echo %s | base64 -d)", encoded)
+}
+
+func (a *bashAdapter) Export(name, value string) string {
+	return fmt.Sprintf("export %s=%s", name, shellQuote(value))
+}
+
+/*
+ * With bracketed paste enabled, readline writes escape sequences
+ * into the TTY every time it reads a new instruction,
+ * which would end up in the output of the commands.
+ */
+func (a *bashAdapter) SilencePrompt() []string {
+	return []string{
+		"export PS1=''",
+		"bind 'set enable-bracketed-paste off' 2>/dev/null",
+	}
+}
+
+func (a *bashAdapter) ProfilePath() string {
+	return "~/.bash_profile"
+}
+
+type zshAdapter struct {
+	bashAdapter
+}
+
+func (a *zshAdapter) Name() string {
+	return ShellZsh
+}
+
+/*
+ * Besides the prompts, zsh marks output not ending in a newline
+ * with a '%' before showing the next prompt. Disabling the line editor
+ * also disables bracketed paste.
+ */
+func (a *zshAdapter) SilencePrompt() []string {
+	return []string{
+		"PS1=''; PROMPT=''; RPROMPT=''",
+		"unsetopt prompt_cr prompt_sp zle",
+	}
+}
+
+func (a *zshAdapter) ProfilePath() string {
+	return "~/.zprofile"
+}
+
+/*
+ * Used for sh, ash, dash and other POSIX shells,
+ * which don't have 'source' nor process substitution.
+ */
+type posixAdapter struct{}
+
+func (a *posixAdapter) Name() string {
+	return ShellSh
+}
+
+func (a *posixAdapter) DefaultArgs() []string {
+	return []string{"-l"}
+}
+
+func (a *posixAdapter) Source(path string) string {
+	return fmt.Sprintf(". %s", path)
+}
+
+func (a *posixAdapter) SourceBase64(encoded string) string {
+	return fmt.Sprintf(`eval "$(echo %s | base64 -d)"`, encoded)
+}
+
+func (a *posixAdapter) Export(name, value string) string {
+	return fmt.Sprintf("export %s=%s", name, shellQuote(value))
+}
+
+func (a *posixAdapter) SilencePrompt() []string {
+	return []string{"PS1=''"}
+}
+
+func (a *posixAdapter) ProfilePath() string {
+	return "~/.profile"
+}
+
+type powershellAdapter struct{}
+
+func (a *powershellAdapter) Name() string {
+	return ShellPowershell
+}
+
+func (a *powershellAdapter) DefaultArgs() []string {
+	return []string{"-NoProfile", "-NonInteractive"}
+}
+
+func (a *powershellAdapter) Source(path string) string {
+	return fmt.Sprintf(". %s", path)
+}
+
+func (a *powershellAdapter) SourceBase64(encoded string) string {
+	return fmt.Sprintf("Invoke-Expression ([System.Text.Encoding]::UTF8.GetString([System.Convert]::FromBase64String('%s')))", encoded)
+}
+
+func (a *powershellAdapter) Export(name, value string) string {
+	return fmt.Sprintf("$env:%s = \"%s\"", name, escapePowershellQuotes(value))
+}
+
+func (a *powershellAdapter) SilencePrompt() []string {
+	return []string{}
+}
+
+func (a *powershellAdapter) ProfilePath() string {
+	return "$PROFILE"
+}
@@ -0,0 +1,38 @@
+package shell
+
+import (
+	"testing"
+
+	assert "github.com/stretchr/testify/assert"
+)
+
+func Test__AdapterFor(t *testing.T) {
+	assert.Equal(t, ShellBash, AdapterFor("bash").Name())
+	assert.Equal(t, ShellBash, AdapterFor("/usr/local/bin/bash").Name())
+	assert.Equal(t, ShellZsh, AdapterFor("/bin/zsh").Name())
+	assert.Equal(t, ShellSh, AdapterFor("sh").Name())
+	assert.Equal(t, ShellSh, AdapterFor("/bin/ash").Name())
+	assert.Equal(t, ShellSh, AdapterFor("dash").Name())
+	assert.Equal(t, ShellPowershell, AdapterFor("powershell.exe").Name())
+}
+
+func Test__AdapterInstructions(t *testing.T) {
+	bash := AdapterFor("bash")
+	assert.Equal(t, "source /tmp/file", bash.Source("/tmp/file"))
+	assert.Equal(t, "source <(echo ZWNobw== | base64 -d)", bash.SourceBase64("ZWNobw=="))
+	assert.Equal(t, "export A='hello world'", bash.Export("A", "hello world"))
+	assert.Equal(t, "~/.bash_profile", bash.ProfilePath())
+
+	sh := AdapterFor("ash")
+	assert.Equal(t, ". /tmp/file", sh.Source("/tmp/file"))
+	assert.Equal(t, `eval "$(echo ZWNobw== | base64 -d)"`, sh.SourceBase64("ZWNobw=="))
+	assert.Equal(t, "export A='hello world'", sh.Export("A", "hello world"))
+	assert.Equal(t, "~/.profile", sh.ProfilePath())
+
+	zsh := AdapterFor("zsh")
+	assert.Equal(t, "source /tmp/file", zsh.Source("/tmp/file"))
+	assert.Equal(t, "~/.zprofile", zsh.ProfilePath())
+
+	powershell := AdapterFor("powershell")
+	assert.Equal(t, "$env:A = \"say `\"hi`\"\"", powershell.Export("A", "say \"hi\""))
+}
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"io/ioutil"
 	"regexp"
-	"runtime"
 	"sort"
 	"strings"
 
@@ -62,6 +61,64 @@ func CreateEnvironmentFromFile(fileName string) (*Environment, error) {
 	return &environment, nil
 }
 
+/*
+ * Create an environment by reading a file created with EnvDumpCommand,
+ * where each variable is in its own line, and the backslashes
+ * and newlines in the values are escaped.
+ */
+func CreateEnvironmentFromEnvDump(fileName string) (*Environment, error) {
+	// #nosec
+	bytes, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	environment := Environment{env: map[string]string{}}
+	for _, line := range strings.Split(string(bytes), "\n") {
+		name, value, found := strings.Cut(line, "=")
+		if found && name != "" {
+			environment.Set(name, unescapeEnvDumpValue(value))
+		}
+	}
+
+	return &environment, nil
+}
+
+func unescapeEnvDumpValue(value string) string {
+	if !strings.Contains(value, "\\") {
+		return value
+	}
+
+	unescaped := strings.Builder{}
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' || i == len(value)-1 {
+			unescaped.WriteByte(value[i])
+			continue
+		}
+
+		i++
+		if value[i] == 'n' {
+			unescaped.WriteByte('\n')
+		} else {
+			unescaped.WriteByte(value[i])
+		}
+	}
+
+	return unescaped.String()
+}
+
+func CreateEnvironmentFromSlice(variables []string) *Environment {
+	environment := Environment{env: map[string]string{}}
+	for _, variable := range variables {
+		nameAndValue := strings.SplitN(variable, "=", 2)
+		if len(nameAndValue) == 2 && nameAndValue[0] != "" {
+			environment.Set(nameAndValue[0], nameAndValue[1])
+		}
+	}
+
+	return &environment
+}
+
 func (e *Environment) Set(name, value string) {
 	if e.env == nil {
 		e.env = map[string]string{}
@@ -112,38 +169,50 @@ func (e *Environment) ToSlice() []string {
 }
 
 func (e *Environment) ToCommands() []string {
+	return e.ToCommandsFor(AdapterFor(Executable()))
+}
+
+func (e *Environment) ToCommandsFor(adapter Adapter) []string {
 	commands := []string{}
 
 	for _, name := range e.Keys() {
 		value, _ := e.Get(name)
-		commands = append(commands, fmt.Sprintf("export %s=%s\n", name, shellQuote(value)))
+		commands = append(commands, adapter.Export(name, value)+"\n")
 	}
 
 	return commands
 }
 
 func (e *Environment) ToFile(fileName string, callback func(name string)) error {
-	fileContent := ""
+	return e.ToFileFor(fileName, AdapterFor(Executable()), callback)
+}
+
+/*
+ * The file holds decoded secrets, so only the agent's user can read it.
+ */
+func (e *Environment) ToFileFor(fileName string, adapter Adapter, callback func(name string)) error {
+	// #nosec
+	err := ioutil.WriteFile(fileName, []byte(e.ToScriptFor(adapter, callback)), 0600)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// The instructions to export all the variables in the environment.
+func (e *Environment) ToScriptFor(adapter Adapter, callback func(name string)) string {
+	script := ""
 	for _, name := range e.Keys() {
 		value, _ := e.Get(name)
-		if runtime.GOOS == "windows" {
-			fileContent += fmt.Sprintf("$env:%s = \"%s\"\n", name, escapePowershellQuotes(value))
-		} else {
-			fileContent += fmt.Sprintf("export %s=%s\n", name, shellQuote(value))
-		}
+		script += adapter.Export(name, value) + "\n"
 
 		if callback != nil {
 			callback(name)
 		}
 	}
 
-	// #nosec
-	err := ioutil.WriteFile(fileName, []byte(fileContent), 0644)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return script
 }
 
 func escapePowershellQuotes(s string) string {
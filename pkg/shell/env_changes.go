@@ -0,0 +1,69 @@
+package shell
+
+/*
+ * Variables that change on every command, or that the agent sets itself,
+ * which are not interesting when looking for what a command changed.
+ */
+var untrackedVariables = map[string]bool{
+	"_":                           true,
+	"SHLVL":                       true,
+	"PWD":                         true,
+	"OLDPWD":                      true,
+	"SEMAPHORE_AGENT_CURRENT_DIR": true,
+	"SEMAPHORE_AGENT_CURRENT_CMD_EXIT_STATUS": true,
+}
+
+/*
+ * What a command changed in the environment.
+ * Only the names of the variables are kept,
+ * so no secrets end up in the job logs.
+ */
+type EnvironmentChanges struct {
+	Added   []string
+	Changed []string
+	Removed []string
+
+	// Empty, if the working directory did not change.
+	Directory string
+}
+
+/*
+ * Returns nil if nothing changed.
+ */
+func DiffEnvironments(before, after *Environment, cwdBefore, cwdAfter string) *EnvironmentChanges {
+	changes := EnvironmentChanges{}
+
+	for _, name := range after.Keys() {
+		if untrackedVariables[name] {
+			continue
+		}
+
+		newValue, _ := after.Get(name)
+		oldValue, existed := before.Get(name)
+		if !existed {
+			changes.Added = append(changes.Added, name)
+		} else if oldValue != newValue {
+			changes.Changed = append(changes.Changed, name)
+		}
+	}
+
+	for _, name := range before.Keys() {
+		if untrackedVariables[name] {
+			continue
+		}
+
+		if _, exists := after.Get(name); !exists {
+			changes.Removed = append(changes.Removed, name)
+		}
+	}
+
+	if cwdAfter != "" && cwdAfter != cwdBefore {
+		changes.Directory = cwdAfter
+	}
+
+	if len(changes.Added) == 0 && len(changes.Changed) == 0 && len(changes.Removed) == 0 && changes.Directory == "" {
+		return nil
+	}
+
+	return &changes
+}
@@ -4,6 +4,8 @@ import (
 	"encoding/base64"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"runtime"
 	"testing"
 
@@ -101,6 +103,34 @@ VAR_C=CCC
 	os.Remove(file.Name())
 }
 
+func Test__CreateEnvironmentFromEnvDump(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	dumpFile := filepath.Join(t.TempDir(), "env.after")
+
+	// #nosec
+	cmd := exec.Command("sh", "-c", EnvDumpCommand+" > "+dumpFile)
+	cmd.Env = []string{
+		"VAR_A=AAA",
+		"VAR_B=multiple\nlines\n",
+		`VAR_C=back\slashes\n\\n`,
+		"VAR_D=with=equals",
+		"VAR_E=",
+	}
+
+	assert.NoError(t, cmd.Run())
+
+	env, err := CreateEnvironmentFromEnvDump(dumpFile)
+	assert.Nil(t, err)
+	assertValueExists(t, env, "VAR_A", "AAA")
+	assertValueExists(t, env, "VAR_B", "multiple\nlines\n")
+	assertValueExists(t, env, "VAR_C", `back\slashes\n\\n`)
+	assertValueExists(t, env, "VAR_D", "with=equals")
+	assertValueExists(t, env, "VAR_E", "")
+}
+
 func Test__EnvironmentToFile(t *testing.T) {
 	vars := []api.EnvVar{
 		{Name: "Z", Value: base64.StdEncoding.EncodeToString([]byte("ZZZ"))},
@@ -145,6 +175,22 @@ export Z=ZZZ
 	os.Remove(file.Name())
 }
 
+func Test__EnvironmentToFileIsOnlyReadableByOwner(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	env, err := CreateEnvironment([]api.EnvVar{}, []config.HostEnvVar{{Name: "SECRET", Value: "hunter2"}})
+	assert.Nil(t, err)
+
+	fileName := filepath.Join(t.TempDir(), ".env")
+	assert.Nil(t, env.ToFile(fileName, nil))
+
+	info, err := os.Stat(fileName)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
 func Test__EnvironmentToSlice(t *testing.T) {
 	varsFromRequest := []api.EnvVar{
 		{Name: "A", Value: base64.StdEncoding.EncodeToString([]byte("AAA"))},
@@ -201,3 +247,18 @@ func assertValueExists(t *testing.T, env *Environment, key, expectedValue string
 	assert.True(t, ok)
 	assert.Equal(t, value, expectedValue)
 }
+
+func Test__DiffEnvironments(t *testing.T) {
+	before := CreateEnvironmentFromSlice([]string{"A=1", "B=2", "C=3", "SHLVL=1", "PWD=/home"})
+	after := CreateEnvironmentFromSlice([]string{"A=1", "B=changed", "D=4", "SHLVL=2", "PWD=/tmp"})
+
+	changes := DiffEnvironments(before, after, "/home", "/tmp")
+	assert.Equal(t, &EnvironmentChanges{
+		Added:     []string{"D"},
+		Changed:   []string{"B"},
+		Removed:   []string{"C"},
+		Directory: "/tmp",
+	}, changes)
+
+	assert.Nil(t, DiffEnvironments(before, before, "/home", "/home"))
+}
@@ -0,0 +1,81 @@
+package shell
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+/*
+ * The kernel counts how many processes the OOM killer killed in a cgroup
+ * and in its descendants. We use the counter of the agent's own cgroup,
+ * since the commands run by a local shell are in it too. See Shell.DetectOOMKills.
+ */
+func countOOMKills() (int, bool) {
+	file := oomKillsFile()
+	if file == "" {
+		return 0, false
+	}
+
+	// #nosec
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return 0, false
+	}
+
+	return parseOOMKills(string(content))
+}
+
+/*
+ * With cgroup v1, or in hybrid mode, the counter is in the memory controller.
+ * With cgroup v2, it is in the unified hierarchy.
+ */
+func oomKillsFile() string {
+	content, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return ""
+	}
+
+	unified := ""
+	for _, line := range strings.Split(string(content), "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+
+		if parts[0] == "0" && parts[1] == "" {
+			unified = filepath.Join(cgroupRoot, parts[2], "memory.events")
+			continue
+		}
+
+		for _, controller := range strings.Split(parts[1], ",") {
+			if controller == "memory" {
+				return filepath.Join(cgroupRoot, "memory", parts[2], "memory.oom_control")
+			}
+		}
+	}
+
+	return unified
+}
+
+// Both memory.events and memory.oom_control have an "oom_kill <count>" line.
+func parseOOMKills(content string) (int, bool) {
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[0] != "oom_kill" {
+			continue
+		}
+
+		count, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return 0, false
+		}
+
+		return count, true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,20 @@
+package shell
+
+import (
+	"testing"
+
+	assert "github.com/stretchr/testify/assert"
+)
+
+func Test__ParseOOMKills(t *testing.T) {
+	count, ok := parseOOMKills("low 0\nhigh 0\nmax 12\noom 3\noom_kill 2\noom_group_kill 0\n")
+	assert.True(t, ok)
+	assert.Equal(t, 2, count)
+
+	count, ok = parseOOMKills("oom_kill_disable 0\nunder_oom 0\noom_kill 5\n")
+	assert.True(t, ok)
+	assert.Equal(t, 5, count)
+
+	_, ok = parseOOMKills("oom_kill_disable 0\nunder_oom 0\n")
+	assert.False(t, ok)
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package shell
+
+// The OOM killer counters are only available on Linux.
+func countOOMKills() (int, bool) {
+	return 0, false
+}
@@ -41,23 +41,47 @@ type OutputBuffer struct {
 	done         bool
 	lastAppend   *time.Time
 	flushTimeout time.Duration
+	limiter      *OutputLimiter
+}
+
+type OutputBufferOptions struct {
+	Consumer func(string)
+
+	// If zero, one minute is used.
+	FlushTimeout time.Duration
+
+	// If empty, the output is not limited.
+	Limits OutputLimits
 }
 
 func NewOutputBuffer(consumer func(string)) (*OutputBuffer, error) {
-	return NewOutputBufferWithFlushTimeout(consumer, time.Minute)
+	return NewOutputBufferWithOptions(OutputBufferOptions{Consumer: consumer})
 }
 
 func NewOutputBufferWithFlushTimeout(consumer func(string), flushTimeout time.Duration) (*OutputBuffer, error) {
-	if consumer == nil {
+	return NewOutputBufferWithOptions(OutputBufferOptions{Consumer: consumer, FlushTimeout: flushTimeout})
+}
+
+func NewOutputBufferWithOptions(options OutputBufferOptions) (*OutputBuffer, error) {
+	if options.Consumer == nil {
 		return nil, fmt.Errorf("output buffer requires a consumer")
 	}
 
+	flushTimeout := options.FlushTimeout
+	if flushTimeout == 0 {
+		flushTimeout = time.Minute
+	}
+
 	b := &OutputBuffer{
-		Consumer:     consumer,
+		Consumer:     options.Consumer,
 		bytes:        []byte{},
 		flushTimeout: flushTimeout,
 	}
 
+	if !options.Limits.IsEmpty() {
+		b.limiter = NewOutputLimiter(options.Consumer, options.Limits)
+	}
+
 	go b.Flush()
 
 	return b, nil
@@ -178,6 +202,11 @@ func (b *OutputBuffer) flush() {
 	// Make sure we normalize newline sequences, and flush the output to the consumer.
 	output := strings.Replace(string(bytes), "\r\n", "\n", -1)
 	log.Debugf("%d bytes flushed: %s", len(bytes), output)
+	if b.limiter != nil {
+		b.limiter.Write(output)
+		return
+	}
+
 	b.Consumer(output)
 }
 
@@ -233,7 +262,7 @@ func (b *OutputBuffer) Close() error {
 
 	log.Debugf("Waiting for buffer to be completely flushed...")
 
-	return retry.RetryWithConstantWaitAndContext(ctx, retry.RetryOptions{
+	err := retry.RetryWithConstantWaitAndContext(ctx, retry.RetryOptions{
 		Task:                 "wait for all output to be flushed",
 		MaxAttempts:          math.MaxInt, // flush it until the the context reaches the deadline
 		DelayBetweenAttempts: 0,           // no need to sleep between flushes
@@ -247,4 +276,17 @@ func (b *OutputBuffer) Close() error {
 			return fmt.Errorf("not fully flushed")
 		},
 	})
+
+	/*
+	 * Whatever the limiter is still holding is only flushed
+	 * after all the output went through it. Holding the lock here
+	 * makes sure a flush in progress in the Flush() goroutine finishes first.
+	 */
+	if b.limiter != nil {
+		b.mu.Lock()
+		b.limiter.Close()
+		b.mu.Unlock()
+	}
+
+	return err
 }
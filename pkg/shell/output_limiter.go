@@ -0,0 +1,360 @@
+package shell
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+ * Lines longer than this are never collapsed,
+ * to avoid keeping huge lines around just to compare them with the next one.
+ */
+const OutputLimiterMaxCollapsibleLineLength = 4096
+
+/*
+ * Limits applied to the output of a single command,
+ * to protect the job logs from commands that flood them.
+ * A zero value disables the corresponding limit.
+ */
+type OutputLimits struct {
+	// Output after this many bytes is omitted, except for the last TailBytes.
+	MaxBytesPerCommand int
+
+	// How many bytes from the end of the output are shown
+	// when the command finishes, if MaxBytesPerCommand was reached.
+	TailBytes int
+
+	// Output produced faster than this is dropped.
+	MaxBytesPerSecond int
+
+	// Consecutive identical lines are replaced by a notice with the number of repetitions.
+	CollapseRepeatedLines bool
+}
+
+func (l OutputLimits) IsEmpty() bool {
+	return l.MaxBytesPerCommand <= 0 && l.MaxBytesPerSecond <= 0 && !l.CollapseRepeatedLines
+}
+
+func (l OutputLimits) Validate() error {
+	if l.MaxBytesPerCommand < 0 {
+		return fmt.Errorf("max bytes per command can't be negative")
+	}
+
+	if l.TailBytes < 0 {
+		return fmt.Errorf("tail bytes can't be negative")
+	}
+
+	if l.MaxBytesPerSecond < 0 {
+		return fmt.Errorf("max bytes per second can't be negative")
+	}
+
+	if l.TailBytes > 0 && l.TailBytes >= l.MaxBytesPerCommand {
+		return fmt.Errorf("tail bytes (%d) must be smaller than max bytes per command (%d)", l.TailBytes, l.MaxBytesPerCommand)
+	}
+
+	return nil
+}
+
+/*
+ * The OutputLimiter sits between the OutputBuffer and its consumer.
+ * The output goes through three stages, in this order:
+ *
+ * 1 - Repeated lines are collapsed. A line that could still become
+ *     a repetition of the previous one is held until we know if it is.
+ * 2 - After MaxBytesPerCommand - TailBytes bytes, the output is omitted,
+ *     but the last TailBytes bytes are kept and shown when the command finishes.
+ * 3 - The output is rate limited with a token bucket,
+ *     which refills at MaxBytesPerSecond and holds at most one second worth of output.
+ *
+ * Every time output is changed or dropped, a notice is written in the log instead.
+ */
+type OutputLimiter struct {
+	Consumer func(string)
+	limits   OutputLimits
+	mu       sync.Mutex
+	now      func() time.Time
+	lastByte byte
+
+	// repeated lines
+	lastLine           string
+	currentLine        string
+	currentLineEmitted bool
+	currentLineTooLong bool
+	repetitions        int
+
+	// byte cap
+	totalBytes  int
+	headEmitted int
+	capped      bool
+	tail        []byte
+
+	// rate limiting
+	tokens       float64
+	lastRefill   time.Time
+	droppedBytes int
+}
+
+func NewOutputLimiter(consumer func(string), limits OutputLimits) *OutputLimiter {
+	return newOutputLimiterWithClock(consumer, limits, time.Now)
+}
+
+func newOutputLimiterWithClock(consumer func(string), limits OutputLimits, now func() time.Time) *OutputLimiter {
+	return &OutputLimiter{
+		Consumer:   consumer,
+		limits:     limits,
+		now:        now,
+		tokens:     float64(limits.MaxBytesPerSecond),
+		lastRefill: now(),
+	}
+}
+
+func (l *OutputLimiter) Write(output string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.limits.CollapseRepeatedLines {
+		l.capBytes(output)
+		return
+	}
+
+	l.collapse(output)
+}
+
+/*
+ * Flushes everything still held by the limiter:
+ * the number of repetitions of the last line, a partial line,
+ * and the tail of the output, if the byte cap was reached.
+ */
+func (l *OutputLimiter) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.flushRepetitions()
+	if !l.currentLineEmitted && l.currentLine != "" {
+		l.capBytes(l.currentLine)
+		l.currentLine = ""
+	}
+
+	if l.droppedBytes > 0 {
+		l.emitNotice(fmt.Sprintf("[%d bytes dropped by the output rate limit]", l.droppedBytes))
+		l.droppedBytes = 0
+	}
+
+	if l.capped {
+		tail := l.trimTail()
+		l.emitNotice(fmt.Sprintf("[%d bytes omitted]", l.totalBytes-l.headEmitted-len(tail)))
+		if len(tail) > 0 {
+			l.emit(string(tail))
+		}
+
+		l.capped = false
+		l.tail = nil
+	}
+}
+
+func (l *OutputLimiter) collapse(output string) {
+	for len(output) > 0 {
+		segment := output
+		if i := strings.IndexByte(output, '\n'); i >= 0 {
+			segment = output[:i+1]
+		}
+
+		output = output[len(segment):]
+		complete := strings.HasSuffix(segment, "\n")
+
+		if !l.currentLineEmitted {
+			candidate := l.currentLine + segment
+			if l.lastLine != "" && strings.HasPrefix(l.lastLine, candidate) {
+				if complete {
+					l.repetitions++
+					l.currentLine = ""
+				} else {
+					l.currentLine = candidate
+				}
+
+				continue
+			}
+
+			l.flushRepetitions()
+			l.currentLine = ""
+			segment = candidate
+		}
+
+		l.capBytes(segment)
+		l.trackLine(segment, complete)
+	}
+}
+
+func (l *OutputLimiter) trackLine(segment string, complete bool) {
+	if complete {
+		line := l.currentLine + segment
+		if l.currentLineTooLong || len(line) > OutputLimiterMaxCollapsibleLineLength {
+			l.lastLine = ""
+		} else {
+			l.lastLine = line
+		}
+
+		l.currentLine = ""
+		l.currentLineEmitted = false
+		l.currentLineTooLong = false
+		return
+	}
+
+	l.currentLineEmitted = true
+	if l.currentLineTooLong {
+		return
+	}
+
+	if len(l.currentLine)+len(segment) > OutputLimiterMaxCollapsibleLineLength {
+		l.currentLineTooLong = true
+		l.currentLine = ""
+		return
+	}
+
+	l.currentLine += segment
+}
+
+func (l *OutputLimiter) flushRepetitions() {
+	switch l.repetitions {
+	case 0:
+		return
+	case 1:
+		l.emitNotice("[previous line repeated 1 more time]")
+	default:
+		l.emitNotice(fmt.Sprintf("[previous line repeated %d more times]", l.repetitions))
+	}
+
+	l.repetitions = 0
+}
+
+func (l *OutputLimiter) headBytes() int {
+	return l.limits.MaxBytesPerCommand - l.limits.TailBytes
+}
+
+func (l *OutputLimiter) capBytes(output string) {
+	if l.limits.MaxBytesPerCommand <= 0 {
+		l.rateLimit(output)
+		return
+	}
+
+	if !l.capped {
+		remaining := l.headBytes() - l.totalBytes
+		if len(output) <= remaining {
+			l.totalBytes += len(output)
+			l.rateLimit(output)
+			return
+		}
+
+		// We don't want to cut in the middle of an UTF-8 sequence.
+		for remaining > 0 && !utf8.RuneStart(output[remaining]) {
+			remaining--
+		}
+
+		if remaining > 0 {
+			l.totalBytes += remaining
+			l.rateLimit(output[:remaining])
+			output = output[remaining:]
+		}
+
+		l.capped = true
+		l.headEmitted = l.totalBytes
+		if l.limits.TailBytes > 0 {
+			l.emitNotice(fmt.Sprintf(
+				"[output limit of %d bytes reached - omitting the rest of the output, except for the last %d bytes]",
+				l.limits.MaxBytesPerCommand,
+				l.limits.TailBytes,
+			))
+		} else {
+			l.emitNotice(fmt.Sprintf("[output limit of %d bytes reached - omitting the rest of the output]", l.limits.MaxBytesPerCommand))
+		}
+	}
+
+	l.totalBytes += len(output)
+	if l.limits.TailBytes <= 0 {
+		return
+	}
+
+	l.tail = append(l.tail, output...)
+	if len(l.tail) > l.limits.TailBytes {
+		l.tail = l.tail[len(l.tail)-l.limits.TailBytes:]
+	}
+}
+
+/*
+ * The tail starts at the beginning of a line, if there's one in it,
+ * and never in the middle of an UTF-8 sequence.
+ */
+func (l *OutputLimiter) trimTail() []byte {
+	tail := l.tail
+	if i := strings.IndexByte(string(tail), '\n'); i >= 0 && i < len(tail)-1 {
+		return tail[i+1:]
+	}
+
+	for len(tail) > 0 && !utf8.RuneStart(tail[0]) {
+		tail = tail[1:]
+	}
+
+	return tail
+}
+
+func (l *OutputLimiter) rateLimit(output string) {
+	if l.limits.MaxBytesPerSecond <= 0 {
+		l.emit(output)
+		return
+	}
+
+	l.refill()
+
+	/*
+	 * Chunks are never split, so the bucket is allowed to go into debt,
+	 * which still keeps the average rate at MaxBytesPerSecond.
+	 */
+	if l.tokens > 0 {
+		if l.droppedBytes > 0 {
+			l.emitNotice(fmt.Sprintf("[%d bytes dropped by the output rate limit]", l.droppedBytes))
+			l.droppedBytes = 0
+		}
+
+		l.tokens -= float64(len(output))
+		l.emit(output)
+		return
+	}
+
+	if l.droppedBytes == 0 {
+		l.emitNotice(fmt.Sprintf("[output rate limit of %d bytes per second exceeded - dropping output]", l.limits.MaxBytesPerSecond))
+	}
+
+	l.droppedBytes += len(output)
+}
+
+func (l *OutputLimiter) refill() {
+	now := l.now()
+	elapsed := now.Sub(l.lastRefill)
+	l.lastRefill = now
+
+	l.tokens += elapsed.Seconds() * float64(l.limits.MaxBytesPerSecond)
+	if l.tokens > float64(l.limits.MaxBytesPerSecond) {
+		l.tokens = float64(l.limits.MaxBytesPerSecond)
+	}
+}
+
+// Notices are always written in their own line.
+func (l *OutputLimiter) emitNotice(notice string) {
+	if l.lastByte != 0 && l.lastByte != '\n' {
+		notice = "\n" + notice
+	}
+
+	l.emit(notice + "\n")
+}
+
+func (l *OutputLimiter) emit(output string) {
+	if output == "" {
+		return
+	}
+
+	l.lastByte = output[len(output)-1]
+	l.Consumer(output)
+}
@@ -0,0 +1,136 @@
+package shell
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test__OutputLimits__Validate(t *testing.T) {
+	assert.NoError(t, OutputLimits{}.Validate())
+	assert.NoError(t, OutputLimits{MaxBytesPerCommand: 100, TailBytes: 50}.Validate())
+	assert.ErrorContains(t, OutputLimits{MaxBytesPerCommand: -1}.Validate(), "can't be negative")
+	assert.ErrorContains(t, OutputLimits{MaxBytesPerSecond: -1}.Validate(), "can't be negative")
+	assert.ErrorContains(t, OutputLimits{MaxBytesPerCommand: 100, TailBytes: 100}.Validate(), "must be smaller")
+	assert.ErrorContains(t, OutputLimits{TailBytes: 10}.Validate(), "must be smaller")
+}
+
+func Test__OutputLimiter__CollapsesRepeatedLines(t *testing.T) {
+	output, limiter := newTestOutputLimiter(OutputLimits{CollapseRepeatedLines: true}, time.Now)
+
+	// lines split between chunks are still collapsed
+	limiter.Write("hello\nhel")
+	limiter.Write("lo\nhello\nhello\nworld\n")
+	limiter.Write("world\nbye")
+	limiter.Close()
+
+	assert.Equal(t, strings.Join([]string{
+		"hello",
+		"[previous line repeated 3 more times]",
+		"world",
+		"[previous line repeated 1 more time]",
+		"bye",
+	}, "\n"), output.String())
+}
+
+func Test__OutputLimiter__EmitsLinesThatAreNotRepetitionsImmediately(t *testing.T) {
+	output, limiter := newTestOutputLimiter(OutputLimits{CollapseRepeatedLines: true}, time.Now)
+
+	limiter.Write("hello\n")
+	limiter.Write("hel")
+	assert.Equal(t, "hello\n", output.String())
+
+	// as soon as we know it's not a repetition, the held output is emitted
+	limiter.Write("p")
+	assert.Equal(t, "hello\nhelp", output.String())
+
+	limiter.Write(" me\nhelp me\n")
+	limiter.Close()
+	assert.Equal(t, "hello\nhelp me\n[previous line repeated 1 more time]\n", output.String())
+}
+
+func Test__OutputLimiter__KeepsHeadAndTail(t *testing.T) {
+	output, limiter := newTestOutputLimiter(OutputLimits{MaxBytesPerCommand: 30, TailBytes: 10}, time.Now)
+
+	for i := 0; i < 10; i++ {
+		limiter.Write("line " + string(rune('0'+i)) + "\n")
+	}
+
+	limiter.Close()
+
+	assert.Equal(t, strings.Join([]string{
+		"line 0",
+		"line 1",
+		"line 2",
+		"[output limit of 30 bytes reached - omitting the rest of the output, except for the last 10 bytes]",
+		"[43 bytes omitted]",
+		"line 9",
+		"",
+	}, "\n"), output.String())
+}
+
+func Test__OutputLimiter__DoesNotCutUTF8Sequences(t *testing.T) {
+	output, limiter := newTestOutputLimiter(OutputLimits{MaxBytesPerCommand: 4}, time.Now)
+
+	limiter.Write("aaé")
+	limiter.Write("é")
+	limiter.Close()
+
+	assert.Equal(t, strings.Join([]string{
+		"aaé",
+		"[output limit of 4 bytes reached - omitting the rest of the output]",
+		"[2 bytes omitted]",
+		"",
+	}, "\n"), output.String())
+}
+
+func Test__OutputLimiter__RateLimitsOutput(t *testing.T) {
+	now := time.Now()
+	clock := func() time.Time { return now }
+	output, limiter := newTestOutputLimiter(OutputLimits{MaxBytesPerSecond: 10}, clock)
+
+	limiter.Write("0123456789\n")
+	limiter.Write("dropped\n")
+	limiter.Write("dropped\n")
+
+	// after one second, the bucket is full again,
+	// and it can go into debt to accept a whole chunk
+	now = now.Add(time.Second)
+	limiter.Write("back\n")
+	limiter.Write("again\n")
+	limiter.Write("dropped\n")
+	limiter.Close()
+
+	assert.Equal(t, strings.Join([]string{
+		"0123456789",
+		"[output rate limit of 10 bytes per second exceeded - dropping output]",
+		"[16 bytes dropped by the output rate limit]",
+		"back",
+		"again",
+		"[output rate limit of 10 bytes per second exceeded - dropping output]",
+		"[8 bytes dropped by the output rate limit]",
+		"",
+	}, "\n"), output.String())
+}
+
+func Test__OutputBuffer__UsesLimits(t *testing.T) {
+	output := strings.Builder{}
+	buffer, err := NewOutputBufferWithOptions(OutputBufferOptions{
+		Consumer: func(s string) { output.WriteString(s) },
+		Limits:   OutputLimits{CollapseRepeatedLines: true},
+	})
+
+	require.NoError(t, err)
+	buffer.Append([]byte(strings.Repeat("y\n", 1000)))
+	require.NoError(t, buffer.Close())
+	assert.Equal(t, "y\n[previous line repeated 999 more times]\n", output.String())
+}
+
+func newTestOutputLimiter(limits OutputLimits, clock func() time.Time) (*strings.Builder, *OutputLimiter) {
+	output := &strings.Builder{}
+	limiter := newOutputLimiterWithClock(func(s string) { output.WriteString(s) }, limits, clock)
+	return output, limiter
+}
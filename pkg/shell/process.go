@@ -1,7 +1,11 @@
 package shell
 
 import (
+	"bufio"
+	crand "crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
@@ -30,24 +34,59 @@ $ErrorActionPreference = "STOP"
 %s
 if ($LASTEXITCODE -eq $null) {$Env:SEMAPHORE_AGENT_CURRENT_CMD_EXIT_STATUS = 0} else {$Env:SEMAPHORE_AGENT_CURRENT_CMD_EXIT_STATUS = $LASTEXITCODE}
 $Env:SEMAPHORE_AGENT_CURRENT_DIR = $PWD | Select-Object -ExpandProperty Path
-Get-ChildItem Env: | Foreach-Object {"$($_.Name)=$($_.Value)"} | Set-Content "%s.env.after"
+Get-ChildItem Env: | Foreach-Object {"$($_.Name)=$($_.Value)"} | Set-Content "%s"
 exit $Env:SEMAPHORE_AGENT_CURRENT_CMD_EXIT_STATUS
 `
 
+/*
+ * Dumps the environment, one variable per line, with backslashes and newlines escaped,
+ * to be read with CreateEnvironmentFromEnvDump().
+ * We use awk, since 'env -0' is not available everywhere, e.g. on macOS.
+ */
+const EnvDumpCommand = `awk 'BEGIN { for (name in ENVIRON) { value = ENVIRON[name]; escaped = ""; while ((i = match(value, /[\\\n]/)) > 0) { escaped = escaped substr(value, 1, i - 1) (substr(value, i, 1) == "\\" ? "\\\\" : "\\n"); value = substr(value, i + 1) } print name "=" escaped value } }'`
+
+/*
+ * In the PTY, the agent does not wait for the commands, so the shell
+ * tells it which signal an exit status above 128 stands for, as `kill -l` names it.
+ */
+const ReportSignalCommand = `if [ $AGENT_CMD_RESULT -gt 128 ]; then AGENT_CMD_SIGNAL=$(kill -l $AGENT_CMD_RESULT 2>/dev/null); else AGENT_CMD_SIGNAL=; fi`
+
+/*
+ * Without a PTY on Linux and macOS, each command runs in a new shell,
+ * and we keep track of the working directory and environment
+ * by dumping them after the command is executed, like we do on Windows.
+ * The dump holds the job's secrets, so only the agent's user can read it.
+ */
+const NonPTYScript = `%s
+AGENT_CMD_RESULT=$?
+(umask 077; SEMAPHORE_AGENT_CURRENT_DIR="$PWD" %s > %s)
+exit $AGENT_CMD_RESULT
+`
+
 type Config struct {
 	Shell             *Shell
 	StoragePath       string
 	Command           string
 	OnOutput          func(string)
 	UseBase64Encoding bool
+
+	/*
+	 * If set, the output written to stderr is sent here
+	 * instead of OnOutput. Only used when the shell does not use a PTY,
+	 * since a PTY merges both streams.
+	 */
+	OnStderr func(string)
+
+	// Limits applied to the output of the command. Each stream is limited separately.
+	OutputLimits OutputLimits
 }
 
 type Process struct {
 	Command           string
 	Shell             *Shell
 	StoragePath       string
-	StartedAt         int
-	FinishedAt        int
+	StartedAt         time.Time
+	FinishedAt        time.Time
 	ExitCode          int
 	Pid               int
 	startMark         string
@@ -55,19 +94,50 @@ type Process struct {
 	commandEndRegex   *regexp.Regexp
 	inputBuffer       []byte
 	outputBuffer      *OutputBuffer
+	stderrBuffer      *OutputBuffer
 	SysProcAttr       *syscall.SysProcAttr
 	UseBase64Encoding bool
+	statusPipe        *os.File
+
+	// Only set if the shell tracks environment changes, and the command changed something.
+	EnvironmentChanges *EnvironmentChanges
+
+	// Only set if the command was killed.
+	Termination *Termination
+
+	// Set if the command was killed by a signal, as told by the wait status or by the shell in the PTY.
+	signalTermination *Termination
 }
 
+/*
+ * The markers are random, so the output of a command
+ * can't end the command early by printing them.
+ */
 func randomMagicMark() string {
-	return fmt.Sprintf("949556c7-%d", time.Now().Unix())
+	mark := make([]byte, 16)
+	if _, err := crand.Read(mark); err != nil {
+		return fmt.Sprintf("949556c7-%d", time.Now().UnixNano())
+	}
+
+	return hex.EncodeToString(mark)
 }
 
 func NewProcess(config Config) *Process {
 	startMark := randomMagicMark() + "-start"
 	endMark := randomMagicMark() + "-end"
-	commandEndRegex := regexp.MustCompile(endMark + " " + `(\d+)` + "[\r\n]+")
-	outputBuffer, _ := NewOutputBuffer(config.OnOutput)
+	commandEndRegex := regexp.MustCompile(endMark + " " + `(\d+) ([\w+-]*)` + "[\r\n]+")
+	outputBuffer, _ := NewOutputBufferWithOptions(OutputBufferOptions{
+		Consumer: config.OnOutput,
+		Limits:   config.OutputLimits,
+	})
+
+	var stderrBuffer *OutputBuffer
+	if config.OnStderr != nil {
+		stderrBuffer, _ = NewOutputBufferWithOptions(OutputBufferOptions{
+			Consumer: config.OnStderr,
+			Limits:   config.OutputLimits,
+		})
+	}
 
 	return &Process{
 		Shell:             config.Shell,
@@ -78,6 +148,7 @@ func NewProcess(config Config) *Process {
 		endMark:           endMark,
 		commandEndRegex:   commandEndRegex,
 		outputBuffer:      outputBuffer,
+		stderrBuffer:      stderrBuffer,
 		UseBase64Encoding: config.UseBase64Encoding,
 	}
 }
@@ -86,8 +157,39 @@ func (p *Process) CmdFilePath() string {
 	return filepath.Join(p.StoragePath, "current-agent-cmd")
 }
 
+func (p *Process) StatusPipePath() string {
+	return fmt.Sprintf("%s.status", p.CmdFilePath())
+}
+
+/*
+ * The environment is dumped into a private directory of the shell,
+ * since it holds the job's secrets.
+ */
 func (p *Process) EnvironmentFilePath() string {
-	return fmt.Sprintf("%s.env.after", p.CmdFilePath())
+	return filepath.Join(p.Shell.environmentDirectory, "current-agent-cmd.env.after")
+}
+
+/*
+ * Without a PTY, or when tracking the environment in one,
+ * the environment is dumped into a file after each command.
+ */
+func (p *Process) dumpsEnvironment() bool {
+	if p.UseBase64Encoding {
+		return false
+	}
+
+	return runtime.GOOS == "windows" || p.Shell.DisablePTY || p.tracksEnvironmentInPTY()
+}
+
+/*
+ * We remove the dump as soon as it is read,
+ * so the secrets in it don't stay around in the disk.
+ */
+func (p *Process) removeEnvironmentFile() {
+	err := RemoveSecretFile(p.EnvironmentFilePath())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Errorf("Error removing environment file %s: %v", p.EnvironmentFilePath(), err)
+	}
 }
 
 func (p *Process) flushInputAll() {
@@ -112,23 +214,37 @@ func (p *Process) Run() {
 		return
 	}
 
+	/*
+	 * If the command kills its shell, no environment is dumped,
+	 * and we shouldn't use the one left behind by a previous command.
+	 */
+	if p.dumpsEnvironment() {
+		p.removeEnvironmentFile()
+	}
+
 	instruction := p.constructShellInstruction()
-	p.StartedAt = int(time.Now().Unix())
+	oomKills, countsOOMKills := p.countOOMKills()
+	p.StartedAt = time.Now()
 	defer func() {
-		p.FinishedAt = int(time.Now().Unix())
+		p.FinishedAt = time.Now()
+		p.Termination = p.findTermination(oomKills, countsOOMKills)
 	}()
 
 	/*
 	 * If the agent is running in an non-windows environment,
-	 * we use a PTY session to run commands.
+	 * we use a PTY session to run commands, unless it is disabled.
 	 */
-	if runtime.GOOS != "windows" {
+	if runtime.GOOS != "windows" && !p.Shell.DisablePTY {
 		p.runWithPTY(instruction)
+		p.trackEnvironmentInPTY()
 		return
 	}
 
 	// In windows, so no PTY support.
 	p.setup()
+
+	before := p.Shell.environmentForCommand()
+	cwdBefore := p.Shell.Cwd
 	p.runWithoutPTY(instruction)
 
 	/*
@@ -136,7 +252,8 @@ func (p *Process) Run() {
 	 * We use a file with all the environment variables available after the command
 	 * is executed. From that file, we can update our shell "state".
 	 */
-	after, err := CreateEnvironmentFromFile(p.EnvironmentFilePath())
+	after, err := p.environmentAfterCommand()
+	p.removeEnvironmentFile()
 	if err != nil {
 		log.Errorf("Error creating environment from file %s: %v\n", p.EnvironmentFilePath(), err)
 		return
@@ -159,14 +276,72 @@ func (p *Process) Run() {
 	 */
 	after.Remove("SEMAPHORE_AGENT_CURRENT_DIR")
 	after.Remove("SEMAPHORE_AGENT_CURRENT_CMD_EXIT_STATUS")
+
+	// Set by the shell itself, without a PTY, on every command.
+	after.Remove("SHLVL")
+	after.Remove("_")
 	p.Shell.UpdateEnvironment(after)
+
+	if p.Shell.TrackEnvironment {
+		p.EnvironmentChanges = DiffEnvironments(before, after, cwdBefore, p.Shell.Cwd)
+	}
+}
+
+/*
+ * In the PTY, the shell keeps its own state, so we only
+ * use the environment dumped after the command to find what changed.
+ * The first command executed only records the environment.
+ */
+func (p *Process) trackEnvironmentInPTY() {
+	if !p.tracksEnvironmentInPTY() {
+		return
+	}
+
+	after, err := CreateEnvironmentFromEnvDump(p.EnvironmentFilePath())
+	p.removeEnvironmentFile()
+	if err != nil {
+		log.Debugf("No environment dumped after the command: %v", err)
+		return
+	}
+
+	cwd, _ := after.Get("SEMAPHORE_AGENT_CURRENT_DIR")
+	before, cwdBefore := p.Shell.trackedEnvironment, p.Shell.trackedCwd
+	p.Shell.trackedEnvironment, p.Shell.trackedCwd = after, cwd
+
+	if before != nil {
+		p.EnvironmentChanges = DiffEnvironments(before, after, cwdBefore, cwd)
+	}
+}
+
+func (p *Process) tracksEnvironmentInPTY() bool {
+	return p.Shell.TrackEnvironment && p.statusPipe != nil
 }
 
 func (p *Process) runWithoutPTY(instruction string) {
-	cmd, reader, writer := p.buildNonPTYCommand(instruction)
-	err := cmd.Start()
+	cmd, readers, writers, buffers, err := p.buildNonPTYCommand(instruction)
+	if err != nil {
+		log.Errorf("Error creating pipes for command: %v\n", err)
+		p.ExitCode = 1
+		return
+	}
+
+	err = cmd.Start()
+
+	/*
+	 * The command has its own copies of the writing ends of the pipes now,
+	 * so we close ours, and the pipes are only held open by the command,
+	 * and by the processes it starts.
+	 */
+	for _, writer := range writers {
+		_ = writer.Close()
+	}
+
 	if err != nil {
 		log.Errorf("Error starting command: %v\n", err)
+		for _, reader := range readers {
+			_ = reader.Close()
+		}
+
 		p.ExitCode = 1
 		return
 	}
@@ -182,28 +357,37 @@ func (p *Process) runWithoutPTY(instruction string) {
 		log.Errorf("Process after creation procedure failed: %v", err)
 	}
 
+	if runtime.GOOS != "windows" {
+		p.Shell.trackProcessGroup(cmd.Process.Pid)
+	}
+
 	/*
 	 * Start reading the command's output and wait until it finishes.
 	 */
-	done := make(chan bool, 1)
-	go p.readNonPTY(reader, done)
+	done := make(chan bool, len(readers))
+	for i := range readers {
+		go p.readNonPTY(readers[i], buffers[i], done)
+	}
+
 	waitResult := cmd.Wait()
 
 	/*
-	 * Command is done, We close our output writer
-	 * so our output reader knows the command is over.
+	 * Command is done, so we let our output readers know about it.
+	 * Processes started in the background by the command
+	 * may still be holding the pipes open, so we don't wait for them to be closed.
 	 */
-	err = writer.Close()
-	if err != nil {
-		log.Errorf("Error closing writer: %v", err)
+	for _, reader := range readers {
+		stopReadingPipe(reader)
 	}
 
 	/*
-	 * Let's wait for the reader to finish, just to make sure
+	 * Let's wait for the readers to finish, just to make sure
 	 * we don't leave any goroutines hanging around.
 	 */
 	log.Debug("Waiting for reading to finish")
-	<-done
+	for range readers {
+		<-done
+	}
 
 	/*
 	 * The command was successful, so we just return.
@@ -220,6 +404,12 @@ func (p *Process) runWithoutPTY(instruction string) {
 	if err, ok := waitResult.(*exec.ExitError); ok {
 		if s, ok := err.Sys().(syscall.WaitStatus); ok {
 			p.ExitCode = s.ExitStatus()
+
+			// Like a shell does, we use 128+N as the exit code of a process killed by signal N.
+			if s.Signaled() {
+				p.ExitCode = 128 + int(s.Signal())
+				p.signalTermination = terminationFromWaitStatus(s)
+			}
 		} else {
 			log.Errorf("Could not cast *exec.ExitError to syscall.WaitStatus: %v\n", err)
 			p.ExitCode = 1
@@ -230,8 +420,54 @@ func (p *Process) runWithoutPTY(instruction string) {
 	}
 }
 
-func (p *Process) buildNonPTYCommand(instruction string) (*exec.Cmd, *io.PipeReader, *io.PipeWriter) {
-	args := append(p.Shell.Args, instruction)
+func (p *Process) countOOMKills() (int, bool) {
+	if !p.Shell.DetectOOMKills {
+		return 0, false
+	}
+
+	return countOOMKills()
+}
+
+/*
+ * An OOM kill only explains the failure of a command
+ * if it happened while the command was running.
+ */
+func (p *Process) findTermination(oomKillsBefore int, countsOOMKills bool) *Termination {
+	if p.ExitCode == 0 {
+		return nil
+	}
+
+	termination := p.signalTermination
+
+	if !countsOOMKills {
+		return termination
+	}
+
+	oomKillsAfter, ok := countOOMKills()
+	if !ok || oomKillsAfter <= oomKillsBefore {
+		return termination
+	}
+
+	if termination == nil {
+		termination = &Termination{}
+	}
+
+	termination.OOMKilled = true
+	return termination
+}
+
+/*
+ * The command writes into real pipes, instead of into writers
+ * copied by the exec package, so waiting for the command
+ * does not wait for the processes it started in the background.
+ */
+func (p *Process) buildNonPTYCommand(instruction string) (*exec.Cmd, []*os.File, []*os.File, []*OutputBuffer, error) {
+	args := append([]string{}, p.Shell.Args...)
+	if runtime.GOOS != "windows" {
+		args = append(args, "-c")
+	}
+
+	args = append(args, instruction)
 
 	// #nosec
 	cmd := exec.Command(p.Shell.Executable, args...)
@@ -242,13 +478,48 @@ func (p *Process) buildNonPTYCommand(instruction string) (*exec.Cmd, *io.PipeRea
 		cmd.Env = append(os.Environ(), p.Shell.Env.ToSlice()...)
 	}
 
-	reader, writer := io.Pipe()
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
 	cmd.Stdout = writer
 	cmd.Stderr = writer
-	return cmd, reader, writer
+
+	if p.stderrBuffer == nil {
+		return cmd, []*os.File{reader}, []*os.File{writer}, []*OutputBuffer{p.outputBuffer}, nil
+	}
+
+	stderrReader, stderrWriter, err := os.Pipe()
+	if err != nil {
+		_ = reader.Close()
+		_ = writer.Close()
+		return nil, nil, nil, nil, err
+	}
+
+	cmd.Stderr = stderrWriter
+
+	return cmd,
+		[]*os.File{reader, stderrReader},
+		[]*os.File{writer, stderrWriter},
+		[]*OutputBuffer{p.outputBuffer, p.stderrBuffer},
+		nil
+}
+
+func (p *Process) environmentAfterCommand() (*Environment, error) {
+	if runtime.GOOS == "windows" {
+		return CreateEnvironmentFromFile(p.EnvironmentFilePath())
+	}
+
+	return CreateEnvironmentFromEnvDump(p.EnvironmentFilePath())
 }
 
 func (p *Process) runWithPTY(instruction string) {
+	if p.statusPipe != nil {
+		p.runWithStatusPipe(instruction)
+		return
+	}
+
 	_, err := p.Shell.Write(instruction)
 	if err != nil {
 		log.Errorf("Error writing instruction: %v", err)
@@ -269,9 +540,10 @@ func (p *Process) constructShellInstruction() string {
 	if p.UseBase64Encoding {
 		base64EncodedCommand := base64.StdEncoding.EncodeToString([]byte(p.Command))
 		return fmt.Sprintf(
-			`echo -e "\001 %s"; source <(echo %s | base64 -d); AGENT_CMD_RESULT=$?; echo -e "\001 %s $AGENT_CMD_RESULT"; echo "exit $AGENT_CMD_RESULT" | sh`,
+			`printf '\001 %s\n'; %s; AGENT_CMD_RESULT=$?; %s; printf '\001 %s %%s %%s\n' $AGENT_CMD_RESULT "$AGENT_CMD_SIGNAL"; echo "exit $AGENT_CMD_RESULT" | sh`,
 			p.startMark,
-			base64EncodedCommand,
+			p.Shell.Adapter.SourceBase64(base64EncodedCommand),
+			ReportSignalCommand,
 			p.endMark,
 		)
 	}
@@ -280,6 +552,32 @@ func (p *Process) constructShellInstruction() string {
 		return fmt.Sprintf(`%s.ps1`, p.CmdFilePath())
 	}
 
+	if p.Shell.DisablePTY {
+		return fmt.Sprintf(NonPTYScript, p.Shell.Adapter.Source(p.CmdFilePath()), EnvDumpCommand, p.EnvironmentFilePath())
+	}
+
+	//
+	// With a status pipe, nothing besides the command's output is written into the TTY:
+	//
+	//   1. execute the command file by sourcing it
+	//   2. save the original exit status
+	//   3. disable echoing again, in case the command enabled it,
+	//      so the next instruction is not echoed back into the output
+	//   4. find the signal the exit status stands for, if any
+	//   5. if environment changes are tracked, dump the environment
+	//   6. write the exit status and the signal into the status pipe
+	//   7. return the original exit status to the caller
+	//
+	if p.statusPipe != nil {
+		dumpEnvironment := ""
+		if p.tracksEnvironmentInPTY() {
+			dumpEnvironment = fmt.Sprintf(`(umask 077; SEMAPHORE_AGENT_CURRENT_DIR="$PWD" %s > %s); `, EnvDumpCommand, p.EnvironmentFilePath())
+		}
+
+		template := `%s; AGENT_CMD_RESULT=$?; stty -echo 2>/dev/null; %s; %secho $AGENT_CMD_RESULT $AGENT_CMD_SIGNAL > %s; echo "exit $AGENT_CMD_RESULT" | sh`
+		return fmt.Sprintf(template, p.Shell.Adapter.Source(p.CmdFilePath()), ReportSignalCommand, dumpEnvironment, p.StatusPipePath())
+	}
+
 	//
 	// A process is sending a complex instruction to the shell. The instruction
 	// does the following:
@@ -287,12 +585,13 @@ func (p *Process) constructShellInstruction() string {
 	//   1. display magic-header and the START marker
 	//   2. execute the command file by sourcing it
 	//   3. save the original exit status
-	//   4. display magic-header, the end marker, and the command's exit status
-	//   5. return the original exit status to the caller
+	//   4. find the signal the exit status stands for, if any
+	//   5. display magic-header, the end marker, the command's exit status and the signal
+	//   6. return the original exit status to the caller
 	//
-	template := `echo -e "\001 %s"; source %s; AGENT_CMD_RESULT=$?; echo -e "\001 %s $AGENT_CMD_RESULT"; echo "exit $AGENT_CMD_RESULT" | sh`
+	template := `printf '\001 %s\n'; %s; AGENT_CMD_RESULT=$?; %s; printf '\001 %s %%s %%s\n' $AGENT_CMD_RESULT "$AGENT_CMD_SIGNAL"; echo "exit $AGENT_CMD_RESULT" | sh`
 
-	return fmt.Sprintf(template, p.startMark, p.CmdFilePath(), p.endMark)
+	return fmt.Sprintf(template, p.startMark, p.Shell.Adapter.Source(p.CmdFilePath()), ReportSignalCommand, p.endMark)
 }
 
 /*
@@ -307,15 +606,43 @@ func (p *Process) loadCommand() error {
 		return nil
 	}
 
+	if runtime.GOOS != "windows" {
+		p.openStatusPipe()
+	}
+
+	if p.dumpsEnvironment() {
+		if err := p.Shell.createEnvironmentDirectory(p.StoragePath); err != nil {
+			return err
+		}
+	}
+
 	if runtime.GOOS != "windows" {
 		return p.writeCommandToFile(p.CmdFilePath(), p.Command)
 	}
 
 	cmdFilePath := fmt.Sprintf("%s.ps1", p.CmdFilePath())
-	command := fmt.Sprintf(WindowsPwshScript, p.Command, p.CmdFilePath())
+	command := fmt.Sprintf(WindowsPwshScript, p.Command, p.EnvironmentFilePath())
 	return p.writeCommandToFile(cmdFilePath, command)
 }
 
+/*
+ * If the status pipe can't be used, we fall back
+ * to the start/finish markers written into the TTY.
+ */
+func (p *Process) openStatusPipe() {
+	if p.Shell == nil || !p.Shell.UseStatusPipe || p.Shell.DisablePTY || p.Shell.flusher == nil {
+		return
+	}
+
+	statusPipe, err := openStatusPipe(p.StatusPipePath())
+	if err != nil {
+		log.Errorf("Error opening status pipe %s - using output markers: %v", p.StatusPipePath(), err)
+		return
+	}
+
+	p.statusPipe = statusPipe
+}
+
 func (p *Process) writeCommandToFile(cmdFilePath, command string) error {
 	// #nosec
 	file, err := os.OpenFile(cmdFilePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
@@ -359,32 +686,52 @@ func (p *Process) readBufferSize() int {
 	return rand.Intn(max-min) + min
 }
 
-func (p *Process) readNonPTY(reader *io.PipeReader, done chan bool) {
+/*
+ * Reads the output of the command until the pipe is closed,
+ * or until the command finishes and stopReadingPipe() is called.
+ * In the latter case, the output of the processes the command started in the background
+ * is discarded, but the pipe is kept open until they close it, so they can keep writing into it.
+ */
+func (p *Process) readNonPTY(reader *os.File, outputBuffer *OutputBuffer, done chan bool) {
 	for {
 		log.Debug("Reading started")
 		buffer := make([]byte, p.readBufferSize())
 		n, err := reader.Read(buffer)
-		if err != nil && err != io.EOF {
-			log.Errorf("Error while reading. Error: %v", err)
-		}
 
-		p.inputBuffer = append(p.inputBuffer, buffer[0:n]...)
-		log.Debugf("reading data from command. Input buffer: %#v", string(p.inputBuffer))
-		p.flushInputAll()
+		log.Debugf("reading data from command: %#v", string(buffer[0:n]))
+		outputBuffer.Append(buffer[0:n])
 
-		if err == io.EOF {
-			log.Debug("Finished reading")
-			if err := p.outputBuffer.Close(); err != nil {
-				log.Error("Could not flush all the output in the buffer")
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			log.Debug("Command finished - reading what is left in the pipe")
+			readAvailable(reader, outputBuffer)
+			go discardOutput(reader)
+			break
+		}
+
+		if err != nil {
+			if err != io.EOF {
+				log.Errorf("Error while reading. Error: %v", err)
 			}
 
+			log.Debug("Finished reading")
+			_ = reader.Close()
 			break
 		}
 	}
 
+	if err := outputBuffer.Close(); err != nil {
+		log.Error("Could not flush all the output in the buffer")
+	}
+
 	done <- true
 }
 
+func discardOutput(reader *os.File) {
+	n, _ := io.Copy(io.Discard, reader)
+	log.Debugf("Discarded %d bytes written by background processes after their command finished", n)
+	_ = reader.Close()
+}
+
 // Read state from shell into the inputBuffer
 func (p *Process) read() error {
 	buffer := make([]byte, p.readBufferSize())
@@ -452,6 +799,7 @@ func (p *Process) scan() error {
 	}
 
 	exitCode := ""
+	signal := ""
 
 	for {
 		if index := p.endMarkerHeaderIndex(); index >= 0 {
@@ -462,20 +810,21 @@ func (p *Process) scan() error {
 
 			log.Debug("Start of end marker detected, entering buffering mode.")
 
-			if match := p.commandEndRegex.FindStringSubmatch(string(p.inputBuffer)); len(match) == 2 {
+			if match := p.commandEndRegex.FindStringSubmatch(string(p.inputBuffer)); len(match) == 3 {
 				log.Debug("End marker detected. Exit code: ", match[1])
 
 				exitCode = match[1]
+				signal = match[2]
 				break
 			}
 
 			//
-			// The buffer is much longer than the end mark, at least by 10
-			// characters.
+			// The buffer is much longer than the end mark, at least by 24
+			// characters, enough for the exit code and the signal name.
 			//
 			// If it is not matching the full end mark, it is safe to dump.
 			//
-			if len(p.inputBuffer) >= len(p.endMark)+10 {
+			if len(p.inputBuffer) >= len(p.endMark)+24 {
 				p.flushInputAll()
 			}
 		} else {
@@ -511,6 +860,119 @@ func (p *Process) scan() error {
 
 	log.Debugf("Parsing exit code finished %d", code)
 	p.ExitCode = code
+	p.signalTermination = terminationFromSignalName(code, signal)
 
 	return nil
 }
+
+/*
+ * The exit status arrives through the status pipe, but the output of the command
+ * goes through the PTY, so the last bytes of output can arrive after the exit status.
+ * Once the exit status arrives, we publish what is left in the PTY,
+ * and whatever is written into it after that belongs to the next command.
+ */
+func (p *Process) runWithStatusPipe(instruction string) {
+	defer p.statusPipe.Close()
+
+	exitStatuses := make(chan exitStatus, 1)
+	go p.readExitStatus(exitStatuses)
+
+	_, err := p.Shell.Write(instruction)
+	if err != nil {
+		log.Errorf("Error writing instruction: %v", err)
+		return
+	}
+
+	if pending := p.Shell.takePendingOutput(); len(pending) > 0 {
+		p.outputBuffer.Append(pending)
+	}
+
+	exited := p.Shell.exited
+	var flushed <-chan struct{}
+
+	for {
+		select {
+		case chunk, ok := <-p.Shell.output:
+			if !ok {
+				p.closeOutputBuffer()
+				return
+			}
+
+			p.outputBuffer.Append(chunk)
+
+		// The shell died without writing the exit status, e.g. the command was `exit 1`.
+		case <-exited:
+			exited = nil
+			if flushed = p.Shell.flushOutput(); flushed == nil {
+				p.finishStatusPipeOutput()
+				return
+			}
+
+		case status := <-exitStatuses:
+			log.Debugf("Exit code received: %d", status.code)
+			p.ExitCode = status.code
+			p.signalTermination = terminationFromSignalName(status.code, status.signal)
+			exitStatuses = nil
+			exited = nil
+			if flushed = p.Shell.flushOutput(); flushed == nil {
+				p.finishStatusPipeOutput()
+				return
+			}
+
+		case <-flushed:
+			p.finishStatusPipeOutput()
+			return
+		}
+	}
+}
+
+/*
+ * The output read before the PTY was flushed
+ * is already waiting in the shell's output channel.
+ */
+func (p *Process) finishStatusPipeOutput() {
+	for {
+		select {
+		case chunk, ok := <-p.Shell.output:
+			if !ok {
+				p.closeOutputBuffer()
+				return
+			}
+
+			p.outputBuffer.Append(chunk)
+
+		default:
+			p.closeOutputBuffer()
+			return
+		}
+	}
+}
+
+// The shell writes the exit status, followed by the name of the signal, if any.
+type exitStatus struct {
+	code   int
+	signal string
+}
+
+func (p *Process) readExitStatus(exitStatuses chan exitStatus) {
+	line, err := bufio.NewReader(p.statusPipe).ReadString('\n')
+	if err != nil {
+		log.Debugf("Stopped reading status pipe: %v", err)
+		return
+	}
+
+	code, signal, _ := strings.Cut(strings.TrimSpace(line), " ")
+	exitCode, err := strconv.Atoi(code)
+	if err != nil {
+		log.Errorf("Error parsing exit code '%s': %v", line, err)
+		exitCode = 1
+	}
+
+	exitStatuses <- exitStatus{code: exitCode, signal: signal}
+}
+
+func (p *Process) closeOutputBuffer() {
+	if err := p.outputBuffer.Close(); err != nil {
+		log.Error("Could not flush all the output in the buffer")
+	}
+}
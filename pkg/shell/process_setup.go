@@ -2,16 +2,96 @@
 
 package shell
 
+import (
+	"os"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
 /*
  * For non-windows agents, we handle job termination
  * by closing the TTY associated with the job.
- * Therefore, no special handling here is necessary.
+ * Without a PTY, the command gets its own process group,
+ * so it can be killed together with everything it started.
  */
 
 func (p *Process) setup() {
-
+	p.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 }
 
 func (p *Process) afterCreation(jobObject uintptr) error {
 	return nil
 }
+
+/*
+ * The status pipe is opened for both reading and writing,
+ * so reading from it never returns EOF when the shell closes its end
+ * after writing the exit status of a command.
+ */
+func openStatusPipe(path string) (*os.File, error) {
+	info, err := os.Lstat(path)
+	if err == nil && info.Mode()&os.ModeNamedPipe == 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err != nil || info.Mode()&os.ModeNamedPipe == 0 {
+		if err := syscall.Mkfifo(path, 0600); err != nil {
+			return nil, err
+		}
+	}
+
+	// #nosec
+	return os.OpenFile(path, os.O_RDWR, os.ModeNamedPipe)
+}
+
+/*
+ * Makes a read blocked on a pipe return,
+ * once the command writing into it has finished.
+ */
+func stopReadingPipe(pipe *os.File) {
+	_ = pipe.SetReadDeadline(time.Now())
+}
+
+/*
+ * Once the command finished, everything it wrote is already in the pipe,
+ * so we read it without waiting for more. Processes the command started
+ * in the background could keep the pipe busy forever, so we stop after pipeDrainMaxBytes.
+ */
+const pipeDrainMaxBytes = 1024 * 1024
+
+func readAvailable(pipe *os.File, outputBuffer *OutputBuffer) {
+	rawConn, err := pipe.SyscallConn()
+	if err != nil {
+		log.Errorf("Error reading what is left in the pipe: %v", err)
+		return
+	}
+
+	// The deadline would also stop the reads here, and they don't block anyway.
+	_ = pipe.SetReadDeadline(time.Time{})
+
+	buffer := make([]byte, 4096)
+	for total := 0; total < pipeDrainMaxBytes; {
+		n := 0
+		var readErr error
+		err := rawConn.Read(func(fd uintptr) bool {
+			n, readErr = syscall.Read(int(fd), buffer)
+			return true
+		})
+
+		if err != nil || readErr != nil || n <= 0 {
+			return
+		}
+
+		outputBuffer.Append(buffer[0:n])
+		total += n
+	}
+}
+
+func signalName(signal syscall.Signal) string {
+	return unix.SignalName(signal)
+}
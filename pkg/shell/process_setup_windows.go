@@ -3,6 +3,10 @@
 package shell
 
 import (
+	"fmt"
+	"os"
+	"syscall"
+
 	"golang.org/x/sys/windows"
 )
 
@@ -28,3 +32,20 @@ func (p *Process) afterCreation(jobObject uintptr) error {
 
 	return nil
 }
+
+func openStatusPipe(path string) (*os.File, error) {
+	return nil, fmt.Errorf("status pipes are not supported on windows")
+}
+
+/*
+ * Pipes on Windows don't support deadlines,
+ * so we keep reading the output until the pipe is closed.
+ */
+func stopReadingPipe(pipe *os.File) {}
+
+func readAvailable(pipe *os.File, outputBuffer *OutputBuffer) {}
+
+// There are no signals on Windows.
+func signalName(signal syscall.Signal) string {
+	return ""
+}
@@ -12,3 +12,11 @@ import (
 func StartPTY(command *exec.Cmd) (*os.File, error) {
 	return pty.Start(command)
 }
+
+func StartPTYWithSize(command *exec.Cmd, cols, rows uint16) (*os.File, error) {
+	return pty.StartWithSize(command, &pty.Winsize{Cols: cols, Rows: rows})
+}
+
+func ResizePTY(tty *os.File, cols, rows uint16) error {
+	return pty.Setsize(tty, &pty.Winsize{Cols: cols, Rows: rows})
+}
@@ -26,3 +26,15 @@ func Test__PTYIsSupportedOnNonWindows(t *testing.T) {
 	assert.Nil(t, err)
 	tty.Close()
 }
+
+func Test__PTYCanBeResized(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	tty, err := StartPTYWithSize(exec.Command("bash", "--login"), 100, 30)
+	assert.Nil(t, err)
+	defer tty.Close()
+
+	assert.Nil(t, ResizePTY(tty, 120, 40))
+}
@@ -11,3 +11,11 @@ import (
 func StartPTY(c *exec.Cmd) (*os.File, error) {
 	return nil, errors.New("PTY is not supported on Windows")
 }
+
+func StartPTYWithSize(c *exec.Cmd, cols, rows uint16) (*os.File, error) {
+	return nil, errors.New("PTY is not supported on Windows")
+}
+
+func ResizePTY(tty *os.File, cols, rows uint16) error {
+	return errors.New("PTY is not supported on Windows")
+}
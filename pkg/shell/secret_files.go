@@ -0,0 +1,81 @@
+package shell
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+/*
+ * Overwrites all the files in the directory before removing them,
+ * so the secrets they hold don't linger around in the disk.
+ */
+func RemoveSecretDirectory(directory string) error {
+	if directory == "" {
+		return nil
+	}
+
+	err := filepath.WalkDir(directory, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		return RemoveSecretFile(path)
+	})
+
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return os.RemoveAll(directory)
+}
+
+// Overwrites the file before removing it.
+func RemoveSecretFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+
+		return err
+	}
+
+	// #nosec
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	zeros := make([]byte, 32*1024)
+	for remaining := info.Size(); remaining > 0; {
+		chunk := int64(len(zeros))
+		if remaining < chunk {
+			chunk = remaining
+		}
+
+		n, err := file.Write(zeros[:chunk])
+		if err != nil {
+			_ = file.Close()
+			return err
+		}
+
+		remaining -= int64(n)
+	}
+
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
@@ -0,0 +1,24 @@
+package shell
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	assert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test__RemoveSecretDirectory(t *testing.T) {
+	directory := filepath.Join(t.TempDir(), "env")
+	require.NoError(t, os.MkdirAll(filepath.Join(directory, "nested"), 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(directory, ".env"), []byte("export A=secret\n"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(directory, "nested", "file"), []byte("secret"), 0600))
+
+	assert.NoError(t, RemoveSecretDirectory(directory))
+	assert.NoDirExists(t, directory)
+
+	// nothing to remove
+	assert.NoError(t, RemoveSecretDirectory(directory))
+	assert.NoError(t, RemoveSecretDirectory(""))
+}
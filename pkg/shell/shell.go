@@ -4,10 +4,12 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -18,11 +20,88 @@ type Shell struct {
 	Args        []string
 	BootCommand *exec.Cmd
 	StoragePath string
-	TTY         *os.File
+	TTY         io.ReadWriteCloser
 	ExitSignal  chan string
 	Env         *Environment
 	Cwd         string
 
+	// The size and type of the PTY the shell runs in.
+	Terminal Terminal
+
+	/*
+	 * Builds the instructions sent to the shell.
+	 * By default, it is chosen based on the executable's name.
+	 */
+	Adapter Adapter
+
+	/*
+	 * If set, commands report their exit status through a named pipe
+	 * instead of printing markers into the TTY, so the TTY output
+	 * only contains what the command itself wrote.
+	 *
+	 * Once the exit status arrives, the agent reads what is left in the PTY,
+	 * which only tells that all the output arrived if the agent owns the PTY
+	 * the command writes into. Shells in containers or remote hosts write into a PTY
+	 * owned by the docker, podman, kubectl or ssh processes, which relay the output
+	 * to the agent at their own pace, and can't share a named pipe with the agent
+	 * either, so it is only enabled for local shells.
+	 */
+	UseStatusPipe bool
+
+	/*
+	 * The OOM killer is detected through the cgroup of the agent,
+	 * which only holds the commands if the shell runs in the same host.
+	 * Commands in containers run in the cgroups of the container runtime.
+	 */
+	DetectOOMKills bool
+
+	/*
+	 * On Linux and macOS, commands run in a PTY by default, which merges
+	 * stdout and stderr. If the PTY is disabled, each command runs in a new shell,
+	 * like it does on Windows, and its stdout and stderr can be read separately.
+	 * Shell functions and aliases defined by a command are not
+	 * available to the commands executed after it, and since Args
+	 * are used for every command, they shouldn't start a login shell.
+	 */
+	DisablePTY bool
+
+	/*
+	 * If set, the environment and working directory are compared
+	 * before and after each command, and the differences are available
+	 * in Process.EnvironmentChanges. In a PTY, that requires the status pipe.
+	 */
+	TrackEnvironment bool
+
+	// The environment after the last command executed in the PTY.
+	trackedEnvironment *Environment
+	trackedCwd         string
+
+	/*
+	 * The private directory the environment is dumped into after each command.
+	 * It is created on the first command that needs it, and removed when the shell is closed.
+	 */
+	environmentDirectory string
+
+	/*
+	 * The process groups of the commands executed without a PTY,
+	 * which are killed when the shell is terminated.
+	 */
+	processGroups []int
+	mu            sync.Mutex
+
+	/*
+	 * After the shell is started, a single goroutine reads the TTY
+	 * and publishes its output here. The channel is closed when the TTY is closed.
+	 */
+	output        chan []byte
+	pendingOutput []byte
+
+	// Only set if the status pipe is used. See UseStatusPipe.
+	flusher *ttyFlusher
+
+	// Closed when the shell process exits.
+	exited chan struct{}
+
 	/*
 	 * A job object handle used to interrupt the command
 	 * process in case of a stop request.
@@ -31,7 +110,26 @@ type Shell struct {
 }
 
 func NewShell(storagePath string) (*Shell, error) {
-	return NewShellFromExecAndArgs(Executable(), Args(), storagePath)
+	return NewLocalShell(Executable(), Args(), storagePath)
+}
+
+/*
+ * A shell running in the same host as the agent.
+ * If no arguments are given, the default ones for the shell are used.
+ */
+func NewLocalShell(executable string, args []string, storagePath string) (*Shell, error) {
+	if len(args) == 0 {
+		args = AdapterFor(executable).DefaultArgs()
+	}
+
+	shell, err := NewShellFromExecAndArgs(executable, args, storagePath)
+	if err != nil {
+		return nil, err
+	}
+
+	shell.UseStatusPipe = runtime.GOOS != "windows"
+	shell.DetectOOMKills = true
+	return shell, nil
 }
 
 func NewShellFromExecAndArgs(executable string, args []string, storagePath string) (*Shell, error) {
@@ -47,8 +145,10 @@ func NewShellFromExecAndArgs(executable string, args []string, storagePath strin
 		Args:        args,
 		StoragePath: storagePath,
 		ExitSignal:  exitChannel,
+		exited:      make(chan struct{}),
 		Env:         &Environment{},
 		Cwd:         cwd,
+		Adapter:     AdapterFor(executable),
 	}, nil
 }
 
@@ -63,11 +163,25 @@ func (s *Shell) Start() error {
 		return nil
 	}
 
+	/*
+	 * Without a PTY, commands start in the home directory,
+	 * just like they do in the PTY session.
+	 */
+	if s.DisablePTY {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return fmt.Errorf("error finding home directory: %v", err)
+		}
+
+		s.Cwd = home
+		return nil
+	}
+
 	log.Debug("Starting stateful shell")
 
 	// #nosec
 	s.BootCommand = exec.Command(s.Executable, s.Args...)
-	tty, err := StartPTY(s.BootCommand)
+	tty, err := s.Terminal.StartPTY(s.BootCommand)
 	if err != nil {
 		log.Errorf("Failed to start stateful shell: %v", err)
 		return err
@@ -75,11 +189,42 @@ func (s *Shell) Start() error {
 
 	s.TTY = tty
 
+	if s.UseStatusPipe {
+		s.flusher, err = newTTYFlusher(tty)
+		if err != nil {
+			log.Errorf("Error reading the TTY with a status pipe - using output markers: %v", err)
+			s.UseStatusPipe = false
+		}
+	}
+
 	s.handleAbruptShellCloses()
 
 	time.Sleep(1000)
 
-	return s.silencePromptAndDisablePS1()
+	err = s.silencePromptAndDisablePS1()
+	if err != nil {
+		return err
+	}
+
+	s.readOutput()
+	return nil
+}
+
+/*
+ * Starts the shell in a terminal the agent does not own, e.g. one
+ * given by the Docker Engine API for a container's process.
+ * The shell is considered closed once the terminal is closed.
+ */
+func (s *Shell) StartInTerminal(tty io.ReadWriteCloser) error {
+	s.TTY = tty
+
+	err := s.silencePromptAndDisablePS1()
+	if err != nil {
+		return err
+	}
+
+	s.readOutput()
+	return nil
 }
 
 func (s *Shell) handleAbruptShellCloses() {
@@ -104,31 +249,122 @@ func (s *Shell) handleAbruptShellCloses() {
 
 		log.Debugf("Shell closed with %s. Closing associated TTY", msg)
 		_ = s.TTY.Close()
-
-		log.Debugf("Publishing an exit signal: %s", msg)
-		s.ExitSignal <- msg
+		s.closeFlusher()
+		s.publishExit(msg)
 	}()
 }
 
-func (s *Shell) Read(buffer *([]byte)) (int, error) {
-	done := make(chan bool, 1)
+func (s *Shell) publishExit(msg string) {
+	close(s.exited)
 
-	var n int
-	var err error
+	log.Debugf("Publishing an exit signal: %s", msg)
+	s.ExitSignal <- msg
+}
+
+/*
+ * Reading the TTY from a single goroutine guarantees that no output
+ * is lost between commands, which could happen if a read for
+ * a command that already finished was still pending.
+ */
+func (s *Shell) readOutput() {
+	s.output = make(chan []byte, 64)
 
 	go func() {
-		n, err = s.TTY.Read(*buffer)
-		done <- true
+		defer close(s.output)
+
+		var err error
+		if s.flusher != nil {
+			err = s.flusher.read(s.output)
+		} else {
+			err = s.readTTY()
+		}
+
+		log.Debugf("Stopped reading from TTY: %v", err)
+
+		// Without a process of its own, the shell is gone with its terminal.
+		if s.BootCommand == nil {
+			s.publishExit(err.Error())
+		}
 	}()
+}
+
+func (s *Shell) readTTY() error {
+	for {
+		buffer := make([]byte, 4096)
+		n, err := s.TTY.Read(buffer)
+		if n > 0 {
+			s.output <- buffer[0:n]
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+/*
+ * Asks for everything already written into the PTY to be published.
+ * The returned channel receives a value once it is,
+ * and is nil if the PTY can't be flushed anymore.
+ */
+func (s *Shell) flushOutput() <-chan struct{} {
+	flushed, err := s.flusher.requestFlush()
+	if err != nil {
+		log.Debugf("Could not flush the TTY: %v", err)
+		return nil
+	}
 
+	return flushed
+}
+
+func (s *Shell) closeFlusher() {
+	if s.flusher != nil {
+		s.flusher.close()
+	}
+}
+
+func (s *Shell) Read(buffer *([]byte)) (int, error) {
+	if len(s.pendingOutput) == 0 {
+		chunk, ok := s.nextOutputChunk()
+		if !ok {
+			return 0, fmt.Errorf("Shell Closed")
+		}
+
+		s.pendingOutput = chunk
+	}
+
+	n := copy(*buffer, s.pendingOutput)
+	s.pendingOutput = s.pendingOutput[n:]
+	return n, nil
+}
+
+/*
+ * Waits for the next chunk of output from the TTY.
+ * If the shell exits while a background process still holds the TTY open,
+ * the read from the TTY may never return, so we stop waiting
+ * once the shell has exited and all the output already read was consumed.
+ */
+func (s *Shell) nextOutputChunk() ([]byte, bool) {
 	select {
-	case <-done:
-		return n, err
-	case <-s.ExitSignal:
-		return 0, fmt.Errorf("Shell Closed")
+	case chunk, ok := <-s.output:
+		return chunk, ok
+	case <-s.exited:
+		select {
+		case chunk, ok := <-s.output:
+			return chunk, ok
+		default:
+			return nil, false
+		}
 	}
 }
 
+// Returns output already read from the TTY, but not consumed by Read() yet.
+func (s *Shell) takePendingOutput() []byte {
+	chunk := s.pendingOutput
+	s.pendingOutput = nil
+	return chunk
+}
+
 func (s *Shell) Write(instruction string) (int, error) {
 	log.Debugf("Sending Instruction: %s", instruction)
 
@@ -153,12 +389,14 @@ func (s *Shell) Write(instruction string) (int, error) {
 func (s *Shell) silencePromptAndDisablePS1() error {
 	everythingIsReadyMark := "87d140552e404df69f6472729d2b2c3"
 
-	_, err := s.TTY.Write([]byte("export PS1=''\n"))
-	if err != nil {
-		return err
+	for _, instruction := range s.Adapter.SilencePrompt() {
+		_, err := s.TTY.Write([]byte(instruction + "\n"))
+		if err != nil {
+			return err
+		}
 	}
 
-	_, err = s.TTY.Write([]byte("stty -echo\n"))
+	_, err := s.TTY.Write([]byte("stty -echo\n"))
 	if err != nil {
 		return err
 	}
@@ -243,8 +481,18 @@ func (s *Shell) NewProcessWithConfig(config Config) *Process {
 }
 
 func (s *Shell) Close() error {
+	if s.environmentDirectory != "" {
+		err := RemoveSecretDirectory(s.environmentDirectory)
+		if err != nil {
+			log.Errorf("Error removing environment directory %s: %v", s.environmentDirectory, err)
+		}
+
+		s.environmentDirectory = ""
+	}
+
 	if s.TTY != nil {
 		err := s.TTY.Close()
+		s.closeFlusher()
 		if err != nil {
 			log.Errorf("Closing the TTY returned an error: %v", err)
 			return err
@@ -262,6 +510,58 @@ func (s *Shell) Close() error {
 	return nil
 }
 
+/*
+ * os.MkdirTemp creates the directory with 0700 permissions,
+ * so only the agent's user can read the environment dumped into it.
+ */
+func (s *Shell) createEnvironmentDirectory(storagePath string) error {
+	if s.environmentDirectory != "" {
+		return nil
+	}
+
+	directory, err := os.MkdirTemp(storagePath, "semaphore-env-")
+	if err != nil {
+		return fmt.Errorf("error creating environment directory: %v", err)
+	}
+
+	s.environmentDirectory = directory
+	return nil
+}
+
+/*
+ * Groups without any processes left are dropped,
+ * so we don't kill unrelated processes that reuse their IDs.
+ */
+func (s *Shell) trackProcessGroup(pgid int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	groups := []int{pgid}
+	for _, group := range s.processGroups {
+		if processGroupExists(group) {
+			groups = append(groups, group)
+		}
+	}
+
+	s.processGroups = groups
+}
+
+func (s *Shell) trackedProcessGroups() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int{}, s.processGroups...)
+}
+
+// The environment a command executed without a PTY starts with.
+func (s *Shell) environmentForCommand() *Environment {
+	variables := os.Environ()
+	if s.Env != nil {
+		variables = append(variables, s.Env.ToSlice()...)
+	}
+
+	return CreateEnvironmentFromSlice(variables)
+}
+
 func (s *Shell) Chdir(newCwd string) {
 	if newCwd != s.Cwd {
 		s.Cwd = newCwd
@@ -2,16 +2,34 @@
 
 package shell
 
+import (
+	"errors"
+	"syscall"
+)
+
 /*
  * For non-windows agents, we handle job termination
  * by closing the TTY associated with the job.
- * Therefore, no special handling here is necessary.
+ * Therefore, no special handling here is necessary,
+ * unless the PTY is disabled. In that case, we kill the
+ * process groups of all the commands executed.
  */
 
 func (s *Shell) Setup() {
 
 }
 
+func processGroupExists(pgid int) bool {
+	return syscall.Kill(-pgid, 0) == nil
+}
+
 func (s *Shell) Terminate() error {
+	for _, pgid := range s.trackedProcessGroups() {
+		err := syscall.Kill(-pgid, syscall.SIGKILL)
+		if err != nil && !errors.Is(err, syscall.ESRCH) {
+			return err
+		}
+	}
+
 	return nil
 }
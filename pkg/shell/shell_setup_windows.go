@@ -42,3 +42,7 @@ func (s *Shell) Terminate() error {
 	log.Debugf("Terminating all processes assigned to job object %v", s.windowsJobObject)
 	return windows.CloseHandle(windows.Handle(s.windowsJobObject))
 }
+
+func processGroupExists(pgid int) bool {
+	return false
+}
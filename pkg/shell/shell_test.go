@@ -2,11 +2,17 @@ package shell
 
 import (
 	"bytes"
+	"fmt"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	assert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test__Shell__NewShell(t *testing.T) {
@@ -141,3 +147,292 @@ func Test__Shell__HandlingBashProcessKillThatHasBackgroundJobs(t *testing.T) {
 
 	assert.Equal(t, output.String(), "Hello\n")
 }
+
+func Test__Shell__OutputThatLooksLikeMarkersIsNotInterpreted(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	shell, _ := NewShell(t.TempDir())
+	shell.Start()
+
+	var output bytes.Buffer
+	p1 := shell.NewProcessWithOutput(`printf '\001 949556c7-1-end 0\n'; echo after; (exit 3)`, func(line string) {
+		output.WriteString(line)
+	})
+
+	p1.Run()
+	assert.Equal(t, "\001 949556c7-1-end 0\nafter\n", output.String())
+	assert.Equal(t, 3, p1.ExitCode)
+
+	output.Reset()
+	p2 := shell.NewProcessWithOutput("echo next", func(line string) {
+		output.WriteString(line)
+	})
+
+	p2.Run()
+	assert.Equal(t, "next\n", output.String())
+	assert.Equal(t, 0, p2.ExitCode)
+	assert.NoError(t, shell.Close())
+}
+
+func Test__Shell__WaitsForAllTheOutputOfACommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	shell, _ := NewShell(t.TempDir())
+	shell.Start()
+
+	var output bytes.Buffer
+	p1 := shell.NewProcessWithOutput(`head -c 300000 /dev/zero | tr '\0' 'a'; echo; echo done`, func(line string) {
+		output.WriteString(line)
+	})
+
+	p1.Run()
+	assert.Equal(t, strings.Repeat("a", 300000)+"\ndone\n", output.String())
+	assert.Equal(t, 0, p1.ExitCode)
+
+	output.Reset()
+	p2 := shell.NewProcessWithOutput("echo next", func(line string) {
+		output.WriteString(line)
+	})
+
+	p2.Run()
+	assert.Equal(t, "next\n", output.String())
+	assert.NoError(t, shell.Close())
+}
+
+func Test__Shell__CommandsWithoutOutput(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	shell, _ := NewShell(t.TempDir())
+	shell.Start()
+
+	var output bytes.Buffer
+	for _, command := range []string{"true", "export A=1", "false", "echo $A"} {
+		p := shell.NewProcessWithOutput(command, func(line string) {
+			output.WriteString(line)
+		})
+
+		p.Run()
+	}
+
+	assert.Equal(t, "1\n", output.String())
+	assert.NoError(t, shell.Close())
+}
+
+func Test__Shell__PosixShell(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	dash, err := exec.LookPath("dash")
+	if err != nil {
+		t.Skip("dash is not available")
+	}
+
+	shell, err := NewLocalShell(dash, []string{}, t.TempDir())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-l"}, shell.Args)
+	assert.NoError(t, shell.Start())
+
+	env := Environment{}
+	env.Set("GREETING", "hello world")
+	envFile := filepath.Join(t.TempDir(), ".env")
+	assert.NoError(t, env.ToFileFor(envFile, shell.Adapter, nil))
+
+	var output bytes.Buffer
+	onOutput := func(line string) { output.WriteString(line) }
+
+	p1 := shell.NewProcessWithOutput(shell.Adapter.Source(envFile), onOutput)
+	p1.Run()
+	assert.Equal(t, 0, p1.ExitCode)
+
+	p2 := shell.NewProcessWithOutput("echo $GREETING; false", onOutput)
+	p2.Run()
+	assert.Equal(t, 1, p2.ExitCode)
+
+	p3 := shell.NewProcessWithConfig(Config{
+		Command:           "echo $GREETING again",
+		UseBase64Encoding: true,
+		Shell:             shell,
+		OnOutput:          onOutput,
+	})
+
+	p3.Run()
+	assert.Equal(t, 0, p3.ExitCode)
+	assert.Equal(t, "hello world\nhello world again\n", output.String())
+	assert.NoError(t, shell.Close())
+}
+
+func Test__Shell__WithoutPTY(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	shell, err := NewShellFromExecAndArgs("bash", []string{}, t.TempDir())
+	assert.NoError(t, err)
+	shell.DisablePTY = true
+	assert.NoError(t, shell.Start())
+
+	var stdout, stderr bytes.Buffer
+	run := func(command string) *Process {
+		p := shell.NewProcessWithConfig(Config{
+			Command:     command,
+			Shell:       shell,
+			StoragePath: shell.StoragePath,
+			OnOutput:    func(line string) { stdout.WriteString(line) },
+			OnStderr:    func(line string) { stderr.WriteString(line) },
+		})
+
+		p.Run()
+		return p
+	}
+
+	p1 := run("echo out; echo err >&2; export MULTILINE=$(printf 'a\\nb'); cd /tmp")
+	assert.Equal(t, 0, p1.ExitCode)
+	assert.Equal(t, "out\n", stdout.String())
+	assert.Equal(t, "err\n", stderr.String())
+
+	// directory and environment are kept between commands
+	stdout.Reset()
+	p2 := run(`pwd; echo "$MULTILINE"; exit 4`)
+	assert.Equal(t, 4, p2.ExitCode)
+	assert.Equal(t, "/tmp\na\nb\n", stdout.String())
+
+	// background processes do not block the command,
+	// and can keep writing into their output after it finishes
+	stdout.Reset()
+	doneFile := filepath.Join(t.TempDir(), "done")
+	p3 := run(fmt.Sprintf("(for i in 1 2 3 4 5; do echo tick; sleep 0.2; done; touch %s) & echo started", doneFile))
+	assert.Equal(t, 0, p3.ExitCode)
+	assert.Less(t, p3.FinishedAt.Sub(p3.StartedAt), time.Second)
+	assert.Contains(t, stdout.String(), "started\n")
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(doneFile)
+		return err == nil
+	}, 5*time.Second, 100*time.Millisecond)
+
+	assert.NoError(t, shell.Terminate())
+	assert.NoError(t, shell.Close())
+}
+
+func Test__Shell__KeepsTheEnvironmentDumpPrivate(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	for _, disablePTY := range []bool{true, false} {
+		t.Run(fmt.Sprintf("disablePTY=%v", disablePTY), func(t *testing.T) {
+			shell, err := NewShellFromExecAndArgs("bash", []string{}, t.TempDir())
+			require.NoError(t, err)
+			shell.DisablePTY = disablePTY
+			shell.UseStatusPipe = true
+			shell.TrackEnvironment = true
+			require.NoError(t, shell.Start())
+
+			for _, command := range []string{"export SECRET=hello", "echo $SECRET"} {
+				p := shell.NewProcessWithOutput(command, func(string) {})
+				p.Run()
+				require.Equal(t, 0, p.ExitCode)
+
+				// the dump is removed as soon as it is read
+				_, err := os.Stat(p.EnvironmentFilePath())
+				assert.True(t, os.IsNotExist(err))
+			}
+
+			directory := shell.environmentDirectory
+			info, err := os.Stat(directory)
+			require.NoError(t, err)
+			assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+			assert.NoError(t, shell.Close())
+			_, err = os.Stat(directory)
+			assert.True(t, os.IsNotExist(err))
+		})
+	}
+}
+
+func Test__Shell__ReportsSignals(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	for _, useStatusPipe := range []bool{true, false} {
+		t.Run(fmt.Sprintf("useStatusPipe=%v", useStatusPipe), func(t *testing.T) {
+			shell, _ := NewShell(t.TempDir())
+			shell.UseStatusPipe = useStatusPipe
+			require.NoError(t, shell.Start())
+
+			// with a PTY, the shell reports the signal an exit status above 128 stands for
+			p1 := shell.NewProcessWithOutput("sh -c 'kill -KILL $$'", func(string) {})
+			p1.Run()
+			assert.Equal(t, 137, p1.ExitCode)
+			assert.Equal(t, &Termination{Signal: "SIGKILL"}, p1.Termination)
+
+			p2 := shell.NewProcessWithOutput("sh -c 'exit 139'", func(string) {})
+			p2.Run()
+			assert.Equal(t, 139, p2.ExitCode)
+			assert.Equal(t, &Termination{Signal: "SIGSEGV"}, p2.Termination)
+
+			// a 130 reported by the shell is the command stopping the job
+			p3 := shell.NewProcessWithOutput("sh -c 'exit 130'", func(string) {})
+			p3.Run()
+			assert.Equal(t, 130, p3.ExitCode)
+			assert.Nil(t, p3.Termination)
+
+			p4 := shell.NewProcessWithOutput("sh -c 'exit 1'", func(string) {})
+			p4.Run()
+			assert.Equal(t, 1, p4.ExitCode)
+			assert.Nil(t, p4.Termination)
+			assert.NoError(t, shell.Close())
+		})
+	}
+}
+
+func Test__Shell__ReportsSignalsWithoutPTY(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	shell, err := NewShellFromExecAndArgs("bash", []string{}, t.TempDir())
+	assert.NoError(t, err)
+	shell.DisablePTY = true
+	assert.NoError(t, shell.Start())
+
+	// without a PTY, the agent waits for the shell itself
+	p1 := shell.NewProcessWithOutput("kill -INT $$", func(string) {})
+	p1.Run()
+	assert.Equal(t, 130, p1.ExitCode)
+	assert.Equal(t, &Termination{Signal: "SIGINT"}, p1.Termination)
+	assert.True(t, p1.Termination.Interrupted())
+
+	p2 := shell.NewProcessWithOutput("exit 130", func(string) {})
+	p2.Run()
+	assert.Equal(t, 130, p2.ExitCode)
+	assert.Nil(t, p2.Termination)
+	assert.False(t, p2.Termination.Interrupted())
+
+	assert.NoError(t, shell.Terminate())
+	assert.NoError(t, shell.Close())
+}
+
+func Test__Shell__UsesTerminalSettings(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip()
+	}
+
+	shell, _ := NewShell(t.TempDir())
+	shell.Terminal = Terminal{Cols: 120, Rows: 40, Type: "xterm-256color"}
+	assert.NoError(t, shell.Start())
+
+	output := ""
+	p := shell.NewProcessWithOutput("stty size; echo $TERM", func(s string) { output += s })
+	p.Run()
+	assert.Equal(t, 0, p.ExitCode)
+	assert.Equal(t, "40 120\nxterm-256color\n", output)
+	assert.NoError(t, shell.Close())
+}
@@ -0,0 +1,57 @@
+package shell
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+/*
+ * The pseudo-terminal the job commands run in.
+ * Zero values keep the defaults: the size the PTY is created with,
+ * and the TERM the agent inherited.
+ */
+type Terminal struct {
+	Cols uint16
+	Rows uint16
+
+	// The value of TERM.
+	Type string
+}
+
+func (t Terminal) HasSize() bool {
+	return t.Cols > 0 && t.Rows > 0
+}
+
+func (t Terminal) Validate() error {
+	if (t.Cols == 0) != (t.Rows == 0) {
+		return fmt.Errorf("terminal columns and rows must be set together")
+	}
+
+	if strings.ContainsAny(t.Type, " \t\n=") {
+		return fmt.Errorf("invalid terminal type '%s'", t.Type)
+	}
+
+	return nil
+}
+
+/*
+ * Starts the command in a PTY with the size and TERM configured.
+ * TERM is only changed in the command's environment.
+ */
+func (t Terminal) StartPTY(cmd *exec.Cmd) (*os.File, error) {
+	if t.Type != "" {
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
+		}
+
+		cmd.Env = append(cmd.Env, "TERM="+t.Type)
+	}
+
+	if t.HasSize() {
+		return StartPTYWithSize(cmd, t.Cols, t.Rows)
+	}
+
+	return StartPTY(cmd)
+}
@@ -0,0 +1,16 @@
+package shell
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test__Terminal__Validate(t *testing.T) {
+	assert.NoError(t, Terminal{}.Validate())
+	assert.NoError(t, Terminal{Cols: 200, Rows: 50, Type: "xterm-256color"}.Validate())
+	assert.ErrorContains(t, Terminal{Cols: 200}.Validate(), "must be set together")
+	assert.ErrorContains(t, Terminal{Rows: 50}.Validate(), "must be set together")
+	assert.ErrorContains(t, Terminal{Type: "xterm 256"}.Validate(), "invalid terminal type")
+	assert.ErrorContains(t, Terminal{Type: "A=B"}.Validate(), "invalid terminal type")
+}
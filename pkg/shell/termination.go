@@ -0,0 +1,59 @@
+package shell
+
+import (
+	"syscall"
+)
+
+/*
+ * How a command was terminated, if it did not simply exit.
+ *
+ * Without a PTY, the agent waits for the killed process itself.
+ * In the PTY, commands run in a long-lived shell, which reports
+ * the name of the signal for an exit status above 128, so a command
+ * exiting with 128+N is reported as killed by signal N too.
+ */
+type Termination struct {
+	// The name of the signal, e.g. SIGKILL.
+	Signal string
+
+	CoreDumped bool
+
+	// The kernel OOM killer killed a process while the command was running.
+	OOMKilled bool
+}
+
+/*
+ * Exit code 130 is what commands use to stop the job on purpose,
+ * so it is only treated as an interruption if we know the command was killed by SIGINT.
+ * In the PTY, it never is: when the command is killed by SIGINT,
+ * the interactive shell drops the rest of the instruction,
+ * so the exit status that would say so is never reported.
+ */
+const SelfStopExitCode = 130
+
+func (t *Termination) Interrupted() bool {
+	return t != nil && t.Signal == "SIGINT"
+}
+
+func terminationFromWaitStatus(status syscall.WaitStatus) *Termination {
+	if !status.Signaled() {
+		return nil
+	}
+
+	return &Termination{
+		Signal:     signalName(status.Signal()),
+		CoreDumped: status.CoreDump(),
+	}
+}
+
+/*
+ * The shell in the PTY gives us the name `kill -l` prints, e.g. KILL.
+ * It is resolved by the shell running the command, which could be in another host.
+ */
+func terminationFromSignalName(exitCode int, name string) *Termination {
+	if name == "" || exitCode == SelfStopExitCode {
+		return nil
+	}
+
+	return &Termination{Signal: "SIG" + name}
+}
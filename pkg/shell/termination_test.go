@@ -0,0 +1,21 @@
+package shell
+
+import (
+	"testing"
+
+	assert "github.com/stretchr/testify/assert"
+)
+
+func Test__TerminationInterrupted(t *testing.T) {
+	var nilTermination *Termination
+	assert.False(t, nilTermination.Interrupted())
+	assert.False(t, (&Termination{OOMKilled: true}).Interrupted())
+	assert.False(t, (&Termination{Signal: "SIGKILL"}).Interrupted())
+	assert.True(t, (&Termination{Signal: "SIGINT"}).Interrupted())
+}
+
+func Test__TerminationFromSignalName(t *testing.T) {
+	assert.Equal(t, &Termination{Signal: "SIGKILL"}, terminationFromSignalName(137, "KILL"))
+	assert.Nil(t, terminationFromSignalName(1, ""))
+	assert.Nil(t, terminationFromSignalName(SelfStopExitCode, "INT"))
+}
@@ -0,0 +1,164 @@
+//go:build !windows
+
+package shell
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+ * Reads a PTY owned by the agent, and reads everything already written into it
+ * when asked to, so the agent knows all the output of a command went through the PTY
+ * once the command's exit status arrives through the status pipe.
+ *
+ * Data written into a PTY is handed over to the other side asynchronously,
+ * but the kernel completes that hand-off before telling if there is anything
+ * to read in it, so reading until select() reports nothing is left
+ * gets all the output written before the flush was requested.
+ */
+type ttyFlusher struct {
+	tty       *os.File
+	ttyFd     int
+	requests  *os.File
+	requestFd int
+	wake      *os.File
+	flushed   chan struct{}
+	closeOnce sync.Once
+}
+
+func newTTYFlusher(tty *os.File) (*ttyFlusher, error) {
+	requests, wake, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	f := &ttyFlusher{
+		tty:       tty,
+		ttyFd:     int(tty.Fd()),
+		requests:  requests,
+		requestFd: int(requests.Fd()),
+		wake:      wake,
+		flushed:   make(chan struct{}, 1),
+	}
+
+	if f.ttyFd >= unix.FD_SETSIZE || f.requestFd >= unix.FD_SETSIZE {
+		f.close()
+		_ = requests.Close()
+		return nil, fmt.Errorf("file descriptors %d and %d can't be used with select()", f.ttyFd, f.requestFd)
+	}
+
+	return f, nil
+}
+
+/*
+ * Publishes the output of the TTY until it is closed.
+ * Flushes are handled in the same goroutine, so every chunk read before
+ * a flush is finished is published before the flush is acknowledged.
+ */
+func (f *ttyFlusher) read(output chan []byte) error {
+	defer f.requests.Close()
+
+	for {
+		ttyReady, flushRequested, err := f.wait(nil)
+		if err != nil {
+			return err
+		}
+
+		if flushRequested {
+			if err := f.takeRequest(); err != nil {
+				return err
+			}
+
+			err := f.flush(output)
+			f.flushed <- struct{}{}
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if ttyReady {
+			if err := f.readChunk(output); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+/*
+ * Asks the reader to flush the TTY.
+ * The returned channel receives a value once it is done.
+ */
+func (f *ttyFlusher) requestFlush() (<-chan struct{}, error) {
+	if _, err := f.wake.Write([]byte{0}); err != nil {
+		return nil, err
+	}
+
+	return f.flushed, nil
+}
+
+// Makes the reader stop, if it is still waiting for the TTY.
+func (f *ttyFlusher) close() {
+	f.closeOnce.Do(func() {
+		_ = f.wake.Close()
+	})
+}
+
+func (f *ttyFlusher) flush(output chan []byte) error {
+	for {
+		ttyReady, _, err := f.wait(&unix.Timeval{})
+		if err != nil || !ttyReady {
+			return err
+		}
+
+		if err := f.readChunk(output); err != nil {
+			return err
+		}
+	}
+}
+
+func (f *ttyFlusher) readChunk(output chan []byte) error {
+	buffer := make([]byte, 4096)
+	n, err := f.tty.Read(buffer)
+	if n > 0 {
+		output <- buffer[0:n]
+	}
+
+	return err
+}
+
+// Once the flusher is closed, reading a request returns io.EOF, and the reader stops.
+func (f *ttyFlusher) takeRequest() error {
+	buffer := make([]byte, 1)
+	_, err := f.requests.Read(buffer)
+	return err
+}
+
+/*
+ * Waits until the TTY has something to read, or a flush is requested.
+ * Without a timeout, it waits until one of them happens.
+ */
+func (f *ttyFlusher) wait(timeout *unix.Timeval) (bool, bool, error) {
+	for {
+		fds := unix.FdSet{}
+		fds.Set(f.ttyFd)
+		fds.Set(f.requestFd)
+
+		_, err := unix.Select(max(f.ttyFd, f.requestFd)+1, &fds, nil, nil, timeout)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+
+		if err != nil {
+			return false, false, err
+		}
+
+		return fds.IsSet(f.ttyFd), fds.IsSet(f.requestFd), nil
+	}
+}
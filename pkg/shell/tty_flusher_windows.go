@@ -0,0 +1,25 @@
+//go:build windows
+
+package shell
+
+import (
+	"errors"
+	"os"
+)
+
+// There is no PTY on Windows, so there is nothing to flush.
+type ttyFlusher struct{}
+
+func newTTYFlusher(tty *os.File) (*ttyFlusher, error) {
+	return nil, errors.New("flushing a TTY is not supported on Windows")
+}
+
+func (f *ttyFlusher) read(output chan []byte) error {
+	return errors.New("flushing a TTY is not supported on Windows")
+}
+
+func (f *ttyFlusher) requestFlush() (<-chan struct{}, error) {
+	return nil, errors.New("flushing a TTY is not supported on Windows")
+}
+
+func (f *ttyFlusher) close() {}
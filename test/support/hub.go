@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/semaphoreci/agent/pkg/api"
@@ -35,6 +36,9 @@ type HubMockServer struct {
 	JobResult                 selfhostedapi.JobResult
 	LastState                 selfhostedapi.AgentState
 	LastStateChange           *time.Time
+
+	mu           sync.Mutex
+	finishedJobs map[string]selfhostedapi.JobResult
 }
 
 func NewHubMockServer() *HubMockServer {
@@ -42,6 +46,7 @@ func NewHubMockServer() *HubMockServer {
 	return &HubMockServer{
 		RegisterAttempts:  -1,
 		LastStateChange:   &now,
+		finishedJobs:      map[string]selfhostedapi.JobResult{},
 		ExpectedUserAgent: fmt.Sprintf("SemaphoreAgent/%s", AgentVersionExpected),
 	}
 }
@@ -198,6 +203,9 @@ func (m *HubMockServer) handleSyncRequest(w http.ResponseWriter, r *http.Request
 		m.JobRequest = nil
 		m.FinishedJob = true
 		m.JobResult = request.JobResult
+		m.mu.Lock()
+		m.finishedJobs[request.JobID] = request.JobResult
+		m.mu.Unlock()
 
 		if m.ShouldShutdown {
 			syncResponse.Action = selfhostedapi.AgentActionShutdown
@@ -340,6 +348,19 @@ func (m *HubMockServer) GetLastJobResult() selfhostedapi.JobResult {
 	return m.JobResult
 }
 
+// The result reported for every finished job, by job ID.
+func (m *HubMockServer) GetFinishedJobs() map[string]selfhostedapi.JobResult {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	finishedJobs := map[string]selfhostedapi.JobResult{}
+	for jobID, result := range m.finishedJobs {
+		finishedJobs[jobID] = result
+	}
+
+	return finishedJobs
+}
+
 func (m *HubMockServer) GetRegisterRequest() *selfhostedapi.RegisterRequest {
 	return m.RegisterRequest
 }
@@ -1,11 +1,14 @@
 package testsupport
 
 import (
+	"compress/gzip"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 )
 
 const ExpiredLogToken = "expired-token"
@@ -17,6 +20,16 @@ type LoghubMockServer struct {
 	Server            *httptest.Server
 	Handler           http.Handler
 	ExpectedUserAgent string
+
+	// Compression-related options
+	AcceptEncoding       string
+	RejectCompression    bool
+	compressedRequests   int
+	uncompressedRequests int
+
+	// The handler runs in the server's goroutines,
+	// so everything it records is protected by this.
+	mu sync.Mutex
 }
 
 func NewLoghubMockServer() *LoghubMockServer {
@@ -32,10 +45,27 @@ func (m *LoghubMockServer) Init() {
 }
 
 func (m *LoghubMockServer) SetMaxSizeForLogs(maxSize int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.MaxSizeForLogs = maxSize
 }
 
+func (m *LoghubMockServer) SetAcceptEncoding(encoding string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.AcceptEncoding = encoding
+}
+
+func (m *LoghubMockServer) SetRejectCompression(reject bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.RejectCompression = reject
+}
+
 func (m *LoghubMockServer) handler(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	if r.Header.Get("User-Agent") != m.ExpectedUserAgent {
 		w.WriteHeader(500)
 		return
@@ -59,7 +89,27 @@ func (m *LoghubMockServer) handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	body, err := ioutil.ReadAll(r.Body)
+	var reader io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		if m.RejectCompression {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+
+		gzipReader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			fmt.Printf("[LOGHUB MOCK] Error decompressing body: %v\n", err)
+			w.WriteHeader(400)
+			return
+		}
+
+		m.compressedRequests++
+		reader = gzipReader
+	} else {
+		m.uncompressedRequests++
+	}
+
+	body, err := ioutil.ReadAll(reader)
 	if err != nil {
 		fmt.Printf("[LOGHUB MOCK] Error reading body: %v\n", err)
 	}
@@ -70,6 +120,10 @@ func (m *LoghubMockServer) handler(w http.ResponseWriter, r *http.Request) {
 	m.BatchSizesUsed = append(m.BatchSizesUsed, len(logs))
 	m.Logs = append(m.Logs, logs...)
 
+	if m.AcceptEncoding != "" {
+		w.Header().Set("Accept-Encoding", m.AcceptEncoding)
+	}
+
 	w.WriteHeader(200)
 }
 
@@ -88,11 +142,27 @@ func (m *LoghubMockServer) findToken(r *http.Request) (string, error) {
 }
 
 func (m *LoghubMockServer) GetLogs() []string {
-	return m.Logs
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string{}, m.Logs...)
 }
 
 func (m *LoghubMockServer) GetBatchSizesUsed() []int {
-	return m.BatchSizesUsed
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]int{}, m.BatchSizesUsed...)
+}
+
+func (m *LoghubMockServer) GetCompressedRequests() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.compressedRequests
+}
+
+func (m *LoghubMockServer) GetUncompressedRequests() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.uncompressedRequests
 }
 
 func (m *LoghubMockServer) URL() string {